@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// AccessPolicy restricts who may use a route, or the bridge for routes
+// without a policy of their own: by client address, and by credentials
+// the bridge checks and removes before the request enters the tunnel.
+type AccessPolicy struct {
+	Allow        []string `json:"allow,omitempty"`         // CIDRs or addresses; any address if empty
+	Deny         []string `json:"deny,omitempty"`          // CIDRs or addresses, checked before allow
+	BasicAuth    []string `json:"basic_auth,omitempty"`    // user:password
+	BearerTokens []string `json:"bearer_tokens,omitempty"` // tokens
+	DenyAction   string   `json:"deny_action,omitempty"`   // for refused addresses: reject (default) or tarpit
+
+	allow, deny []*net.IPNet
+	basic       [][sha256.Size]byte
+	bearer      [][sha256.Size]byte
+}
+
+// Reasons a request was refused access
+const (
+	accessDeniedAddress     = "address"
+	accessDeniedCredentials = "credentials"
+)
+
+func (p *AccessPolicy) compile() error {
+	if p == nil {
+		return nil
+	}
+	var err error
+	if p.allow, err = parseCIDRs(p.Allow); err != nil {
+		return fmt.Errorf("allow: %v", err)
+	}
+	if p.deny, err = parseCIDRs(p.Deny); err != nil {
+		return fmt.Errorf("deny: %v", err)
+	}
+	if p.DenyAction != "" && p.DenyAction != denyActionReject && p.DenyAction != denyActionTarpit {
+		return fmt.Errorf("deny action must be reject or tarpit")
+	}
+	p.basic = p.basic[:0]
+	for _, credentials := range p.BasicAuth {
+		if user, _, ok := strings.Cut(credentials, ":"); !ok || user == "" {
+			return fmt.Errorf("basic auth credentials must be user:password")
+		}
+		p.basic = append(p.basic, sha256.Sum256([]byte(credentials)))
+	}
+	p.bearer = p.bearer[:0]
+	for _, token := range p.BearerTokens {
+		if token == "" {
+			return fmt.Errorf("bearer tokens must not be empty")
+		}
+		p.bearer = append(p.bearer, sha256.Sum256([]byte(token)))
+	}
+	return nil
+}
+
+// parseCIDRs parses CIDRs, taking a plain address as a network of its own.
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if ip := net.ParseIP(value); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", value)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// needsCredentials reports whether the policy asks clients to authenticate.
+func (p *AccessPolicy) needsCredentials() bool {
+	return len(p.basic) > 0 || len(p.bearer) > 0
+}
+
+// check reports why r may not use the route, or "" if it may. Credentials
+// the policy accepted are removed from r, the target does not know them.
+func (p *AccessPolicy) check(r *http.Request) string {
+	if p == nil {
+		return ""
+	}
+	ip := net.ParseIP(clientIP(r))
+	if ip == nil || containsIP(p.deny, ip) || (len(p.allow) > 0 && !containsIP(p.allow, ip)) {
+		return accessDeniedAddress
+	}
+	if !p.needsCredentials() {
+		return ""
+	}
+	var accepted [][sha256.Size]byte
+	var presented string
+	if user, password, ok := r.BasicAuth(); ok {
+		accepted, presented = p.basic, user+":"+password
+	} else if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		accepted, presented = p.bearer, strings.TrimSpace(token)
+	}
+	// Compare hashes in constant time, so neither the length nor the content
+	// of a credential leaks through the response time
+	sum := sha256.Sum256([]byte(presented))
+	match := 0
+	for _, credential := range accepted {
+		match |= subtle.ConstantTimeCompare(sum[:], credential[:])
+	}
+	if presented == "" || match == 0 {
+		return accessDeniedCredentials
+	}
+	r.Header.Del("Authorization")
+	return ""
+}
+
+// challenge sets the WWW-Authenticate headers for the credentials the policy
+// accepts.
+func (p *AccessPolicy) challenge(w http.ResponseWriter) {
+	if len(p.basic) > 0 {
+		w.Header().Add("WWW-Authenticate", `Basic realm="apiduct", charset="UTF-8"`)
+	}
+	if len(p.bearer) > 0 {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="apiduct"`)
+	}
+}
+
+// internalKey marks the requests the bridge makes itself, warm-ups and
+// replays, which no client access policy applies to.
+const internalKey contextKey = "internal"
+
+// internalRequest reports whether the bridge made r itself.
+func internalRequest(r *http.Request) bool {
+	internal, _ := r.Context().Value(internalKey).(bool)
+	return internal
+}
+
+// accessPolicy returns the policy r is checked against: its route's, or the
+// bridge's.
+func accessPolicy(route *Route, bridge *AccessPolicy) *AccessPolicy {
+	if route != nil && route.Access != nil {
+		return route.Access
+	}
+	return bridge
+}
+
+// buildAccessPolicy returns the bridge-wide policy given on the command
+// line, or nil if there is none.
+func buildAccessPolicy(config *Config) (*AccessPolicy, error) {
+	policy := &AccessPolicy{
+		Allow:        config.AllowCIDRs,
+		Deny:         config.DenyCIDRs,
+		BasicAuth:    config.BasicAuth,
+		BearerTokens: config.BearerTokens,
+		DenyAction:   config.DenyAction,
+	}
+	if len(policy.Allow)+len(policy.Deny)+len(policy.BasicAuth)+len(policy.BearerTokens) == 0 {
+		return nil, nil
+	}
+	return policy, policy.compile()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"apiduct/pkg/accesslog"
+)
+
+// accessLog logs every request with --access-log, nil if disabled.
+var accessLog *accesslog.Logger
+
+// checkAccessLog validates the --access-log-* settings.
+func checkAccessLog(format string, maxSize int, rotate time.Duration, maxBackups int) error {
+	if err := accesslog.CheckFormat(format); err != nil {
+		return err
+	}
+	if maxSize < 0 || rotate < 0 || maxBackups < 0 {
+		return fmt.Errorf("access log rotation settings must not be negative")
+	}
+	return nil
+}
+
+func openAccessLog(config *Config) (*accesslog.Logger, error) {
+	return accesslog.Open(config.AccessLog, config.AccessLogFormat, accesslog.Rotation{
+		MaxSize:    int64(config.AccessLogMaxSize) << 20,
+		Interval:   config.AccessLogRotate,
+		MaxBackups: config.AccessLogMaxBackups,
+	})
+}
+
+// logAccess writes a finished request to the access log. The URI is the one
+// the client sent, before any path rewrite.
+func logAccess(r *http.Request, route *Route, requestID string, status int, bytes int64, duration time.Duration) {
+	if accessLog == nil {
+		return
+	}
+	err := accessLog.Log(accesslog.Entry{
+		Time:      time.Now().Add(-duration),
+		ClientIP:  clientIP(r),
+		User:      r.Header.Get(clientSubjectHeader),
+		Method:    r.Method,
+		URI:       r.RequestURI,
+		Proto:     r.Proto,
+		Status:    status,
+		Bytes:     bytes,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+		Route:     routeLabel(route),
+		Duration:  duration,
+		RequestID: requestID,
+	})
+	if err != nil {
+		log.Printf("[BRIDGE] Failed to write access log: %v", err)
+	}
+}
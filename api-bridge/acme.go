@@ -0,0 +1,364 @@
+//go:build !noacme
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const acmeCompiled = true
+
+// Certificates are renewed when they have less than this left
+const acmeRenewBefore = 30 * 24 * time.Hour
+
+// acmeManager obtains and renews one certificate for all hosts from an ACME
+// CA, answering DNS-01 challenges through a DNS provider. The account key,
+// certificate and key are cached in a directory so restarts reuse them.
+type acmeManager struct {
+	client   *acme.Client
+	hosts    []string
+	email    string
+	cacheDir string
+	dns      dnsProvider
+	dnsWait  time.Duration
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// acmeHosts parses the comma separated --acme-hosts.
+func acmeHosts(list string) ([]string, error) {
+	var hosts []string
+	for _, host := range strings.Split(list, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("--acme-hosts is required")
+	}
+	return hosts, nil
+}
+
+func newACMEManager(config *Config) (*acmeManager, error) {
+	hosts, err := acmeHosts(config.ACMEHosts)
+	if err != nil {
+		return nil, err
+	}
+	if config.ACMEDNSProvider == "" {
+		return nil, fmt.Errorf("--acme-dns-provider is required for DNS-01 challenges")
+	}
+	dns, err := newDNSProvider(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(config.ACMECacheDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create ACME cache directory: %v", err)
+	}
+	key, err := loadOrCreateKey(filepath.Join(config.ACMECacheDir, "account-key.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ACME account key: %v", err)
+	}
+	sort.Strings(hosts)
+	return &acmeManager{
+		client:   &acme.Client{Key: key, DirectoryURL: config.ACMEDirectory, UserAgent: "api-bridge/" + Version},
+		hosts:    hosts,
+		email:    config.ACMEEmail,
+		cacheDir: config.ACMECacheDir,
+		dns:      dns,
+		dnsWait:  config.ACMEDNSWait,
+	}, nil
+}
+
+// Start loads the cached certificate, or obtains a new one if there is none
+// or it is due for renewal, then keeps renewing it in the background.
+func (m *acmeManager) Start() error {
+	if cert, err := m.loadCached(); err == nil && time.Until(cert.Leaf.NotAfter) > acmeRenewBefore {
+		log.Printf("[BRIDGE] Using cached certificate for %s, valid until %s", strings.Join(m.hosts, ", "), cert.Leaf.NotAfter.Format(time.RFC3339))
+		m.setCert(cert)
+	} else if err := m.renew(); err != nil {
+		return err
+	}
+	go m.renewLoop()
+	return nil
+}
+
+func (m *acmeManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return nil, errors.New("no certificate available yet")
+	}
+	return m.cert, nil
+}
+
+func (m *acmeManager) setCert(cert *tls.Certificate) {
+	m.mu.Lock()
+	m.cert = cert
+	m.mu.Unlock()
+}
+
+func (m *acmeManager) renewLoop() {
+	for {
+		m.mu.RLock()
+		due := time.Until(m.cert.Leaf.NotAfter) - acmeRenewBefore
+		m.mu.RUnlock()
+		if due > 12*time.Hour {
+			due = 12 * time.Hour
+		}
+		if due > 0 {
+			time.Sleep(due)
+			continue
+		}
+		if err := m.renew(); err != nil {
+			log.Printf("[BRIDGE] Failed to renew certificate, retrying in an hour: %v", err)
+			time.Sleep(time.Hour)
+		}
+	}
+}
+
+// renew obtains a new certificate and caches it.
+func (m *acmeManager) renew() error {
+	log.Printf("[BRIDGE] Requesting certificate for %s from %s", strings.Join(m.hosts, ", "), m.client.DirectoryURL)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	cert, err := m.obtain(ctx)
+	if err != nil {
+		metrics.Counter("apiduct_acme_renewals_total", "result", "failure").Inc()
+		return fmt.Errorf("failed to obtain certificate: %v", err)
+	}
+	metrics.Counter("apiduct_acme_renewals_total", "result", "success").Inc()
+	log.Printf("[BRIDGE] Obtained certificate for %s, valid until %s", strings.Join(m.hosts, ", "), cert.Leaf.NotAfter.Format(time.RFC3339))
+	m.setCert(cert)
+	return nil
+}
+
+func (m *acmeManager) obtain(ctx context.Context) (*tls.Certificate, error) {
+	account := &acme.Account{}
+	if m.email != "" {
+		account.Contact = []string{"mailto:" + m.email}
+	}
+	if _, err := m.client.Register(ctx, account, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, fmt.Errorf("failed to register ACME account: %v", err)
+	}
+
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(m.hosts...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create order: %v", err)
+	}
+	if err := m.authorize(ctx, order.AuthzURLs); err != nil {
+		return nil, err
+	}
+	if order, err = m.client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, fmt.Errorf("order not ready: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate key: %v", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: m.hosts}, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate request: %v", err)
+	}
+	chain, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to finalize order: %v", err)
+	}
+
+	if err := m.saveCached(chain, key); err != nil {
+		log.Printf("[BRIDGE] Failed to cache certificate: %v", err)
+	}
+	return buildCertificate(chain, key)
+}
+
+// dnsChallenge is a DNS-01 challenge and the TXT record answering it.
+type dnsChallenge struct {
+	authz     *acme.Authorization
+	challenge *acme.Challenge
+	fqdn      string
+	value     string
+}
+
+// authorize answers the DNS-01 challenges of all pending authorizations.
+// Records for the same name, such as example.com and *.example.com, are
+// published together.
+func (m *acmeManager) authorize(ctx context.Context, urls []string) error {
+	var challenges []*dnsChallenge
+	records := make(map[string][]string)
+	for _, url := range urls {
+		authz, err := m.client.GetAuthorization(ctx, url)
+		if err != nil {
+			return fmt.Errorf("failed to get authorization: %v", err)
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+		var challenge *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == "dns-01" {
+				challenge = c
+			}
+		}
+		if challenge == nil {
+			return fmt.Errorf("CA offers no dns-01 challenge for %s", authz.Identifier.Value)
+		}
+		value, err := m.client.DNS01ChallengeRecord(challenge.Token)
+		if err != nil {
+			return err
+		}
+		fqdn := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.")
+		challenges = append(challenges, &dnsChallenge{authz: authz, challenge: challenge, fqdn: fqdn, value: value})
+		records[fqdn] = append(records[fqdn], value)
+	}
+	if len(challenges) == 0 {
+		return nil
+	}
+
+	for fqdn, values := range records {
+		log.Printf("[BRIDGE] Publishing DNS-01 challenge record %s", fqdn)
+		if err := m.dns.Present(ctx, fqdn, values); err != nil {
+			return fmt.Errorf("failed to publish %s: %v", fqdn, err)
+		}
+		defer func(fqdn string, values []string) {
+			if err := m.dns.CleanUp(context.Background(), fqdn, values); err != nil {
+				log.Printf("[BRIDGE] Failed to remove DNS-01 challenge record %s: %v", fqdn, err)
+			}
+		}(fqdn, values)
+	}
+	for fqdn, values := range records {
+		waitForTXT(ctx, fqdn, values, m.dnsWait)
+	}
+
+	for _, c := range challenges {
+		if _, err := m.client.Accept(ctx, c.challenge); err != nil {
+			return fmt.Errorf("failed to accept challenge for %s: %v", c.authz.Identifier.Value, err)
+		}
+	}
+	for _, c := range challenges {
+		if _, err := m.client.WaitAuthorization(ctx, c.authz.URI); err != nil {
+			return fmt.Errorf("authorization for %s failed: %v", c.authz.Identifier.Value, err)
+		}
+	}
+	return nil
+}
+
+// waitForTXT polls DNS until all values are visible under fqdn, or gives up
+// after wait and lets the CA try anyway.
+func waitForTXT(ctx context.Context, fqdn string, values []string, wait time.Duration) {
+	deadline := time.Now().Add(wait)
+	for {
+		found, _ := net.DefaultResolver.LookupTXT(ctx, fqdn)
+		visible := 0
+		for _, value := range values {
+			for _, txt := range found {
+				if txt == value {
+					visible++
+					break
+				}
+			}
+		}
+		if visible == len(values) {
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Printf("[BRIDGE] DNS-01 challenge record %s not visible after %s, continuing", fqdn, wait)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (m *acmeManager) loadCached() (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(m.cacheDir, "certificate.pem"), filepath.Join(m.cacheDir, "certificate-key.pem"))
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	// Hosts may have changed since the certificate was issued
+	names := append([]string(nil), cert.Leaf.DNSNames...)
+	sort.Strings(names)
+	if strings.Join(names, ",") != strings.Join(m.hosts, ",") {
+		return nil, fmt.Errorf("cached certificate is for other hosts")
+	}
+	return &cert, nil
+}
+
+func (m *acmeManager) saveCached(chain [][]byte, key *ecdsa.PrivateKey) error {
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(m.cacheDir, "certificate-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(m.cacheDir, "certificate.pem"), certPEM, 0644)
+}
+
+func buildCertificate(chain [][]byte, key crypto.Signer) (*tls.Certificate, error) {
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("CA returned an empty certificate chain")
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate from CA: %v", err)
+	}
+	return &tls.Certificate{Certificate: chain, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// loadOrCreateKey reads an EC private key from path, generating and saving a
+// new one if the file does not exist.
+func loadOrCreateKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM data in %s", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"apiduct/pkg/tunnel"
+)
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		log.Printf("[BRIDGE] Failed to write admin response: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// adminHeader marks a request to the admin interface as sent by a tool
+// rather than a web page, which cannot set it on a cross-site request.
+const adminHeader = "X-Apiduct-Admin"
+
+// createAdminHandler serves the local admin interface. It must only be
+// exposed on a trusted address as it controls the bridge and gives access to
+// captured traffic; guardAdmin keeps web pages the operator opens out.
+func createAdminHandler(config *Config, tunnels *tunnel.Pool, captures *CaptureStore, proxy http.Handler) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/drain", handleDrain)
+	mux.HandleFunc("/api/killswitch", handleKillSwitch)
+	mux.HandleFunc("/api/ready", handleReady)
+	mux.HandleFunc("/healthz", handleHealth(tunnels, false))
+	mux.HandleFunc("/readyz", handleHealth(tunnels, true))
+	mux.HandleFunc("/api/features", handleFeatures(config))
+	mux.HandleFunc("/api/tunnels", handleTunnels(tunnels))
+	mux.HandleFunc("/api/tunnels/", handleTunnels(tunnels))
+	mux.HandleFunc("/api/routes", handleRoutes(tunnels))
+	mux.HandleFunc("/api/reload", handleReload(config))
+	if enrollments != nil {
+		mux.HandleFunc("/api/bootstrap-tokens", handleBootstrapTokens)
+		mux.HandleFunc("/api/offramps", handleEnrolledOfframps(tunnels))
+		mux.HandleFunc("/api/offramps/", handleEnrolledOfframps(tunnels))
+	}
+
+	if config.Inspect {
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(inspectorPage))
+		})
+
+		mux.HandleFunc("/api/requests", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			writeJSON(w, http.StatusOK, captures.List(r.URL.Query().Get("q")))
+		})
+
+		mux.HandleFunc("/api/requests/", func(w http.ResponseWriter, r *http.Request) {
+			parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/requests/"), "/")
+			id, err := strconv.ParseUint(parts[0], 10, 64)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid request id")
+				return
+			}
+			exchange := captures.Get(id)
+			if exchange == nil {
+				writeJSONError(w, http.StatusNotFound, "request not found")
+				return
+			}
+
+			switch {
+			case len(parts) == 1 && r.Method == http.MethodGet:
+				writeJSON(w, http.StatusOK, exchange)
+			case len(parts) == 2 && parts[1] == "replay" && r.Method == http.MethodPost:
+				handleReplay(w, r, exchange, proxy)
+			default:
+				writeJSONError(w, http.StatusNotFound, "not found")
+			}
+		})
+	}
+
+	return guardAdmin(config.AdminListen, mux)
+}
+
+// guardAdmin refuses requests to the admin interface that a web page could
+// have sent. The Host must be the admin address, localhost or an IP address,
+// so a page cannot reach the interface through DNS rebinding. Requests
+// changing anything must not come from another site and must carry a JSON
+// body or adminHeader, neither of which a cross-site form can send.
+func guardAdmin(listen string, next http.Handler) http.Handler {
+	listenHost, _, _ := net.SplitHostPort(listen)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !adminHost(r.Host, listenHost) {
+			writeJSONError(w, http.StatusForbidden, "host not allowed on the admin interface")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" {
+			writeJSONError(w, http.StatusForbidden, "cross-site request refused")
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+				writeJSONError(w, http.StatusForbidden, "cross-origin request refused")
+				return
+			}
+		}
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if r.Header.Get(adminHeader) == "" && mediaType != "application/json" {
+			writeJSONError(w, http.StatusForbidden, "changes need a JSON body or the "+adminHeader+" header")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminHost reports whether host may be asked for on the admin interface
+// listening on listenHost: that host, localhost or an IP address, none of
+// which a rebound DNS name can pass for. Requests without a Host, which
+// browsers always send, are let through.
+func adminHost(host, listenHost string) bool {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	return host == "" || strings.EqualFold(host, "localhost") || net.ParseIP(host) != nil ||
+		(listenHost != "" && strings.EqualFold(host, listenHost))
+}
+
+func handleReplay(w http.ResponseWriter, r *http.Request, exchange *Exchange, proxy http.Handler) {
+	// An optional JSON body modifies the request before it is re-sent
+	var overrides *ReplayOverrides
+	if r.ContentLength != 0 {
+		overrides = &ReplayOverrides{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxInspectBodySize)).Decode(overrides); err != nil && err != io.EOF {
+			writeJSONError(w, http.StatusBadRequest, "invalid replay overrides: "+err.Error())
+			return
+		}
+	}
+
+	if exchange.Request.BodyTruncated && (overrides == nil || overrides.Body == nil) {
+		writeJSONError(w, http.StatusConflict, "request body was truncated during capture and cannot be replayed without a body override")
+		return
+	}
+
+	req, err := replayRequest(r.Context(), exchange, overrides)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	log.Printf("[BRIDGE] Replaying captured request %d: %s %s", exchange.ID, req.Method, req.RequestURI)
+	resp := newBufferedResponse()
+	proxy.ServeHTTP(resp, req)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"replay_of": exchange.ID,
+		"status":    resp.status,
+		"header":    resp.header,
+		"body":      resp.body.String(),
+	})
+}
+
+// listenAdminSocket listens on a unix socket at path, replacing the socket a
+// previous bridge left behind, and restricts it to the bridge's user.
+func listenAdminSocket(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict admin socket: %v", err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGuardAdmin(t *testing.T) {
+	handler := guardAdmin("admin.internal:4040", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	tests := []struct {
+		name   string
+		method string
+		host   string
+		header []string
+		want   int
+	}{
+		{"loopback", "GET", "127.0.0.1:4040", nil, http.StatusNoContent},
+		{"localhost", "GET", "localhost:4040", nil, http.StatusNoContent},
+		{"IPv6", "GET", "[::1]:4040", nil, http.StatusNoContent},
+		{"admin address", "GET", "admin.internal:4040", nil, http.StatusNoContent},
+		{"rebound name", "GET", "attacker.example:4040", nil, http.StatusForbidden},
+		{"form post", "POST", "127.0.0.1:4040", []string{"Content-Type", "application/x-www-form-urlencoded"}, http.StatusForbidden},
+		{"bare post", "POST", "127.0.0.1:4040", nil, http.StatusForbidden},
+		{"admin header", "POST", "127.0.0.1:4040", []string{adminHeader, "1"}, http.StatusNoContent},
+		{"json", "DELETE", "127.0.0.1:4040", []string{"Content-Type", "application/json; charset=utf-8"}, http.StatusNoContent},
+		{"same origin", "POST", "127.0.0.1:4040", []string{adminHeader, "1", "Origin", "http://127.0.0.1:4040", "Sec-Fetch-Site", "same-origin"}, http.StatusNoContent},
+		{"other origin", "POST", "127.0.0.1:4040", []string{"Content-Type", "application/json", "Origin", "http://attacker.example"}, http.StatusForbidden},
+		{"cross site", "POST", "127.0.0.1:4040", []string{adminHeader, "1", "Sec-Fetch-Site", "cross-site"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/api/killswitch", strings.NewReader(""))
+		r.Host = tt.host
+		for i := 0; i < len(tt.header); i += 2 {
+			r.Header.Set(tt.header[i], tt.header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+
+	"apiduct/pkg/proxy"
+)
+
+// Error codes of responses generated by the bridge. The offramp adds
+// TARGET_UNREACHABLE, TARGET_TIMEOUT and TARGET_ERROR.
+const (
+	errCodeTunnelDown         = "TUNNEL_DOWN"          // no tunnel to an offramp
+	errCodeTunnelBusy         = "TUNNEL_BUSY"          // every tunnel at its concurrency limit
+	errCodeTunnelError        = "TUNNEL_ERROR"         // the tunnel failed during the request
+	errCodeTunnelTimeout      = "TUNNEL_TIMEOUT"       // no response from the tunnel in time
+	errCodeMaintenance        = "MAINTENANCE"          // the bridge is draining
+	errCodeKillSwitch         = "KILL_SWITCH"          // the kill switch severed the duct
+	errCodeTooManyRequests    = "TOO_MANY_REQUESTS"    // bridge concurrency limit
+	errCodeQuotaExceeded      = "QUOTA_EXCEEDED"       // route quota used up
+	errCodeRateLimited        = "RATE_LIMITED"         // requests arriving faster than a rate limit
+	errCodeOutsideSchedule    = "OUTSIDE_SCHEDULE"     // request outside the route's or client's time windows
+	errCodeBodyTooLarge       = "BODY_TOO_LARGE"       // request or response above its size limit
+	errCodeContentTypeBlocked = "CONTENT_TYPE_BLOCKED" // content type not allowed on the route
+	errCodeInvalidRequest     = "INVALID_REQUEST"      // request failed validation or processing
+	errCodeInvalidResponse    = "INVALID_RESPONSE"     // response failed processing
+	errCodeAuthFailed         = "AUTH_FAILED"          // offramp presented the wrong PSK
+	errCodeForwardDenied      = "FORWARD_DENIED"       // forward address not allowed for the offramp
+	errCodeAccessDenied       = "ACCESS_DENIED"        // client address not allowed on the route
+	errCodeUnauthorized       = "UNAUTHORIZED"         // missing or wrong credentials for the route
+	errCodeClientClosed       = "CLIENT_CLOSED"        // client gave up before the request was forwarded
+)
+
+// statusClientClosed is logged for requests whose client went away before
+// the bridge could answer, as nginx does.
+const statusClientClosed = 499
+
+// writeError answers with an apiduct error: the code in the X-Apiduct-Error
+// header and a JSON body such as
+// {"error": "Tunnel connection not available", "code": "TUNNEL_DOWN"}.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeErrorDetails(w, status, code, message, nil)
+}
+
+// writeErrorDetails is writeError with a list of problems found in the
+// request.
+func writeErrorDetails(w http.ResponseWriter, status int, code, message string, details []string) {
+	body := map[string]interface{}{"error": message, "code": code}
+	if details != nil {
+		body["details"] = details
+	}
+	metrics.Counter("apiduct_errors_total", "code", code).Inc()
+	w.Header().Set(proxy.ErrorCodeHeader, code)
+	writeJSON(w, status, body)
+}
@@ -0,0 +1,133 @@
+//go:build !noacme
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// autocertManager obtains a certificate per host with autocert, answering
+// HTTP-01 challenges on a plain HTTP listener or TLS-ALPN-01 challenges in
+// the HTTPS handshake. Unlike DNS-01, these need the bridge to be reachable
+// from the CA under each host name, and wildcards are not possible.
+type autocertManager struct {
+	manager    *autocert.Manager
+	hosts      []string
+	challenge  string
+	httpListen string
+}
+
+func newAutocertManager(config *Config) (*autocertManager, error) {
+	hosts, err := acmeHosts(config.ACMEHosts)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		if strings.Contains(host, "*") {
+			return nil, fmt.Errorf("wildcard host %s needs the dns-01 challenge", host)
+		}
+	}
+	if err := os.MkdirAll(config.ACMECacheDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create ACME cache directory: %v", err)
+	}
+	return &autocertManager{
+		manager: &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       renewalCountingCache{autocert.DirCache(config.ACMECacheDir), hosts},
+			HostPolicy:  autocert.HostWhitelist(hosts...),
+			RenewBefore: acmeRenewBefore,
+			Email:       config.ACMEEmail,
+			Client:      &acme.Client{DirectoryURL: config.ACMEDirectory, UserAgent: "api-bridge/" + Version},
+		},
+		hosts:      hosts,
+		challenge:  config.ACMEChallenge,
+		httpListen: config.ACMEHTTPListen,
+	}, nil
+}
+
+// Start serves HTTP-01 challenges if needed and obtains the certificates in
+// the background. Hosts without one yet get it on their first handshake.
+func (m *autocertManager) Start() error {
+	if m.challenge == acmeHTTP01 {
+		listener, err := net.Listen("tcp", m.httpListen)
+		if err != nil {
+			return fmt.Errorf("failed to start ACME HTTP-01 listener: %v", err)
+		}
+		go func() {
+			log.Printf("[BRIDGE] Answering ACME HTTP-01 challenges on %s", m.httpListen)
+			// Anything else is redirected to HTTPS
+			if err := http.Serve(listener, m.manager.HTTPHandler(nil)); err != nil {
+				log.Fatalf("ACME HTTP-01 listener failed: %v", err)
+			}
+		}()
+	}
+	go m.prefetch()
+	return nil
+}
+
+// prefetch obtains or loads the certificate of every host, retrying failures.
+// TLS-ALPN-01 challenges can only succeed once the HTTPS listener serves, so
+// this does not hold up startup.
+func (m *autocertManager) prefetch() {
+	for _, host := range m.hosts {
+		// Back off, failed validations count toward the CA's rate limits
+		retry := time.Minute
+		for {
+			// As from a client that accepts the ECDSA certificate autocert
+			// prefers
+			hello := &tls.ClientHelloInfo{ServerName: host, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}}
+			cert, err := m.manager.GetCertificate(hello)
+			if err == nil {
+				log.Printf("[BRIDGE] Certificate for %s valid until %s", host, cert.Leaf.NotAfter.Format(time.RFC3339))
+				break
+			}
+			metrics.Counter("apiduct_acme_renewals_total", "result", "failure").Inc()
+			log.Printf("[BRIDGE] Failed to obtain certificate for %s, retrying in %s: %v", host, retry, err)
+			time.Sleep(retry)
+			if retry < time.Hour {
+				retry *= 2
+			}
+		}
+	}
+}
+
+// TLSConfig returns the HTTPS configuration serving the certificates and
+// answering TLS-ALPN-01 challenges.
+func (m *autocertManager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.manager.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
+	}
+}
+
+// renewalCountingCache counts the certificates autocert obtained, which it
+// stores under the host name.
+type renewalCountingCache struct {
+	autocert.Cache
+	hosts []string
+}
+
+func (c renewalCountingCache) Put(ctx context.Context, key string, data []byte) error {
+	err := c.Cache.Put(ctx, key, data)
+	for _, host := range c.hosts {
+		if key == host || key == host+"+rsa" {
+			result := "success"
+			if err != nil {
+				result = "failure"
+			}
+			metrics.Counter("apiduct_acme_renewals_total", "result", result).Inc()
+		}
+	}
+	return err
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Maximum (decompressed) body size buffered for inspection and rewriting
+const maxInspectBodySize = 10 << 20
+
+// Maximum time spent reading and decoding a body for inspection
+var inspectTimeout = 10 * time.Second
+
+var errInspectTimeout = errors.New("body inspection timed out")
+
+// deadlineReader fails once the deadline has passed, bounding the time spent
+// on slow senders or expensive decompression. It can only check between
+// reads; a Read blocked on a stalled sender is cut short by a read deadline
+// on the connection the body arrives on, which it reports the same way.
+type deadlineReader struct {
+	r        io.Reader
+	deadline time.Time
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if time.Now().After(d.deadline) {
+		return 0, errInspectTimeout
+	}
+	n, err := d.r.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = errInspectTimeout
+	}
+	return n, err
+}
+
+// limitRequestInspection sets a read deadline of inspectTimeout on the client
+// connection while the request body is buffered for inspection, so a client
+// that stops sending cannot hold the handler. The returned function lifts
+// the deadline again before the body is forwarded.
+func limitRequestInspection(w http.ResponseWriter) func() {
+	controller := http.NewResponseController(w)
+	if err := controller.SetReadDeadline(time.Now().Add(inspectTimeout)); err != nil {
+		return func() {}
+	}
+	return func() { controller.SetReadDeadline(time.Time{}) }
+}
+
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// readLimitedBody reads at most maxInspectBodySize bytes from body.
+func readLimitedBody(body io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(body, maxInspectBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxInspectBodySize {
+		return nil, fmt.Errorf("body exceeds %d bytes", maxInspectBodySize)
+	}
+	return data, nil
+}
+
+func isGzipEncoding(encoding string) bool {
+	return encoding == "gzip" || encoding == "x-gzip"
+}
+
+// readPlainBody reads a body and undoes its Content-Encoding, enforcing the
+// inspection size and time limits on the decoded data.
+func readPlainBody(body io.Reader, encoding string) ([]byte, error) {
+	body = &deadlineReader{r: body, deadline: time.Now().Add(inspectTimeout)}
+
+	switch {
+	case encoding == "" || encoding == "identity":
+		return readLimitedBody(body)
+	case isGzipEncoding(encoding):
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %v", err)
+		}
+		defer zr.Close()
+		return readLimitedBody(zr)
+	default:
+		return nil, fmt.Errorf("cannot inspect %s encoded body", encoding)
+	}
+}
+
+// encodeBody re-applies the Content-Encoding removed by readPlainBody.
+func encodeBody(data []byte, encoding string) ([]byte, error) {
+	if !isGzipEncoding(encoding) {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// rewriteBody decodes body, passes the plaintext through fn and returns the
+// re-encoded result.
+func rewriteBody(body io.ReadCloser, encoding string, fn func([]byte) ([]byte, error)) ([]byte, error) {
+	plain, err := readPlainBody(body, encoding)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := fn(plain)
+	if err != nil {
+		return nil, err
+	}
+	return encodeBody(out, encoding)
+}
+
+// rewriteRequestBody buffers a JSON request body, passes it through fn and
+// replaces the body with the result. Non-JSON bodies are left untouched and
+// gzip bodies are transparently decompressed and recompressed.
+func rewriteRequestBody(r *http.Request, fn func([]byte) ([]byte, error)) error {
+	if r.Body == nil || r.Body == http.NoBody || !isJSONContentType(r.Header.Get("Content-Type")) {
+		return nil
+	}
+
+	out, err := rewriteBody(r.Body, strings.ToLower(r.Header.Get("Content-Encoding")), fn)
+	if err != nil {
+		return err
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(out))
+	r.ContentLength = int64(len(out))
+	r.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	return nil
+}
+
+// rewriteResponseBody is the response counterpart of rewriteRequestBody.
+func rewriteResponseBody(resp *http.Response, fn func([]byte) ([]byte, error)) error {
+	if !isJSONContentType(resp.Header.Get("Content-Type")) {
+		return nil
+	}
+
+	out, err := rewriteBody(resp.Body, strings.ToLower(resp.Header.Get("Content-Encoding")), fn)
+	if err != nil {
+		return err
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(out))
+	resp.ContentLength = int64(len(out))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	return nil
+}
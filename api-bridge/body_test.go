@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestInspectionOfStalledRequest sends part of a JSON body and then nothing,
+// which must not hold the handler past the inspection timeout.
+func TestInspectionOfStalledRequest(t *testing.T) {
+	defer func(timeout time.Duration) { inspectTimeout = timeout }(inspectTimeout)
+	inspectTimeout = 200 * time.Millisecond
+
+	inspected := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		liftDeadline := limitRequestInspection(w)
+		defer liftDeadline()
+		inspected <- rewriteRequestBody(r, func(body []byte) ([]byte, error) { return body, nil })
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "POST /orders HTTP/1.1\r\nHost: api.example.com\r\nContent-Type: application/json\r\nContent-Length: 100\r\n\r\n{\"id\":")
+
+	select {
+	case err := <-inspected:
+		if !errors.Is(err, errInspectTimeout) {
+			t.Fatalf("inspecting a stalled body returned %v, want %v", err, errInspectTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("inspecting a stalled body did not time out")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("no response after the inspection timed out: %v", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+// TestInspectionOfStalledResponse reads a response body from a connection
+// whose sender stalls, bounded by the read deadline the handler sets on the
+// tunnel stream.
+func TestInspectionOfStalledResponse(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	go remote.Write([]byte(`{"id":`))
+
+	local.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := readPlainBody(local, ""); !errors.Is(err, errInspectTimeout) {
+		t.Fatalf("reading a stalled body returned %v, want %v", err, errInspectTimeout)
+	}
+}
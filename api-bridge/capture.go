@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type contextKey string
+
+// Set on requests re-sent from the inspector so the capture links them
+const replayOfKey contextKey = "replay-of"
+
+// CapturedMessage is one side of a captured exchange. Bodies are kept up to
+// the store's body limit.
+type CapturedMessage struct {
+	Header        http.Header `json:"header"`
+	Body          string      `json:"body"`
+	BodyTruncated bool        `json:"body_truncated"`
+}
+
+type CapturedRequest struct {
+	Method string `json:"method"`
+	URI    string `json:"uri"`
+	Host   string `json:"host"`
+	CapturedMessage
+}
+
+type CapturedResponse struct {
+	Status int `json:"status"`
+	CapturedMessage
+}
+
+// Exchange is a captured request/response pair.
+type Exchange struct {
+	ID         uint64           `json:"id"`
+	Time       time.Time        `json:"time"`
+	DurationMs float64          `json:"duration_ms"`
+	Route      string           `json:"route,omitempty"`
+	RemoteAddr string           `json:"remote_addr"`
+	ReplayOf   uint64           `json:"replay_of,omitempty"`
+	Request    CapturedRequest  `json:"request"`
+	Response   CapturedResponse `json:"response"`
+
+	requestBody  *limitedBuffer
+	responseBody *limitedBuffer
+	key          string      // of the recorded response for the request
+	clientHeader http.Header // request headers as the client sent them
+}
+
+// limitedBuffer keeps the first limit bytes written and discards the rest.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// Header marking responses served from the recorded store
+const offlineHeader = "X-Apiduct-Offline"
+
+// CaptureStore keeps the most recent exchanges in memory. When recording is
+// enabled it also keeps the last successful GET response per URL so it can be
+// served while the tunnel is down.
+type CaptureStore struct {
+	mu       sync.Mutex
+	capacity int
+	maxBody  int
+	nextID   uint64
+	entries  []*Exchange
+	recorded map[string]*Exchange
+}
+
+func NewCaptureStore(capacity, maxBody int, record bool) *CaptureStore {
+	s := &CaptureStore{capacity: capacity, maxBody: maxBody}
+	if record {
+		s.recorded = make(map[string]*Exchange)
+	}
+	return s
+}
+
+// recordKey identifies the recorded response for a request by the headers
+// requests are coalesced by, so a response is only served again to requests
+// with the same credentials and client certificate.
+func recordKey(host, uri string, header http.Header) string {
+	return requestKey(host, uri, header, coalesceHeaders)
+}
+
+// recordable reports whether a response may be recorded. Responses that set
+// cookies, that caches must keep private or not store, or that vary on
+// anything are only for the request they answer.
+func recordable(header http.Header) bool {
+	if len(header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	for _, directive := range headerTokens(header, "Cache-Control") {
+		name, _, _ := strings.Cut(directive, "=")
+		if name == "private" || name == "no-store" {
+			return false
+		}
+	}
+	for _, name := range headerTokens(header, "Vary") {
+		if name == "*" {
+			return false
+		}
+	}
+	return true
+}
+
+// headerTokens returns the comma separated, lower case elements of the
+// header key.
+func headerTokens(header http.Header, key string) []string {
+	var tokens []string
+	for _, value := range header.Values(key) {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.ToLower(strings.TrimSpace(token)); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+// matchesVary reports whether a request with header sends the same values
+// of the headers the recorded response varies on as the request it answered.
+func (e *Exchange) matchesVary(header http.Header) bool {
+	return sameVary(e.Response.Header, e.clientHeader, header)
+}
+
+// sameVary reports whether two requests, the first answered with a response
+// carrying response, send the same values of the headers it varies on.
+func sameVary(response, answered, header http.Header) bool {
+	for _, name := range headerTokens(response, "Vary") {
+		if strings.Join(answered.Values(name), ",") != strings.Join(header.Values(name), ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// Begin starts capturing r. The returned ResponseWriter must be used for the
+// rest of the request and Finish called once the handler is done.
+func (s *CaptureStore) Begin(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *Exchange) {
+	exchange := &Exchange{
+		Time:       time.Now(),
+		RemoteAddr: r.RemoteAddr,
+		Request: CapturedRequest{
+			Method:          r.Method,
+			URI:             r.RequestURI,
+			Host:            r.Host,
+			CapturedMessage: CapturedMessage{Header: r.Header.Clone()},
+		},
+		requestBody:  &limitedBuffer{limit: s.maxBody},
+		responseBody: &limitedBuffer{limit: s.maxBody},
+		key:          recordKey(r.Host, r.RequestURI, r.Header),
+	}
+	exchange.clientHeader = exchange.Request.Header
+	if replayOf, ok := r.Context().Value(replayOfKey).(uint64); ok {
+		exchange.ReplayOf = replayOf
+	}
+	return &captureWriter{ResponseWriter: w, exchange: exchange}, exchange
+}
+
+// CaptureRequestBody records the body as it is forwarded through the tunnel.
+func (e *Exchange) CaptureRequestBody(r *http.Request) {
+	// Refresh headers, which may have been rewritten since Begin
+	e.Request.Header = r.Header.Clone()
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, e.requestBody), r.Body}
+	}
+}
+
+func (s *CaptureStore) Finish(exchange *Exchange, route *Route) {
+	exchange.DurationMs = float64(time.Since(exchange.Time).Microseconds()) / 1000
+	if route != nil {
+		exchange.Route = route.Name
+	}
+	exchange.Request.Body = exchange.requestBody.buf.String()
+	exchange.Request.BodyTruncated = exchange.requestBody.truncated
+	exchange.Response.Body = exchange.responseBody.buf.String()
+	exchange.Response.BodyTruncated = exchange.responseBody.truncated
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	exchange.ID = s.nextID
+	if s.capacity > 0 {
+		s.entries = append(s.entries, exchange)
+		if len(s.entries) > s.capacity {
+			s.entries = s.entries[len(s.entries)-s.capacity:]
+		}
+	}
+
+	// Remember complete successful GET responses for offline mode
+	if s.recorded != nil && exchange.Request.Method == http.MethodGet &&
+		exchange.Response.Status >= 200 && exchange.Response.Status < 300 &&
+		!exchange.Response.BodyTruncated && exchange.Response.Header.Get(offlineHeader) == "" &&
+		recordable(exchange.Response.Header) {
+		s.recorded[exchange.key] = exchange
+	}
+}
+
+// Recorded returns the last response recorded for the GET or HEAD request
+// captured in exchange, if one was recorded for the same credentials and
+// the headers it varies on match.
+func (s *CaptureStore) Recorded(exchange *Exchange) *Exchange {
+	method := exchange.Request.Method
+	if s.recorded == nil || (method != http.MethodGet && method != http.MethodHead) {
+		return nil
+	}
+	s.mu.Lock()
+	recorded := s.recorded[exchange.key]
+	s.mu.Unlock()
+	if recorded == nil || !recorded.matchesVary(exchange.clientHeader) {
+		return nil
+	}
+	return recorded
+}
+
+// serveRecorded writes a recorded response, marking it as served offline.
+func serveRecorded(w http.ResponseWriter, r *http.Request, exchange *Exchange) {
+	for key, values := range exchange.Response.Header {
+		if key == requestIDHeader {
+			continue
+		}
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.Header().Set(offlineHeader, "recorded")
+	w.Header().Set("X-Apiduct-Recorded-At", exchange.Time.UTC().Format(http.TimeFormat))
+	w.WriteHeader(exchange.Response.Status)
+	if r.Method != http.MethodHead {
+		io.WriteString(w, exchange.Response.Body)
+	}
+}
+
+// List returns exchanges matching query, newest first.
+func (s *CaptureStore) List(query string) []*Exchange {
+	query = strings.ToLower(query)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]*Exchange, 0, len(s.entries))
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		if query == "" || s.entries[i].matches(query) {
+			result = append(result, s.entries[i])
+		}
+	}
+	return result
+}
+
+func (s *CaptureStore) Get(id uint64) *Exchange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, exchange := range s.entries {
+		if exchange.ID == id {
+			return exchange
+		}
+	}
+	return nil
+}
+
+func (e *Exchange) matches(query string) bool {
+	fields := []string{
+		e.Request.Method,
+		e.Request.URI,
+		e.Route,
+		strconv.Itoa(e.Response.Status),
+		e.Request.Body,
+		e.Response.Body,
+	}
+	for _, field := range fields {
+		if strings.Contains(strings.ToLower(field), query) {
+			return true
+		}
+	}
+	for _, header := range []http.Header{e.Request.Header, e.Response.Header} {
+		for key, values := range header {
+			for _, value := range values {
+				if strings.Contains(strings.ToLower(key+": "+value), query) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// captureWriter records the status, headers and body sent to the client.
+type captureWriter struct {
+	http.ResponseWriter
+	exchange    *Exchange
+	wroteHeader bool
+}
+
+func (c *captureWriter) WriteHeader(status int) {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		c.exchange.Response.Status = status
+		c.exchange.Response.Header = c.Header().Clone()
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *captureWriter) Write(p []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	c.exchange.responseBody.Write(p)
+	return c.ResponseWriter.Write(p)
+}
+
+func (c *captureWriter) Flush() {
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// ReplayOverrides optionally modifies a captured request before it is
+// replayed. Unset fields keep their captured values.
+type ReplayOverrides struct {
+	Method        string            `json:"method,omitempty"`
+	URI           string            `json:"uri,omitempty"`
+	Host          string            `json:"host,omitempty"`
+	SetHeaders    map[string]string `json:"set_headers,omitempty"`
+	RemoveHeaders []string          `json:"remove_headers,omitempty"`
+	Body          *string           `json:"body,omitempty"`
+}
+
+// replayRequest rebuilds a captured request, applying overrides, so it can be
+// sent again.
+func replayRequest(ctx context.Context, exchange *Exchange, overrides *ReplayOverrides) (*http.Request, error) {
+	method, uri, host, body := exchange.Request.Method, exchange.Request.URI, exchange.Request.Host, exchange.Request.Body
+	header := exchange.Request.Header.Clone()
+	if overrides != nil {
+		if overrides.Method != "" {
+			method = overrides.Method
+		}
+		if overrides.URI != "" {
+			uri = overrides.URI
+		}
+		if overrides.Host != "" {
+			host = overrides.Host
+		}
+		if overrides.Body != nil {
+			body = *overrides.Body
+		}
+		for _, key := range overrides.RemoveHeaders {
+			header.Del(key)
+		}
+		for key, value := range overrides.SetHeaders {
+			header.Set(key, value)
+		}
+	}
+	if !strings.HasPrefix(uri, "/") {
+		return nil, fmt.Errorf("uri must be an absolute path")
+	}
+
+	ctx = context.WithValue(context.WithValue(ctx, replayOfKey, exchange.ID), internalKey, true)
+	req, err := http.NewRequestWithContext(ctx, method, uri, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.RequestURI = uri
+	req.Host = host
+	req.Header = header
+	req.RemoteAddr = "replay"
+	req.ContentLength = int64(len(body))
+	if req.ContentLength == 0 {
+		req.Body = http.NoBody
+	}
+	req.Header.Del("Content-Length")
+	return req, nil
+}
+
+// bufferedResponse collects the output of a replayed request.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header)}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecordKey(t *testing.T) {
+	header := func(pairs ...string) http.Header {
+		h := http.Header{}
+		for i := 0; i < len(pairs); i += 2 {
+			h.Add(pairs[i], pairs[i+1])
+		}
+		return h
+	}
+	base := recordKey("api.example.com", "/v1/orders", header("Authorization", "Bearer alice"))
+	tests := []struct {
+		name   string
+		host   string
+		uri    string
+		header http.Header
+		same   bool
+	}{
+		{"same request", "api.example.com", "/v1/orders", header("Authorization", "Bearer alice"), true},
+		{"unrelated header", "api.example.com", "/v1/orders", header("Authorization", "Bearer alice", "User-Agent", "curl"), true},
+		{"other credentials", "api.example.com", "/v1/orders", header("Authorization", "Bearer bob"), false},
+		{"no credentials", "api.example.com", "/v1/orders", header(), false},
+		{"cookie", "api.example.com", "/v1/orders", header("Authorization", "Bearer alice", "Cookie", "session=1"), false},
+		{"client certificate", "api.example.com", "/v1/orders", header("Authorization", "Bearer alice", clientSubjectHeader, "CN=alice"), false},
+		{"other host", "www.example.com", "/v1/orders", header("Authorization", "Bearer alice"), false},
+		{"other URI", "api.example.com", "/v1/orders?page=2", header("Authorization", "Bearer alice"), false},
+	}
+	for _, tt := range tests {
+		if got := recordKey(tt.host, tt.uri, tt.header) == base; got != tt.same {
+			t.Errorf("%s: same key %v, want %v", tt.name, got, tt.same)
+		}
+	}
+}
+
+func TestRecordable(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   bool
+	}{
+		{"plain", http.Header{"Content-Type": {"application/json"}}, true},
+		{"public", http.Header{"Cache-Control": {"public, max-age=60"}}, true},
+		{"private", http.Header{"Cache-Control": {"max-age=60, private"}}, false},
+		{"private fields", http.Header{"Cache-Control": {`private="Authorization"`}}, false},
+		{"no-store", http.Header{"Cache-Control": {"No-Store"}}, false},
+		{"sets cookie", http.Header{"Set-Cookie": {"session=1"}}, false},
+		{"varies on headers", http.Header{"Vary": {"Accept-Encoding"}}, true},
+		{"varies on anything", http.Header{"Vary": {"Accept, *"}}, false},
+	}
+	for _, tt := range tests {
+		if got := recordable(tt.header); got != tt.want {
+			t.Errorf("%s: recordable %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// record passes a GET request through the capture store, answered with
+// header.
+func record(store *CaptureStore, r *http.Request, header http.Header) {
+	w, exchange := store.Begin(httptest.NewRecorder(), r)
+	for key, values := range header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"orders":[]}`))
+	store.Finish(exchange, nil)
+}
+
+// recorded returns the response store would serve offline for r.
+func recorded(store *CaptureStore, r *http.Request) *Exchange {
+	_, exchange := store.Begin(httptest.NewRecorder(), r)
+	return store.Recorded(exchange)
+}
+
+func TestRecorded(t *testing.T) {
+	request := func(method string, header ...string) *http.Request {
+		r := httptest.NewRequest(method, "http://api.example.com/v1/orders", nil)
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		return r
+	}
+
+	store := NewCaptureStore(0, 1<<20, true)
+	record(store, request("GET", "Authorization", "Bearer alice", "Accept-Encoding", "gzip", "Accept-Charset", "utf-8"),
+		http.Header{"Vary": {"Accept-Charset"}})
+	record(store, request("GET", "Authorization", "Bearer bob"), http.Header{"Cache-Control": {"private"}})
+	record(store, request("GET", "Cookie", "session=1"), http.Header{"Set-Cookie": {"session=2"}})
+
+	tests := []struct {
+		name    string
+		request *http.Request
+		want    bool
+	}{
+		{"same credentials", request("GET", "Authorization", "Bearer alice", "Accept-Encoding", "gzip", "Accept-Charset", "utf-8"), true},
+		{"HEAD", request("HEAD", "Authorization", "Bearer alice", "Accept-Encoding", "gzip", "Accept-Charset", "utf-8"), true},
+		{"other credentials", request("GET", "Authorization", "Bearer mallory", "Accept-Encoding", "gzip", "Accept-Charset", "utf-8"), false},
+		{"no credentials", request("GET", "Accept-Encoding", "gzip", "Accept-Charset", "utf-8"), false},
+		{"other encoding", request("GET", "Authorization", "Bearer alice", "Accept-Charset", "utf-8"), false},
+		{"other varied header", request("GET", "Authorization", "Bearer alice", "Accept-Encoding", "gzip", "Accept-Charset", "latin1"), false},
+		{"POST", request("POST", "Authorization", "Bearer alice", "Accept-Encoding", "gzip", "Accept-Charset", "utf-8"), false},
+		{"private response", request("GET", "Authorization", "Bearer bob"), false},
+		{"cookie response", request("GET", "Cookie", "session=1"), false},
+	}
+	for _, tt := range tests {
+		if got := recorded(store, tt.request) != nil; got != tt.want {
+			t.Errorf("%s: served recorded response %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// How often the certificate is checked for expiry and a due OCSP refresh
+const certCheckInterval = time.Minute
+
+// certHealth serves the HTTPS certificate with a stapled OCSP response and
+// watches its expiry. The certificate comes from source, so certificates
+// renewed by ACME are picked up.
+type certHealth struct {
+	source   func() (*tls.Certificate, error)
+	staple   bool
+	warning  time.Duration
+	client   *http.Client
+	notifier Notifier
+
+	mu          sync.RWMutex
+	cert        *tls.Certificate // the source certificate the staple belongs to
+	stapled     *tls.Certificate // cert with the OCSP response attached
+	stapleUntil time.Time        // the staple's next update, after which it is dropped
+	nextStaple  time.Time        // when to fetch a new OCSP response
+	lastWarned  time.Time
+}
+
+func newCertHealth(source func() (*tls.Certificate, error), config *Config, notifier Notifier) *certHealth {
+	return &certHealth{
+		source:   source,
+		staple:   config.OCSPStapling,
+		warning:  config.CertExpiryWarning,
+		client:   &http.Client{Timeout: 15 * time.Second},
+		notifier: notifier,
+	}
+}
+
+// GetCertificate returns the current certificate, stapled if a valid OCSP
+// response is available for it.
+func (c *certHealth) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := c.source()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cert == cert && c.stapled != nil && time.Now().Before(c.stapleUntil) {
+		return c.stapled, nil
+	}
+	return cert, nil
+}
+
+// Start checks the certificate now and then periodically in the background.
+func (c *certHealth) Start() {
+	c.check()
+	go func() {
+		for range time.Tick(certCheckInterval) {
+			c.check()
+		}
+	}()
+}
+
+func (c *certHealth) check() {
+	cert, err := c.source()
+	if err != nil || len(cert.Certificate) == 0 {
+		return
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return
+		}
+	}
+	c.checkExpiry(leaf)
+	if !c.staple {
+		return
+	}
+
+	c.mu.RLock()
+	due := c.cert != cert || time.Now().After(c.nextStaple)
+	c.mu.RUnlock()
+	if due {
+		c.refreshStaple(cert, leaf)
+	}
+}
+
+// checkExpiry publishes the time left on the certificate and warns once a day
+// when it is about to expire.
+func (c *certHealth) checkExpiry(leaf *x509.Certificate) {
+	name := certName(leaf)
+	left := time.Until(leaf.NotAfter)
+	metrics.Gauge("apiduct_certificate_expiry_seconds", "cert", name).Set(int64(left.Seconds()))
+	if c.warning <= 0 || left > c.warning {
+		return
+	}
+
+	c.mu.Lock()
+	if time.Since(c.lastWarned) < 24*time.Hour {
+		c.mu.Unlock()
+		return
+	}
+	c.lastWarned = time.Now()
+	c.mu.Unlock()
+
+	var message string
+	if left <= 0 {
+		message = fmt.Sprintf("HTTPS certificate for %s expired on %s", name, leaf.NotAfter.Format(time.RFC3339))
+	} else {
+		message = fmt.Sprintf("HTTPS certificate for %s expires in %s, on %s", name, left.Round(time.Hour), leaf.NotAfter.Format(time.RFC3339))
+	}
+	logEvent("certificate_expiring", map[string]string{"cert": name}, "[BRIDGE] Warning: %s", message)
+	if c.notifier != nil {
+		go func() {
+			if err := c.notifier.Notify("apiduct certificate expiring", message, map[string]string{
+				"cert":      name,
+				"not_after": leaf.NotAfter.Format(time.RFC3339),
+			}); err != nil {
+				log.Printf("[BRIDGE] Failed to deliver certificate warning: %v", err)
+			}
+		}()
+	}
+}
+
+// refreshStaple fetches an OCSP response for cert. A response that cannot be
+// refreshed is kept until its next update, then dropped.
+func (c *certHealth) refreshStaple(cert *tls.Certificate, leaf *x509.Certificate) {
+	c.mu.Lock()
+	if c.cert != cert {
+		// A new certificate, the old staple does not apply
+		c.cert = cert
+		c.stapled = nil
+	}
+	c.mu.Unlock()
+
+	if len(leaf.OCSPServer) == 0 || len(cert.Certificate) < 2 {
+		// Nothing to staple until the certificate changes
+		log.Printf("[BRIDGE] Not stapling OCSP for %s: the certificate has no OCSP responder or issuer in its chain", certName(leaf))
+		c.setNextStaple(leaf.NotAfter)
+		return
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		log.Printf("[BRIDGE] Not stapling OCSP for %s: invalid issuer certificate: %v", certName(leaf), err)
+		c.setNextStaple(leaf.NotAfter)
+		return
+	}
+
+	resp, raw, err := fetchOCSP(c.client, leaf, issuer)
+	if err != nil {
+		metrics.Counter("apiduct_ocsp_refresh_total", "result", "error").Inc()
+		log.Printf("[BRIDGE] Failed to refresh OCSP response for %s, retrying in 5 minutes: %v", certName(leaf), err)
+		c.setNextStaple(time.Now().Add(5 * time.Minute))
+		return
+	}
+
+	switch resp.Status {
+	case ocsp.Good:
+		metrics.Counter("apiduct_ocsp_refresh_total", "result", "good").Inc()
+	case ocsp.Revoked:
+		metrics.Counter("apiduct_ocsp_refresh_total", "result", "revoked").Inc()
+		logEvent("certificate_revoked", map[string]string{"cert": certName(leaf)},
+			"[BRIDGE] Error: HTTPS certificate for %s was revoked on %s, replace it", certName(leaf), resp.RevokedAt.Format(time.RFC3339))
+	default:
+		metrics.Counter("apiduct_ocsp_refresh_total", "result", "unknown").Inc()
+		log.Printf("[BRIDGE] OCSP responder does not know the certificate for %s", certName(leaf))
+	}
+	if resp.Status != ocsp.Good {
+		c.mu.Lock()
+		c.stapled = nil
+		c.mu.Unlock()
+		c.setNextStaple(time.Now().Add(time.Hour))
+		return
+	}
+
+	// Refresh halfway through the response's validity
+	until := resp.NextUpdate
+	if until.IsZero() {
+		until = time.Now().Add(2 * time.Hour)
+	}
+	stapled := *cert
+	stapled.OCSPStaple = raw
+	c.mu.Lock()
+	c.stapled = &stapled
+	c.stapleUntil = until
+	c.mu.Unlock()
+	c.setNextStaple(time.Now().Add(time.Until(until) / 2))
+	log.Printf("[BRIDGE] Stapled OCSP response for %s, valid until %s", certName(leaf), until.Format(time.RFC3339))
+}
+
+func (c *certHealth) setNextStaple(t time.Time) {
+	c.mu.Lock()
+	c.nextStaple = t
+	c.mu.Unlock()
+}
+
+// fetchOCSP asks the certificate's OCSP responder for its status.
+func fetchOCSP(client *http.Client, leaf, issuer *x509.Certificate) (*ocsp.Response, []byte, error) {
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := client.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP responder returned status %d", resp.StatusCode)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, nil, err
+	}
+	parsed, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid OCSP response: %v", err)
+	}
+	return parsed, raw, nil
+}
+
+// certName identifies a certificate in logs and metric labels.
+func certName(leaf *x509.Certificate) string {
+	if len(leaf.DNSNames) > 0 {
+		return strings.Join(leaf.DNSNames, ",")
+	}
+	return leaf.Subject.CommonName
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// checksumWait bounds how long a response waits for the checksum that follows
+// its body, which the offramp sends as soon as the body is written.
+const checksumWait = 5 * time.Second
+
+// tailWriter passes writes on except for their last byte, which it holds
+// until release, so a client does not receive a body in full before the
+// checksum that follows it was verified.
+type tailWriter struct {
+	w    io.Writer
+	tail []byte
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := t.release(); err != nil {
+		return 0, err
+	}
+	if _, err := t.w.Write(p[:len(p)-1]); err != nil {
+		return 0, err
+	}
+	t.tail = append(t.tail, p[len(p)-1])
+	return len(p), nil
+}
+
+// release writes the byte held back.
+func (t *tailWriter) release() error {
+	if len(t.tail) == 0 {
+		return nil
+	}
+	_, err := t.w.Write(t.tail)
+	t.tail = t.tail[:0]
+	return err
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"apiduct/pkg/accesslog"
+	"apiduct/pkg/buildinfo"
+	"apiduct/pkg/telemetry"
+	"apiduct/pkg/tunnel"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// flagAliases maps deprecated flag names to their replacements. The old names
+// keep working but print a deprecation notice.
+var flagAliases = map[string]string{
+	"listen-ip":    "listen-host",
+	"enable-https": "https",
+	"cert-file":    "tls-cert-file",
+	"key-file":     "tls-key-file",
+}
+
+// flagGroup is a titled section of flags in the help output.
+type flagGroup struct {
+	title string
+	flags *pflag.FlagSet
+}
+
+func newFlagGroup(title string) *flagGroup {
+	return &flagGroup{title: title, flags: pflag.NewFlagSet(title, pflag.ContinueOnError)}
+}
+
+func newRootCommand() *cobra.Command {
+	config := &Config{}
+	var reportInterval, warmupURLs string
+
+	listeners := newFlagGroup("Listeners")
+	listeners.flags.StringVar(&config.ListenIP, "listen-host", "0.0.0.0", "IP address to listen on")
+	listeners.flags.IntVar(&config.ListenPort, "listen-port", 8000, "Port to listen on")
+	listeners.flags.IntVar(&config.TunnelPort, "tunnel-port", 8001, "Port to listen for tunnel connections")
+	listeners.flags.BoolVar(&config.EnableHTTPS, "https", false, "Enable HTTPS for HTTP listener")
+	listeners.flags.BoolVar(&config.H2C, "h2c", false, "Accept HTTP/2 without TLS (h2c) on the HTTP listener, e.g. for gRPC clients; HTTPS negotiates HTTP/2 on its own")
+	listeners.flags.StringVar(&config.CertFile, "tls-cert-file", "", "Path to TLS certificate file")
+	listeners.flags.StringVar(&config.KeyFile, "tls-key-file", "", "Path to TLS key file")
+	listeners.flags.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "Time to wait on SIGINT or SIGTERM for requests in flight to finish, 0 to exit at once")
+	listeners.flags.BoolVar(&config.KillSwitch, "kill-switch", false, "Start with the kill switch engaged, refusing tunnels and serving the incident page until released on the admin interface")
+	listeners.flags.StringVar(&config.IncidentPage, "incident-page", "", "File served with 503 to public requests while the kill switch is engaged (a JSON error if empty)")
+	listeners.flags.StringVar(&config.DrainRedirect, "drain-redirect", "", "URL that requests are redirected to while draining, with the request path appended (503 if empty)")
+	listeners.flags.StringVar(&config.AdminListen, "admin-listen", "", "Address for the local admin interface (e.g. 127.0.0.1:4040), disabled if empty")
+	listeners.flags.StringVar(&config.AdminSocket, "admin-socket", "", "Unix socket to serve the admin interface on as well, only accessible to the bridge's user; disabled if empty")
+	listeners.flags.StringVar(&config.PriorityListen, "priority-listen", "", "Address of a second HTTP listener whose requests, e.g. load balancer health checks, all take the priority lane; disabled if empty")
+
+	tunnelGroup := newFlagGroup("Tunnel")
+	tunnelGroup.flags.StringVar(&config.PSK, "psk", "", "Pre-shared key for tunnel authentication, key ID default")
+	tunnelGroup.flags.StringVar(&config.PSKDir, "psk-dir", "", "Directory of further pre-shared keys, one per file named after its key ID, read again when its files change; for rotating keys one offramp at a time")
+	tunnelGroup.flags.StringVar(&config.EnrollmentFile, "enrollment-file", "", "File keeping bootstrap tokens and the keys of offramps enrolled with them, enabling enrollment on the admin interface; disabled if empty")
+	tunnelGroup.flags.DurationVar(&config.MaxClockSkew, "max-clock-skew", 30*time.Second, "Maximum tolerated clock difference to the offramp, 0 to disable the check")
+	tunnelGroup.flags.StringVar(&config.ClockSkewAction, "clock-skew-action", "warn", "Action when the clock skew is exceeded: warn or fail")
+	tunnelGroup.flags.BoolVar(&config.TunnelHeader, "tunnel-header", false, "Add an X-Apiduct-Tunnel header naming the tunnel that served each response and its age")
+	tunnelGroup.flags.BoolVar(&config.ServerTiming, "server-timing", false, "Add a Server-Timing header to each response from the tunnel, splitting its time into offramp queue, tunnel transfer and target time")
+	tunnelGroup.flags.IntVar(&config.MaxConcurrency, "max-concurrency", 0, "Maximum requests in flight across the bridge, answered with 429 beyond it, 0 for no limit")
+	tunnelGroup.flags.Int64Var(&config.MaxRequestBody, "max-request-body", 0, "Largest request body in bytes sent down the tunnel, answered with 413 beyond it, 0 for no limit; a route's request_bytes takes precedence")
+	tunnelGroup.flags.Int64Var(&config.MaxResponseBody, "max-response-body", 0, "Largest response body in bytes passed on from the tunnel, answered with 502 or cut off beyond it, 0 for no limit; a route's response_bytes takes precedence")
+	tunnelGroup.flags.Float64Var(&config.RateLimit, "rate-limit", 0, "Requests per second admitted across the bridge, answered with 429 beyond it, 0 for no limit")
+	tunnelGroup.flags.IntVar(&config.RateBurst, "rate-burst", 0, "Requests admitted at once under --rate-limit (defaults to the rate)")
+	tunnelGroup.flags.Float64Var(&config.ClientRateLimit, "client-rate-limit", 0, "Requests per second admitted from each client IP address, answered with 429 beyond it, 0 for no limit")
+	tunnelGroup.flags.IntVar(&config.ClientRateBurst, "client-rate-burst", 0, "Requests admitted at once from each client under --client-rate-limit (defaults to the rate)")
+	tunnelGroup.flags.IntVar(&config.TunnelMaxConcurrency, "tunnel-max-concurrency", 0, "Maximum requests pushed down each tunnel at once, answered with 503 beyond it, 0 for no limit")
+	tunnelGroup.flags.BoolVar(&config.AdaptiveConcurrency, "adaptive-concurrency", false, "Limit the requests pushed down each tunnel at once to what its latency allows, up to --tunnel-max-concurrency")
+	tunnelGroup.flags.StringVar(&config.TunnelBalance, "tunnel-balance", tunnel.BalanceLeastLoaded, "How requests are spread across connected offramps: least-loaded or round-robin")
+	tunnelGroup.flags.StringArrayVar(&config.OfframpRoutes, "offramp-route", nil, "Send requests for a host or path prefix to the offramp with that name: name=host, name=/prefix or name=host/prefix (repeatable)")
+	tunnelGroup.flags.StringArrayVar(&config.OfframpPolicy, "offramp-policy", nil, "Routes an offramp identity, its enrolled identity or --client-id, may serve, as identity=route[,route...] with default naming requests that match no route (repeatable); unlisted identities serve none")
+	tunnelGroup.flags.StringArrayVar(&config.TunnelACL, "tunnel-acl", nil, "Addresses forward clients may reach through an offramp, as name=host:port[,host:port...] with - naming unnamed offramps (repeatable); everything else is denied")
+	tunnelGroup.flags.IntVar(&config.TunnelMaxFailures, "tunnel-max-failures", 3, "Close a tunnel after this many requests in a row failed on it, 0 to keep it until it disconnects")
+	tunnelGroup.flags.IntVar(&config.TunnelRetries, "tunnel-retries", 1, "Times an idempotent request without a body that was lost to a closed or replaced tunnel is sent again on another, 0 to answer 502 at once")
+	tunnelGroup.flags.DurationVar(&config.TunnelRetryWait, "tunnel-retry-wait", 5*time.Second, "Time to wait for a replacement tunnel to retry a lost request on")
+	tunnelGroup.flags.BoolVar(&config.TunnelChecksums, "tunnel-checksums", false, "Have offramps checksum each response they send, aborting responses that arrive damaged instead of passing them on")
+	tunnelGroup.flags.DurationVar(&config.RequestTimeout, "request-timeout", time.Minute, "Time to wait for the response headers of a request from the tunnel, answered with 504 beyond it, 0 to wait indefinitely")
+	tunnelGroup.flags.DurationVar(&config.HeartbeatInterval, "heartbeat-interval", 15*time.Second, "Interval between pings on each tunnel, 0 to disable the heartbeat")
+	tunnelGroup.flags.DurationVar(&config.HeartbeatTimeout, "heartbeat-timeout", 15*time.Second, "Time to wait for a ping answer before the tunnel is considered dead and closed")
+	tunnelGroup.flags.StringArrayVar(&config.PriorityPaths, "priority-path", nil, "Path prefix of requests, e.g. health checks, that skip the bridge-wide rate and concurrency limits and are served ahead of data traffic by the offramp (repeatable)")
+	tunnelGroup.flags.DurationVar(&config.CoalesceWindow, "coalesce-window", 0, "Share one tunnel request between identical GETs in flight together or within this window, 0 to disable")
+	tunnelGroup.flags.IntVar(&config.CoalesceMaxBody, "coalesce-max-body", 1024*1024, "Largest response body in bytes shared between coalesced requests")
+
+	access := newFlagGroup("Access control")
+	access.flags.StringArrayVar(&config.AllowCIDRs, "allow-cidr", nil, "Client address or CIDR admitted to routes without an access policy of their own (repeatable); any address if none")
+	access.flags.StringArrayVar(&config.DenyCIDRs, "deny-cidr", nil, "Client address or CIDR refused on routes without an access policy of their own, before --allow-cidr (repeatable)")
+	access.flags.StringArrayVar(&config.BasicAuth, "basic-auth", nil, "user:password accepted as HTTP basic auth on routes without an access policy of their own (repeatable)")
+	access.flags.StringArrayVar(&config.BearerTokens, "bearer-token", nil, "Bearer token accepted on routes without an access policy of their own (repeatable)")
+	access.flags.StringVar(&config.DenyAction, "deny-action", denyActionReject, "Answer to clients refused by address on routes without an access policy of their own: reject at once, or tarpit to answer after --tarpit-delay")
+	access.flags.DurationVar(&config.TarpitDelay, "tarpit-delay", 30*time.Second, "Time tarpitted requests are held before they are answered")
+	access.flags.IntVar(&config.TarpitMax, "tarpit-max", 100, "Requests held in the tarpit at once; refused clients beyond it are rejected at once")
+
+	forwarding := newFlagGroup("Forwarded headers")
+	forwarding.flags.BoolVar(&config.ForwardedHeaders, "forwarded-headers", true, "Tell the target the client address, scheme and host in X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host")
+	forwarding.flags.BoolVar(&config.ForwardedRFC7239, "forwarded-rfc7239", false, "Add the standard Forwarded header (RFC 7239) as well")
+	forwarding.flags.StringArrayVar(&config.TrustedProxies, "trusted-proxy", nil, "Address or CIDR of a proxy in front of the bridge whose forwarded headers are kept and extended (repeatable); those of other clients are removed")
+
+	certificates := newFlagGroup("Certificates")
+	certificates.flags.BoolVar(&config.ACME, "acme", false, "Obtain and renew the HTTPS certificate from an ACME CA such as Let's Encrypt (implies --https)")
+	certificates.flags.StringVar(&config.ACMEHosts, "acme-hosts", "", "Comma separated host names for the certificate, e.g. api.example.com,*.example.com")
+	certificates.flags.StringVar(&config.ACMEEmail, "acme-email", "", "Contact email for the ACME account")
+	certificates.flags.StringVar(&config.ACMEDirectory, "acme-directory", letsEncryptURL, "ACME directory URL")
+	certificates.flags.StringVar(&config.ACMECacheDir, "acme-cache-dir", "acme-cache", "Directory where the account key and certificate are kept")
+	certificates.flags.StringVar(&config.ACMEChallenge, "acme-challenge", "", "ACME challenge: tls-alpn-01 or http-01 (one certificate per host, obtained with autocert) or dns-01 (defaults to dns-01 with --acme-dns-provider, tls-alpn-01 otherwise)")
+	certificates.flags.StringVar(&config.ACMEHTTPListen, "acme-http-listen", ":80", "Address answering HTTP-01 challenges, which also redirects other requests to HTTPS")
+	certificates.flags.StringVar(&config.ACMEDNSProvider, "acme-dns-provider", "", "DNS provider answering DNS-01 challenges: route53 or cloudflare")
+	certificates.flags.DurationVar(&config.ACMEDNSWait, "acme-dns-wait", 2*time.Minute, "Maximum time to wait for challenge records to show up in DNS")
+	certificates.flags.StringVar(&config.CloudflareToken, "acme-cloudflare-token", os.Getenv("CLOUDFLARE_API_TOKEN"), "Cloudflare API token with DNS edit permission (defaults to $CLOUDFLARE_API_TOKEN)")
+	certificates.flags.BoolVar(&config.OCSPStapling, "ocsp-stapling", true, "Staple OCSP responses from the CA to HTTPS handshakes")
+	certificates.flags.DurationVar(&config.CertExpiryWarning, "cert-expiry-warning", 30*24*time.Hour, "Warn daily when the HTTPS certificate expires within this time, 0 to disable")
+	certificates.flags.StringVar(&config.ClientCAFile, "client-ca-file", "", "CA bundle verifying client certificates on the HTTPS listener, disabled if empty")
+	certificates.flags.StringVar(&config.ClientAuth, "client-auth", "require", "Client certificate policy with --client-ca-file: require, or optional to verify only those given")
+	certificates.flags.StringVar(&config.ClientCRLFiles, "client-crl-files", "", "Comma separated CRL files (PEM or DER) checked for revoked client certificates, reloaded when changed")
+	certificates.flags.BoolVar(&config.ClientOCSP, "client-ocsp", false, "Check client certificates with the OCSP responder they name")
+	certificates.flags.BoolVar(&config.ForwardTLSHeaders, "forward-tls-headers", true, "Describe the client's TLS connection and certificate to the target in X-Forwarded-TLS-* headers")
+
+	configuration := newFlagGroup("Configuration")
+	configuration.flags.StringVar(&config.ConfigFile, "config", "", "Path to a JSON, YAML or TOML config file with settings and routes, or a directory of per-profile config files")
+	configuration.flags.BoolVar(&config.ValidateConfig, "validate-config", false, "Check the config file and flags, then exit without starting the bridge")
+	configuration.flags.StringVar(&config.Profile, "profile", os.Getenv("APIDUCT_PROFILE"), "Configuration profile, e.g. dev, staging or prod (defaults to $APIDUCT_PROFILE)")
+	configuration.flags.StringVar(&config.OpenAPIFile, "openapi", "", "Path to an OpenAPI 3 spec (YAML or JSON) used to validate incoming requests")
+
+	inspector := newFlagGroup("Inspector and offline mode")
+	inspector.flags.BoolVar(&config.Inspect, "inspect", false, "Capture recent requests and serve the inspector UI on the admin interface")
+	inspector.flags.IntVar(&config.InspectCapacity, "inspect-capacity", 100, "Number of requests kept by the inspector")
+	inspector.flags.IntVar(&config.InspectMaxBody, "inspect-max-body", 64*1024, "Maximum number of body bytes captured per request and response")
+	inspector.flags.BoolVar(&config.OfflineResponses, "offline-responses", false, "Record successful GET responses and serve them while the tunnel is down")
+	inspector.flags.StringVar(&config.RecordDir, "record-dir", "", "Record the frames of each tunnel session to a file in this directory for 'api-bridge replay'; credentials are redacted, bodies are not")
+	inspector.flags.StringVar(&warmupURLs, "warmup-urls", "", "Comma separated paths or URLs fetched through the tunnel after it (re)connects")
+
+	logging := newFlagGroup("Logging")
+	logging.flags.StringVar(&config.LogSink, "log-sink", "auto", "Log destination: auto (journald under systemd, else stderr), stderr, journald, gcp (Google Cloud Logging) or syslog")
+	logging.flags.StringVar(&config.LogLevel, "log-level", "info", "Minimum level logged by the --log-sink destination: debug (adds per-request progress and wire traces), info, warning or error")
+	logging.flags.StringVar(&config.LogFormat, "log-format", "text", "Format of stderr logs: text or json")
+	logging.flags.StringVar(&config.GCPProject, "gcp-project", "", "GCP project for Cloud Logging (defaults to the project of the instance)")
+	logging.flags.StringVar(&config.GCPLogName, "gcp-log-name", "apiduct-bridge", "Log name used for Cloud Logging entries")
+	logging.flags.StringVar(&config.SyslogAddr, "syslog-addr", "", "Syslog endpoint: udp://host:514, tcp://host:601, tls://host:6514 or unix:///dev/log (default)")
+	logging.flags.StringVar(&config.SyslogFacility, "syslog-facility", "daemon", "Syslog facility (e.g. daemon, local0)")
+	logging.flags.StringVar(&config.SyslogCAFile, "syslog-ca-file", "", "CA certificate used to verify a TLS syslog endpoint (defaults to system roots)")
+	logging.flags.IntVar(&config.LogSampleBurst, "log-sample-burst", 20, "Log at most this many similar messages per sampling window, 0 to disable sampling")
+	logging.flags.DurationVar(&config.LogSampleWindow, "log-sample-window", 10*time.Second, "Sampling window for repetitive log messages")
+	logging.flags.StringVar(&config.AccessLog, "access-log", "", "File logging every request, separate from the operational log, disabled if empty")
+	logging.flags.StringVar(&config.AccessLogFormat, "access-log-format", accesslog.FormatCombined, "Format of access log lines: common, combined or json")
+	logging.flags.IntVar(&config.AccessLogMaxSize, "access-log-max-size", 100, "Megabytes the access log may grow to before it is rotated, 0 for no limit")
+	logging.flags.DurationVar(&config.AccessLogRotate, "access-log-rotate", 24*time.Hour, "Rotate the access log at each multiple of this interval (UTC), 0 to only rotate by size")
+	logging.flags.IntVar(&config.AccessLogMaxBackups, "access-log-max-backups", 7, "Rotated access logs kept, 0 to keep all")
+	logging.flags.StringVar(&config.ServiceName, "service-name", "api-bridge", "Windows service and event source name")
+
+	notifications := newFlagGroup("Notifications and reports")
+	notifications.flags.StringVar(&config.NotifyWebhook, "notify-webhook", "", "URL receiving notifications as JSON POST requests")
+	notifications.flags.StringVar(&config.NotifyEmailTo, "notify-email-to", "", "Comma separated email recipients for notifications")
+	notifications.flags.StringVar(&config.NotifyEmailFrom, "notify-email-from", "", "Sender address for email notifications")
+	notifications.flags.StringVar(&config.NotifySMTPAddr, "notify-smtp-addr", "", "SMTP server address (host:port) for email notifications")
+	notifications.flags.StringVar(&config.NotifySMTPUser, "notify-smtp-user", "", "SMTP username")
+	notifications.flags.StringVar(&config.NotifySMTPPassword, "notify-smtp-password", "", "SMTP password")
+	notifications.flags.StringVar(&reportInterval, "report-interval", "off", "Interval for summary reports: daily, weekly, a duration such as 12h, or off")
+
+	metricsGroup := newFlagGroup("Metrics and usage")
+	metricsGroup.flags.IntVar(&config.MetricsPort, "metrics-port", 0, "Port on the listen IP to serve Prometheus metrics on at /metrics, disabled if 0")
+	metricsGroup.flags.StringVar(&config.CloudWatchNamespace, "cloudwatch-namespace", "", "Publish metrics to AWS CloudWatch under this namespace, disabled if empty")
+	metricsGroup.flags.StringVar(&config.CloudWatchRegion, "cloudwatch-region", "", "AWS region for CloudWatch (defaults to AWS_REGION or the EC2 instance region)")
+	metricsGroup.flags.StringVar(&config.CloudWatchDimensions, "cloudwatch-dimensions", "", "Comma separated Name=Value dimensions added to every CloudWatch metric")
+	metricsGroup.flags.DurationVar(&config.CloudWatchInterval, "cloudwatch-interval", time.Minute, "Interval between CloudWatch metric publications")
+	metricsGroup.flags.StringVar(&config.UsageStateFile, "usage-state-file", "", "File where usage counters are checkpointed and restored from on startup, disabled if empty")
+	metricsGroup.flags.DurationVar(&config.UsageCheckpoint, "usage-checkpoint-interval", time.Minute, "Interval between usage counter checkpoints")
+	metricsGroup.flags.StringVar(&config.Telemetry, "telemetry", telemetry.Off, "Send anonymous usage reports (version, features used, error counts by code) to --telemetry-endpoint: on or off")
+	metricsGroup.flags.StringVar(&config.TelemetryEndpoint, "telemetry-endpoint", "", "URL telemetry reports are posted to")
+	metricsGroup.flags.DurationVar(&config.TelemetryInterval, "telemetry-interval", 24*time.Hour, "Interval between telemetry reports, at least 1h")
+	metricsGroup.flags.StringVar(&config.JournalFile, "journal-file", "", "Append-only, hash-chained file journaling the metadata of every request for audits, disabled if empty")
+
+	groups := []*flagGroup{listeners, access, forwarding, certificates, tunnelGroup, configuration, inspector, logging, notifications, metricsGroup}
+	for _, group := range groups {
+		addDeprecatedAliases(group.flags)
+	}
+
+	runBridge := func(cmd *cobra.Command, args []string) {
+		run(config, cmd.Flags(), reportInterval, warmupURLs)
+	}
+	root := &cobra.Command{
+		Use:   "api-bridge [flags]",
+		Short: "Expose an API reachable only through an apiduct tunnel",
+		Long: "api-bridge accepts HTTP requests and forwards them through a tunnel to an\n" +
+			"api-offramp, which relays them to the target API.\n\n" +
+			"Without a command, api-bridge runs the bridge like the run command.",
+		Args: cobra.NoArgs,
+		Run:  runBridge,
+	}
+	runCmd := &cobra.Command{
+		Use:   "run [flags]",
+		Short: "Run the bridge",
+		Args:  cobra.NoArgs,
+		Run:   runBridge,
+	}
+	for _, cmd := range []*cobra.Command{root, runCmd} {
+		for _, group := range groups {
+			cmd.Flags().AddFlagSet(group.flags)
+		}
+		cmd.SetUsageFunc(groupedUsage(groups))
+	}
+	registerCompletions(root)
+
+	root.AddCommand(runCmd, newInitCommand(), newJournalCommand(), newReplayCommand(), &cobra.Command{
+		Use:   "version",
+		Short: "Print the version",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Printf("api-bridge %s (built %s)\n", Version, BuildTime)
+			fmt.Printf("features: %s\n", strings.Join(buildinfo.Compiled(features(&Config{})), " "))
+		},
+	})
+	root.SetArgs(normalizeArgs(os.Args[1:], root))
+	return root
+}
+
+// addDeprecatedAliases registers the old name of each renamed flag in the set.
+// The alias shares the flag's value and is hidden from the help output.
+func addDeprecatedAliases(flags *pflag.FlagSet) {
+	for old, name := range flagAliases {
+		f := flags.Lookup(name)
+		if f == nil {
+			continue
+		}
+		flags.Var(f.Value, old, f.Usage)
+		flags.Lookup(old).NoOptDefVal = f.NoOptDefVal
+		flags.MarkDeprecated(old, "use --"+name+" instead")
+	}
+}
+
+// flagChanged reports whether a flag, or its deprecated alias, was given on
+// the command line.
+func flagChanged(flags *pflag.FlagSet, name string) bool {
+	if flags.Changed(name) {
+		return true
+	}
+	for old, renamed := range flagAliases {
+		if renamed == name && flags.Changed(old) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeArgs rewrites single-dash long flags such as -psk to --psk, so
+// existing command lines keep working.
+func normalizeArgs(args []string, root *cobra.Command) []string {
+	known := func(name string) bool {
+		if root.Flags().Lookup(name) != nil || flagAliases[name] != "" {
+			return true
+		}
+		for _, cmd := range root.Commands() {
+			if cmd.Flags().Lookup(name) != nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	normalized := make([]string, 0, len(args))
+	for i, arg := range args {
+		if arg == "--" {
+			return append(normalized, args[i:]...)
+		}
+		if len(arg) > 2 && arg[0] == '-' && arg[1] != '-' {
+			name := strings.SplitN(arg[1:], "=", 2)[0]
+			if len(name) > 1 && known(name) {
+				arg = "-" + arg
+			}
+		}
+		normalized = append(normalized, arg)
+	}
+	return normalized
+}
+
+// groupedUsage prints the flags of a command in titled sections.
+func groupedUsage(groups []*flagGroup) func(*cobra.Command) error {
+	return func(cmd *cobra.Command) error {
+		out := cmd.OutOrStderr()
+		fmt.Fprintf(out, "Usage:\n  %s\n", cmd.UseLine())
+		if cmd.HasAvailableSubCommands() {
+			fmt.Fprintf(out, "  %s [command]\n\nCommands:\n", cmd.CommandPath())
+			for _, sub := range cmd.Commands() {
+				if sub.IsAvailableCommand() {
+					fmt.Fprintf(out, "  %-12s %s\n", sub.Name(), sub.Short)
+				}
+			}
+		}
+		for _, group := range groups {
+			fmt.Fprintf(out, "\n%s:\n%s", group.title, group.flags.FlagUsages())
+		}
+		fmt.Fprintf(out, "\n  -h, --help   help for %s\n", cmd.Name())
+		if cmd.HasAvailableSubCommands() {
+			fmt.Fprintf(out, "\nUse \"%s [command] --help\" for more information about a command.\n", cmd.CommandPath())
+		}
+		return nil
+	}
+}
+
+// registerCompletions adds value completions for flags with a fixed set of
+// values or file arguments.
+func registerCompletions(cmd *cobra.Command) {
+	fixed := map[string][]string{
+		"profile":           {"dev", "staging", "prod"},
+		"log-sink":          {"auto", "stderr", "journald", "gcp", "syslog"},
+		"log-level":         {"debug", "info", "warning", "error"},
+		"log-format":        {"text", "json"},
+		"access-log-format": {accesslog.FormatCommon, accesslog.FormatCombined, accesslog.FormatJSON},
+		"clock-skew-action": {"warn", "fail"},
+		"report-interval":   {"off", "daily", "weekly"},
+		"acme-dns-provider": {"route53", "cloudflare"},
+		"acme-challenge":    {acmeTLSALPN01, acmeHTTP01, acmeDNS01},
+		"client-auth":       {"require", "optional"},
+		"tunnel-balance":    {"least-loaded", "round-robin"},
+		"deny-action":       {denyActionReject, denyActionTarpit},
+	}
+	for name, values := range fixed {
+		values := values
+		cmd.RegisterFlagCompletionFunc(name, func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+			return values, cobra.ShellCompDirectiveNoFileComp
+		})
+	}
+
+	facilities := make([]string, 0, len(syslogFacilities))
+	for facility := range syslogFacilities {
+		facilities = append(facilities, facility)
+	}
+	sort.Strings(facilities)
+	cmd.RegisterFlagCompletionFunc("syslog-facility", func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+		return facilities, cobra.ShellCompDirectiveNoFileComp
+	})
+
+	cmd.MarkFlagFilename("config")
+	cmd.MarkFlagFilename("openapi", "yaml", "yml", "json")
+	cmd.MarkFlagFilename("tls-cert-file")
+	cmd.MarkFlagFilename("tls-key-file")
+	cmd.MarkFlagFilename("syslog-ca-file")
+	cmd.MarkFlagFilename("client-ca-file")
+	cmd.MarkFlagFilename("admin-socket")
+	cmd.MarkFlagFilename("access-log")
+	cmd.MarkFlagDirname("acme-cache-dir")
+}
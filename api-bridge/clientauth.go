@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// Header carrying the verified client certificate's subject to the target
+const clientSubjectHeader = "X-Apiduct-Client-Subject"
+
+// How long a client certificate's OCSP status is trusted
+const clientOCSPCacheTime = 10 * time.Minute
+
+// clientAuth verifies client certificates on the HTTPS listener against a CA
+// bundle, then checks them against CRLs and, optionally, the CA's OCSP
+// responder.
+type clientAuth struct {
+	pool     *x509.CertPool
+	required bool
+	crlFiles []string
+	ocsp     bool
+	client   *http.Client
+
+	mu        sync.Mutex
+	crls      []*x509.RevocationList
+	crlLoaded map[string]time.Time // file to the modification time loaded
+	statuses  map[string]clientOCSPStatus
+}
+
+type clientOCSPStatus struct {
+	revoked bool
+	checked time.Time
+}
+
+func newClientAuth(config *Config) (*clientAuth, error) {
+	data, err := os.ReadFile(config.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in client CA file %s", config.ClientCAFile)
+	}
+
+	a := &clientAuth{
+		pool:      pool,
+		ocsp:      config.ClientOCSP,
+		client:    &http.Client{Timeout: 5 * time.Second},
+		crlLoaded: make(map[string]time.Time),
+		statuses:  make(map[string]clientOCSPStatus),
+	}
+	switch config.ClientAuth {
+	case "require":
+		a.required = true
+	case "optional":
+	default:
+		return nil, fmt.Errorf("client auth must be require or optional")
+	}
+	for _, file := range strings.Split(config.ClientCRLFiles, ",") {
+		if file = strings.TrimSpace(file); file != "" {
+			a.crlFiles = append(a.crlFiles, file)
+		}
+	}
+	if err := a.loadCRLs(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// apply makes tlsConfig ask for and verify client certificates.
+func (a *clientAuth) apply(tlsConfig *tls.Config) {
+	tlsConfig.ClientCAs = a.pool
+	if a.required {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	tlsConfig.VerifyConnection = a.verifyConnection
+}
+
+// loadCRLs reads the CRL files again if any of them changed.
+func (a *clientAuth) loadCRLs() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	changed := false
+	for _, file := range a.crlFiles {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("failed to read CRL file: %v", err)
+		}
+		if !info.ModTime().Equal(a.crlLoaded[file]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	var crls []*x509.RevocationList
+	loaded := make(map[string]time.Time)
+	for _, file := range a.crlFiles {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("failed to read CRL file: %v", err)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read CRL file: %v", err)
+		}
+		// CRLs may be PEM (one or more blocks) or a single DER list
+		var ders [][]byte
+		for rest := data; ; {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if block.Type == "X509 CRL" {
+				ders = append(ders, block.Bytes)
+			}
+		}
+		if len(ders) == 0 {
+			ders = [][]byte{data}
+		}
+		for _, der := range ders {
+			crl, err := x509.ParseRevocationList(der)
+			if err != nil {
+				return fmt.Errorf("invalid CRL in %s: %v", file, err)
+			}
+			crls = append(crls, crl)
+		}
+		loaded[file] = info.ModTime()
+	}
+	a.crls = crls
+	a.crlLoaded = loaded
+	log.Printf("[BRIDGE] Loaded %d client certificate revocation lists", len(crls))
+	return nil
+}
+
+// verifyConnection rejects revoked client certificates once the chain has
+// been verified against the CA bundle.
+func (a *clientAuth) verifyConnection(state tls.ConnectionState) error {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) < 2 {
+		// No certificate given, or one issued directly by a trusted root
+		// that we cannot check for revocation
+		return nil
+	}
+	leaf, issuer := state.VerifiedChains[0][0], state.VerifiedChains[0][1]
+
+	if err := a.loadCRLs(); err != nil {
+		log.Printf("[BRIDGE] Failed to reload client CRLs, using the loaded ones: %v", err)
+	}
+	if a.revokedByCRL(leaf, issuer) {
+		return a.reject(leaf, "crl")
+	}
+	if a.ocsp && len(leaf.OCSPServer) > 0 && a.revokedByOCSP(leaf, issuer) {
+		return a.reject(leaf, "ocsp")
+	}
+	return nil
+}
+
+func (a *clientAuth) reject(leaf *x509.Certificate, source string) error {
+	metrics.Counter("apiduct_client_cert_rejected_total", "reason", source).Inc()
+	logEvent("auth_failure", map[string]string{"client_subject": leaf.Subject.String()},
+		"[BRIDGE] Rejected revoked client certificate %s (serial %s) per %s", leaf.Subject, leaf.SerialNumber, strings.ToUpper(source))
+	return fmt.Errorf("client certificate %s is revoked", leaf.SerialNumber)
+}
+
+func (a *clientAuth) revokedByCRL(leaf, issuer *x509.Certificate) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, crl := range a.crls {
+		if crl.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// revokedByOCSP asks the CA's OCSP responder about the certificate. If the
+// responder cannot be reached the certificate is let through, like browsers
+// do, so an OCSP outage does not lock out every client.
+func (a *clientAuth) revokedByOCSP(leaf, issuer *x509.Certificate) bool {
+	key := string(issuer.RawSubject) + leaf.SerialNumber.String()
+	a.mu.Lock()
+	status, ok := a.statuses[key]
+	a.mu.Unlock()
+	if ok && time.Since(status.checked) < clientOCSPCacheTime {
+		return status.revoked
+	}
+
+	resp, _, err := fetchOCSP(a.client, leaf, issuer)
+	if err != nil {
+		metrics.Counter("apiduct_client_cert_ocsp_errors_total").Inc()
+		log.Printf("[BRIDGE] OCSP check for client certificate %s failed, allowing it: %v", leaf.Subject, err)
+		return false
+	}
+	status = clientOCSPStatus{revoked: resp.Status == ocsp.Revoked, checked: time.Now()}
+	a.mu.Lock()
+	for k, s := range a.statuses {
+		if time.Since(s.checked) >= clientOCSPCacheTime {
+			delete(a.statuses, k)
+		}
+	}
+	a.statuses[key] = status
+	a.mu.Unlock()
+	return status.revoked
+}
+
+// setClientSubject passes the verified client certificate's subject to the
+// target, replacing any value sent by the client itself.
+func setClientSubject(r *http.Request) {
+	r.Header.Del(clientSubjectHeader)
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		r.Header.Set(clientSubjectHeader, r.TLS.VerifiedChains[0][0].Subject.String())
+	}
+}
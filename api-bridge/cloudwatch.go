@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"apiduct/pkg/stats"
+)
+
+// CloudWatch accepts at most this many metric datums per PutMetricData call
+const cloudWatchBatchSize = 20
+
+const imdsEndpoint = "http://169.254.169.254"
+
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+}
+
+// awsCredentialProvider reads credentials from the environment or, when
+// running on EC2, from the instance metadata service (IMDSv2).
+type awsCredentialProvider struct {
+	client *http.Client
+	mu     sync.Mutex
+	cached *awsCredentials
+}
+
+func (p *awsCredentialProvider) Credentials() (*awsCredentials, error) {
+	if key := os.Getenv("AWS_ACCESS_KEY_ID"); key != "" {
+		return &awsCredentials{
+			AccessKeyID:     key,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cached != nil && time.Until(p.cached.Expiration) > 5*time.Minute {
+		return p.cached, nil
+	}
+
+	role, err := p.imdsGet("/latest/meta-data/iam/security-credentials/")
+	if err != nil {
+		return nil, fmt.Errorf("no AWS credentials in environment and instance metadata unavailable: %v", err)
+	}
+	data, err := p.imdsGet("/latest/meta-data/iam/security-credentials/" + strings.TrimSpace(strings.SplitN(role, "\n", 2)[0]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read instance role credentials: %v", err)
+	}
+
+	var creds struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string `json:"SecretAccessKey"`
+		Token           string `json:"Token"`
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal([]byte(data), &creds); err != nil {
+		return nil, fmt.Errorf("invalid instance role credentials: %v", err)
+	}
+	p.cached = &awsCredentials{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.Token,
+		Expiration:      creds.Expiration,
+	}
+	return p.cached, nil
+}
+
+func (p *awsCredentialProvider) imdsGet(path string) (string, error) {
+	tokenReq, err := http.NewRequest(http.MethodPut, imdsEndpoint+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	tokenReq.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	tokenResp, err := p.client.Do(tokenReq)
+	if err != nil {
+		return "", err
+	}
+	token, err := io.ReadAll(io.LimitReader(tokenResp.Body, 4096))
+	tokenResp.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	if tokenResp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata token request returned status %d", tokenResp.StatusCode)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, imdsEndpoint+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata request %s returned status %d", path, resp.StatusCode)
+	}
+	return string(body), nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// signAWSRequest adds an AWS Signature Version 4 Authorization header.
+func signAWSRequest(req *http.Request, body []byte, creds *awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{
+		"host":       req.URL.Host,
+		"x-amz-date": amzDate,
+	}
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		headers["content-type"] = contentType
+	}
+	if creds.SessionToken != "" {
+		headers["x-amz-security-token"] = creds.SessionToken
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// cloudWatchDimensionName turns a metric label such as "route" into a
+// CloudWatch style dimension name ("Route").
+func cloudWatchDimensionName(label string) string {
+	parts := strings.Split(label, "_")
+	for i, part := range parts {
+		if part != "" {
+			parts[i] = strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// CloudWatchPublisher periodically publishes counter deltas to CloudWatch.
+type CloudWatchPublisher struct {
+	namespace  string
+	region     string
+	dimensions [][2]string
+	client     *http.Client
+	creds      *awsCredentialProvider
+	previous   map[string]int64
+}
+
+// NewCloudWatchPublisher parses "Name=Value" dimensions added to every
+// metric. A Tunnel dimension is added unless one is given explicitly.
+func NewCloudWatchPublisher(namespace, region, dimensions, tunnel string) (*CloudWatchPublisher, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	p := &CloudWatchPublisher{
+		namespace: namespace,
+		region:    region,
+		client:    client,
+		creds:     &awsCredentialProvider{client: &http.Client{Timeout: 2 * time.Second}},
+		previous:  make(map[string]int64),
+	}
+
+	for _, pair := range strings.Split(dimensions, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid dimension %q, expected Name=Value", pair)
+		}
+		p.dimensions = append(p.dimensions, [2]string{kv[0], kv[1]})
+	}
+	hasTunnel := false
+	for _, dimension := range p.dimensions {
+		if dimension[0] == "Tunnel" {
+			hasTunnel = true
+		}
+	}
+	if !hasTunnel && tunnel != "" {
+		p.dimensions = append([][2]string{{"Tunnel", tunnel}}, p.dimensions...)
+	}
+
+	// Start from the current values, which may have been restored from disk
+	for _, c := range metrics.Counters() {
+		p.previous[stats.Key(c.Name, c.Labels)] = c.Value()
+	}
+
+	if p.region == "" {
+		p.region = os.Getenv("AWS_REGION")
+	}
+	if p.region == "" {
+		p.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if p.region == "" {
+		region, err := p.creds.imdsGet("/latest/meta-data/placement/region")
+		if err != nil {
+			return nil, fmt.Errorf("AWS region not configured and instance metadata unavailable: %v", err)
+		}
+		p.region = strings.TrimSpace(region)
+	}
+	return p, nil
+}
+
+// Publish sends the change of every counter since the previous call and the
+// current value of every gauge.
+func (p *CloudWatchPublisher) Publish() error {
+	form := url.Values{}
+	n := 0
+	flush := func() error {
+		if n == 0 {
+			return nil
+		}
+		err := p.send(form)
+		form = url.Values{}
+		n = 0
+		return err
+	}
+	add := func(name string, labels []string, value int64, unit string) error {
+		n++
+		prefix := "MetricData.member." + strconv.Itoa(n) + "."
+		form.Set(prefix+"MetricName", name)
+		form.Set(prefix+"Value", strconv.FormatInt(value, 10))
+		form.Set(prefix+"Unit", unit)
+
+		d := 0
+		for _, dimension := range p.dimensions {
+			d++
+			form.Set(prefix+"Dimensions.member."+strconv.Itoa(d)+".Name", dimension[0])
+			form.Set(prefix+"Dimensions.member."+strconv.Itoa(d)+".Value", dimension[1])
+		}
+		for i := 0; i+1 < len(labels); i += 2 {
+			d++
+			form.Set(prefix+"Dimensions.member."+strconv.Itoa(d)+".Name", cloudWatchDimensionName(labels[i]))
+			form.Set(prefix+"Dimensions.member."+strconv.Itoa(d)+".Value", labels[i+1])
+		}
+
+		if n == cloudWatchBatchSize {
+			return flush()
+		}
+		return nil
+	}
+
+	for _, c := range metrics.Counters() {
+		key := stats.Key(c.Name, c.Labels)
+		value := c.Value()
+		delta := value - p.previous[key]
+		p.previous[key] = value
+		if err := add(c.Name, c.Labels, delta, "Count"); err != nil {
+			return err
+		}
+	}
+	for _, g := range metrics.Gauges() {
+		if err := add(g.Name, g.Labels, g.Value(), "None"); err != nil {
+			return err
+		}
+	}
+	return flush()
+}
+
+func (p *CloudWatchPublisher) send(form url.Values) error {
+	creds, err := p.creds.Credentials()
+	if err != nil {
+		return err
+	}
+
+	form.Set("Action", "PutMetricData")
+	form.Set("Version", "2010-08-01")
+	form.Set("Namespace", p.namespace)
+	body := []byte(form.Encode())
+
+	endpoint := fmt.Sprintf("https://monitoring.%s.amazonaws.com/", p.region)
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(string(body)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequest(req, body, creds, p.region, "monitoring", time.Now())
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("PutMetricData request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("PutMetricData returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+func runCloudWatchPublisher(p *CloudWatchPublisher, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := p.Publish(); err != nil {
+			log.Printf("[BRIDGE] Failed to publish CloudWatch metrics: %v", err)
+		}
+	}
+}
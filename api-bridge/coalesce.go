@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"apiduct/pkg/proxy"
+)
+
+// Request headers that may change the response, and so are part of the key.
+// Credentials and the client certificate are included so responses are
+// never shared between users.
+var coalesceHeaders = []string{"Authorization", "Cookie", clientSubjectHeader, "Accept", "Accept-Encoding", "Accept-Language"}
+
+// coalescer merges identical GET requests into one tunnel request. Requests
+// arriving while it is in flight, or within window after it completed, get a
+// copy of its response.
+type coalescer struct {
+	window  time.Duration
+	maxBody int
+
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+type coalescedCall struct {
+	done     chan struct{}
+	header   http.Header       // of the leader's request
+	resp     *bufferedResponse // nil if the response cannot be shared
+	finished time.Time
+}
+
+// newCoalescer returns a coalescer, or nil if window is 0.
+func newCoalescer(window time.Duration, maxBody int) *coalescer {
+	if window <= 0 {
+		return nil
+	}
+	return &coalescer{window: window, maxBody: maxBody, calls: make(map[string]*coalescedCall)}
+}
+
+// coalescable reports whether r may share a response with identical requests.
+func coalescable(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.ContentLength <= 0 && !proxy.IsWebSocket(r)
+}
+
+func coalesceKey(r *http.Request) string {
+	return requestKey(r.Host, r.URL.RequestURI(), r.Header, coalesceHeaders)
+}
+
+// requestKey hashes the host and URI of a request with the values of the
+// named headers.
+func requestKey(host, uri string, header http.Header, names []string) string {
+	h := sha256.New()
+	h.Write([]byte(host + "\n" + uri + "\n"))
+	for _, name := range names {
+		for _, value := range header.Values(name) {
+			h.Write([]byte(name + ": " + value + "\n"))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// join returns the call for key and whether the caller, sending header,
+// leads it, that is, forwards the request and must call finish.
+func (c *coalescer) join(key string, header http.Header) (*coalescedCall, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if call, ok := c.calls[key]; ok {
+		select {
+		case <-call.done:
+			if call.resp != nil && time.Since(call.finished) < c.window {
+				return call, false
+			}
+		default:
+			return call, false
+		}
+	}
+	call := &coalescedCall{done: make(chan struct{}), header: header.Clone()}
+	c.calls[key] = call
+	return call, true
+}
+
+// finish hands the leader's response to the waiting requests and keeps it
+// for the window.
+func (c *coalescer) finish(key string, call *coalescedCall, resp *bufferedResponse) {
+	c.mu.Lock()
+	call.resp = resp
+	call.finished = time.Now()
+	close(call.done)
+	c.mu.Unlock()
+
+	time.AfterFunc(c.window, func() {
+		c.mu.Lock()
+		if c.calls[key] == call {
+			delete(c.calls, key)
+		}
+		c.mu.Unlock()
+	})
+}
+
+// wait returns the shared response for a request sending header, or nil if
+// there is none, the response varies on a header the request sends another
+// value of, or the client went away.
+func (call *coalescedCall) wait(ctx context.Context, header http.Header) *bufferedResponse {
+	select {
+	case <-call.done:
+		if call.resp == nil || !sameVary(call.resp.header, call.header, header) {
+			return nil
+		}
+		return call.resp
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// coalesceRecorder passes the leader's response to its client and keeps a
+// copy for the other requests.
+type coalesceRecorder struct {
+	http.ResponseWriter
+	copy     *bufferedResponse
+	maxBody  int
+	overflow bool
+}
+
+func newCoalesceRecorder(w http.ResponseWriter, maxBody int) *coalesceRecorder {
+	return &coalesceRecorder{ResponseWriter: w, copy: newBufferedResponse(), maxBody: maxBody}
+}
+
+func (c *coalesceRecorder) WriteHeader(status int) {
+	if c.copy.status == 0 {
+		c.copy.header = c.Header().Clone()
+		c.copy.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *coalesceRecorder) Write(p []byte) (int, error) {
+	if c.copy.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.overflow {
+		if c.copy.body.Len()+len(p) > c.maxBody {
+			c.overflow = true
+			c.copy.body.Reset()
+		} else {
+			c.copy.body.Write(p)
+		}
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+func (c *coalesceRecorder) Flush() {
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Errors turning the leader away before it reached the tunnel. They are
+// not shared, the waiting requests are admitted or refused on their own.
+var unsharedErrors = map[string]bool{
+	errCodeRateLimited:     true,
+	errCodeQuotaExceeded:   true,
+	errCodeTooManyRequests: true,
+	errCodeTunnelBusy:      true,
+}
+
+// result returns the recorded response if it can be shared, on the terms a
+// response may be recorded on.
+func (c *coalesceRecorder) result() *bufferedResponse {
+	if c.copy.status == 0 || c.overflow || !recordable(c.copy.header) ||
+		unsharedErrors[c.copy.header.Get(proxy.ErrorCodeHeader)] {
+		return nil
+	}
+	return c.copy
+}
+
+// serveCoalesced writes a copy of a shared response.
+func serveCoalesced(w http.ResponseWriter, resp *bufferedResponse) {
+	for key, values := range resp.header {
+		// Each request keeps its own ID
+		if key != requestIDHeader {
+			w.Header()[key] = append([]string(nil), values...)
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(resp.body.Len()))
+	w.WriteHeader(resp.status)
+	w.Write(resp.body.Bytes())
+}
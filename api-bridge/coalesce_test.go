@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCoalesceKey(t *testing.T) {
+	request := func(target string, header ...string) string {
+		r := httptest.NewRequest("GET", target, nil)
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Add(header[i], header[i+1])
+		}
+		return coalesceKey(r)
+	}
+	base := request("http://api.example.com/v1/orders?page=1", "Authorization", "Bearer alice", "Accept", "application/json")
+	tests := []struct {
+		name string
+		key  string
+		same bool
+	}{
+		{"same request", request("http://api.example.com/v1/orders?page=1", "Authorization", "Bearer alice", "Accept", "application/json"), true},
+		{"unrelated header", request("http://api.example.com/v1/orders?page=1", "Authorization", "Bearer alice", "Accept", "application/json", "User-Agent", "curl"), true},
+		{"other credentials", request("http://api.example.com/v1/orders?page=1", "Authorization", "Bearer bob", "Accept", "application/json"), false},
+		{"cookie", request("http://api.example.com/v1/orders?page=1", "Authorization", "Bearer alice", "Accept", "application/json", "Cookie", "a=1"), false},
+		{"other accept", request("http://api.example.com/v1/orders?page=1", "Authorization", "Bearer alice", "Accept", "text/csv"), false},
+		{"accept encoding", request("http://api.example.com/v1/orders?page=1", "Authorization", "Bearer alice", "Accept", "application/json", "Accept-Encoding", "gzip"), false},
+		{"client certificate", request("http://api.example.com/v1/orders?page=1", "Authorization", "Bearer alice", "Accept", "application/json", clientSubjectHeader, "CN=alice"), false},
+		{"other query", request("http://api.example.com/v1/orders?page=2", "Authorization", "Bearer alice", "Accept", "application/json"), false},
+		{"other host", request("http://www.example.com/v1/orders?page=1", "Authorization", "Bearer alice", "Accept", "application/json"), false},
+	}
+	for _, tt := range tests {
+		if got := tt.key == base; got != tt.same {
+			t.Errorf("%s: same key %v, want %v", tt.name, got, tt.same)
+		}
+	}
+}
+
+func TestCoalesceShares(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []string // of the response
+		accept string   // of the waiting request
+		shared bool
+	}{
+		{"plain", nil, "application/json", true},
+		{"cookie", []string{"Set-Cookie", "session=1"}, "application/json", false},
+		{"private", []string{"Cache-Control", "private, max-age=60"}, "application/json", false},
+		{"no store", []string{"Cache-Control", "no-store"}, "application/json", false},
+		{"vary on any", []string{"Vary", "*"}, "application/json", false},
+		{"same vary", []string{"Vary", "Accept"}, "application/json", true},
+		{"other vary", []string{"Vary", "Accept"}, "text/csv", false},
+	}
+	for _, tt := range tests {
+		c := newCoalescer(time.Minute, 1024)
+		leaderHeader := http.Header{"Accept": {"application/json"}}
+		call, leader := c.join("key", leaderHeader)
+		if !leader {
+			t.Fatalf("%s: first request does not lead", tt.name)
+		}
+		waiting, leader := c.join("key", http.Header{"Accept": {tt.accept}})
+		if leader {
+			t.Fatalf("%s: request in flight together leads", tt.name)
+		}
+
+		recorder := newCoalesceRecorder(httptest.NewRecorder(), c.maxBody)
+		for i := 0; i < len(tt.header); i += 2 {
+			recorder.Header().Add(tt.header[i], tt.header[i+1])
+		}
+		recorder.Write([]byte("ok"))
+		c.finish("key", call, recorder.result())
+		if got := waiting.wait(context.Background(), http.Header{"Accept": {tt.accept}}) != nil; got != tt.shared {
+			t.Errorf("%s: shared %v, want %v", tt.name, got, tt.shared)
+		}
+	}
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"apiduct/pkg/auth"
+	"apiduct/pkg/buildinfo"
+	"apiduct/pkg/proxy"
+	"apiduct/pkg/telemetry"
+	"apiduct/pkg/tunnel"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings of the bridge, from flags and the config file.
+type Config struct {
+	ListenIP    string
+	ListenPort  int
+	TunnelPort  int
+	PSK         string
+	PSKDir      string
+	EnableHTTP  bool
+	EnableHTTPS bool
+	H2C         bool
+	CertFile    string
+	KeyFile     string
+	ConfigFile  string
+	Profile     string
+	// ValidateConfig checks the configuration and exits
+	ValidateConfig bool
+	Routes         []*Route
+	OpenAPIFile    string
+	OpenAPI        *OpenAPIValidator
+
+	AdminListen     string
+	AdminSocket     string
+	Inspect         bool
+	InspectCapacity int
+	InspectMaxBody  int
+
+	OfflineResponses bool
+	RecordDir        string
+	WarmupURLs       []string
+
+	ReportInterval     time.Duration
+	NotifyWebhook      string
+	NotifyEmailTo      string
+	NotifyEmailFrom    string
+	NotifySMTPAddr     string
+	NotifySMTPUser     string
+	NotifySMTPPassword string
+
+	MetricsPort          int
+	CloudWatchNamespace  string
+	CloudWatchRegion     string
+	CloudWatchDimensions string
+	CloudWatchInterval   time.Duration
+
+	LogSink    string
+	LogLevel   string
+	LogFormat  string
+	LogSinks   []*LogSinkConfig
+	GCPProject string
+	GCPLogName string
+
+	SyslogAddr     string
+	SyslogFacility string
+	SyslogCAFile   string
+
+	ServiceName string
+
+	LogSampleBurst  int
+	LogSampleWindow time.Duration
+
+	AccessLog           string
+	AccessLogFormat     string
+	AccessLogMaxSize    int // megabytes
+	AccessLogRotate     time.Duration
+	AccessLogMaxBackups int
+
+	MaxClockSkew    time.Duration
+	ClockSkewAction string
+
+	MaxConcurrency       int
+	MaxRequestBody       int64
+	MaxResponseBody      int64
+	RateLimit            float64
+	RateBurst            int
+	ClientRateLimit      float64
+	ClientRateBurst      int
+	TunnelMaxConcurrency int
+	AdaptiveConcurrency  bool
+	TunnelBalance        string
+	TunnelMaxFailures    int
+	TunnelRetries        int
+	TunnelRetryWait      time.Duration
+	TunnelChecksums      bool
+	RequestTimeout       time.Duration
+	HeartbeatInterval    time.Duration
+	HeartbeatTimeout     time.Duration
+	OfframpRoutes        []string
+	TunnelACL            []string
+	TunnelACLs           tunnelACLs
+	OfframpPolicy        []string
+	OfframpPolicies      offrampPolicy
+	ClientSchedules      map[string]Schedule
+
+	DrainRedirect   string
+	KillSwitch      bool
+	IncidentPage    string
+	ShutdownTimeout time.Duration
+	TunnelHeader    bool
+	ServerTiming    bool
+
+	PriorityListen string
+	PriorityPaths  []string
+
+	ACME            bool
+	ACMEHosts       string
+	ACMEEmail       string
+	ACMEDirectory   string
+	ACMECacheDir    string
+	ACMEDNSProvider string
+	ACMEChallenge   string
+	ACMEHTTPListen  string
+	ACMEDNSWait     time.Duration
+	CloudflareToken string
+
+	OCSPStapling      bool
+	CertExpiryWarning time.Duration
+
+	ClientCAFile   string
+	ClientAuth     string
+	ClientCRLFiles string
+	ClientOCSP     bool
+
+	ForwardTLSHeaders bool
+
+	AllowCIDRs   []string
+	DenyCIDRs    []string
+	BasicAuth    []string
+	BearerTokens []string
+	DenyAction   string
+	TarpitDelay  time.Duration
+	TarpitMax    int
+	Access       *AccessPolicy
+
+	ForwardedHeaders bool
+	ForwardedRFC7239 bool
+	TrustedProxies   []string
+	trustedProxies   []*net.IPNet
+
+	CoalesceWindow  time.Duration
+	CoalesceMaxBody int
+
+	UsageStateFile  string
+	UsageCheckpoint time.Duration
+
+	JournalFile string
+
+	Telemetry         string
+	TelemetryEndpoint string
+	TelemetryInterval time.Duration
+
+	EnrollmentFile string
+}
+
+// FileConfig is the structure of the optional -config file. Profiles
+// override the settings, routes and logging of the top level.
+type FileConfig struct {
+	Settings map[string]interface{} `json:"settings,omitempty"` // flag name to value
+	Routes   []*Route               `json:"routes"`
+	Logging  []*LogSinkConfig       `json:"logging,omitempty"`
+	Profiles map[string]*FileConfig `json:"profiles,omitempty"`
+
+	// TunnelACLs lists the host:port addresses forward clients may reach
+	// through each offramp, by name ("-" for unnamed offramps)
+	TunnelACLs map[string][]string `json:"tunnel_acls,omitempty"`
+
+	// OfframpPolicy lists the routes each offramp identity may serve
+	OfframpPolicy map[string][]string `json:"offramp_policy,omitempty"`
+
+	// ClientSchedules limits when clients may connect, by the common name
+	// of their certificate
+	ClientSchedules map[string]Schedule `json:"client_schedules,omitempty"`
+}
+
+// Route applies per-path behaviour to requests whose path starts with
+// PathPrefix and, if Host is set, whose Host header matches it.
+type Route struct {
+	Name              string     `json:"name"`
+	Host              string     `json:"host,omitempty"`
+	PathPrefix        string     `json:"path_prefix"`
+	RequestTransform  *Transform `json:"request_transform,omitempty"`
+	ResponseTransform *Transform `json:"response_transform,omitempty"`
+	RedactRequest     *Redaction `json:"redact_request,omitempty"`
+	RedactResponse    *Redaction `json:"redact_response,omitempty"`
+
+	RequestContentTypes  *ContentTypePolicy `json:"request_content_types,omitempty"`
+	ResponseContentTypes *ContentTypePolicy `json:"response_content_types,omitempty"`
+
+	// MaxResponseBytes is the hard response limit, kept for older configs
+	MaxResponseBytes int64  `json:"max_response_bytes,omitempty"`
+	RequestBytes     *Limit `json:"request_bytes,omitempty"`
+	ResponseBytes    *Limit `json:"response_bytes,omitempty"`
+	Quota            *Quota `json:"quota,omitempty"`
+
+	// RateLimit is shared by all clients of the route, ClientRateLimit
+	// applies to each client IP address
+	RateLimit       *RateLimit `json:"rate_limit,omitempty"`
+	ClientRateLimit *RateLimit `json:"client_rate_limit,omitempty"`
+
+	// Static and Redirect answer at the bridge, the tunnel is not used
+	Static   *StaticResponse `json:"static,omitempty"`
+	Redirect *Redirect       `json:"redirect,omitempty"`
+
+	// Offramp names the offramp that serves the route; requests of routes
+	// without one go to offramps that did not announce a name
+	Offramp string `json:"offramp,omitempty"`
+
+	// Rewrite changes the path of requests before they enter the tunnel
+	Rewrite *proxy.Rewrite `json:"rewrite,omitempty"`
+
+	// Access restricts the route to client addresses and credentials, in
+	// place of the bridge-wide policy
+	Access *AccessPolicy `json:"access,omitempty"`
+
+	// Schedule limits the route to time windows, answering 403 outside them
+	Schedule Schedule `json:"schedule,omitempty"`
+
+	// FIFO forwards the route's requests one at a time, in arrival order,
+	// for targets that need them in order
+	FIFO bool `json:"fifo,omitempty"`
+
+	// Timeout overrides --request-timeout for the route, e.g. "5m"
+	Timeout string `json:"timeout,omitempty"`
+	timeout time.Duration
+}
+
+// configExtensions are the config file formats, by file extension.
+var configExtensions = []string{".json", ".yaml", ".yml", ".toml"}
+
+const letsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+// ACME challenge types
+const (
+	acmeDNS01     = "dns-01"
+	acmeHTTP01    = "http-01"
+	acmeTLSALPN01 = "tls-alpn-01"
+)
+
+// readFileConfig reads a JSON, YAML or TOML config file, chosen by its
+// extension. YAML and TOML use the same keys as JSON.
+func readFileConfig(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	// Other formats are converted to JSON, so they decode the same way
+	var document interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &document)
+	case ".toml":
+		err = toml.Unmarshal(data, &document)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	if document != nil {
+		if data, err = json.Marshal(document); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+		}
+	}
+
+	fileConfig := &FileConfig{}
+	if err := json.Unmarshal(data, fileConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return fileConfig, nil
+}
+
+// configFileIn returns the config file named name in dir, in any of the
+// formats, or "" if there is none.
+func configFileIn(dir, name string) string {
+	for _, ext := range configExtensions {
+		path := filepath.Join(dir, name+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// checkConfig validates the settings once flags and the config file are
+// applied, and parses those given as strings. It does not start anything.
+func checkConfig(config *Config, reportInterval, warmupURLs string) error {
+	if _, err := parseSeverity(config.LogLevel); err != nil {
+		return fmt.Errorf("log level: %v", err)
+	}
+	if config.LogFormat != "text" && config.LogFormat != "json" {
+		return fmt.Errorf("log format %q, use text or json", config.LogFormat)
+	}
+	if config.LogSampleBurst > 0 && config.LogSampleWindow < time.Second {
+		return fmt.Errorf("log sampling window must be at least one second")
+	}
+	if err := checkAccessLog(config.AccessLogFormat, config.AccessLogMaxSize, config.AccessLogRotate, config.AccessLogMaxBackups); err != nil {
+		return err
+	}
+
+	if config.PSK == "" && config.PSKDir == "" {
+		return fmt.Errorf("PSK is required")
+	}
+	if config.ClockSkewAction != "warn" && config.ClockSkewAction != "fail" {
+		return fmt.Errorf("clock skew action must be warn or fail")
+	}
+	if config.RequestTimeout < 0 {
+		return fmt.Errorf("request timeout must not be negative")
+	}
+	if config.HeartbeatInterval < 0 || config.HeartbeatTimeout <= 0 {
+		return fmt.Errorf("heartbeat interval must not be negative and heartbeat timeout must be positive")
+	}
+	for _, prefix := range config.PriorityPaths {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("priority path %q must start with /", prefix)
+		}
+	}
+	if err := buildinfo.Check(features(config), "bridge"); err != nil {
+		return err
+	}
+	if err := telemetry.Check(config.Telemetry, config.TelemetryEndpoint, config.TelemetryInterval); err != nil {
+		return err
+	}
+	if config.ACME {
+		if config.CertFile != "" || config.KeyFile != "" {
+			return fmt.Errorf("--acme cannot be combined with --tls-cert-file and --tls-key-file")
+		}
+		if config.ACMEChallenge == "" {
+			config.ACMEChallenge = acmeTLSALPN01
+			if config.ACMEDNSProvider != "" {
+				config.ACMEChallenge = acmeDNS01
+			}
+		}
+		switch config.ACMEChallenge {
+		case acmeTLSALPN01, acmeHTTP01, acmeDNS01:
+		default:
+			return fmt.Errorf("ACME challenge must be tls-alpn-01, http-01 or dns-01")
+		}
+		config.EnableHTTPS = true
+	} else if config.EnableHTTPS {
+		if config.CertFile == "" || config.KeyFile == "" {
+			return fmt.Errorf("certificate and key files are required for HTTPS")
+		}
+		if _, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile); err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+	}
+	if config.H2C && config.EnableHTTPS {
+		return fmt.Errorf("--h2c only applies to plain HTTP, HTTPS negotiates HTTP/2 on its own")
+	}
+	if config.ClientCAFile != "" && !config.EnableHTTPS {
+		return fmt.Errorf("client certificate authentication requires --https")
+	}
+	if err := checkProfile(config); err != nil {
+		return fmt.Errorf("%s profile: %v", config.Profile, err)
+	}
+
+	if warmupURLs != "" {
+		urls, err := parseWarmupURLs(warmupURLs)
+		if err != nil {
+			return fmt.Errorf("warm-up URLs: %v", err)
+		}
+		config.WarmupURLs = urls
+	}
+	interval, err := parseReportInterval(reportInterval)
+	if err != nil {
+		return fmt.Errorf("report interval: %v", err)
+	}
+	config.ReportInterval = interval
+	if config.OpenAPIFile != "" {
+		validator, err := LoadOpenAPIValidator(config.OpenAPIFile)
+		if err != nil {
+			return fmt.Errorf("failed to load OpenAPI spec: %v", err)
+		}
+		config.OpenAPI = validator
+	}
+
+	if config.DrainRedirect != "" {
+		if u, err := url.Parse(config.DrainRedirect); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("drain redirect must be an absolute http or https URL")
+		}
+	}
+	if config.IncidentPage != "" {
+		if err := emergency.loadPage(config.IncidentPage); err != nil {
+			return err
+		}
+	}
+	if config.Inspect && config.AdminListen == "" && config.AdminSocket == "" {
+		return fmt.Errorf("admin listen address or socket is required for the inspector")
+	}
+	if config.UsageStateFile != "" && config.UsageCheckpoint < time.Second {
+		return fmt.Errorf("usage checkpoint interval must be at least one second")
+	}
+	if config.MaxConcurrency < 0 || config.TunnelMaxConcurrency < 0 {
+		return fmt.Errorf("concurrency limits must not be negative")
+	}
+	if config.MaxRequestBody < 0 || config.MaxResponseBody < 0 {
+		return fmt.Errorf("body size limits must not be negative")
+	}
+	if config.TunnelRetries < 0 || config.TunnelRetryWait < 0 {
+		return fmt.Errorf("tunnel retries and their wait must not be negative")
+	}
+	if config.RateLimit < 0 || config.ClientRateLimit < 0 || config.RateBurst < 0 || config.ClientRateBurst < 0 {
+		return fmt.Errorf("rate limits must not be negative")
+	}
+	if config.TunnelBalance != tunnel.BalanceLeastLoaded && config.TunnelBalance != tunnel.BalanceRoundRobin {
+		return fmt.Errorf("tunnel balance must be least-loaded or round-robin")
+	}
+	if config.Access, err = buildAccessPolicy(config); err != nil {
+		return fmt.Errorf("invalid access policy: %v", err)
+	}
+	if config.DenyAction != denyActionReject && config.DenyAction != denyActionTarpit {
+		return fmt.Errorf("deny action must be reject or tarpit")
+	}
+	if config.TarpitDelay < 0 || config.TarpitMax < 0 {
+		return fmt.Errorf("tarpit settings must not be negative")
+	}
+	if config.trustedProxies, err = parseCIDRs(config.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid trusted proxy: %v", err)
+	}
+
+	notifier, err := buildNotifier(config)
+	if err != nil {
+		return fmt.Errorf("notifier: %v", err)
+	}
+	if config.ReportInterval > 0 && notifier == nil {
+		return fmt.Errorf("a notifier (--notify-webhook or --notify-email-to) is required for summary reports")
+	}
+	if config.CloudWatchNamespace != "" && config.CloudWatchInterval < time.Second {
+		return fmt.Errorf("CloudWatch interval must be at least one second")
+	}
+	return nil
+}
+
+// loadFileConfig reads the config file, or a directory of per-profile files,
+// and resolves the selected profile.
+func loadFileConfig(path, profile string) (*FileConfig, error) {
+	fileConfig, err := resolveProfile(path, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, route := range fileConfig.Routes {
+		if route.Name == "" {
+			route.Name = fmt.Sprintf("route-%d", i)
+		}
+		if route.PathPrefix == "" {
+			route.PathPrefix = "/"
+		}
+		if route.Offramp != "" {
+			if err := auth.ValidateName(route.Offramp); err != nil {
+				return nil, fmt.Errorf("route %s: %v", route.Name, err)
+			}
+		}
+		if err := route.Rewrite.Compile(); err != nil {
+			return nil, fmt.Errorf("route %s: invalid rewrite: %v", route.Name, err)
+		}
+		if err := route.RequestTransform.compile(); err != nil {
+			return nil, fmt.Errorf("route %s: invalid request transform: %v", route.Name, err)
+		}
+		if err := route.ResponseTransform.compile(); err != nil {
+			return nil, fmt.Errorf("route %s: invalid response transform: %v", route.Name, err)
+		}
+		if err := route.RedactRequest.validate(); err != nil {
+			return nil, fmt.Errorf("route %s: invalid request redaction: %v", route.Name, err)
+		}
+		if err := route.RedactResponse.validate(); err != nil {
+			return nil, fmt.Errorf("route %s: invalid response redaction: %v", route.Name, err)
+		}
+		if err := route.RequestContentTypes.validate(); err != nil {
+			return nil, fmt.Errorf("route %s: invalid request content type policy: %v", route.Name, err)
+		}
+		if err := route.ResponseContentTypes.validate(); err != nil {
+			return nil, fmt.Errorf("route %s: invalid response content type policy: %v", route.Name, err)
+		}
+		if route.MaxResponseBytes > 0 {
+			if route.ResponseBytes == nil {
+				route.ResponseBytes = &Limit{}
+			}
+			if route.ResponseBytes.Max == 0 {
+				route.ResponseBytes.Max = route.MaxResponseBytes
+			}
+		}
+		if err := route.RequestBytes.validate(); err != nil {
+			return nil, fmt.Errorf("route %s: invalid request size limit: %v", route.Name, err)
+		}
+		if err := route.ResponseBytes.validate(); err != nil {
+			return nil, fmt.Errorf("route %s: invalid response size limit: %v", route.Name, err)
+		}
+		if err := route.Quota.validate(); err != nil {
+			return nil, fmt.Errorf("route %s: invalid quota: %v", route.Name, err)
+		}
+		if err := route.RateLimit.validate(); err != nil {
+			return nil, fmt.Errorf("route %s: invalid rate limit: %v", route.Name, err)
+		}
+		if err := route.ClientRateLimit.validate(); err != nil {
+			return nil, fmt.Errorf("route %s: invalid client rate limit: %v", route.Name, err)
+		}
+		if route.Static != nil && route.Redirect != nil {
+			return nil, fmt.Errorf("route %s: static and redirect are mutually exclusive", route.Name)
+		}
+		if err := route.Static.load(); err != nil {
+			return nil, fmt.Errorf("route %s: invalid static response: %v", route.Name, err)
+		}
+		if err := route.Redirect.validate(); err != nil {
+			return nil, fmt.Errorf("route %s: invalid redirect: %v", route.Name, err)
+		}
+		if err := route.Access.compile(); err != nil {
+			return nil, fmt.Errorf("route %s: invalid access policy: %v", route.Name, err)
+		}
+		if err := route.Schedule.compile(); err != nil {
+			return nil, fmt.Errorf("route %s: invalid schedule: %v", route.Name, err)
+		}
+		if err := route.parseTimeout(); err != nil {
+			return nil, fmt.Errorf("route %s: invalid timeout: %v", route.Name, err)
+		}
+	}
+	if err := compileClientSchedules(fileConfig.ClientSchedules); err != nil {
+		return nil, fmt.Errorf("invalid client schedule: %v", err)
+	}
+
+	for i, sink := range fileConfig.Logging {
+		if err := sink.validate(); err != nil {
+			return nil, fmt.Errorf("logging sink %d: %v", i, err)
+		}
+	}
+
+	return fileConfig, nil
+}
+
+// matchRoute returns the route for r, or nil. Routes for the request's host
+// take precedence over routes for any host, then the longest matching path
+// prefix wins.
+func matchRoute(routes []*Route, r *http.Request) *Route {
+	var best *Route
+	for _, route := range routes {
+		if route.Host != "" && !hostMatches(route.Host, r.Host) {
+			continue
+		}
+		if !strings.HasPrefix(r.URL.Path, route.PathPrefix) {
+			continue
+		}
+		if best == nil || moreSpecific(route, best) {
+			best = route
+		}
+	}
+	return best
+}
+
+func moreSpecific(route, than *Route) bool {
+	if (route.Host != "") != (than.Host != "") {
+		return route.Host != ""
+	}
+	return len(route.PathPrefix) > len(than.PathPrefix)
+}
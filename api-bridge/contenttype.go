@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// ContentTypePolicy restricts which media types may pass through a route.
+// Patterns are media types such as "application/json", "multipart/*" or "*/*".
+// Deny rules win over allow rules; an empty allow list allows everything.
+type ContentTypePolicy struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+func (p *ContentTypePolicy) validate() error {
+	if p == nil {
+		return nil
+	}
+	for _, pattern := range append(append([]string{}, p.Allow...), p.Deny...) {
+		if !strings.Contains(pattern, "/") {
+			return fmt.Errorf("invalid media type pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+func mediaTypeMatches(pattern, mediaType string) bool {
+	pattern = strings.ToLower(pattern)
+	if pattern == "*/*" || pattern == mediaType {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))
+	}
+	return false
+}
+
+// mediaTypeOf strips parameters such as charset or boundary from a Content-Type.
+func mediaTypeOf(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+// allows reports whether the given Content-Type header value is permitted.
+func (p *ContentTypePolicy) allows(contentType string) bool {
+	mediaType := mediaTypeOf(contentType)
+
+	for _, pattern := range p.Deny {
+		if mediaTypeMatches(pattern, mediaType) {
+			return false
+		}
+	}
+	if len(p.Allow) == 0 {
+		return true
+	}
+	for _, pattern := range p.Allow {
+		if mediaTypeMatches(pattern, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRequestContentType returns false if the request carries a body whose
+// content type is rejected by the policy.
+func checkRequestContentType(r *http.Request, p *ContentTypePolicy) bool {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" && (r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0) {
+		return true
+	}
+	return p.allows(contentType)
+}
+
+func checkResponseContentType(resp *http.Response, p *ContentTypePolicy) bool {
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" && resp.ContentLength == 0 {
+		return true
+	}
+	return p.allows(contentType)
+}
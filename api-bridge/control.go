@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"apiduct/pkg/tunnel"
+)
+
+// RouteStatus describes a route and the requests it served for the admin
+// interface.
+type RouteStatus struct {
+	Name          string           `json:"name"`
+	Host          string           `json:"host,omitempty"`
+	PathPrefix    string           `json:"path_prefix,omitempty"`
+	Offramp       string           `json:"offramp,omitempty"`
+	Tunnels       int              `json:"tunnels"`
+	Requests      map[string]int64 `json:"requests"` // by status class
+	RequestBytes  int64            `json:"request_bytes"`
+	ResponseBytes int64            `json:"response_bytes"`
+}
+
+// routeStatus describes the routes with the requests counted for them, and
+// the requests that matched no route if there were any.
+func routeStatus(routes []*Route, pool *tunnel.Pool) []RouteStatus {
+	byName := make(map[string]*RouteStatus)
+	status := make([]RouteStatus, 0, len(routes)+1)
+	for _, route := range routes {
+		status = append(status, RouteStatus{
+			Name:       route.Name,
+			Host:       route.Host,
+			PathPrefix: route.PathPrefix,
+			Offramp:    route.Offramp,
+			Requests:   make(map[string]int64),
+		})
+	}
+	for i := range status {
+		byName[status[i].Name] = &status[i]
+	}
+	tunnels := make(map[string]int)
+	for _, t := range pool.Status() {
+		if !t.Standby && !t.Draining {
+			tunnels[t.Offramp]++
+		}
+	}
+
+	fallback := RouteStatus{Name: routeLabel(nil), Requests: make(map[string]int64)}
+	for _, c := range metrics.Counters() {
+		name := labelValue(c.Labels, "route")
+		route := byName[name]
+		if route == nil {
+			if name != fallback.Name {
+				continue
+			}
+			route = &fallback
+		}
+		switch c.Name {
+		case "apiduct_requests_total":
+			route.Requests[labelValue(c.Labels, "code")] += c.Value()
+		case "apiduct_request_bytes_total":
+			route.RequestBytes += c.Value()
+		case "apiduct_response_bytes_total":
+			route.ResponseBytes += c.Value()
+		}
+	}
+	for i := range status {
+		status[i].Tunnels = tunnels[status[i].Offramp]
+	}
+	if len(fallback.Requests) > 0 && byName[fallback.Name] == nil {
+		fallback.Tunnels = tunnels[""]
+		status = append(status, fallback)
+	}
+	return status
+}
+
+// handleTunnels lists the tunnels on GET /api/tunnels, drains one on POST
+// /api/tunnels/<id>/drain and closes one at once on DELETE /api/tunnels/<id>.
+func handleTunnels(pool *tunnel.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/tunnels"), "/")
+		if path == "" {
+			if r.Method != http.MethodGet {
+				writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			writeJSON(w, http.StatusOK, pool.Status())
+			return
+		}
+
+		id, action, _ := strings.Cut(path, "/")
+		t := pool.ByID(id)
+		if t == nil {
+			writeJSONError(w, http.StatusNotFound, "tunnel not found")
+			return
+		}
+		switch {
+		case action == "drain" && r.Method == http.MethodPost:
+			logEvent("tunnel_drain", map[string]string{"tunnel": t.Addr, "tunnel_id": t.ID}, "[BRIDGE] Draining tunnel on the admin interface")
+			pool.Drain(t, "drained on the admin interface")
+			writeJSON(w, http.StatusAccepted, pool.StatusOf(t))
+		case action == "" && r.Method == http.MethodDelete:
+			status := pool.StatusOf(t)
+			pool.Drop(t, "kicked on the admin interface")
+			writeJSON(w, http.StatusOK, status)
+		case action == "" || action == "drain":
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		default:
+			writeJSONError(w, http.StatusNotFound, "not found")
+		}
+	}
+}
+
+func handleRoutes(pool *tunnel.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, routeStatus(live.Routes(), pool))
+	}
+}
+
+func handleReload(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		status, err := reloadConfig(config)
+		if err == errNoConfigFile {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			logEvent("config_reload_failed", nil, "[BRIDGE] Failed to reload config, keeping the loaded one: %v", err)
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	}
+}
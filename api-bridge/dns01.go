@@ -0,0 +1,272 @@
+//go:build !noacme
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dnsProvider publishes the TXT records answering DNS-01 challenges. All
+// values for a name are passed at once, as a wildcard and its base domain
+// share the record name.
+type dnsProvider interface {
+	Present(ctx context.Context, fqdn string, values []string) error
+	CleanUp(ctx context.Context, fqdn string, values []string) error
+}
+
+func newDNSProvider(config *Config) (dnsProvider, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	switch config.ACMEDNSProvider {
+	case "route53":
+		return &route53Provider{client: client, creds: &awsCredentialProvider{client: &http.Client{Timeout: 2 * time.Second}}}, nil
+	case "cloudflare":
+		if config.CloudflareToken == "" {
+			return nil, fmt.Errorf("--acme-cloudflare-token (or CLOUDFLARE_API_TOKEN) is required for the cloudflare DNS provider")
+		}
+		return &cloudflareProvider{client: client, token: config.CloudflareToken, records: make(map[string][]string)}, nil
+	default:
+		return nil, fmt.Errorf("unknown DNS provider %q (use route53 or cloudflare)", config.ACMEDNSProvider)
+	}
+}
+
+// parentDomains returns name and each of its parent domains, longest first,
+// to find the zone a record belongs to.
+func parentDomains(name string) []string {
+	var domains []string
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for i := 0; i < len(labels)-1; i++ {
+		domains = append(domains, strings.Join(labels[i:], "."))
+	}
+	return domains
+}
+
+// route53Provider manages records in AWS Route 53, with credentials from the
+// environment or the EC2 instance role like the CloudWatch publisher.
+type route53Provider struct {
+	client *http.Client
+	creds  *awsCredentialProvider
+}
+
+const route53Endpoint = "https://route53.amazonaws.com/2013-04-01"
+
+func (p *route53Provider) Present(ctx context.Context, fqdn string, values []string) error {
+	return p.change(ctx, "UPSERT", fqdn, values)
+}
+
+func (p *route53Provider) CleanUp(ctx context.Context, fqdn string, values []string) error {
+	return p.change(ctx, "DELETE", fqdn, values)
+}
+
+func (p *route53Provider) do(ctx context.Context, method, path string, body []byte, out interface{}) error {
+	creds, err := p.creds.Credentials()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, route53Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "text/xml")
+	}
+	// Route 53 is a global service signed for us-east-1
+	signAWSRequest(req, body, creds, "us-east-1", "route53", time.Now())
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Route 53 request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Route 53 returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return xml.Unmarshal(data, out)
+}
+
+// zoneID finds the public hosted zone holding fqdn.
+func (p *route53Provider) zoneID(ctx context.Context, fqdn string) (string, error) {
+	for _, domain := range parentDomains(fqdn) {
+		var result struct {
+			HostedZones []struct {
+				ID     string `xml:"Id"`
+				Name   string `xml:"Name"`
+				Config struct {
+					PrivateZone bool `xml:"PrivateZone"`
+				} `xml:"Config"`
+			} `xml:"HostedZones>HostedZone"`
+		}
+		query := url.Values{"dnsname": {domain}, "maxitems": {"10"}}
+		if err := p.do(ctx, http.MethodGet, "/hostedzonesbyname?"+query.Encode(), nil, &result); err != nil {
+			return "", err
+		}
+		for _, zone := range result.HostedZones {
+			if zone.Name == domain+"." && !zone.Config.PrivateZone {
+				return strings.TrimPrefix(zone.ID, "/hostedzone/"), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no Route 53 hosted zone found for %s", fqdn)
+}
+
+func (p *route53Provider) change(ctx context.Context, action, fqdn string, values []string) error {
+	zone, err := p.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+
+	var records strings.Builder
+	for _, value := range values {
+		records.WriteString("<ResourceRecord><Value>\"" + value + "\"</Value></ResourceRecord>")
+	}
+	body := []byte(`<?xml version="1.0" encoding="UTF-8"?>` +
+		`<ChangeResourceRecordSetsRequest xmlns="https://route53.amazonaws.com/doc/2013-04-01/"><ChangeBatch><Changes><Change>` +
+		"<Action>" + action + "</Action><ResourceRecordSet><Name>" + fqdn + ".</Name><Type>TXT</Type><TTL>60</TTL>" +
+		"<ResourceRecords>" + records.String() + "</ResourceRecords></ResourceRecordSet></Change></Changes></ChangeBatch></ChangeResourceRecordSetsRequest>")
+
+	var result struct {
+		ID     string `xml:"ChangeInfo>Id"`
+		Status string `xml:"ChangeInfo>Status"`
+	}
+	if err := p.do(ctx, http.MethodPost, "/hostedzone/"+zone+"/rrset/", body, &result); err != nil {
+		return err
+	}
+	if action == "DELETE" {
+		return nil
+	}
+
+	// Wait until the change reached all Route 53 name servers
+	for result.Status != "INSYNC" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+		if err := p.do(ctx, http.MethodGet, "/change/"+strings.TrimPrefix(result.ID, "/change/"), nil, &result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cloudflareProvider manages records through the Cloudflare API with an API
+// token allowed to edit DNS in the zone.
+type cloudflareProvider struct {
+	client *http.Client
+	token  string
+
+	mu      sync.Mutex
+	records map[string][]string // fqdn to the IDs of the records we created
+}
+
+const cloudflareEndpoint = "https://api.cloudflare.com/client/v4"
+
+func (p *cloudflareProvider) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, cloudflareEndpoint+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Cloudflare request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&envelope); err != nil {
+		return fmt.Errorf("invalid Cloudflare response (status %d): %v", resp.StatusCode, err)
+	}
+	if !envelope.Success {
+		var messages []string
+		for _, e := range envelope.Errors {
+			messages = append(messages, e.Message)
+		}
+		return fmt.Errorf("Cloudflare returned status %d: %s", resp.StatusCode, strings.Join(messages, "; "))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(envelope.Result, out)
+}
+
+func (p *cloudflareProvider) zoneID(ctx context.Context, fqdn string) (string, error) {
+	for _, domain := range parentDomains(fqdn) {
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		if err := p.do(ctx, http.MethodGet, "/zones?name="+url.QueryEscape(domain), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			return zones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("no Cloudflare zone found for %s", fqdn)
+}
+
+func (p *cloudflareProvider) Present(ctx context.Context, fqdn string, values []string) error {
+	zone, err := p.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	for _, value := range values {
+		var record struct {
+			ID string `json:"id"`
+		}
+		if err := p.do(ctx, http.MethodPost, "/zones/"+zone+"/dns_records", map[string]interface{}{
+			"type": "TXT", "name": fqdn, "content": value, "ttl": 120,
+		}, &record); err != nil {
+			return err
+		}
+		p.mu.Lock()
+		p.records[fqdn] = append(p.records[fqdn], zone+"/dns_records/"+record.ID)
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+func (p *cloudflareProvider) CleanUp(ctx context.Context, fqdn string, values []string) error {
+	p.mu.Lock()
+	records := p.records[fqdn]
+	delete(p.records, fqdn)
+	p.mu.Unlock()
+
+	var failed []string
+	for _, record := range records {
+		if err := p.do(ctx, http.MethodDelete, "/zones/"+record, nil, nil); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// drainMode takes the bridge out of service for maintenance. While draining,
+// new public requests are turned away and new tunnels refused, and the
+// requests in flight are left to finish.
+type drainMode struct {
+	mu        sync.Mutex
+	draining  bool
+	since     time.Time
+	drainedAt time.Time
+	inflight  int
+	notifier  Notifier
+}
+
+// maintenance is the bridge's drain state, toggled on the admin interface.
+var maintenance = &drainMode{}
+
+// DrainStatus is the drain state reported by the admin interface.
+type DrainStatus struct {
+	Draining  bool       `json:"draining"`
+	Since     *time.Time `json:"since,omitempty"`
+	InFlight  int        `json:"in_flight"`
+	Drained   bool       `json:"drained"`
+	DrainedAt *time.Time `json:"drained_at,omitempty"`
+}
+
+// begin counts a public request. It fails while draining.
+func (d *drainMode) begin() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return false
+	}
+	d.inflight++
+	return true
+}
+
+// end marks a request started with begin as finished.
+func (d *drainMode) end() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inflight--
+	d.checkDrained()
+}
+
+func (d *drainMode) isDraining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining
+}
+
+// Start begins draining. It is a no-op if the bridge is already draining.
+func (d *drainMode) Start() DrainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.draining {
+		d.draining = true
+		d.since = time.Now()
+		d.drainedAt = time.Time{}
+		logEvent("drain_start", nil, "[BRIDGE] Draining for maintenance, %d requests in flight", d.inflight)
+		d.checkDrained()
+	}
+	return d.status()
+}
+
+// Stop puts the bridge back into service.
+func (d *drainMode) Stop() DrainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		d.draining = false
+		logEvent("drain_stop", nil, "[BRIDGE] Drain cancelled, accepting requests and tunnels again")
+	}
+	return d.status()
+}
+
+func (d *drainMode) Status() DrainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.status()
+}
+
+func (d *drainMode) status() DrainStatus {
+	s := DrainStatus{Draining: d.draining, InFlight: d.inflight}
+	if d.draining {
+		since := d.since
+		s.Since = &since
+		if !d.drainedAt.IsZero() {
+			drainedAt := d.drainedAt
+			s.Drained = true
+			s.DrainedAt = &drainedAt
+		}
+	}
+	return s
+}
+
+// checkDrained reports the drain as complete once the last request finished.
+// The caller holds d.mu.
+func (d *drainMode) checkDrained() {
+	if !d.draining || d.inflight > 0 || !d.drainedAt.IsZero() {
+		return
+	}
+	d.drainedAt = time.Now()
+	took := d.drainedAt.Sub(d.since).Round(time.Millisecond)
+	logEvent("drained", nil, "[BRIDGE] Drained after %s, no requests in flight", took)
+	if d.notifier != nil {
+		notifier := d.notifier
+		go func() {
+			if err := notifier.Notify("apiduct bridge drained", "The bridge finished all requests in flight after "+took.String()+" and can be taken down.",
+				map[string]string{"drained_after": took.String()}); err != nil {
+				log.Printf("[BRIDGE] Failed to deliver drain notification: %v", err)
+			}
+		}()
+	}
+}
+
+// rejectDraining answers a public request that arrived while draining, with a
+// redirect if one is configured and 503 otherwise.
+func rejectDraining(w http.ResponseWriter, r *http.Request, redirect string) {
+	metrics.Counter("apiduct_drain_rejected_total").Inc()
+	if redirect != "" {
+		http.Redirect(w, r, strings.TrimSuffix(redirect, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return
+	}
+	w.Header().Set("Retry-After", "30")
+	writeError(w, http.StatusServiceUnavailable, errCodeMaintenance, "Service is down for maintenance")
+}
+
+func handleDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, maintenance.Status())
+	case http.MethodPost:
+		writeJSON(w, http.StatusOK, maintenance.Start())
+	case http.MethodDelete:
+		writeJSON(w, http.StatusOK, maintenance.Stop())
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"apiduct/pkg/auth"
+	"apiduct/pkg/mux"
+	"apiduct/pkg/tunnel"
+)
+
+// defaultBootstrapTTL is how long a bootstrap token is valid unless the
+// request issuing it says otherwise.
+const defaultBootstrapTTL = 24 * time.Hour
+
+// BootstrapToken lets one offramp enroll under Identity until it expires.
+type BootstrapToken struct {
+	Token     string    `json:"token"`
+	Identity  string    `json:"identity"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// EnrolledOfframp is an offramp that enrolled with a bootstrap token and
+// authenticates with the key derived from it instead of the PSK.
+type EnrolledOfframp struct {
+	Identity     string    `json:"identity"`
+	Key          string    `json:"key,omitempty"`
+	EnrolledAt   time.Time `json:"enrolled_at"`
+	EnrolledFrom string    `json:"enrolled_from"`
+}
+
+// enrollmentStore keeps the bootstrap tokens not yet used and the enrolled
+// offramps in --enrollment-file, which holds secrets and is only readable by
+// the bridge's user.
+type enrollmentStore struct {
+	path string
+
+	mu       sync.Mutex
+	Tokens   []BootstrapToken  `json:"bootstrap_tokens"`
+	Offramps []EnrolledOfframp `json:"offramps"`
+}
+
+// enrollments is nil unless --enrollment-file is set.
+var enrollments *enrollmentStore
+
+// loadEnrollments reads the enrollment file. A missing file is not an error,
+// it is created with the first bootstrap token.
+func loadEnrollments(path string) (*enrollmentStore, error) {
+	s := &enrollmentStore{path: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read enrollments: %v", err)
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse enrollments: %v", err)
+	}
+	return s, nil
+}
+
+// saveLocked writes the store atomically via a temporary file. The caller
+// must hold s.mu.
+func (s *enrollmentStore) saveLocked() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".enrollments-*")
+	if err != nil {
+		return fmt.Errorf("failed to create enrollments: %v", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write enrollments: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write enrollments: %v", err)
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to replace enrollments: %v", err)
+	}
+	return nil
+}
+
+// issue creates a bootstrap token for identity, valid for ttl.
+func (s *enrollmentStore) issue(identity string, ttl time.Duration) (BootstrapToken, error) {
+	if err := auth.ValidateName(identity); err != nil {
+		return BootstrapToken{}, err
+	}
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return BootstrapToken{}, fmt.Errorf("failed to create token: %v", err)
+	}
+	token := BootstrapToken{
+		Token:     "apdt_" + hex.EncodeToString(secret),
+		Identity:  identity,
+		ExpiresAt: time.Now().Add(ttl).UTC().Truncate(time.Second),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens := s.Tokens
+	s.Tokens = append(s.unexpiredLocked(), token)
+	if err := s.saveLocked(); err != nil {
+		s.Tokens = tokens
+		return BootstrapToken{}, err
+	}
+	return token, nil
+}
+
+// unexpiredLocked returns the tokens that have not expired. The caller must
+// hold s.mu.
+func (s *enrollmentStore) unexpiredLocked() []BootstrapToken {
+	var tokens []BootstrapToken
+	for _, token := range s.Tokens {
+		if time.Now().Before(token.ExpiresAt) {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// redeem enrolls the offramp that proved a bootstrap token in hello, using
+// it up. The offramp's key is derived from the token and salt, and replaces
+// the key of an earlier enrollment under the same identity. It returns the
+// identity, or "" if hello proves no valid token.
+func (s *enrollmentStore) redeem(hello *auth.Hello, salt []byte, addr string) (string, error) {
+	if s == nil {
+		return "", nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var used *BootstrapToken
+	var rest []BootstrapToken
+	for _, token := range s.unexpiredLocked() {
+		if used == nil && hello.Verify(token.Token) {
+			token := token
+			used = &token
+			continue
+		}
+		rest = append(rest, token)
+	}
+	if used == nil {
+		return "", nil
+	}
+
+	enrolled := EnrolledOfframp{
+		Identity:     used.Identity,
+		Key:          auth.DeriveKey(used.Token, salt),
+		EnrolledAt:   time.Now().UTC().Truncate(time.Second),
+		EnrolledFrom: addr,
+	}
+	tokens, offramps := s.Tokens, s.Offramps
+	s.Tokens = rest
+	s.Offramps = []EnrolledOfframp{enrolled}
+	for _, offramp := range offramps {
+		if offramp.Identity != enrolled.Identity {
+			s.Offramps = append(s.Offramps, offramp)
+		}
+	}
+	if err := s.saveLocked(); err != nil {
+		s.Tokens, s.Offramps = tokens, offramps
+		return "", err
+	}
+	return enrolled.Identity, nil
+}
+
+// verify returns the identity of the enrolled offramp whose key hello
+// proves, or "" if there is none.
+func (s *enrollmentStore) verify(hello *auth.Hello) string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, offramp := range s.Offramps {
+		if hello.Verify(offramp.Key) {
+			return offramp.Identity
+		}
+	}
+	return ""
+}
+
+// list returns the enrolled offramps without their keys.
+func (s *enrollmentStore) list() []EnrolledOfframp {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offramps := make([]EnrolledOfframp, 0, len(s.Offramps))
+	for _, offramp := range s.Offramps {
+		offramp.Key = ""
+		offramps = append(offramps, offramp)
+	}
+	return offramps
+}
+
+// revoke removes the enrollment of identity, reporting whether there was one.
+func (s *enrollmentStore) revoke(identity string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offramps := s.Offramps
+	s.Offramps = nil
+	for _, offramp := range offramps {
+		if offramp.Identity != identity {
+			s.Offramps = append(s.Offramps, offramp)
+		}
+	}
+	if len(s.Offramps) == len(offramps) {
+		return false, nil
+	}
+	if err := s.saveLocked(); err != nil {
+		s.Offramps = offramps
+		return false, err
+	}
+	return true, nil
+}
+
+// enrollOfframp answers an offramp that proved a bootstrap token: it ends the
+// handshake and sends the identity and the salt the offramp derives its key
+// with. The offramp then reconnects with that key.
+func enrollOfframp(conn net.Conn, hello *auth.Hello, start time.Time) {
+	addr := conn.RemoteAddr().String()
+	failed := func(err error) {
+		mux.ObserveHandshake(start, "error")
+		log.Printf("[BRIDGE] Failed to enroll offramp from %s: %v", addr, err)
+	}
+	salt, err := auth.NewSalt()
+	if err != nil {
+		failed(err)
+		return
+	}
+	identity, err := enrollments.redeem(hello, salt, addr)
+	if err != nil {
+		failed(err)
+		return
+	}
+	if identity == "" {
+		mux.ObserveHandshake(start, "failed")
+		logEvent("auth_failure", map[string]string{"tunnel": addr, "code": errCodeAuthFailed},
+			"[BRIDGE] Enrollment refused, unknown or expired bootstrap token")
+		auth.WriteStatus(conn, auth.StatusFailed)
+		return
+	}
+
+	if err := auth.WriteStatus(conn, auth.StatusOK); err != nil {
+		failed(err)
+		return
+	}
+	if err := auth.WriteEnrollment(conn, identity, salt); err != nil {
+		failed(err)
+		return
+	}
+	mux.ObserveHandshake(start, "ok")
+	logEvent("offramp_enrolled", map[string]string{"tunnel": addr, "identity": identity},
+		"[BRIDGE] Enrolled offramp %s from %s", identity, addr)
+}
+
+// handleBootstrapTokens issues a bootstrap token on POST /api/bootstrap-tokens
+// with {"identity": "...", "ttl": "24h"}.
+func handleBootstrapTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var request struct {
+		Identity string `json:"identity"`
+		TTL      string `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err))
+		return
+	}
+	ttl := defaultBootstrapTTL
+	if request.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(request.TTL); err != nil || ttl <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "ttl must be a positive duration")
+			return
+		}
+	}
+	token, err := enrollments.issue(request.Identity, ttl)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	logEvent("bootstrap_token_issued", map[string]string{"identity": token.Identity},
+		"[BRIDGE] Issued bootstrap token for %s, valid until %s", token.Identity, token.ExpiresAt.Format(time.RFC3339))
+	writeJSON(w, http.StatusCreated, token)
+}
+
+// handleEnrolledOfframps lists the enrolled offramps on GET /api/offramps and
+// revokes one on DELETE /api/offramps/<identity>, closing its tunnels.
+func handleEnrolledOfframps(pool *tunnel.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/offramps"), "/")
+		switch {
+		case identity == "" && r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, enrollments.list())
+		case identity != "" && r.Method == http.MethodDelete:
+			revoked, err := enrollments.revoke(identity)
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if !revoked {
+				writeJSONError(w, http.StatusNotFound, "offramp not enrolled")
+				return
+			}
+			logEvent("offramp_revoked", map[string]string{"identity": identity}, "[BRIDGE] Revoked enrollment of %s", identity)
+			for _, t := range pool.All() {
+				if t.Identity == identity {
+					pool.Drop(t, "enrollment revoked")
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+// newEventSink returns nil as the Windows Event Log is not available.
+func newEventSink(config *Config) (LogSink, error) {
+	return nil, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// Event IDs written to the Windows Event Log
+var eventIDs = map[string]uint32{
+	"startup":      1,
+	"shutdown":     2,
+	"tunnel_up":    3,
+	"tunnel_down":  4,
+	"auth_failure": 5,
+}
+
+// eventLogSink writes significant events to the Windows Event Log.
+type eventLogSink struct {
+	log *eventlog.Log
+}
+
+// newEventSink opens the Event Log when running as a Windows service.
+func newEventSink(config *Config) (LogSink, error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return nil, nil
+	}
+
+	// Register the event source, which fails harmlessly if it already exists
+	eventlog.InstallAsEventCreate(config.ServiceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	l, err := eventlog.Open(config.ServiceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event log: %v", err)
+	}
+	return &eventLogSink{log: l}, nil
+}
+
+func (s *eventLogSink) Emit(entry *LogEntry) {
+	event := entry.Fields["event"]
+	if event == "" {
+		return
+	}
+	id, ok := eventIDs[event]
+	if !ok {
+		id = 100
+	}
+
+	var details []string
+	for key, value := range entry.Fields {
+		if key != "event" {
+			details = append(details, key+"="+value)
+		}
+	}
+	message := entry.Message
+	if len(details) > 0 {
+		message += " (" + strings.Join(details, ", ") + ")"
+	}
+
+	var err error
+	switch entry.Severity {
+	case SeverityError:
+		err = s.log.Error(id, message)
+	case SeverityWarning:
+		err = s.log.Warning(id, message)
+	default:
+		err = s.log.Info(id, message)
+	}
+	if err != nil {
+		sinkError("Failed to write to event log: %v", err)
+	}
+}
+
+func (s *eventLogSink) Close() error {
+	return s.log.Close()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+
+	"apiduct/pkg/buildinfo"
+)
+
+// features lists the optional subsystems, and whether config uses them.
+func features(config *Config) []buildinfo.Feature {
+	return []buildinfo.Feature{
+		{Name: "acme", BuildTag: "noacme", Compiled: acmeCompiled, Enabled: config.ACME},
+		{Name: "h2c", BuildTag: "noh2c", Compiled: h2cCompiled, Enabled: config.H2C},
+		{Name: "inspector", BuildTag: "noinspector", Compiled: inspectorCompiled, Enabled: config.Inspect},
+		{Name: "access_log", Compiled: true, Enabled: config.AccessLog != ""},
+		{Name: "client_certificates", Compiled: true, Enabled: config.ClientCAFile != ""},
+		{Name: "cloudwatch", Compiled: true, Enabled: config.CloudWatchNamespace != ""},
+		{Name: "enrollment", Compiled: true, Enabled: config.EnrollmentFile != ""},
+		{Name: "journal", Compiled: true, Enabled: config.JournalFile != ""},
+		{Name: "openapi", Compiled: true, Enabled: config.OpenAPIFile != ""},
+		{Name: "tunnel_checksums", Compiled: true, Enabled: config.TunnelChecksums},
+	}
+}
+
+// handleFeatures answers GET /api/features.
+func handleFeatures(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, buildinfo.NewReport(Version, BuildTime, features(config)))
+	}
+}
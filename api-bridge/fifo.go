@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// fifoLine lets the requests of a FIFO route through one at a time, in the
+// order they arrived, so they reach the target in that order regardless of
+// how many tunnels and offramp workers could carry them at once.
+type fifoLine struct {
+	route string
+
+	mu      sync.Mutex
+	busy    bool
+	waiting []chan struct{}
+}
+
+// fifoLines are kept by route name, so a config reload does not open a
+// second line next to the one requests are waiting in.
+var fifoLines = struct {
+	sync.Mutex
+	byRoute map[string]*fifoLine
+}{byRoute: make(map[string]*fifoLine)}
+
+// fifoLineFor returns the line of route, or nil if its requests need no
+// ordering.
+func fifoLineFor(route *Route) *fifoLine {
+	if route == nil || !route.FIFO {
+		return nil
+	}
+	fifoLines.Lock()
+	defer fifoLines.Unlock()
+	line := fifoLines.byRoute[route.Name]
+	if line == nil {
+		line = &fifoLine{route: route.Name}
+		fifoLines.byRoute[route.Name] = line
+	}
+	return line
+}
+
+// wait blocks until it is the caller's turn and returns the function that
+// passes the turn on, which may be called more than once. It returns false
+// if ctx ended first.
+func (l *fifoLine) wait(ctx context.Context) (func(), bool) {
+	if l == nil {
+		return func() {}, true
+	}
+	l.mu.Lock()
+	if !l.busy {
+		l.busy = true
+		l.countLocked()
+		l.mu.Unlock()
+		return l.doneOnce(), true
+	}
+	turn := make(chan struct{})
+	l.waiting = append(l.waiting, turn)
+	l.countLocked()
+	l.mu.Unlock()
+
+	select {
+	case <-turn:
+		return l.doneOnce(), true
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, waiting := range l.waiting {
+		if waiting == turn {
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			l.countLocked()
+			return nil, false
+		}
+	}
+	// The turn came as ctx ended, pass it on
+	l.passLocked()
+	return nil, false
+}
+
+func (l *fifoLine) doneOnce() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.passLocked()
+		})
+	}
+}
+
+// passLocked hands the turn to the longest waiting request. The caller must
+// hold l.mu.
+func (l *fifoLine) passLocked() {
+	if len(l.waiting) == 0 {
+		l.busy = false
+	} else {
+		close(l.waiting[0])
+		l.waiting = l.waiting[1:]
+	}
+	l.countLocked()
+}
+
+// countLocked updates the gauge of requests waiting for their turn. The
+// caller must hold l.mu.
+func (l *fifoLine) countLocked() {
+	metrics.Gauge("apiduct_fifo_waiting", "route", l.route).Set(int64(len(l.waiting)))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// flushWriter flushes the response to the client after every write, so
+// streamed bodies are passed on as they arrive instead of waiting for the
+// server's buffer to fill.
+type flushWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if n > 0 {
+		f.flusher.Flush()
+	}
+	return n, err
+}
+
+// isStreamed reports whether resp is a stream of unknown length, such as
+// server-sent events or a chunked download, that must be flushed as it goes.
+func isStreamed(resp *http.Response) bool {
+	return resp.ContentLength < 0 || mediaTypeOf(resp.Header.Get("Content-Type")) == "text/event-stream"
+}
+
+// responseWriterFor returns the writer to copy resp's body to.
+func responseWriterFor(w http.ResponseWriter, resp *http.Response) io.Writer {
+	flusher, ok := w.(http.Flusher)
+	if !ok || !isStreamed(resp) {
+		return w
+	}
+	return &flushWriter{w: w, flusher: flusher}
+}
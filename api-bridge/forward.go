@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"apiduct/pkg/auth"
+	"apiduct/pkg/proxy"
+	"apiduct/pkg/tunnel"
+)
+
+// forwardOfframpHeader on a forward client's CONNECT request names the
+// offramp to reach the address through; unnamed offramps are used without it.
+const forwardOfframpHeader = "X-Apiduct-Offramp"
+
+// handleForward relays a port-forward client to an address behind an
+// offramp. The client sends a CONNECT request for the address, which is
+// passed to an offramp on a new tunnel stream; from then on, the offramp's
+// answer and the connection's bytes are copied both ways until either side
+// closes.
+func handleForward(conn net.Conn, pool *tunnel.Pool, acls tunnelACLs, logTunnel func(string, ...interface{})) {
+	reader := proxy.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	req, err := reader.ReadRequest()
+	if err != nil {
+		logTunnel("[BRIDGE] Failed to read forward request: %v", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	if req.Method != http.MethodConnect {
+		writeConnError(conn, http.StatusMethodNotAllowed, errCodeInvalidRequest, "Forward clients must send CONNECT")
+		return
+	}
+	if _, _, err := net.SplitHostPort(req.Host); err != nil {
+		writeConnError(conn, http.StatusBadRequest, errCodeInvalidRequest, "CONNECT needs a host:port address")
+		return
+	}
+	offramp := req.Header.Get(forwardOfframpHeader)
+	if offramp != "" {
+		if err := auth.ValidateName(offramp); err != nil {
+			writeConnError(conn, http.StatusBadRequest, errCodeInvalidRequest, "Invalid offramp name")
+			return
+		}
+	}
+
+	// Only addresses the offramp's ACL lists may be reached through it
+	if !acls.allows(offramp, req.Host) {
+		logEvent("forward_denied", map[string]string{"tunnel": conn.RemoteAddr().String(), "offramp": offramp, "address": req.Host},
+			"[BRIDGE] Refusing to forward to %s, not in the tunnel ACL", req.Host)
+		metrics.Counter("apiduct_forward_denied_total").Inc()
+		writeConnError(conn, http.StatusForbidden, errCodeForwardDenied, "Forwarding to this address is not allowed")
+		return
+	}
+
+	tun, err := pool.Pick(offramp, nil, false)
+	switch err {
+	case nil:
+	case tunnel.ErrBusy:
+		writeConnError(conn, http.StatusServiceUnavailable, errCodeTunnelBusy, "Tunnel is busy")
+		return
+	default:
+		writeConnError(conn, http.StatusServiceUnavailable, errCodeTunnelDown, "Tunnel connection not available")
+		return
+	}
+	defer tun.Release(false)
+
+	stream, err := tun.Session.Open()
+	if err != nil {
+		pool.Failed(tun)
+		writeConnError(conn, http.StatusServiceUnavailable, errCodeTunnelDown, "Tunnel connection not available")
+		return
+	}
+	if _, err := fmt.Fprintf(stream, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", req.Host, req.Host); err != nil {
+		stream.Reset()
+		pool.Failed(tun)
+		writeConnError(conn, http.StatusBadGateway, errCodeTunnelError, "Failed to forward request")
+		return
+	}
+	tun.Succeeded()
+	markSuccess()
+	logTunnel("[BRIDGE] Forwarding connection to %s through tunnel %s", req.Host, tun.ID)
+
+	metrics.Counter("apiduct_forward_connections_total").Inc()
+	open := metrics.Gauge("apiduct_forward_open")
+	open.Add(1)
+	defer open.Add(-1)
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(stream, reader)
+		stream.Close()
+		close(done)
+	}()
+	io.Copy(conn, stream)
+	conn.Close()
+	<-done
+	logTunnel("[BRIDGE] Forwarded connection to %s closed", req.Host)
+}
+
+// writeConnError answers a forward client with an apiduct error, as
+// writeError does for HTTP clients.
+func writeConnError(conn net.Conn, status int, code, message string) {
+	body, _ := json.Marshal(map[string]string{"error": message, "code": code})
+	body = append(body, '\n')
+	resp := &http.Response{
+		Status:     strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode: status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":        {"application/json"},
+			proxy.ErrorCodeHeader: {code},
+		},
+		Body:          io.NopCloser(strings.NewReader(string(body))),
+		ContentLength: int64(len(body)),
+	}
+	resp.Write(conn)
+}
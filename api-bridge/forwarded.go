@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardedHeaders describe the client to the target, which otherwise sees
+// every request coming from the offramp.
+var forwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"}
+
+// setForwardedHeaders adds the client's address, the scheme and the host it
+// asked for to r. Values the client sent are kept and extended only if it
+// is one of the trusted proxies, and removed otherwise, as anyone could
+// forge them.
+func setForwardedHeaders(r *http.Request, config *Config) {
+	if !config.ForwardedHeaders {
+		return
+	}
+	client := clientIP(r)
+	ip := net.ParseIP(client)
+	if ip == nil || !containsIP(config.trustedProxies, ip) {
+		for _, name := range forwardedHeaders {
+			r.Header.Del(name)
+		}
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	if ip != nil {
+		if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+			client = prior + ", " + client
+		}
+		r.Header.Set("X-Forwarded-For", client)
+	}
+	if r.Header.Get("X-Forwarded-Proto") == "" {
+		r.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if r.Header.Get("X-Forwarded-Host") == "" {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+	}
+	if config.ForwardedRFC7239 {
+		r.Header.Add("Forwarded", forwardedElement(ip, proto, r.Host))
+	}
+}
+
+// forwardedElement describes one hop in the Forwarded header of RFC 7239.
+func forwardedElement(ip net.IP, proto, host string) string {
+	node := "unknown"
+	if ip != nil {
+		node = ip.String()
+		if ip.To4() == nil {
+			node = `"[` + node + `]"`
+		}
+	}
+	return "for=" + node + ";proto=" + proto + ";host=" + forwardedValue(host)
+}
+
+// forwardedValue quotes value unless it is a token.
+func forwardedValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, `()<>@,;:\"/[]?={} `+"\t") {
+		return value
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
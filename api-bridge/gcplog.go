@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const gcpMetadataEndpoint = "http://metadata.google.internal/computeMetadata/v1"
+
+// gcpMetadata reads GCE/GKE instance metadata.
+type gcpMetadata struct {
+	client *http.Client
+}
+
+func (m *gcpMetadata) get(path string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, gcpMetadataEndpoint+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata request %s returned status %d", path, resp.StatusCode)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+type gcpResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels"`
+}
+
+// detectGCPResource describes where the bridge runs: a GKE container when
+// Kubernetes environment variables are present, otherwise a GCE instance.
+func detectGCPResource(md *gcpMetadata, project string) gcpResource {
+	lastSegment := func(value string) string {
+		return value[strings.LastIndex(value, "/")+1:]
+	}
+
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		cluster, _ := md.get("/instance/attributes/cluster-name")
+		location, _ := md.get("/instance/attributes/cluster-location")
+		namespace := os.Getenv("POD_NAMESPACE")
+		if namespace == "" {
+			data, _ := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+			namespace = strings.TrimSpace(string(data))
+		}
+		pod := os.Getenv("POD_NAME")
+		if pod == "" {
+			pod, _ = os.Hostname()
+		}
+		container := os.Getenv("CONTAINER_NAME")
+		if container == "" {
+			container = "api-bridge"
+		}
+		return gcpResource{Type: "k8s_container", Labels: map[string]string{
+			"project_id":     project,
+			"cluster_name":   cluster,
+			"location":       location,
+			"namespace_name": namespace,
+			"pod_name":       pod,
+			"container_name": container,
+		}}
+	}
+
+	instanceID, err := md.get("/instance/id")
+	if err != nil {
+		return gcpResource{Type: "global", Labels: map[string]string{"project_id": project}}
+	}
+	zone, _ := md.get("/instance/zone")
+	return gcpResource{Type: "gce_instance", Labels: map[string]string{
+		"project_id":  project,
+		"instance_id": instanceID,
+		"zone":        lastSegment(zone),
+	}}
+}
+
+type gcpLogEntry struct {
+	Timestamp   string            `json:"timestamp"`
+	Severity    string            `json:"severity"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	JSONPayload map[string]string `json:"jsonPayload"`
+}
+
+// gcpLogSink batches entries and ships them to the Cloud Logging API using
+// the service account of the GCE instance or GKE node.
+type gcpLogSink struct {
+	metadata *gcpMetadata
+	client   *http.Client
+	logName  string
+	resource gcpResource
+
+	mu          sync.Mutex
+	pending     []gcpLogEntry
+	token       string
+	tokenExpiry time.Time
+	flush       chan struct{}
+	done        chan struct{}
+	stopped     chan struct{}
+}
+
+const (
+	gcpLogBatchSize  = 100
+	gcpLogMaxPending = 10000
+)
+
+func newGCPLogSink(project, logName string) (*gcpLogSink, error) {
+	md := &gcpMetadata{client: &http.Client{Timeout: 2 * time.Second}}
+
+	if project == "" {
+		var err error
+		project, err = md.get("/project/project-id")
+		if err != nil {
+			return nil, fmt.Errorf("GCP project not configured and metadata server unavailable: %v", err)
+		}
+	}
+
+	s := &gcpLogSink{
+		metadata: md,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		logName:  fmt.Sprintf("projects/%s/logs/%s", project, logName),
+		resource: detectGCPResource(md, project),
+		flush:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *gcpLogSink) Emit(entry *LogEntry) {
+	payload := map[string]string{"message": entry.Message}
+	labels := map[string]string{"version": Version}
+	if entry.Component != "" {
+		payload["component"] = entry.Component
+		labels["component"] = strings.ToLower(entry.Component)
+	}
+	for key, value := range entry.Fields {
+		payload[key] = value
+	}
+
+	s.mu.Lock()
+	if len(s.pending) >= gcpLogMaxPending {
+		s.mu.Unlock()
+		metrics.Counter("apiduct_log_entries_dropped_total", "sink", "gcp").Inc()
+		return
+	}
+	s.pending = append(s.pending, gcpLogEntry{
+		Timestamp:   entry.Time.UTC().Format(time.RFC3339Nano),
+		Severity:    entry.Severity.String(),
+		Labels:      labels,
+		JSONPayload: payload,
+	})
+	full := len(s.pending) >= gcpLogBatchSize
+	s.mu.Unlock()
+
+	if full {
+		select {
+		case s.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *gcpLogSink) run() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	defer close(s.stopped)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.flush:
+		case <-s.done:
+			s.send()
+			return
+		}
+		s.send()
+	}
+}
+
+// send writes all pending entries, one batch at a time.
+func (s *gcpLogSink) send() {
+	for {
+		s.mu.Lock()
+		n := len(s.pending)
+		if n > gcpLogBatchSize {
+			n = gcpLogBatchSize
+		}
+		batch := s.pending[:n:n]
+		s.pending = s.pending[n:]
+		s.mu.Unlock()
+
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.write(batch); err != nil {
+			sinkError("Failed to ship %d log entries to Cloud Logging: %v", len(batch), err)
+			metrics.Counter("apiduct_log_entries_dropped_total", "sink", "gcp").Add(int64(len(batch)))
+			return
+		}
+	}
+}
+
+func (s *gcpLogSink) accessToken() (string, error) {
+	if s.token != "" && time.Until(s.tokenExpiry) > time.Minute {
+		return s.token, nil
+	}
+	data, err := s.metadata.get("/instance/service-accounts/default/token")
+	if err != nil {
+		return "", fmt.Errorf("failed to get access token: %v", err)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal([]byte(data), &token); err != nil {
+		return "", fmt.Errorf("invalid access token response: %v", err)
+	}
+	s.token = token.AccessToken
+	s.tokenExpiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+func (s *gcpLogSink) write(batch []gcpLogEntry) error {
+	token, err := s.accessToken()
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"logName":  s.logName,
+		"resource": s.resource,
+		"entries":  batch,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "https://logging.googleapis.com/v2/entries:write", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("entries.write returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// Close flushes pending entries, giving up after a few seconds.
+func (s *gcpLogSink) Close() error {
+	close(s.done)
+	select {
+	case <-s.stopped:
+	case <-time.After(5 * time.Second):
+	}
+	return nil
+}
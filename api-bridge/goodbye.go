@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"net"
+
+	"apiduct/pkg/auth"
+	"apiduct/pkg/tunnel"
+)
+
+// handleGoodbye serves an offramp announcing its disconnect on a separate
+// connection. The offramp names its tunnel by the tunnel's local port. The
+// bridge stops routing to the tunnel, promotes a standby in its place if
+// there is one, waits for the requests in flight and closes it, then tells
+// the offramp it may exit.
+func handleGoodbye(conn net.Conn, pool *tunnel.Pool, logTunnel func(string, ...interface{})) {
+	port, err := auth.ReadGoodbye(conn)
+	if err != nil {
+		logTunnel("[BRIDGE] Failed to read disconnect announcement: %v", err)
+		return
+	}
+	t := pool.Find(conn.RemoteAddr(), port)
+	if t == nil {
+		logTunnel("[BRIDGE] Ignoring disconnect announcement, no matching tunnel from this host")
+		conn.Write([]byte{auth.GoodbyeUnknown})
+		return
+	}
+
+	logTunnel("[BRIDGE] Offramp is disconnecting, draining tunnel %s", t.ID)
+	idle := t.GoAway()
+	pool.Promote(t)
+
+	// The offramp closes the connection if it stops waiting
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+	select {
+	case <-idle:
+	case <-closed:
+		logTunnel("[BRIDGE] Offramp stopped waiting for the tunnel to drain")
+		return
+	}
+
+	pool.Drop(t, "offramp disconnected")
+	logTunnel("[BRIDGE] Tunnel drained and closed")
+	conn.Write([]byte{auth.GoodbyeDrained})
+}
@@ -0,0 +1,18 @@
+//go:build !noh2c
+
+package main
+
+import (
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const h2cCompiled = true
+
+// withH2C lets the plain HTTP listener accept HTTP/2 without TLS, both with
+// prior knowledge, as gRPC clients do, and as an upgrade from HTTP/1.1.
+func withH2C(handler http.Handler) http.Handler {
+	return h2c.NewHandler(handler, &http2.Server{})
+}
@@ -0,0 +1,621 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"apiduct/pkg/mux"
+	"apiduct/pkg/proxy"
+	"apiduct/pkg/tunnel"
+)
+
+// createProxyHandler returns the handler forwarding client requests through
+// the tunnels in tunnelConn, after the route's policies let them pass.
+func createProxyHandler(tunnelConn *tunnel.Pool, config *Config, captures *CaptureStore) http.Handler {
+	global := tunnel.NewLimiter(config.MaxConcurrency)
+	rateLimit := newRateLimit(config.RateLimit, config.RateBurst)
+	clientRateLimit := newRateLimit(config.ClientRateLimit, config.ClientRateBurst)
+	coalesce := newCoalescer(config.CoalesceWindow, config.CoalesceMaxBody)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := matchRoute(live.Routes(), r)
+		priority := isPriority(r, config.PriorityPaths)
+		requestID := requestIDFor(r.Header)
+		r.Header.Del(requestIDHeader)
+		w.Header().Set(requestIDHeader, requestID)
+		logRequest := func(format string, args ...interface{}) {
+			logFields(map[string]string{"request_id": requestID, "route": routeLabel(route)}, format, args...)
+		}
+		requestLog := logger.With("request_id", requestID, "route", routeLabel(route))
+		setClientSubject(r)
+		setTLSHeaders(r, config.ForwardTLSHeaders)
+		setForwardedHeaders(r, config)
+
+		// Upgraded connections are taken over from the server's own writer
+		upgrade := proxy.IsWebSocket(r)
+		conn := w
+
+		// Count requests per route and status class
+		sw := &statusWriter{ResponseWriter: w}
+		w = sw
+		inFlight := metrics.Gauge("apiduct_requests_in_flight")
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+		requestBody := &proxy.CountingReader{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = requestBody
+		}
+		defer func() {
+			requestLog.Info(fmt.Sprintf("Completed %s %s with %d", r.Method, r.URL.Path, sw.status), "status", sw.status, "duration", time.Since(start))
+			journal.Record(JournalEntry{
+				Time:          start.UTC(),
+				RequestID:     requestID,
+				Method:        r.Method,
+				Host:          r.Host,
+				Path:          r.URL.Path,
+				Route:         routeLabel(route),
+				ClientIP:      clientIP(r),
+				ClientSubject: r.Header.Get(clientSubjectHeader),
+				Status:        sw.status,
+				RequestBytes:  requestBody.N,
+				ResponseBytes: sw.bytes,
+				DurationMs:    time.Since(start).Milliseconds(),
+			})
+			logAccess(r, route, requestID, sw.status, sw.bytes, time.Since(start))
+			metrics.Counter("apiduct_requests_total", "route", routeLabel(route), "code", statusClass(sw.status)).Inc()
+			metrics.Counter("apiduct_request_bytes_total", "route", routeLabel(route)).Add(requestBody.N)
+			metrics.Counter("apiduct_response_bytes_total", "route", routeLabel(route)).Add(sw.bytes)
+			if route == nil {
+				return
+			}
+			if route.Quota != nil {
+				quotas.AddBytes(route, requestBody.N+sw.bytes)
+			}
+			if route.RequestBytes.warns(requestBody.N) {
+				warnLimit(route, "request_bytes", false, "request body of %d bytes on route %s exceeds warning threshold of %d bytes",
+					requestBody.N, route.Name, route.RequestBytes.Warn)
+			}
+			if route.ResponseBytes.warns(sw.bytes) {
+				warnLimit(route, "response_bytes", false, "response body of %d bytes on route %s exceeds warning threshold of %d bytes",
+					sw.bytes, route.Name, route.ResponseBytes.Warn)
+			}
+		}()
+
+		// Capture the exchange for the inspector
+		var exchange *Exchange
+		if captures != nil {
+			w, exchange = captures.Begin(w, r)
+			defer captures.Finish(exchange, route)
+		}
+
+		// Answer from recorded responses while the tunnel is down
+		serveOffline := func() bool {
+			if captures == nil {
+				return false
+			}
+			recorded := captures.Recorded(exchange)
+			if recorded == nil {
+				return false
+			}
+			logRequest("[BRIDGE] Serving recorded response for %s %s", r.Method, r.RequestURI)
+			metrics.Counter("apiduct_offline_responses_total").Inc()
+			serveRecorded(w, r, recorded)
+			return true
+		}
+
+		// Keep out clients the route or the bridge does not admit
+		if policy := accessPolicy(route, config.Access); policy != nil && !internalRequest(r) {
+			switch reason := policy.check(r); reason {
+			case accessDeniedAddress:
+				metrics.Counter("apiduct_access_denied_total", "route", routeLabel(route), "reason", reason).Inc()
+				if policy.DenyAction == denyActionTarpit && tarpits.hold(w, r) {
+					logRequest("[BRIDGE] Tarpitted %s %s from %s, address not allowed", r.Method, r.URL.Path, clientIP(r))
+					metrics.Counter("apiduct_tarpitted_requests_total", "route", routeLabel(route)).Inc()
+					return
+				}
+				logRequest("[BRIDGE] Rejected %s %s from %s, address not allowed", r.Method, r.URL.Path, clientIP(r))
+				writeError(w, http.StatusForbidden, errCodeAccessDenied, "Access denied")
+				return
+			case accessDeniedCredentials:
+				logRequest("[BRIDGE] Rejected %s %s from %s, missing or wrong credentials", r.Method, r.URL.Path, clientIP(r))
+				metrics.Counter("apiduct_access_denied_total", "route", routeLabel(route), "reason", reason).Inc()
+				policy.challenge(w)
+				writeError(w, http.StatusUnauthorized, errCodeUnauthorized, "Authentication required")
+				return
+			}
+		}
+
+		// Serve the incident page while the duct is severed
+		if emergency.serve(w) {
+			logRequest("[BRIDGE] Rejected %s %s, kill switch is engaged", r.Method, r.URL.Path)
+			return
+		}
+
+		// Turn requests away while draining for maintenance
+		if !maintenance.begin() {
+			logRequest("[BRIDGE] Rejected %s %s, bridge is draining", r.Method, r.URL.Path)
+			rejectDraining(w, r, config.DrainRedirect)
+			return
+		}
+		defer maintenance.end()
+
+		// Refuse access outside the route's or the client's time windows
+		if subject, schedule := outsideSchedule(r, route, live.ClientSchedules(), time.Now()); schedule != nil {
+			logRequest("[BRIDGE] Rejected %s %s, %s is only available %s", r.Method, r.URL.Path, subject, schedule)
+			metrics.Counter("apiduct_schedule_rejected_total", "route", routeLabel(route)).Inc()
+			writeError(w, http.StatusForbidden, errCodeOutsideSchedule, fmt.Sprintf("Access is only allowed %s", schedule))
+			return
+		}
+
+		// Answer static routes and redirects without the tunnel
+		if serveLocal(w, r, route) {
+			return
+		}
+
+		// Enforce the route's request content type policy and the size
+		// limit before the request counts against a limit or takes a tunnel
+		if route != nil && route.RequestContentTypes != nil && !checkRequestContentType(r, route.RequestContentTypes) {
+			mediaType := mediaTypeOf(r.Header.Get("Content-Type"))
+			logRequest("[BRIDGE] Rejected request content type %q for route %s", mediaType, route.Name)
+			metrics.Counter("apiduct_content_type_blocked_total", "route", route.Name, "direction", "request").Inc()
+			writeError(w, http.StatusUnsupportedMediaType, errCodeContentTypeBlocked, fmt.Sprintf("Content type %q is not allowed on this route", mediaType))
+			return
+		}
+
+		// Enforce the request size limit
+		maxRequest := requestLimit(config, route)
+		requestTooLarge := func() {
+			logRequest("[BRIDGE] Request body exceeds limit of %d bytes for route %s", maxRequest, routeLabel(route))
+			metrics.Counter("apiduct_request_size_exceeded_total", "route", routeLabel(route)).Inc()
+			writeError(w, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "Request body too large")
+		}
+		ok, requestCap := limitRequestBody(r, maxRequest)
+		if !ok {
+			requestTooLarge()
+			return
+		}
+
+		// Reject requests that do not match the OpenAPI spec before they
+		// count against a limit or take a tunnel. Buffering the body for
+		// validation is bounded, also while a read waits on a stalled client
+		if config.OpenAPI != nil {
+			liftDeadline := limitRequestInspection(conn)
+			problems := config.OpenAPI.ValidateRequest(r)
+			liftDeadline()
+			if requestCap.exceeded() {
+				requestTooLarge()
+				return
+			}
+			if len(problems) > 0 {
+				logRequest("[BRIDGE] Request %s %s failed OpenAPI validation: %s", r.Method, r.URL.Path, strings.Join(problems, "; "))
+				metrics.Counter("apiduct_openapi_rejected_total").Inc()
+				writeErrorDetails(w, http.StatusBadRequest, errCodeInvalidRequest, "request does not match the API specification", problems)
+				return
+			}
+		}
+
+		// Share one tunnel request between identical GETs. Only the leader
+		// goes on to take a rate limit token, a concurrency slot and a tunnel,
+		// the others wait for its response without holding any
+		if coalesce != nil && coalescable(r) {
+			key := coalesceKey(r)
+			call, leader := coalesce.join(key, r.Header)
+			if !leader {
+				if shared := call.wait(r.Context(), r.Header); shared != nil {
+					logRequest("[BRIDGE] Serving coalesced response for %s %s", r.Method, r.URL.Path)
+					metrics.Counter("apiduct_coalesced_requests_total", "route", routeLabel(route)).Inc()
+					serveCoalesced(w, shared)
+					return
+				}
+				// Nothing to share, forward the request on its own
+			} else {
+				recorder := newCoalesceRecorder(w, coalesce.maxBody)
+				w = recorder
+				defer func() {
+					if p := recover(); p != nil {
+						coalesce.finish(key, call, nil)
+						panic(p)
+					}
+					coalesce.finish(key, call, recorder.result())
+				}()
+			}
+		}
+
+		// Throttle clients sending requests faster than the rate limits. The
+		// bridge-wide limit is shared with data traffic, so the priority lane
+		// is exempt from it
+		sharedRateLimit := rateLimit
+		if priority {
+			sharedRateLimit = nil
+		}
+		if limit, wait := rateLimited(r, route, sharedRateLimit, clientRateLimit); limit != "" {
+			logRequest("[BRIDGE] Rate limited %s %s from %s, %s limit exceeded", r.Method, r.URL.Path, clientIP(r), limit)
+			metrics.Counter("apiduct_rate_limited_total", "route", routeLabel(route), "limit", limit).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, errCodeRateLimited, "Rate limit exceeded")
+			return
+		}
+
+		// Enforce the route's quota for the current period
+		if route != nil && route.Quota != nil {
+			if ok, retryAfter := quotas.Admit(route); !ok {
+				logRequest("[BRIDGE] Quota of route %s exhausted for this %s", route.Name, route.Quota.Period)
+				metrics.Counter("apiduct_quota_exceeded_total", "route", route.Name).Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+				writeError(w, http.StatusTooManyRequests, errCodeQuotaExceeded, "Quota exceeded")
+				return
+			}
+		}
+
+		// Send the requests of a FIFO route one at a time, in arrival order.
+		// The turn passes on once the target answered. Requests wait for
+		// their turn before they take a concurrency slot, so a backlog on
+		// one route does not hold the slots of the others
+		passTurn, ok := fifoLineFor(route).wait(r.Context())
+		if !ok {
+			logRequest("[BRIDGE] Client gave up on %s %s while it waited for its turn on route %s", r.Method, r.URL.Path, route.Name)
+			writeError(w, statusClientClosed, errCodeClientClosed, "Client closed the request")
+			return
+		}
+		defer passTurn()
+
+		// Limit the requests in flight, across the bridge and per tunnel,
+		// apart from those on the priority lane
+		inFlightLimit := global
+		if priority {
+			inFlightLimit = nil
+		}
+		if !inFlightLimit.TryAcquire() {
+			logRequest("[BRIDGE] Rejected request, %d requests already in flight", config.MaxConcurrency)
+			metrics.Counter("apiduct_concurrency_rejected_total", "limit", "global").Inc()
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusTooManyRequests, errCodeTooManyRequests, "Too many concurrent requests")
+			return
+		}
+		defer inFlightLimit.Release()
+
+		// Pick a tunnel, each carrying a limited number of requests
+		unavailable := func(reason string) {
+			if serveOffline() {
+				return
+			}
+			logRequest("[BRIDGE] %s", reason)
+			writeError(w, http.StatusServiceUnavailable, errCodeTunnelDown, "Tunnel connection not available")
+		}
+		offramp := ""
+		if route != nil {
+			offramp = route.Offramp
+		}
+		// Only tunnels whose identity the offramp policy lets serve the route
+		policy := live.OfframpPolicy()
+		allowed := func(t *tunnel.Tunnel) bool { return policy.allows(t.Identity, route) }
+		tun, err := tunnelConn.Pick(offramp, allowed, priority)
+		switch err {
+		case nil:
+		case tunnel.ErrBusy:
+			if config.AdaptiveConcurrency {
+				logRequest("[BRIDGE] Rejected request, every tunnel is at its adaptive concurrency limit")
+			} else {
+				logRequest("[BRIDGE] Rejected request, every tunnel already carries %d requests", config.TunnelMaxConcurrency)
+			}
+			metrics.Counter("apiduct_concurrency_rejected_total", "limit", "tunnel").Inc()
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, errCodeTunnelBusy, "Tunnel is busy")
+			return
+		case tunnel.ErrDrained:
+			unavailable("Tunnel is draining, offramp is disconnecting")
+			return
+		default:
+			unavailable("Tunnel connection not available")
+			return
+		}
+		defer func() { tun.Release(priority) }()
+
+		// Bound buffering the body for redaction and transformation, also
+		// while a read waits on a stalled client
+		liftDeadline := func() {}
+		if route != nil && (route.RedactRequest != nil || route.RequestTransform != nil) {
+			liftDeadline = limitRequestInspection(conn)
+		}
+
+		// Redact sensitive request fields before anything else sees them
+		if route != nil && route.RedactRequest != nil {
+			if err := redactRequest(r, route.RedactRequest); err != nil {
+				logRequest("[BRIDGE] Failed to redact request for route %s: %v", route.Name, err)
+				writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Failed to process request")
+				return
+			}
+		}
+
+		// Apply route-specific request transformation
+		if route != nil && route.RequestTransform != nil {
+			if err := transformRequest(r, route.RequestTransform); err != nil {
+				logRequest("[BRIDGE] Failed to transform request for route %s: %v", route.Name, err)
+				writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Failed to transform request")
+				return
+			}
+		}
+		liftDeadline()
+
+		// Rewrite the path to the one the target serves
+		if route != nil && route.Rewrite != nil {
+			from := r.URL.EscapedPath()
+			if err := route.Rewrite.Apply(r.URL); err != nil {
+				logRequest("[BRIDGE] Failed to rewrite path %s for route %s: %v", from, route.Name, err)
+				writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Failed to rewrite request path")
+				return
+			}
+			requestLog.Debug(fmt.Sprintf("Rewrote path %s to %s", from, r.URL.EscapedPath()))
+		}
+
+		// Forward the request through the tunnel. An idempotent request lost
+		// because its tunnel closed or went away, as when the offramp
+		// replaces it, is sent again on another instead of failing
+		if exchange != nil {
+			exchange.CaptureRequestBody(r)
+		}
+		r.Header.Set(proxy.TraceHeader, requestID)
+		if config.ServerTiming {
+			r.Header.Set(proxy.TimingHeader, "1")
+		} else {
+			r.Header.Del(proxy.TimingHeader)
+		}
+		duplex := proxy.IsGRPC(r)
+
+		// Give up on a request the offramp does not answer in time, so it
+		// frees its stream and concurrency slot. gRPC calls are exempt, they
+		// may only answer once the client is done sending.
+		timeout := requestTimeout(config, route)
+		if duplex {
+			timeout = 0
+		}
+		var (
+			stream       *mux.Stream
+			streamReader *proxy.Reader
+			resp         *http.Response
+			servedBy     string
+			forwarded    time.Time
+		)
+		timedOut := func() {
+			logRequest("[BRIDGE] No response from tunnel within %s, resetting stream", timeout)
+			metrics.Counter("apiduct_request_timeouts_total", "route", routeLabel(route)).Inc()
+			stream.Reset()
+			tun.TimedOut()
+			writeError(w, http.StatusGatewayTimeout, errCodeTunnelTimeout, "Timed out waiting for a response")
+		}
+
+		// checksumFailed aborts a response whose bytes were damaged on the
+		// way, or whose request was, which the offramp answers by resetting
+		// the stream
+		checksumFailed := func(err error) {
+			logEvent("checksum_mismatch", map[string]string{"tunnel": tun.Addr, "tunnel_id": tun.ID, "request_id": requestID},
+				"[BRIDGE] Response from tunnel %s failed verification, aborting it: %v", tun.Addr, err)
+			tunnelConn.Failed(tun)
+			stream.Reset()
+			panic(http.ErrAbortHandler)
+		}
+
+		// retry moves a request lost with err to a replacement tunnel,
+		// reporting whether it is to be sent again
+		retries := config.TunnelRetries
+		if upgrade || duplex || !tunnel.Replayable(r) {
+			retries = 0
+		}
+		retry := func(err error) bool {
+			if !tunnel.Lost(tun, err) {
+				return false
+			}
+			if retries == 0 {
+				metrics.Counter("apiduct_tunnel_lost_requests_total", "route", routeLabel(route), "action", "failed").Inc()
+				return false
+			}
+			retries--
+			next, pickErr := tunnelConn.PickReplacement(r.Context(), tun, offramp, allowed, priority, config.TunnelRetryWait)
+			if pickErr != nil {
+				logRequest("[BRIDGE] Request lost with tunnel %s and no tunnel to retry it on: %v", tun.Addr, pickErr)
+				metrics.Counter("apiduct_tunnel_lost_requests_total", "route", routeLabel(route), "action", "failed").Inc()
+				return false
+			}
+			logRequest("[BRIDGE] Request lost with tunnel %s (%v), retrying on tunnel %s", tun.Addr, err, next.Addr)
+			metrics.Counter("apiduct_tunnel_lost_requests_total", "route", routeLabel(route), "action", "retried").Inc()
+			tun.Release(priority)
+			tun = next
+			return true
+		}
+
+		for {
+			servedBy = ""
+			if config.TunnelHeader {
+				servedBy = tun.Describe()
+			}
+			logRequest("[BRIDGE] Forwarding request to tunnel: %s %s", r.Method, r.URL.Path)
+			traceWire(requestLog, "Request to tunnel", fmt.Sprintf("%s %s %s", r.Method, r.URL.RequestURI(), r.Proto), r.Header)
+			forwarded = time.Now()
+			sent, err := tun.Send(r, priority, duplex, upgrade, timeout)
+			if sent != nil {
+				stream, streamReader, resp = sent.Stream, sent.Reader, sent.Response
+			}
+			if err == nil {
+				break
+			}
+			var sendErr *tunnel.SendError
+			errors.As(err, &sendErr)
+			if sendErr.Op != "open" {
+				if isTimeout(err) {
+					timedOut()
+					return
+				}
+				if requestCap.exceeded() {
+					// A duplex request's body may cross the limit and reset
+					// the stream before the response arrives
+					requestTooLarge()
+					return
+				}
+			}
+			if retry(err) {
+				continue
+			}
+			tunnelConn.Failed(tun)
+			switch sendErr.Op {
+			case "open":
+				unavailable(fmt.Sprintf("Failed to open tunnel stream: %v", sendErr.Err))
+				return
+			case "write":
+				logRequest("[BRIDGE] Failed to forward request through tunnel: %v", sendErr.Err)
+				if serveOffline() {
+					return
+				}
+				writeError(w, http.StatusBadGateway, errCodeTunnelError, "Failed to forward request")
+			default:
+				logRequest("[BRIDGE] Failed to read response from tunnel: %v", sendErr.Err)
+				if serveOffline() {
+					return
+				}
+				writeError(w, http.StatusBadGateway, errCodeTunnelError, "Failed to read response")
+			}
+			return
+		}
+		defer resp.Body.Close()
+		stream.SetDeadline(time.Time{})
+		roundTrip := time.Since(forwarded)
+		reportedTiming := resp.Header.Get(proxy.TimingHeader)
+		resp.Header.Del(proxy.TimingHeader)
+		tun.Succeeded()
+		markSuccess()
+		passTurn()
+		if !priority {
+			// Health checks answer faster than the data requests the
+			// limit is for
+			tun.Observe(roundTrip)
+		}
+		traceWire(requestLog, "Response from tunnel", resp.Proto+" "+resp.Status, resp.Header)
+
+		// Relay WebSocket frames once the target switched protocols
+		if upgrade {
+			if resp.StatusCode == http.StatusSwitchingProtocols {
+				logRequest("[BRIDGE] Upgraded to WebSocket: %s", r.URL.Path)
+				sw.status = resp.StatusCode
+				resp.Header.Set(requestIDHeader, requestID)
+				if err := serveUpgraded(conn, resp, stream, streamReader.Reader); err != nil {
+					logRequest("[BRIDGE] Failed to take over WebSocket connection: %v", err)
+				}
+				return
+			}
+			stream.Close()
+		}
+
+		// Enforce the route's response content type policy
+		if route != nil && route.ResponseContentTypes != nil && !checkResponseContentType(resp, route.ResponseContentTypes) {
+			mediaType := mediaTypeOf(resp.Header.Get("Content-Type"))
+			logRequest("[BRIDGE] Blocked response content type %q for route %s", mediaType, route.Name)
+			metrics.Counter("apiduct_content_type_blocked_total", "route", route.Name, "direction", "response").Inc()
+			writeError(w, http.StatusBadGateway, errCodeContentTypeBlocked, fmt.Sprintf("Upstream content type %q is not allowed on this route", mediaType))
+			return
+		}
+
+		// Bound buffering the response body for redaction and
+		// transformation, also while a read waits on a stalled target
+		if route != nil && (route.RedactResponse != nil || route.ResponseTransform != nil) {
+			stream.SetReadDeadline(time.Now().Add(inspectTimeout))
+		}
+
+		// Redact sensitive response fields before they leave the bridge
+		if route != nil && route.RedactResponse != nil {
+			if err := redactResponse(resp, route.RedactResponse); err != nil {
+				logRequest("[BRIDGE] Failed to redact response for route %s: %v", route.Name, err)
+				writeError(w, http.StatusBadGateway, errCodeInvalidResponse, "Failed to process response")
+				return
+			}
+		}
+
+		// Apply route-specific response transformation
+		if route != nil && route.ResponseTransform != nil {
+			if err := transformResponse(resp, r, route.ResponseTransform); err != nil {
+				logRequest("[BRIDGE] Failed to transform response for route %s: %v", route.Name, err)
+				writeError(w, http.StatusBadGateway, errCodeInvalidResponse, "Failed to transform response")
+				return
+			}
+		}
+
+		stream.SetReadDeadline(time.Time{})
+
+		// Refuse responses that announce a size above the limit
+		maxResponse := responseLimit(config, route)
+		if maxResponse > 0 && resp.ContentLength > maxResponse {
+			logRequest("[BRIDGE] Response of %d bytes exceeds limit of %d bytes for route %s, dropping tunnel stream", resp.ContentLength, maxResponse, routeLabel(route))
+			metrics.Counter("apiduct_response_size_exceeded_total", "route", routeLabel(route)).Inc()
+			stream.Reset()
+			writeError(w, http.StatusBadGateway, errCodeBodyTooLarge, "Response size limit exceeded")
+			return
+		}
+
+		// Copy response headers
+		logRequest("[BRIDGE] Forwarding response to client: %s", resp.Status)
+		for key, values := range resp.Header {
+			for _, value := range values {
+				w.Header().Add(key, value)
+			}
+		}
+		if servedBy != "" {
+			w.Header().Set(tunnelHeader, servedBy)
+		}
+		if config.ServerTiming {
+			w.Header().Add("Server-Timing", proxy.ServerTiming(roundTrip, reportedTiming))
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		w.WriteHeader(resp.StatusCode)
+
+		// Copy response body, flushing streams as they arrive
+		var body io.Reader = resp.Body
+		if maxResponse > 0 {
+			body = newCappedReader(resp.Body, maxResponse, errResponseTooLarge)
+		}
+		out := responseWriterFor(w, resp)
+		if streamed, ok := out.(*flushWriter); ok {
+			// Send the headers at once, a gRPC client may wait for them
+			// before it sends the messages the body answers
+			streamed.flusher.Flush()
+		}
+		var held *tailWriter
+		if _, streamed := out.(*flushWriter); config.TunnelChecksums && !streamed {
+			held = &tailWriter{w: out}
+			out = held
+		}
+		if _, err := io.Copy(out, body); err != nil {
+			if errors.Is(err, errResponseTooLarge) {
+				// Headers are already sent, so the only option left is to
+				// cut both the client and the tunnel stream short
+				logRequest("[BRIDGE] Response exceeded limit of %d bytes for route %s, terminating transfer", maxResponse, routeLabel(route))
+				metrics.Counter("apiduct_response_size_exceeded_total", "route", routeLabel(route)).Inc()
+				stream.Reset()
+				panic(http.ErrAbortHandler)
+			}
+			if errors.Is(err, mux.ErrChecksumMismatch) {
+				checksumFailed(err)
+			}
+			logRequest("[BRIDGE] Failed to copy response body: %v", err)
+			return
+		}
+		if config.TunnelChecksums {
+			stream.SetReadDeadline(time.Now().Add(checksumWait))
+			// A response whose checksum did not arrive in time is no more
+			// trusted than one that failed it
+			if err := stream.Verify(); err != nil {
+				checksumFailed(err)
+			}
+		}
+		if held != nil {
+			if err := held.release(); err != nil {
+				logRequest("[BRIDGE] Failed to copy response body: %v", err)
+				return
+			}
+		}
+		proxy.CopyTrailers(w, resp)
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"apiduct/pkg/tunnel"
+)
+
+// lastSuccess is when a response last came back through a tunnel, in Unix
+// nanoseconds, 0 if none has yet.
+var lastSuccess atomic.Int64
+
+func markSuccess() {
+	lastSuccess.Store(time.Now().UnixNano())
+}
+
+// HealthReport is the body of /healthz and /readyz.
+type HealthReport struct {
+	Status      string     `json:"status"` // ok or unavailable
+	Tunnels     int        `json:"tunnels"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	Problems    []string   `json:"problems,omitempty"`
+}
+
+// health reports on the duct. The bridge is live once its listeners are
+// bound, and ready while it also has a tunnel, is not draining and its kill
+// switch is not engaged.
+func health(tunnels *tunnel.Pool, readiness bool) HealthReport {
+	report := HealthReport{Status: "ok", Tunnels: tunnels.Len()}
+	if nanos := lastSuccess.Load(); nanos != 0 {
+		last := time.Unix(0, nanos).UTC()
+		report.LastSuccess = &last
+	}
+	if !isReady() {
+		report.Problems = append(report.Problems, "listeners not bound yet")
+	}
+	if readiness {
+		if report.Tunnels == 0 {
+			report.Problems = append(report.Problems, "no tunnel connected")
+		}
+		if maintenance.isDraining() {
+			report.Problems = append(report.Problems, "draining")
+		}
+		if emergency.isEngaged() {
+			report.Problems = append(report.Problems, "kill switch engaged")
+		}
+	}
+	if len(report.Problems) > 0 {
+		report.Status = "unavailable"
+	}
+	return report
+}
+
+// handleHealth answers liveness probes on /healthz, or readiness probes on
+// /readyz if readiness is set, with 503 while the bridge is not healthy.
+func handleHealth(tunnels *tunnel.Pool, readiness bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := health(tunnels, readiness)
+		if report.Status != "ok" {
+			writeJSON(w, http.StatusServiceUnavailable, report)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// initOptions are the answers of the setup wizard.
+type initOptions struct {
+	Output     string
+	PSK        string
+	ListenHost string
+	ListenPort int
+	TunnelPort int
+	BridgeHost string
+	TargetHost string
+	TargetPort int
+	SelfSigned bool
+	CertDir    string
+	Yes        bool
+	Force      bool
+}
+
+func newInitCommand() *cobra.Command {
+	opts := &initOptions{}
+	cmd := &cobra.Command{
+		Use:   "init [flags]",
+		Short: "Generate a config file, PSK and certificates for a new setup",
+		Long: "init asks for the listener ports, the bridge's public host and the target\n" +
+			"API, then writes a config file with a random PSK and prints the matching\n" +
+			"api-bridge and api-offramp command lines. Values given as flags are not\n" +
+			"asked for; with --yes the defaults are used for the rest.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runInit(cmd, opts, os.Stdin, cmd.OutOrStdout())
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVarP(&opts.Output, "output", "o", "apiduct.json", "Config file to write")
+	flags.StringVar(&opts.PSK, "psk", "", "Pre-shared key to use instead of a generated one")
+	flags.StringVar(&opts.ListenHost, "listen-host", "0.0.0.0", "IP address the bridge listens on")
+	flags.IntVar(&opts.ListenPort, "listen-port", 8000, "Port for client requests")
+	flags.IntVar(&opts.TunnelPort, "tunnel-port", 8001, "Port for tunnel connections")
+	flags.StringVar(&opts.BridgeHost, "bridge-host", "", "Host name or IP address the offramp connects to (defaults to this host's name)")
+	flags.StringVar(&opts.TargetHost, "target-host", "localhost", "Target API host as seen from the offramp")
+	flags.IntVar(&opts.TargetPort, "target-port", 8080, "Target API port")
+	flags.BoolVar(&opts.SelfSigned, "self-signed", false, "Generate a self-signed certificate and serve HTTPS with it")
+	flags.StringVar(&opts.CertDir, "cert-dir", ".", "Directory for the generated certificate and key")
+	flags.BoolVarP(&opts.Yes, "yes", "y", false, "Do not ask, use defaults for values not given as flags")
+	flags.BoolVar(&opts.Force, "force", false, "Overwrite existing files")
+	cmd.MarkFlagFilename("output", "json")
+	cmd.MarkFlagDirname("cert-dir")
+	return cmd
+}
+
+// initPrompter asks for values on the terminal, keeping the default when the
+// answer is empty.
+type initPrompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func (p *initPrompter) ask(question, def string) (string, error) {
+	fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	answer, err := p.in.ReadString('\n')
+	if err != nil && (err != io.EOF || answer == "") {
+		return "", err
+	}
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+func (p *initPrompter) askString(value *string, question string) error {
+	answer, err := p.ask(question, *value)
+	if err != nil {
+		return err
+	}
+	*value = answer
+	return nil
+}
+
+func (p *initPrompter) askInt(value *int, question string) error {
+	for {
+		answer, err := p.ask(question, strconv.Itoa(*value))
+		if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(answer)
+		if err == nil && n > 0 && n < 65536 {
+			*value = n
+			return nil
+		}
+		fmt.Fprintf(p.out, "Please enter a port number.\n")
+	}
+}
+
+func (p *initPrompter) askBool(value *bool, question string) error {
+	def := "n"
+	if *value {
+		def = "y"
+	}
+	answer, err := p.ask(question+" (y/n)", def)
+	if err != nil {
+		return err
+	}
+	*value = strings.HasPrefix(strings.ToLower(answer), "y")
+	return nil
+}
+
+// runInit asks for the values not given as flags, then writes the files.
+func runInit(cmd *cobra.Command, opts *initOptions, in io.Reader, out io.Writer) error {
+	if opts.BridgeHost == "" {
+		opts.BridgeHost, _ = os.Hostname()
+	}
+
+	interactive := !opts.Yes
+	if f, ok := in.(*os.File); ok && interactive {
+		if info, err := f.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			interactive = false
+		}
+	}
+	if interactive {
+		p := &initPrompter{in: bufio.NewReader(in), out: out}
+		questions := []struct {
+			flag string
+			ask  func() error
+		}{
+			{"output", func() error { return p.askString(&opts.Output, "Config file") }},
+			{"listen-host", func() error { return p.askString(&opts.ListenHost, "Bridge listen address") }},
+			{"listen-port", func() error { return p.askInt(&opts.ListenPort, "Port for client requests") }},
+			{"tunnel-port", func() error { return p.askInt(&opts.TunnelPort, "Port for tunnel connections") }},
+			{"bridge-host", func() error { return p.askString(&opts.BridgeHost, "Host the offramp connects to") }},
+			{"target-host", func() error { return p.askString(&opts.TargetHost, "Target API host, as seen from the offramp") }},
+			{"target-port", func() error { return p.askInt(&opts.TargetPort, "Target API port") }},
+			{"self-signed", func() error { return p.askBool(&opts.SelfSigned, "Serve HTTPS with a self-signed certificate") }},
+		}
+		for _, q := range questions {
+			if cmd.Flags().Changed(q.flag) {
+				continue
+			}
+			if err := q.ask(); err != nil {
+				return fmt.Errorf("failed to read answer: %v", err)
+			}
+		}
+	}
+
+	if opts.PSK == "" {
+		psk, err := generatePSK()
+		if err != nil {
+			return err
+		}
+		opts.PSK = psk
+	}
+
+	settings := map[string]interface{}{
+		"listen-host": opts.ListenHost,
+		"listen-port": opts.ListenPort,
+		"tunnel-port": opts.TunnelPort,
+		"psk":         opts.PSK,
+	}
+	files := []string{opts.Output}
+	if err := checkOverwrite(opts.Force, opts.Output); err != nil {
+		return err
+	}
+	if opts.SelfSigned {
+		// Absolute paths, so the config works from any directory
+		certDir, err := filepath.Abs(opts.CertDir)
+		if err != nil {
+			return fmt.Errorf("invalid certificate directory: %v", err)
+		}
+		certFile := filepath.Join(certDir, "apiduct-cert.pem")
+		keyFile := filepath.Join(certDir, "apiduct-key.pem")
+		if err := checkOverwrite(opts.Force, certFile, keyFile); err != nil {
+			return err
+		}
+		if err := writeSelfSignedCert(certFile, keyFile, opts.BridgeHost); err != nil {
+			return err
+		}
+		settings["https"] = true
+		settings["tls-cert-file"] = certFile
+		settings["tls-key-file"] = keyFile
+		files = append(files, certFile, keyFile)
+	}
+
+	fileConfig := &FileConfig{
+		Settings: settings,
+		Routes:   []*Route{{Name: "default", PathPrefix: "/"}},
+	}
+	data, err := json.MarshalIndent(fileConfig, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %v", err)
+	}
+	// The file holds the PSK, so only the owner may read it
+	if err := os.WriteFile(opts.Output, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write config file: %v", err)
+	}
+
+	scheme := "http"
+	if opts.SelfSigned {
+		scheme = "https"
+	}
+	fmt.Fprintf(out, "\nWrote %s\n\n", strings.Join(files, ", "))
+	fmt.Fprintf(out, "Start the bridge:\n  api-bridge --config %s\n\n", opts.Output)
+	fmt.Fprintf(out, "Start the offramp next to the target API:\n  api-offramp --bridge-host %s --bridge-port %d --psk '%s' --target-host %s --target-port %d\n\n",
+		opts.BridgeHost, opts.TunnelPort, opts.PSK, opts.TargetHost, opts.TargetPort)
+	fmt.Fprintf(out, "Clients then send requests to %s://%s/\n", scheme, net.JoinHostPort(opts.BridgeHost, strconv.Itoa(opts.ListenPort)))
+	return nil
+}
+
+// generatePSK returns 32 random bytes, base64url encoded.
+func generatePSK() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate PSK: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+func checkOverwrite(force bool, paths ...string) error {
+	if force {
+		return nil
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%s already exists, use --force to overwrite it", path)
+		}
+	}
+	return nil
+}
+
+// writeSelfSignedCert creates an ECDSA certificate valid for a year for host
+// and localhost.
+func writeSelfSignedCert(certFile, keyFile, host string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("failed to generate serial number: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host, Organization: []string{"apiduct"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	} else if host != "" && host != "localhost" {
+		template.DNSNames = append(template.DNSNames, host)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode key: %v", err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return fmt.Errorf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return fmt.Errorf("failed to write key: %v", err)
+	}
+	return nil
+}
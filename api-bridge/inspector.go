@@ -0,0 +1,82 @@
+//go:build !noinspector
+
+package main
+
+const inspectorCompiled = true
+
+// inspectorPage is the single-page request inspector served on the admin
+// listener. It polls the JSON API and renders captured exchanges.
+const inspectorPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>apiduct inspector</title>
+<style>
+body { font-family: sans-serif; margin: 0; display: flex; height: 100vh; }
+#list { width: 40%; overflow-y: auto; border-right: 1px solid #ccc; }
+#detail { flex: 1; overflow-y: auto; padding: 0 1em; }
+#search { width: 100%; box-sizing: border-box; padding: .5em; border: 0; border-bottom: 1px solid #ccc; }
+.row { padding: .4em .6em; border-bottom: 1px solid #eee; cursor: pointer; font-family: monospace; }
+.row:hover, .row.selected { background: #eef; }
+.status-2 { color: #080; } .status-3 { color: #06c; } .status-4 { color: #c60; } .status-5 { color: #c00; }
+pre { background: #f6f6f6; padding: .5em; white-space: pre-wrap; word-break: break-all; }
+</style>
+</head>
+<body>
+<div id="list"><input id="search" placeholder="Search method, path, status, headers or bodies"><div id="rows"></div></div>
+<div id="detail"><p>Select a request.</p></div>
+<script>
+let selected = null;
+
+function esc(s) {
+  return String(s).replace(/[&<>"]/g, c => ({'&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;'}[c]));
+}
+
+function headers(h) {
+  return Object.keys(h || {}).sort().map(k => h[k].map(v => esc(k) + ': ' + esc(v)).join('\n')).join('\n');
+}
+
+function body(m) {
+  let text = m.body;
+  try { text = JSON.stringify(JSON.parse(text), null, 2); } catch (e) {}
+  return esc(text) + (m.body_truncated ? '\n[truncated]' : '');
+}
+
+async function refresh() {
+  const q = document.getElementById('search').value;
+  const res = await fetch('/api/requests?q=' + encodeURIComponent(q));
+  const items = await res.json();
+  document.getElementById('rows').innerHTML = items.map(e =>
+    '<div class="row' + (e.id === selected ? ' selected' : '') + '" onclick="show(' + e.id + ')">' +
+    '<span class="status-' + String(e.response.status)[0] + '">' + e.response.status + '</span> ' +
+    esc(e.request.method) + ' ' + esc(e.request.uri) + ' <small>' + e.duration_ms.toFixed(1) + 'ms' +
+    (e.replay_of ? ' (replay of #' + e.replay_of + ')' : '') + '</small></div>').join('');
+}
+
+async function show(id) {
+  selected = id;
+  const res = await fetch('/api/requests/' + id);
+  const e = await res.json();
+  document.getElementById('detail').innerHTML =
+    '<h3>#' + e.id + ' ' + esc(e.request.method) + ' ' + esc(e.request.uri) + '</h3>' +
+    '<p>' + esc(e.time) + ' from ' + esc(e.remote_addr) + (e.route ? ' via route ' + esc(e.route) : '') +
+    ' <button onclick="replay(' + e.id + ')">Replay</button></p>' +
+    '<h4>Request</h4><pre>' + headers(e.request.header) + '</pre><pre>' + body(e.request) + '</pre>' +
+    '<h4>Response ' + e.response.status + '</h4><pre>' + headers(e.response.header) + '</pre><pre>' + body(e.response) + '</pre>';
+  refresh();
+}
+
+async function replay(id) {
+  const res = await fetch('/api/requests/' + id + '/replay', {method: 'POST', headers: {'X-Apiduct-Admin': '1'}});
+  const r = await res.json();
+  if (r.error) { alert(r.error); }
+  refresh();
+}
+
+document.getElementById('search').addEventListener('input', refresh);
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
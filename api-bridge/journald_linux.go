@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalStreamConnected reports whether stderr is connected to the journal,
+// which systemd signals with JOURNAL_STREAM=<device>:<inode>.
+func journalStreamConnected() bool {
+	stream := os.Getenv("JOURNAL_STREAM")
+	if stream == "" {
+		return false
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(os.Stderr.Fd()), &st); err != nil {
+		return false
+	}
+	return stream == fmt.Sprintf("%d:%d", st.Dev, st.Ino)
+}
+
+// journaldSink writes entries with the native journal protocol so fields such
+// as PRIORITY, REQUEST_ID and TUNNEL can be used with journalctl filters.
+type journaldSink struct {
+	conn       *net.UnixConn
+	addr       *net.UnixAddr
+	identifier string
+}
+
+func newJournaldSink() (*journaldSink, error) {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal socket: %v", err)
+	}
+	addr := &net.UnixAddr{Name: journalSocket, Net: "unixgram"}
+	if _, err := os.Stat(journalSocket); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("journal socket not available: %v", err)
+	}
+	return &journaldSink{conn: conn, addr: addr, identifier: filepath.Base(os.Args[0])}, nil
+}
+
+// appendJournalField encodes one field, using the length-prefixed binary
+// form for values containing newlines.
+func appendJournalField(b *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(name + "=" + value + "\n")
+		return
+	}
+	b.WriteString(name + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
+
+// journalFieldName converts a field key to the upper case form required by
+// the journal, e.g. request_id becomes REQUEST_ID.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	return strings.TrimLeft(name, "_")
+}
+
+func (s *journaldSink) Emit(entry *LogEntry) {
+	var b bytes.Buffer
+	message := entry.Message
+	if entry.Component != "" {
+		message = "[" + entry.Component + "] " + message
+	}
+	appendJournalField(&b, "MESSAGE", message)
+	appendJournalField(&b, "PRIORITY", fmt.Sprint(syslogSeverity(entry.Severity)))
+	appendJournalField(&b, "SYSLOG_IDENTIFIER", s.identifier)
+	if entry.Component != "" {
+		appendJournalField(&b, "COMPONENT", entry.Component)
+	}
+	for key, value := range entry.Fields {
+		if name := journalFieldName(key); name != "" {
+			appendJournalField(&b, name, value)
+		}
+	}
+
+	if _, err := s.conn.WriteToUnix(b.Bytes(), s.addr); err != nil {
+		metrics.Counter("apiduct_log_entries_dropped_total", "sink", "journald").Inc()
+		sinkError("Failed to write to journal: %v", err)
+	}
+}
+
+func (s *journaldSink) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+func journalStreamConnected() bool {
+	return false
+}
+
+type journaldSink struct{}
+
+func newJournaldSink() (*journaldSink, error) {
+	return nil, fmt.Errorf("journald logging is only supported on Linux")
+}
+
+func (s *journaldSink) Emit(entry *LogEntry) {}
+
+func (s *journaldSink) Close() error {
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// killSignal is the signal that engages the kill switch.
+func killSignal() os.Signal { return syscall.SIGUSR1 }
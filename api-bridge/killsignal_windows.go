@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// killSignal returns nil, Windows has no signal to spare for the kill switch.
+func killSignal() os.Signal { return nil }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"apiduct/pkg/proxy"
+	"apiduct/pkg/tunnel"
+)
+
+// killSwitch severs the duct for security incidents. Once engaged, every
+// tunnel is closed at once, cutting off the requests and forwards in flight,
+// new tunnels are refused and public requests get the incident page, until
+// it is released on the admin interface.
+type killSwitch struct {
+	mu       sync.Mutex
+	engaged  bool
+	since    time.Time
+	reason   string
+	tunnels  *tunnel.Pool
+	page     []byte
+	pageType string
+}
+
+// emergency is the bridge's kill switch, engaged on the admin interface or
+// with SIGUSR1.
+var emergency = &killSwitch{}
+
+// KillSwitchStatus is the kill switch state reported by the admin interface.
+type KillSwitchStatus struct {
+	Engaged bool       `json:"engaged"`
+	Since   *time.Time `json:"since,omitempty"`
+	Reason  string     `json:"reason,omitempty"`
+}
+
+// loadPage sets the incident page served while the switch is engaged. The
+// content type follows the file extension.
+func (k *killSwitch) loadPage(path string) error {
+	page, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read incident page: %v", err)
+	}
+	pageType := mime.TypeByExtension(filepath.Ext(path))
+	if pageType == "" {
+		pageType = "text/html; charset=utf-8"
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.page, k.pageType = page, pageType
+	return nil
+}
+
+// attach hands the switch the tunnels it closes.
+func (k *killSwitch) attach(tunnels *tunnel.Pool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.tunnels = tunnels
+}
+
+func (k *killSwitch) isEngaged() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.engaged
+}
+
+// Engage severs the duct. Tunnels that connected in the meantime are closed
+// again if it is already engaged.
+func (k *killSwitch) Engage(reason string) KillSwitchStatus {
+	k.mu.Lock()
+	if !k.engaged {
+		k.engaged = true
+		k.since = time.Now()
+		k.reason = reason
+		metrics.Counter("apiduct_kill_switch_engaged_total").Inc()
+		logEvent("kill_switch_engaged", map[string]string{"reason": reason}, "[BRIDGE] Kill switch engaged (%s), closing all tunnels", reason)
+	}
+	tunnels := k.tunnels
+	status := k.status()
+	k.mu.Unlock()
+
+	if tunnels != nil {
+		for _, t := range tunnels.All() {
+			tunnels.Drop(t, "kill switch engaged")
+		}
+	}
+	return status
+}
+
+// Release puts the duct back into service, offramps reconnect on their own.
+func (k *killSwitch) Release() KillSwitchStatus {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.engaged {
+		k.engaged = false
+		logEvent("kill_switch_released", nil, "[BRIDGE] Kill switch released after %s, accepting tunnels again", time.Since(k.since).Round(time.Second))
+	}
+	return k.status()
+}
+
+func (k *killSwitch) Status() KillSwitchStatus {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.status()
+}
+
+func (k *killSwitch) status() KillSwitchStatus {
+	s := KillSwitchStatus{Engaged: k.engaged}
+	if k.engaged {
+		since := k.since
+		s.Since = &since
+		s.Reason = k.reason
+	}
+	return s
+}
+
+// serve answers a public request with the incident page if the switch is
+// engaged, reporting whether it did.
+func (k *killSwitch) serve(w http.ResponseWriter) bool {
+	k.mu.Lock()
+	engaged, page, pageType := k.engaged, k.page, k.pageType
+	k.mu.Unlock()
+	if !engaged {
+		return false
+	}
+	metrics.Counter("apiduct_kill_switch_rejected_total").Inc()
+	if page == nil {
+		writeError(w, http.StatusServiceUnavailable, errCodeKillSwitch, "Service is unavailable")
+		return true
+	}
+	w.Header().Set("Content-Type", pageType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set(proxy.ErrorCodeHeader, errCodeKillSwitch)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(page)
+	return true
+}
+
+// handleKillSignal engages the kill switch on each kill signal, on platforms
+// that have one.
+func handleKillSignal() {
+	sig := killSignal()
+	if sig == nil {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sig)
+	for sig := range signals {
+		emergency.Engage(sig.String())
+	}
+}
+
+func handleKillSwitch(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, emergency.Status())
+	case http.MethodPost:
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&body); err != nil && err != io.EOF {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if body.Reason == "" {
+			body.Reason = "admin request"
+		}
+		writeJSON(w, http.StatusOK, emergency.Engage(body.Reason))
+	case http.MethodDelete:
+		writeJSON(w, http.StatusOK, emergency.Release())
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Limit pairs a warning threshold, which only logs and alerts, with a hard
+// threshold that is enforced. Zero disables either of them, so a limit can
+// be tuned with warnings before enforcement is turned on.
+type Limit struct {
+	Warn int64 `json:"warn,omitempty"`
+	Max  int64 `json:"max,omitempty"`
+}
+
+func (l *Limit) validate() error {
+	if l == nil {
+		return nil
+	}
+	if l.Warn < 0 || l.Max < 0 {
+		return fmt.Errorf("thresholds must not be negative")
+	}
+	if l.Warn > 0 && l.Max > 0 && l.Warn >= l.Max {
+		return fmt.Errorf("warn threshold %d must be below max %d", l.Warn, l.Max)
+	}
+	return nil
+}
+
+// max returns the hard threshold, 0 if there is none.
+func (l *Limit) max() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.Max
+}
+
+func (l *Limit) warns(value int64) bool {
+	return l != nil && l.Warn > 0 && value > l.Warn
+}
+
+// limitAlerts receives quota warnings when a notifier is configured.
+var limitAlerts Notifier
+
+// warnLimit reports a crossed warning threshold without enforcing anything.
+func warnLimit(route *Route, limit string, alert bool, format string, args ...interface{}) {
+	metrics.Counter("apiduct_limit_warnings_total", "route", routeLabel(route), "limit", limit).Inc()
+	message := fmt.Sprintf(format, args...)
+	logEvent("limit_warning", map[string]string{"route": routeLabel(route)}, "[BRIDGE] Warning: %s", message)
+	if alert && limitAlerts != nil {
+		go func() {
+			if err := limitAlerts.Notify("apiduct limit warning: "+limit, message, map[string]string{
+				"route": routeLabel(route),
+				"limit": limit,
+			}); err != nil {
+				log.Printf("[BRIDGE] Failed to deliver limit warning: %v", err)
+			}
+		}()
+	}
+}
+
+// limitRequestBody rejects request bodies announcing more than max bytes.
+// Bodies of unknown length are not buffered to find out: they are cut off
+// with errRequestTooLarge once they cross the limit while streaming through,
+// which the returned reader, nil for other bodies, reports.
+func limitRequestBody(r *http.Request, max int64) (bool, *cappedReader) {
+	if max <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return true, nil
+	}
+	if r.ContentLength > max {
+		return false, nil
+	}
+	if r.ContentLength >= 0 {
+		return true, nil
+	}
+	capped := newCappedReader(r.Body, max, errRequestTooLarge)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{capped, r.Body}
+	return true, capped
+}
+
+// Quota limits the requests and bytes (request plus response bodies) a route
+// may use per calendar period in UTC.
+type Quota struct {
+	Period   string `json:"period"` // hour, day or month
+	Requests *Limit `json:"requests,omitempty"`
+	Bytes    *Limit `json:"bytes,omitempty"`
+}
+
+func (q *Quota) validate() error {
+	if q == nil {
+		return nil
+	}
+	switch q.Period {
+	case "hour", "day", "month":
+	default:
+		return fmt.Errorf("unknown quota period %q (use hour, day or month)", q.Period)
+	}
+	if err := q.Requests.validate(); err != nil {
+		return fmt.Errorf("requests: %v", err)
+	}
+	if err := q.Bytes.validate(); err != nil {
+		return fmt.Errorf("bytes: %v", err)
+	}
+	return nil
+}
+
+// window returns the start and end of the period containing t.
+func (q *Quota) window(t time.Time) (time.Time, time.Time) {
+	t = t.UTC()
+	switch q.Period {
+	case "hour":
+		start := t.Truncate(time.Hour)
+		return start, start.Add(time.Hour)
+	case "month":
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	}
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// quotaUsage is the consumption of one route in the current window. It is
+// saved with the usage counters so quotas survive restarts.
+type quotaUsage struct {
+	WindowStart    time.Time `json:"window_start"`
+	Requests       int64     `json:"requests"`
+	Bytes          int64     `json:"bytes"`
+	WarnedRequests bool      `json:"warned_requests,omitempty"`
+	WarnedBytes    bool      `json:"warned_bytes,omitempty"`
+}
+
+// QuotaTracker keeps per-route quota consumption.
+type QuotaTracker struct {
+	mu    sync.Mutex
+	usage map[string]*quotaUsage
+}
+
+var quotas = &QuotaTracker{usage: make(map[string]*quotaUsage)}
+
+// current returns the usage of the route's current window, starting a new
+// window when the period has rolled over. The caller must hold q.mu.
+func (q *QuotaTracker) current(route *Route, now time.Time) *quotaUsage {
+	start, _ := route.Quota.window(now)
+	usage, ok := q.usage[route.Name]
+	if !ok || !usage.WindowStart.Equal(start) {
+		usage = &quotaUsage{WindowStart: start}
+		q.usage[route.Name] = usage
+	}
+	return usage
+}
+
+// Admit counts a request against the route's quota. It returns false and the
+// time until the window resets when a hard limit has been reached.
+func (q *QuotaTracker) Admit(route *Route) (bool, time.Duration) {
+	now := time.Now()
+	_, end := route.Quota.window(now)
+
+	q.mu.Lock()
+	usage := q.current(route, now)
+	if (route.Quota.Requests.max() > 0 && usage.Requests >= route.Quota.Requests.max()) ||
+		(route.Quota.Bytes.max() > 0 && usage.Bytes >= route.Quota.Bytes.max()) {
+		q.mu.Unlock()
+		return false, end.Sub(now)
+	}
+	usage.Requests++
+	warn := route.Quota.Requests.warns(usage.Requests) && !usage.WarnedRequests
+	if warn {
+		usage.WarnedRequests = true
+	}
+	requests := usage.Requests
+	q.mu.Unlock()
+
+	if warn {
+		warnLimit(route, "quota_requests", true, "route %s used %d requests of its %s quota (warn at %d, max %d)",
+			route.Name, requests, route.Quota.Period, route.Quota.Requests.Warn, route.Quota.Requests.Max)
+	}
+	return true, 0
+}
+
+// AddBytes counts transferred body bytes against the route's quota.
+func (q *QuotaTracker) AddBytes(route *Route, n int64) {
+	q.mu.Lock()
+	usage := q.current(route, time.Now())
+	usage.Bytes += n
+	warn := route.Quota.Bytes.warns(usage.Bytes) && !usage.WarnedBytes
+	if warn {
+		usage.WarnedBytes = true
+	}
+	used := usage.Bytes
+	q.mu.Unlock()
+
+	if warn {
+		warnLimit(route, "quota_bytes", true, "route %s transferred %d bytes of its %s quota (warn at %d, max %d)",
+			route.Name, used, route.Quota.Period, route.Quota.Bytes.Warn, route.Quota.Bytes.Max)
+	}
+}
+
+func (q *QuotaTracker) snapshot() map[string]*quotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	usage := make(map[string]*quotaUsage, len(q.usage))
+	for name, u := range q.usage {
+		copied := *u
+		usage[name] = &copied
+	}
+	return usage
+}
+
+func (q *QuotaTracker) restore(usage map[string]*quotaUsage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for name, u := range usage {
+		q.usage[name] = u
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimitValidate(t *testing.T) {
+	tests := []struct {
+		limit *Limit
+		ok    bool
+	}{
+		{nil, true},
+		{&Limit{Warn: 80, Max: 100}, true},
+		{&Limit{Warn: 80}, true},
+		{&Limit{Max: 100}, true},
+		{&Limit{Warn: 100, Max: 100}, false},
+		{&Limit{Max: -1}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.limit.validate(); (err == nil) != tt.ok {
+			t.Errorf("validate %+v: %v, want ok %v", tt.limit, err, tt.ok)
+		}
+	}
+}
+
+func TestQuotaWindow(t *testing.T) {
+	at := time.Date(2026, 12, 31, 23, 30, 15, 0, time.FixedZone("CET", 3600))
+	tests := []struct {
+		period     string
+		start, end time.Time
+	}{
+		{"hour", time.Date(2026, 12, 31, 22, 0, 0, 0, time.UTC), time.Date(2026, 12, 31, 23, 0, 0, 0, time.UTC)},
+		{"day", time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"month", time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		quota := &Quota{Period: tt.period}
+		if err := quota.validate(); err != nil {
+			t.Fatalf("%s: %v", tt.period, err)
+		}
+		start, end := quota.window(at)
+		if !start.Equal(tt.start) || !end.Equal(tt.end) {
+			t.Errorf("%s: window %s - %s, want %s - %s", tt.period, start, end, tt.start, tt.end)
+		}
+	}
+	if err := (&Quota{Period: "week"}).validate(); err == nil {
+		t.Error("validated an unknown period")
+	}
+}
+
+func TestQuotaTracker(t *testing.T) {
+	tests := []struct {
+		name     string
+		quota    Quota
+		bytes    int64 // transferred before each request
+		admitted int   // of 5 requests
+	}{
+		{"no limits", Quota{Period: "day"}, 0, 5},
+		{"requests", Quota{Period: "day", Requests: &Limit{Max: 3}}, 0, 3},
+		{"requests warn only", Quota{Period: "day", Requests: &Limit{Warn: 1}}, 0, 5},
+		{"bytes", Quota{Period: "day", Bytes: &Limit{Max: 250}}, 100, 3},
+		{"bytes warn only", Quota{Period: "day", Bytes: &Limit{Warn: 100}}, 100, 5},
+	}
+	for _, tt := range tests {
+		tracker := &QuotaTracker{usage: make(map[string]*quotaUsage)}
+		route := &Route{Name: tt.name, Quota: &tt.quota}
+		admitted := 0
+		for i := 0; i < 5; i++ {
+			ok, reset := tracker.Admit(route)
+			if !ok {
+				if reset <= 0 || reset > 24*time.Hour {
+					t.Errorf("%s: quota resets in %v", tt.name, reset)
+				}
+				continue
+			}
+			admitted++
+			tracker.AddBytes(route, tt.bytes)
+		}
+		if admitted != tt.admitted {
+			t.Errorf("%s: admitted %d requests, want %d", tt.name, admitted, tt.admitted)
+		}
+	}
+}
+
+func TestQuotaTrackerNewWindow(t *testing.T) {
+	tracker := &QuotaTracker{usage: make(map[string]*quotaUsage)}
+	route := &Route{Name: "api", Quota: &Quota{Period: "hour", Requests: &Limit{Max: 1}}}
+	tracker.restore(map[string]*quotaUsage{"api": {WindowStart: time.Now().Add(-2 * time.Hour).Truncate(time.Hour), Requests: 1}})
+	if ok, _ := tracker.Admit(route); !ok {
+		t.Error("usage of an earlier window counted against the current one")
+	}
+	if ok, _ := tracker.Admit(route); ok {
+		t.Error("admitted a request over the quota")
+	}
+	if got := tracker.snapshot()["api"].Requests; got != 1 {
+		t.Errorf("snapshot has %d requests, want 1", got)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// logger writes structured entries to the log sinks. Unlike lines from
+// log.Printf, whose level is guessed from their wording, its entries keep
+// the level and fields they were logged with.
+var logger = slog.New(&sinkHandler{}).With("component", "BRIDGE")
+
+// sinkHandler is an slog.Handler turning records into log entries for the
+// dispatcher. Before logging is set up, entries go to the standard logger.
+type sinkHandler struct {
+	attrs  []slog.Attr
+	prefix string // of attribute keys, from groups
+}
+
+func severityOf(level slog.Level) Severity {
+	switch {
+	case level < slog.LevelInfo:
+		return SeverityDebug
+	case level < slog.LevelWarn:
+		return SeverityInfo
+	case level < slog.LevelError:
+		return SeverityWarning
+	}
+	return SeverityError
+}
+
+func (h *sinkHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return logOutput == nil || severityOf(level) >= logOutput.min
+}
+
+func (h *sinkHandler) Handle(_ context.Context, record slog.Record) error {
+	entry := &LogEntry{Time: record.Time, Severity: severityOf(record.Level), Message: record.Message}
+	add := func(a slog.Attr) {
+		if a.Key == "component" {
+			entry.Component = a.Value.String()
+			return
+		}
+		if entry.Fields == nil {
+			entry.Fields = make(map[string]string)
+		}
+		entry.Fields[a.Key] = a.Value.Resolve().String()
+	}
+	for _, a := range h.attrs {
+		add(a)
+	}
+	record.Attrs(func(a slog.Attr) bool {
+		a.Key = h.prefix + a.Key
+		add(a)
+		return true
+	})
+
+	if logOutput == nil {
+		prefix := ""
+		if entry.Component != "" {
+			prefix = "[" + entry.Component + "] "
+		}
+		log.Print(prefix + entry.Message + textFields(entry.Fields))
+		return nil
+	}
+	logOutput.emit(entry)
+	return nil
+}
+
+func (h *sinkHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	withAttrs := &sinkHandler{attrs: append([]slog.Attr(nil), h.attrs...), prefix: h.prefix}
+	for _, a := range attrs {
+		a.Key = h.prefix + a.Key
+		withAttrs.attrs = append(withAttrs.attrs, a)
+	}
+	return withAttrs
+}
+
+func (h *sinkHandler) WithGroup(name string) slog.Handler {
+	return &sinkHandler{attrs: h.attrs, prefix: h.prefix + name + "."}
+}
+
+// wireRedacted lists headers whose values are left out of wire traces.
+var wireRedacted = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Api-Key":           true,
+}
+
+// traceWire logs the start line and headers of a request or response at
+// debug level, with credentials redacted.
+func traceWire(l *slog.Logger, message, startLine string, header http.Header) {
+	if !l.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lines := []string{startLine}
+	for _, key := range keys {
+		for _, value := range header[key] {
+			if wireRedacted[key] {
+				value = "[REDACTED]"
+			}
+			lines = append(lines, fmt.Sprintf("%s: %s", key, value))
+		}
+	}
+	l.Debug(message, "wire", strings.Join(lines, "\n"))
+}
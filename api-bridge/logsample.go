@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logSampler limits repetitive log lines. Each kind of message may be logged
+// burst times per window; further occurrences are counted and summarised in
+// a single line once the window has ended.
+type logSampler struct {
+	burst  int
+	window time.Duration
+
+	mu    sync.Mutex
+	lines map[string]*sampledLine
+}
+
+type sampledLine struct {
+	windowStart time.Time
+	count       int
+	suppressed  int
+	first       *LogEntry
+}
+
+func newLogSampler(burst int, window time.Duration) *logSampler {
+	return &logSampler{burst: burst, window: window, lines: make(map[string]*sampledLine)}
+}
+
+// sampleKey groups messages that only differ in details: the text after the
+// first colon (usually an error or a path) and digits are ignored.
+func sampleKey(entry *LogEntry) string {
+	message := entry.Message
+	if i := strings.Index(message, ": "); i > 0 {
+		message = message[:i]
+	}
+	return entry.Component + "|" + strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return '#'
+		}
+		return r
+	}, message)
+}
+
+func (line *sampledLine) summary(now time.Time) *LogEntry {
+	return &LogEntry{
+		Time:      now,
+		Severity:  line.first.Severity,
+		Component: line.first.Component,
+		Message: fmt.Sprintf("Suppressed %d similar messages in the last %s: %s",
+			line.suppressed, now.Sub(line.windowStart).Round(time.Second), line.first.Message),
+	}
+}
+
+// sample reports whether the entry should be logged, along with the summary
+// of a finished window if one is due. Events are never sampled.
+func (s *logSampler) sample(entry *LogEntry) (bool, *LogEntry) {
+	metrics.Counter("apiduct_log_messages_total", "level", strings.ToLower(entry.Severity.String())).Inc()
+	if entry.Fields["event"] != "" {
+		return true, nil
+	}
+
+	key := sampleKey(entry)
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	line, ok := s.lines[key]
+	if !ok || now.Sub(line.windowStart) >= s.window {
+		var summary *LogEntry
+		if ok && line.suppressed > 0 {
+			summary = line.summary(now)
+		}
+		s.lines[key] = &sampledLine{windowStart: now, count: 1, first: entry}
+		return true, summary
+	}
+
+	line.count++
+	if line.count <= s.burst {
+		return true, nil
+	}
+	line.suppressed++
+	metrics.Counter("apiduct_log_messages_suppressed_total").Inc()
+	return false, nil
+}
+
+// flush returns summaries for windows that ended with suppressed lines and
+// forgets idle keys.
+func (s *logSampler) flush() []*LogEntry {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var summaries []*LogEntry
+	for key, line := range s.lines {
+		if now.Sub(line.windowStart) < s.window {
+			continue
+		}
+		if line.suppressed > 0 {
+			summaries = append(summaries, line.summary(now))
+		}
+		delete(s.lines, key)
+	}
+	return summaries
+}
+
+// runSampler periodically logs the summaries of finished windows, so a burst
+// that stops is still reported.
+func (d *logDispatcher) runSampler() {
+	ticker := time.NewTicker(d.sampler.window)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, summary := range d.sampler.flush() {
+			d.fanOut(summary)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Severity int
+
+const (
+	SeverityDebug Severity = iota
+	SeverityInfo
+	SeverityWarning
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityDebug:
+		return "DEBUG"
+	case SeverityWarning:
+		return "WARNING"
+	case SeverityError:
+		return "ERROR"
+	}
+	return "INFO"
+}
+
+func parseSeverity(value string) (Severity, error) {
+	switch strings.ToLower(value) {
+	case "debug":
+		return SeverityDebug, nil
+	case "", "info":
+		return SeverityInfo, nil
+	case "warn", "warning":
+		return SeverityWarning, nil
+	case "error":
+		return SeverityError, nil
+	}
+	return SeverityInfo, fmt.Errorf("unknown log level %q", value)
+}
+
+// LogEntry is a single log line split into its structured parts.
+type LogEntry struct {
+	Time      time.Time
+	Severity  Severity
+	Component string
+	Message   string
+	Fields    map[string]string // e.g. request_id, tunnel
+}
+
+// LogSink receives every log entry written through the standard logger.
+type LogSink interface {
+	Emit(entry *LogEntry)
+	Close() error
+}
+
+// parseLogLine splits "[BRIDGE] Failed to ..." into component and message and
+// guesses the severity from the wording, as log.Printf carries no level.
+func parseLogLine(line string) *LogEntry {
+	entry := &LogEntry{Time: time.Now(), Severity: SeverityInfo, Message: line}
+	if strings.HasPrefix(line, "[") {
+		if end := strings.Index(line, "] "); end > 0 {
+			entry.Component = line[1:end]
+			entry.Message = line[end+2:]
+		}
+	}
+
+	lower := strings.ToLower(entry.Message)
+	switch {
+	case strings.Contains(lower, "failed") || strings.Contains(lower, "error") ||
+		strings.Contains(lower, "invalid") || strings.Contains(lower, "authentication"):
+		entry.Severity = SeverityError
+	case strings.Contains(lower, "warning") || strings.Contains(lower, "closed") || strings.Contains(lower, "lost") ||
+		strings.Contains(lower, "timeout") || strings.Contains(lower, "unhealthy"):
+		entry.Severity = SeverityWarning
+	case strings.HasPrefix(lower, "forwarding ") || strings.HasPrefix(lower, "reading "):
+		// Per-request and handshake progress lines
+		entry.Severity = SeverityDebug
+	}
+	return entry
+}
+
+// logDispatcher is installed as the output of the standard logger and fans
+// each line out to the configured sinks.
+type logDispatcher struct {
+	mu      sync.Mutex
+	sinks   []LogSink
+	sampler *logSampler
+	min     Severity // lowest level any sink takes
+}
+
+func (d *logDispatcher) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		d.emit(parseLogLine(line))
+	}
+	return len(p), nil
+}
+
+func (d *logDispatcher) emit(entry *LogEntry) {
+	if d.sampler != nil {
+		allowed, summary := d.sampler.sample(entry)
+		if summary != nil {
+			d.fanOut(summary)
+		}
+		if !allowed {
+			return
+		}
+	}
+	d.fanOut(entry)
+}
+
+func (d *logDispatcher) fanOut(entry *LogEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, sink := range d.sinks {
+		sink.Emit(entry)
+	}
+}
+
+func (d *logDispatcher) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, sink := range d.sinks {
+		sink.Close()
+	}
+	d.sinks = nil
+	return nil
+}
+
+// logOutput is the installed dispatcher, nil until logging is set up.
+var logOutput *logDispatcher
+
+// logFields logs a message with structured fields. Sinks that support fields
+// receive them separately; plain stderr output only shows the message.
+func logFields(fields map[string]string, format string, args ...interface{}) {
+	if logOutput == nil {
+		log.Printf(format, args...)
+		return
+	}
+	entry := parseLogLine(fmt.Sprintf(format, args...))
+	for key, value := range fields {
+		if value == "" {
+			continue
+		}
+		if entry.Fields == nil {
+			entry.Fields = make(map[string]string)
+		}
+		entry.Fields[key] = value
+	}
+	logOutput.emit(entry)
+}
+
+// logf logs a line for the library packages, which leave out the prefix.
+func logf(format string, args ...interface{}) {
+	log.Printf("[BRIDGE] "+format, args...)
+}
+
+// logEvent logs a significant event such as startup, tunnel up/down or an
+// authentication failure. Event sinks (the Windows Event Log) only receive
+// entries logged this way.
+func logEvent(event string, fields map[string]string, format string, args ...interface{}) {
+	withEvent := map[string]string{"event": event}
+	for key, value := range fields {
+		withEvent[key] = value
+	}
+	logFields(withEvent, format, args...)
+}
+
+// writerSink writes entries as text lines in the standard logger format or
+// as JSON objects, to stderr or a file.
+type writerSink struct {
+	w      io.Writer
+	json   bool
+	closer io.Closer
+}
+
+func (s *writerSink) Emit(entry *LogEntry) {
+	if s.json {
+		record := map[string]string{
+			"time":    entry.Time.UTC().Format(time.RFC3339Nano),
+			"level":   strings.ToLower(entry.Severity.String()),
+			"message": entry.Message,
+		}
+		if entry.Component != "" {
+			record["component"] = entry.Component
+		}
+		for key, value := range entry.Fields {
+			if _, exists := record[key]; !exists {
+				record[key] = value
+			}
+		}
+		data, _ := json.Marshal(record)
+		s.w.Write(append(data, '\n'))
+		return
+	}
+
+	prefix := ""
+	if entry.Component != "" {
+		prefix = "[" + entry.Component + "] "
+	}
+	fmt.Fprintf(s.w, "%s %s%s%s\n", entry.Time.Format("2006/01/02 15:04:05"), prefix, entry.Message, textFields(entry.Fields))
+}
+
+// textFields renders fields as " key=value" pairs, so IDs can be grepped in
+// plain text logs.
+func textFields(fields map[string]string) string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		if key != "event" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		value := fields[key]
+		if strings.ContainsAny(value, "\r\n") {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(" " + key + "=" + value)
+	}
+	return b.String()
+}
+
+func (s *writerSink) Close() error {
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
+
+// levelFilter drops entries below the minimum severity of a sink.
+type levelFilter struct {
+	LogSink
+	min Severity
+}
+
+func (f *levelFilter) Emit(entry *LogEntry) {
+	if entry.Severity >= f.min {
+		f.LogSink.Emit(entry)
+	}
+}
+
+// LogSinkConfig describes one log destination in the config file.
+type LogSinkConfig struct {
+	Type   string `json:"type"` // stderr, file, journald, syslog or gcp
+	Level  string `json:"level,omitempty"`
+	Format string `json:"format,omitempty"` // text or json, for stderr and file
+
+	Path string `json:"path,omitempty"` // file
+
+	Addr     string `json:"addr,omitempty"` // syslog
+	Facility string `json:"facility,omitempty"`
+	CAFile   string `json:"ca_file,omitempty"`
+
+	Project string `json:"project,omitempty"` // gcp
+	LogName string `json:"log_name,omitempty"`
+}
+
+func (c *LogSinkConfig) validate() error {
+	switch c.Type {
+	case "stderr", "journald", "syslog", "gcp":
+	case "file":
+		if c.Path == "" {
+			return fmt.Errorf("file sink requires a path")
+		}
+	default:
+		return fmt.Errorf("unknown sink type %q", c.Type)
+	}
+	if c.Format != "" && c.Format != "text" && c.Format != "json" {
+		return fmt.Errorf("unknown format %q (use text or json)", c.Format)
+	}
+	if _, err := parseSeverity(c.Level); err != nil {
+		return err
+	}
+	if c.Type == "syslog" && c.Facility != "" {
+		if _, ok := syslogFacilities[strings.ToLower(c.Facility)]; !ok {
+			return fmt.Errorf("unknown syslog facility %q", c.Facility)
+		}
+	}
+	return nil
+}
+
+// open creates the sink, wrapped in a level filter unless it takes all levels.
+func (c *LogSinkConfig) open() (LogSink, error) {
+	var sink LogSink
+	var err error
+	switch c.Type {
+	case "auto":
+		// Use the journal when stderr is connected to it, i.e. under systemd
+		sink = &writerSink{w: os.Stderr, json: c.Format == "json"}
+		if journalStreamConnected() {
+			if journal, err := newJournaldSink(); err == nil {
+				sink = journal
+			}
+		}
+	case "stderr":
+		sink = &writerSink{w: os.Stderr, json: c.Format == "json"}
+	case "file":
+		f, err := os.OpenFile(c.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log file: %v", err)
+		}
+		sink = &writerSink{w: f, json: c.Format == "json", closer: f}
+	case "journald":
+		sink, err = newJournaldSink()
+	case "syslog":
+		facility := c.Facility
+		if facility == "" {
+			facility = "daemon"
+		}
+		sink, err = newSyslogSink(c.Addr, facility, c.CAFile)
+	case "gcp":
+		logName := c.LogName
+		if logName == "" {
+			logName = "apiduct-bridge"
+		}
+		sink, err = newGCPLogSink(c.Project, logName)
+	default:
+		return nil, fmt.Errorf("unknown log sink %q", c.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	min, _ := parseSeverity(c.Level)
+	if min == SeverityDebug {
+		return sink, nil
+	}
+	return &levelFilter{LogSink: sink, min: min}, nil
+}
+
+// setupLogSink routes the standard logger to the sinks of the config file,
+// or the one selected with -log-sink, plus any platform event sink.
+func setupLogSink(config *Config) (io.Closer, error) {
+	sinkConfigs := config.LogSinks
+	if len(sinkConfigs) == 0 {
+		sinkConfigs = []*LogSinkConfig{{
+			Type:     config.LogSink,
+			Level:    config.LogLevel,
+			Format:   config.LogFormat,
+			Addr:     config.SyslogAddr,
+			Facility: config.SyslogFacility,
+			CAFile:   config.SyslogCAFile,
+			Project:  config.GCPProject,
+			LogName:  config.GCPLogName,
+		}}
+	}
+
+	dispatcher := &logDispatcher{min: SeverityError}
+	for _, sc := range sinkConfigs {
+		sink, err := sc.open()
+		if err != nil {
+			dispatcher.Close()
+			return nil, fmt.Errorf("%s sink: %v", sc.Type, err)
+		}
+		dispatcher.sinks = append(dispatcher.sinks, sink)
+		if min, _ := parseSeverity(sc.Level); min < dispatcher.min {
+			dispatcher.min = min
+		}
+	}
+
+	events, err := newEventSink(config)
+	if err != nil {
+		dispatcher.Close()
+		return nil, err
+	}
+	if events != nil {
+		dispatcher.sinks = append(dispatcher.sinks, events)
+	}
+
+	if config.LogSampleBurst > 0 {
+		dispatcher.sampler = newLogSampler(config.LogSampleBurst, config.LogSampleWindow)
+		go dispatcher.runSampler()
+	}
+
+	log.SetFlags(0)
+	log.SetOutput(dispatcher)
+	logOutput = dispatcher
+	return dispatcher, nil
+}
+
+// sinkError reports a sink failure directly on stderr, as logging it would
+// feed back into the failing sink.
+func sinkError(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "%s [LOG] %s\n", time.Now().Format("2006/01/02 15:04:05"), fmt.Sprintf(format, args...))
+}
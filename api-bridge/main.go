@@ -1,16 +1,19 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"crypto/sha256"
-	"flag"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
-	"sync"
+	"os"
+
+	"apiduct/pkg/buildinfo"
+	"apiduct/pkg/stats"
+	"apiduct/pkg/telemetry"
+	"apiduct/pkg/tunnel"
+	"github.com/spf13/pflag"
 )
 
 var (
@@ -18,190 +21,364 @@ var (
 	BuildTime = "unknown"
 )
 
-type Config struct {
-	ListenIP    string
-	ListenPort  int
-	TunnelPort  int
-	PSK         string
-	EnableHTTP  bool
-	EnableHTTPS bool
-	CertFile    string
-	KeyFile     string
-}
-
-type TunnelConnection struct {
-	conn net.Conn
-	mu   sync.Mutex
+func main() {
+	if err := newRootCommand().Execute(); err != nil {
+		os.Exit(1)
+	}
 }
 
-func (t *TunnelConnection) Write(data []byte) (int, error) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	return t.conn.Write(data)
-}
+// run starts the bridge with the parsed command line.
+func run(config *Config, flags *pflag.FlagSet, reportInterval, warmupURLs string) {
 
-func (t *TunnelConnection) Read(p []byte) (int, error) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	return t.conn.Read(p)
-}
+	// Load settings, routes and log sinks from config file
+	var settings map[string]interface{}
+	var fileACLs, filePolicy map[string][]string
+	if config.ConfigFile != "" {
+		fileConfig, err := loadFileConfig(config.ConfigFile, config.Profile)
+		if err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+		settings = fileConfig.Settings
+		config.Routes = fileConfig.Routes
+		config.LogSinks = fileConfig.Logging
+		fileACLs = fileConfig.TunnelACLs
+		filePolicy = fileConfig.OfframpPolicy
+		config.ClientSchedules = fileConfig.ClientSchedules
+	} else if config.Profile != "" && builtinProfiles[config.Profile] == nil {
+		log.Fatalf("Unknown profile %q (use dev, staging or prod, or define it in the config file)", config.Profile)
+	}
 
-func (t *TunnelConnection) Close() error {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	return t.conn.Close()
-}
+	// Add the routes to named offramps given on the command line
+	for _, value := range config.OfframpRoutes {
+		route, err := parseOfframpRoute(value)
+		if err != nil {
+			log.Fatalf("Invalid --offramp-route: %v", err)
+		}
+		config.Routes = append(config.Routes, route)
+	}
+	acls, err := buildTunnelACLs(fileACLs, config.TunnelACL)
+	if err != nil {
+		log.Fatalf("Invalid tunnel ACL: %v", err)
+	}
+	config.TunnelACLs = acls
+	policy, err := buildOfframpPolicy(filePolicy, config.OfframpPolicy, config.Routes)
+	if err != nil {
+		log.Fatalf("Invalid offramp policy: %v", err)
+	}
+	config.OfframpPolicies = policy
+	if err := applySettings(flags, config.Profile, settings); err != nil {
+		log.Fatalf("Failed to apply config settings: %v", err)
+	}
 
-func (t *TunnelConnection) IsConnected() bool {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	return t.conn != nil
-}
+	// Check the whole configuration before anything starts, which is all
+	// -validate-config does
+	if err := checkConfig(config, reportInterval, warmupURLs); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if config.ValidateConfig {
+		fmt.Printf("Configuration is valid: %d routes\n", len(config.Routes))
+		return
+	}
+	live.set(config.Routes, config.ClientSchedules, config.TunnelACLs, config.OfframpPolicies)
 
-func createProxyHandler(tunnelConn *TunnelConnection) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check if tunnel connection is available
-		if !tunnelConn.IsConnected() {
-			log.Printf("[BRIDGE] Tunnel connection not available")
-			http.Error(w, "Tunnel connection not available", http.StatusServiceUnavailable)
-			return
+	// Route logs to the configured sinks
+	logSink, err := setupLogSink(config)
+	if err != nil {
+		log.Fatalf("Failed to set up log sink: %v", err)
+	}
+	defer logSink.Close()
+	bridgeShutdown.onStop(func() {
+		if config.UsageStateFile != "" {
+			if err := saveUsage(config.UsageStateFile); err != nil {
+				log.Printf("[BRIDGE] Failed to checkpoint usage counters: %v", err)
+			}
+		}
+		if err := journal.Close(); err != nil {
+			log.Printf("[BRIDGE] Failed to close journal: %v", err)
 		}
+		if err := accessLog.Close(); err != nil {
+			log.Printf("[BRIDGE] Failed to close access log: %v", err)
+		}
+	})
+	serviceStopped := runAsService(config, func() { bridgeShutdown.Stop("service stop") })
+	go handleSignals()
+	logEvent("startup", nil, "[BRIDGE] Starting api-bridge %s (built %s)", Version, BuildTime)
+
+	if config.Profile != "" {
+		log.Printf("[BRIDGE] Using profile %s", config.Profile)
+	}
+	if config.ConfigFile != "" {
+		log.Printf("[BRIDGE] Loaded %d routes from %s", len(config.Routes), config.ConfigFile)
+	}
+
+	if config.OpenAPI != nil {
+		log.Printf("[BRIDGE] Validating requests against %s", config.OpenAPIFile)
+	}
 
-		// Forward the request through the tunnel
-		log.Printf("[BRIDGE] Forwarding request to tunnel: %s %s", r.Method, r.URL.Path)
-		if err := r.Write(tunnelConn); err != nil {
-			log.Printf("[BRIDGE] Failed to forward request through tunnel: %v", err)
-			http.Error(w, "Failed to forward request", http.StatusBadGateway)
-			return
+	// Further PSKs, so offramps can move to a new key one at a time
+	if config.PSKDir != "" {
+		minLength := 0
+		if config.Profile == "prod" {
+			minLength = minProdPSKLength
 		}
+		if psks, err = loadPSKDir(config.PSKDir, minLength); err != nil {
+			log.Fatalf("Failed to load PSKs: %v", err)
+		}
+		if config.PSK == "" && len(psks.ids()) == 0 {
+			log.Fatalf("No PSK given with --psk or in %s", config.PSKDir)
+		}
+	}
 
-		// Read response from tunnel
-		log.Printf("[BRIDGE] Reading response from tunnel")
-		resp, err := http.ReadResponse(bufio.NewReader(tunnelConn), r)
-		if err != nil {
-			log.Printf("[BRIDGE] Failed to read response from tunnel: %v", err)
-			http.Error(w, "Failed to read response", http.StatusBadGateway)
-			return
+	// Offramps enrolled with bootstrap tokens authenticate with keys of their own
+	if config.EnrollmentFile != "" {
+		if enrollments, err = loadEnrollments(config.EnrollmentFile); err != nil {
+			log.Fatalf("Failed to load enrollments: %v", err)
 		}
-		defer resp.Body.Close()
+		log.Printf("[BRIDGE] Loaded %d enrolled offramps from %s", len(enrollments.list()), config.EnrollmentFile)
+	}
 
-		// Copy response headers
-		log.Printf("[BRIDGE] Forwarding response to client: %d %s", resp.StatusCode, resp.Status)
-		for key, values := range resp.Header {
-			for _, value := range values {
-				w.Header().Add(key, value)
-			}
+	// Restore usage counters before anything computes deltas from them
+	if config.UsageStateFile != "" {
+		if err := loadUsage(config.UsageStateFile); err != nil {
+			log.Fatalf("Failed to restore usage counters: %v", err)
 		}
-		w.WriteHeader(resp.StatusCode)
+		go runUsageCheckpoints(config.UsageStateFile, config.UsageCheckpoint)
+	}
+
+	// Hold refused clients that policies send to the tarpit
+	tarpits = newTarpit(config.TarpitDelay, config.TarpitMax)
 
-		// Copy response body
-		if _, err := io.Copy(w, resp.Body); err != nil {
-			log.Printf("[BRIDGE] Failed to copy response body: %v", err)
-			return
+	// Journal requests for audits, continuing the chain already on disk
+	if config.JournalFile != "" {
+		if journal, err = openJournal(config.JournalFile); err != nil {
+			log.Fatalf("Failed to open journal: %v", err)
 		}
-	})
-}
+		log.Printf("[BRIDGE] Journaling requests to %s", config.JournalFile)
+	}
+	if config.AccessLog != "" {
+		if accessLog, err = openAccessLog(config); err != nil {
+			log.Fatalf("Failed to open access log: %v", err)
+		}
+		log.Printf("[BRIDGE] Logging requests to %s in %s format", config.AccessLog, config.AccessLogFormat)
+	}
 
-func main() {
-	config := &Config{}
+	// Create tunnel connection manager
+	tunnelConn := tunnel.NewPool(tunnel.Options{
+		Balance:        config.TunnelBalance,
+		MaxConcurrency: config.TunnelMaxConcurrency,
+		Adaptive:       config.AdaptiveConcurrency,
+		MaxFailures:    config.TunnelMaxFailures,
+		Event: func(event string, fields map[string]string, format string, args ...interface{}) {
+			logEvent(event, fields, "[BRIDGE] "+format, args...)
+		},
+	})
+	emergency.attach(tunnelConn)
+	if config.KillSwitch {
+		emergency.Engage("--kill-switch")
+	}
+	go handleKillSignal()
 
-	// Command line flags
-	flag.StringVar(&config.ListenIP, "listen-ip", "0.0.0.0", "IP address to listen on")
-	flag.IntVar(&config.ListenPort, "listen-port", 8000, "Port to listen on")
-	flag.IntVar(&config.TunnelPort, "tunnel-port", 8001, "Port to listen for tunnel connections")
-	flag.StringVar(&config.PSK, "psk", "", "Pre-shared key for tunnel authentication")
-	flag.BoolVar(&config.EnableHTTPS, "enable-https", false, "Enable HTTPS for HTTP listener")
-	flag.StringVar(&config.CertFile, "cert-file", "", "Path to TLS certificate file")
-	flag.StringVar(&config.KeyFile, "key-file", "", "Path to TLS key file")
-	flag.Parse()
+	notifier, err := buildNotifier(config)
+	if err != nil {
+		log.Fatalf("Invalid notifier configuration: %v", err)
+	}
+	// Quota warnings and drain completion also go to the notifier
+	limitAlerts = notifier
+	maintenance.notifier = notifier
 
-	// Validate required parameters
-	if config.PSK == "" {
-		log.Fatal("PSK is required")
+	// Schedule summary reports
+	if config.ReportInterval > 0 {
+		log.Printf("[BRIDGE] Sending summary reports every %s", config.ReportInterval)
+		go runReports(NewReporter(tunnelConn), notifier, config.ReportInterval)
 	}
 
-	// Create tunnel connection manager
-	tunnelConn := &TunnelConnection{}
+	if config.Telemetry == telemetry.On {
+		telemetry.NewReporter(config.TelemetryEndpoint, config.TelemetryInterval, "api-bridge", Version, func() []string {
+			return buildinfo.Enabled(features(config))
+		}).Start(logf)
+	}
 
-	// Start tunnel listener
-	go func() {
-		log.Printf("[BRIDGE] Starting tunnel listener on %s:%d", config.ListenIP, config.TunnelPort)
-		listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", config.ListenIP, config.TunnelPort))
+	// Publish metrics to CloudWatch
+	if config.CloudWatchNamespace != "" {
+		hostname, _ := os.Hostname()
+		publisher, err := NewCloudWatchPublisher(config.CloudWatchNamespace, config.CloudWatchRegion, config.CloudWatchDimensions, hostname)
 		if err != nil {
-			log.Fatalf("Failed to start tunnel listener: %v", err)
+			log.Fatalf("Invalid CloudWatch configuration: %v", err)
 		}
-		defer listener.Close()
+		log.Printf("[BRIDGE] Publishing metrics to CloudWatch namespace %s in %s every %s",
+			config.CloudWatchNamespace, publisher.region, config.CloudWatchInterval)
+		go runCloudWatchPublisher(publisher, config.CloudWatchInterval)
+	}
 
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				log.Printf("[BRIDGE] Failed to accept tunnel connection: %v", err)
-				continue
-			}
+	// Create request capture store for the inspector and offline mode
+	var captures *CaptureStore
+	if config.Inspect || config.OfflineResponses {
+		capacity := 0
+		if config.Inspect {
+			capacity = config.InspectCapacity
+		}
+		captures = NewCaptureStore(capacity, config.InspectMaxBody, config.OfflineResponses)
+	}
+	proxyHandler := createProxyHandler(tunnelConn, config, captures)
 
-			// Handle tunnel connection
-			go handleTunnelConnection(conn, tunnelConn, config)
+	// Bind every listener before reporting ready, so orchestrators never
+	// route to a half-started bridge
+	var adminListeners []net.Listener
+	if config.AdminListen != "" {
+		listener, err := net.Listen("tcp", config.AdminListen)
+		if err != nil {
+			log.Fatalf("Failed to start admin interface: %v", err)
 		}
-	}()
+		adminListeners = append(adminListeners, listener)
+	}
+	if config.AdminSocket != "" {
+		listener, err := listenAdminSocket(config.AdminSocket)
+		if err != nil {
+			log.Fatalf("Failed to start admin interface: %v", err)
+		}
+		adminListeners = append(adminListeners, listener)
+	}
+	var metricsListener net.Listener
+	if config.MetricsPort != 0 {
+		metricsListener, err = net.Listen("tcp", fmt.Sprintf("%s:%d", config.ListenIP, config.MetricsPort))
+		if err != nil {
+			log.Fatalf("Failed to start metrics listener: %v", err)
+		}
+	}
+	tunnelListener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", config.ListenIP, config.TunnelPort))
+	if err != nil {
+		log.Fatalf("Failed to start tunnel listener: %v", err)
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", config.ListenIP, config.ListenPort))
+	if err != nil {
+		log.Fatalf("Failed to start HTTP server: %v", err)
+	}
+	var priorityLn net.Listener
+	if config.PriorityListen != "" {
+		ln, err := net.Listen("tcp", config.PriorityListen)
+		if err != nil {
+			log.Fatalf("Failed to start priority listener: %v", err)
+		}
+		priorityLn = priorityListener{ln}
+	}
 
 	// Create HTTP server
 	server := &http.Server{
-		Addr:    fmt.Sprintf("%s:%d", config.ListenIP, config.ListenPort),
-		Handler: createProxyHandler(tunnelConn),
+		Addr:        fmt.Sprintf("%s:%d", config.ListenIP, config.ListenPort),
+		Handler:     proxyHandler,
+		ConnContext: priorityConnContext,
 	}
-
-	// Start HTTP server
-	log.Printf("[BRIDGE] Starting HTTP server on %s:%d", config.ListenIP, config.ListenPort)
-	if config.EnableHTTPS {
-		if config.CertFile == "" || config.KeyFile == "" {
-			log.Fatal("Certificate and key files are required for HTTPS")
+	if config.H2C {
+		server.Handler = withH2C(proxyHandler)
+	}
+	if config.ACME && config.ACMEChallenge == acmeDNS01 {
+		manager, err := newACMEManager(config)
+		if err != nil {
+			log.Fatalf("Invalid ACME configuration: %v", err)
 		}
-		if err := server.ListenAndServeTLS(config.CertFile, config.KeyFile); err != nil {
-			log.Fatalf("Failed to start HTTPS server: %v", err)
+		if err := manager.Start(); err != nil {
+			log.Fatalf("Failed to obtain certificate: %v", err)
 		}
-	} else {
-		if err := server.ListenAndServe(); err != nil {
-			log.Fatalf("Failed to start HTTP server: %v", err)
+		health := newCertHealth(func() (*tls.Certificate, error) { return manager.GetCertificate(nil) }, config, notifier)
+		health.Start()
+		server.TLSConfig = &tls.Config{GetCertificate: health.GetCertificate}
+	} else if config.ACME {
+		manager, err := newAutocertManager(config)
+		if err != nil {
+			log.Fatalf("Invalid ACME configuration: %v", err)
+		}
+		if err := manager.Start(); err != nil {
+			log.Fatalf("Failed to start ACME: %v", err)
 		}
+		server.TLSConfig = manager.TLSConfig()
+	} else if config.EnableHTTPS {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		health := newCertHealth(func() (*tls.Certificate, error) { return &cert, nil }, config, notifier)
+		health.Start()
+		server.TLSConfig = &tls.Config{GetCertificate: health.GetCertificate}
 	}
-}
-
-func handleTunnelConnection(conn net.Conn, tunnelConn *TunnelConnection, config *Config) {
-	defer conn.Close()
-
-	// Read PSK
-	log.Printf("[BRIDGE] Reading PSK from tunnel connection")
-	pskHash := make([]byte, 32)
-	if _, err := io.ReadFull(conn, pskHash); err != nil {
-		log.Printf("[BRIDGE] Failed to read PSK: %v", err)
-		return
+	if config.ClientCAFile != "" {
+		auth, err := newClientAuth(config)
+		if err != nil {
+			log.Fatalf("Invalid client certificate configuration: %v", err)
+		}
+		auth.apply(server.TLSConfig)
 	}
 
-	// Verify PSK
-	expectedHash := sha256.Sum256([]byte(config.PSK))
-	if !bytes.Equal(pskHash, expectedHash[:]) {
-		log.Printf("[BRIDGE] PSK verification failed")
-		conn.Write([]byte{1}) // Authentication failed
-		return
+	// Start admin interface
+	adminHandler := createAdminHandler(config, tunnelConn, captures, proxyHandler)
+	for _, listener := range adminListeners {
+		go func(listener net.Listener) {
+			log.Printf("[BRIDGE] Starting admin interface on %s", listener.Addr())
+			if err := http.Serve(listener, adminHandler); err != nil {
+				log.Fatalf("Failed to start admin interface: %v", err)
+			}
+		}(listener)
 	}
 
-	// Send authentication success
-	log.Printf("[BRIDGE] PSK verification successful")
-	if _, err := conn.Write([]byte{0}); err != nil {
-		log.Printf("[BRIDGE] Failed to send authentication success: %v", err)
-		return
+	// Start metrics endpoint
+	if metricsListener != nil {
+		go func() {
+			if err := stats.Serve(metricsListener, metrics, logf); err != nil {
+				log.Fatalf("Failed to serve metrics: %v", err)
+			}
+		}()
 	}
 
-	// Store the tunnel connection
-	tunnelConn.mu.Lock()
-	if tunnelConn.conn != nil {
-		tunnelConn.conn.Close()
-	}
-	tunnelConn.conn = conn
-	tunnelConn.mu.Unlock()
+	// Start tunnel listener
+	go func() {
+		log.Printf("[BRIDGE] Starting tunnel listener on %s:%d", config.ListenIP, config.TunnelPort)
+		defer tunnelListener.Close()
+
+		for {
+			conn, err := tunnelListener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				log.Printf("[BRIDGE] Failed to accept tunnel connection: %v", err)
+				continue
+			}
 
-	log.Printf("[BRIDGE] Tunnel connection established")
+			// Handle tunnel connection
+			go handleTunnelConnection(conn, tunnelConn, config, func() { warmUp(proxyHandler, config) })
+		}
+	}()
 
-	// Keep the connection alive
-	<-make(chan struct{})
+	// Start HTTP server, it serves until the bridge shuts down
+	log.Printf("[BRIDGE] Starting HTTP server on %s:%d", config.ListenIP, config.ListenPort)
+	if !bridgeShutdown.attach(server, tunnelListener, tunnelConn, config.ShutdownTimeout) {
+		return
+	}
+	markReady()
+	if priorityLn != nil {
+		// Served by the same server, so it shuts down along with it
+		go func() {
+			log.Printf("[BRIDGE] Starting priority listener on %s", config.PriorityListen)
+			var err error
+			if config.EnableHTTPS {
+				err = server.ServeTLS(priorityLn, "", "")
+			} else {
+				err = server.Serve(priorityLn)
+			}
+			if err != http.ErrServerClosed {
+				log.Fatalf("Priority listener failed: %v", err)
+			}
+		}()
+	}
+	if config.EnableHTTPS {
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatalf("HTTP server failed: %v", err)
+	}
+	<-bridgeShutdown.Done()
+	if serviceStopped != nil {
+		<-serviceStopped
+	}
 }
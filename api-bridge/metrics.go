@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"apiduct/pkg/stats"
+)
+
+// metrics is the registry of the process
+var metrics = stats.Default
+
+// statusWriter records the status code and body size written by a handler.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusWriter) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusWriter) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusWriter) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// statusClass groups status codes as "2xx", "4xx", etc.
+func statusClass(status int) string {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+func routeLabel(route *Route) string {
+	if route == nil {
+		return "default"
+	}
+	return route.Name
+}
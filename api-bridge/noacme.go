@@ -0,0 +1,43 @@
+//go:build noacme
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+const acmeCompiled = false
+
+var errNoACME = errors.New("built without ACME support")
+
+// The ACME managers are never created without ACME support, --acme is refused
+// instead.
+type (
+	acmeManager     struct{}
+	autocertManager struct{}
+)
+
+func newACMEManager(config *Config) (*acmeManager, error) {
+	return nil, errNoACME
+}
+
+func (m *acmeManager) Start() error {
+	return errNoACME
+}
+
+func (m *acmeManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return nil, errNoACME
+}
+
+func newAutocertManager(config *Config) (*autocertManager, error) {
+	return nil, errNoACME
+}
+
+func (m *autocertManager) Start() error {
+	return errNoACME
+}
+
+func (m *autocertManager) TLSConfig() *tls.Config {
+	return nil
+}
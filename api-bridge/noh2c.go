@@ -0,0 +1,12 @@
+//go:build noh2c
+
+package main
+
+import "net/http"
+
+const h2cCompiled = false
+
+// withH2C is never called without h2c support, --h2c is refused instead.
+func withH2C(handler http.Handler) http.Handler {
+	return handler
+}
@@ -0,0 +1,9 @@
+//go:build noinspector
+
+package main
+
+const inspectorCompiled = false
+
+// inspectorPage is never served without the inspector, --inspect is refused
+// instead.
+const inspectorPage = ""
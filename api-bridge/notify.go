@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Notifier delivers operator notifications such as scheduled reports.
+type Notifier interface {
+	Notify(subject, text string, payload interface{}) error
+}
+
+// webhookNotifier posts notifications as JSON to a URL.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *webhookNotifier) Notify(subject, text string, payload interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"subject": subject,
+		"text":    text,
+		"data":    payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// emailNotifier sends plain text notifications over SMTP.
+type emailNotifier struct {
+	addr     string
+	from     string
+	to       []string
+	username string
+	password string
+}
+
+func (n *emailNotifier) Notify(subject, text string, payload interface{}) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(text, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if n.username != "" {
+		host, _, err := net.SplitHostPort(n.addr)
+		if err != nil {
+			return fmt.Errorf("invalid SMTP address: %v", err)
+		}
+		auth = smtp.PlainAuth("", n.username, n.password, host)
+	}
+	if err := smtp.SendMail(n.addr, auth, n.from, n.to, msg.Bytes()); err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+	return nil
+}
+
+// multiNotifier fans a notification out to several notifiers.
+type multiNotifier []Notifier
+
+func (m multiNotifier) Notify(subject, text string, payload interface{}) error {
+	var errs []string
+	for _, n := range m {
+		if err := n.Notify(subject, text, payload); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// buildNotifier returns the notifier configured by flags, or nil.
+func buildNotifier(config *Config) (Notifier, error) {
+	var notifiers multiNotifier
+	if config.NotifyWebhook != "" {
+		notifiers = append(notifiers, &webhookNotifier{
+			url:    config.NotifyWebhook,
+			client: &http.Client{Timeout: 10 * time.Second},
+		})
+	}
+	if config.NotifyEmailTo != "" {
+		if config.NotifySMTPAddr == "" || config.NotifyEmailFrom == "" {
+			return nil, fmt.Errorf("SMTP address and sender are required for email notifications")
+		}
+		notifiers = append(notifiers, &emailNotifier{
+			addr:     config.NotifySMTPAddr,
+			from:     config.NotifyEmailFrom,
+			to:       strings.Split(config.NotifyEmailTo, ","),
+			username: config.NotifySMTPUser,
+			password: config.NotifySMTPPassword,
+		})
+	}
+	if len(notifiers) == 0 {
+		return nil, nil
+	}
+	return notifiers, nil
+}
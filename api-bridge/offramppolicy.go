@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"apiduct/pkg/auth"
+)
+
+// offrampPolicy lists, per offramp identity, the names of the routes its
+// tunnels may serve, "default" standing for requests that match no route.
+// An identity is the one an offramp enrolled under or the client ID it
+// presented. Without a policy any authenticated offramp may serve any route;
+// with one, offramps it does not list serve none.
+type offrampPolicy map[string]map[string]bool
+
+// add allows identity to serve the named routes, which must exist.
+func (p offrampPolicy) add(identity string, names []string, routes []*Route) error {
+	if err := auth.ValidateName(identity); err != nil {
+		return err
+	}
+	if p[identity] == nil {
+		p[identity] = make(map[string]bool)
+	}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name != routeLabel(nil) && !hasRoute(routes, name) {
+			return fmt.Errorf("offramp %s: no route is called %q", identity, name)
+		}
+		p[identity][name] = true
+	}
+	return nil
+}
+
+func hasRoute(routes []*Route, name string) bool {
+	for _, route := range routes {
+		if route.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// buildOfframpPolicy combines the config file's offramp_policy with the
+// --offramp-policy values, given as identity=route[,route...].
+func buildOfframpPolicy(fromFile map[string][]string, fromFlags []string, routes []*Route) (offrampPolicy, error) {
+	policy := make(offrampPolicy)
+	for identity, names := range fromFile {
+		if err := policy.add(identity, names, routes); err != nil {
+			return nil, err
+		}
+	}
+	for _, value := range fromFlags {
+		identity, names, ok := strings.Cut(value, "=")
+		if !ok || names == "" {
+			return nil, fmt.Errorf("invalid offramp policy %q, expected identity=route[,route...]", value)
+		}
+		if err := policy.add(identity, strings.Split(names, ","), routes); err != nil {
+			return nil, err
+		}
+	}
+	return policy, nil
+}
+
+// lists reports whether the policy names identity, whose --psk-dir key of
+// the same ID then only authenticates that client ID.
+func (p offrampPolicy) lists(identity string) bool {
+	return p[identity] != nil
+}
+
+// allows reports whether a tunnel of identity may serve route, nil for
+// requests that match no route.
+func (p offrampPolicy) allows(identity string, route *Route) bool {
+	return len(p) == 0 || p[identity][routeLabel(route)]
+}
+
+// admits reports whether an offramp of identity announcing name may serve
+// any of the routes it would be sent: those naming it, or for an unnamed
+// offramp those naming no offramp and requests matching no route.
+func (p offrampPolicy) admits(identity, name string, routes []*Route) bool {
+	if len(p) == 0 {
+		return true
+	}
+	if name == "" && p.allows(identity, nil) {
+		return true
+	}
+	for _, route := range routes {
+		if route.Offramp == name && p.allows(identity, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkClientID returns why an offramp that authenticated with the --psk-dir
+// key keyID, or enrolled under identity, may not present clientID, "" if it
+// may.
+func checkClientID(clientID, identity, keyID string) string {
+	if identity != "" && clientID != "" && clientID != identity {
+		return fmt.Sprintf("Offramp enrolled as %s presented client ID %s", identity, clientID)
+	}
+	if keyID != "" && keyID != defaultKeyID && live.OfframpPolicy().lists(keyID) && clientID != keyID {
+		return fmt.Sprintf("PSK %s only authenticates client ID %s, offramp presented %q", keyID, keyID, clientID)
+	}
+	return ""
+}
+
+func describeIdentity(identity string) string {
+	if identity == "" {
+		return "an offramp without identity"
+	}
+	return "identity " + identity
+}
+
+func describeOfframpName(name string) string {
+	if name == "" {
+		return "unnamed routes"
+	}
+	return "offramp name " + name
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"apiduct/pkg/auth"
+)
+
+// servesRoute reports whether a route sends its requests to the offramp
+// called name.
+func servesRoute(routes []*Route, name string) bool {
+	for _, route := range routes {
+		if route.Offramp == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOfframpRoute parses an --offramp-route value, name=host, name=/prefix
+// or name=host/prefix, into a route served by the offramp called name.
+func parseOfframpRoute(value string) (*Route, error) {
+	name, target, ok := strings.Cut(value, "=")
+	if !ok || target == "" {
+		return nil, fmt.Errorf("invalid offramp route %q, expected name=host, name=/prefix or name=host/prefix", value)
+	}
+	if err := auth.ValidateName(name); err != nil {
+		return nil, err
+	}
+	route := &Route{Name: name, Offramp: name, PathPrefix: "/"}
+	if i := strings.Index(target, "/"); i >= 0 {
+		route.Host, route.PathPrefix = target[:i], target[i:]
+	} else {
+		route.Host = target
+	}
+	return route, nil
+}
+
+// hostMatches reports whether the Host header host matches pattern, a host
+// name or a wildcard such as *.example.com. The port is ignored.
+func hostMatches(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	pattern = strings.ToLower(pattern)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
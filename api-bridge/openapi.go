@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Maximum depth followed when resolving nested schemas and $refs
+const maxSchemaDepth = 32
+
+type openAPISchema struct {
+	Ref        string                    `yaml:"$ref"`
+	Type       string                    `yaml:"type"`
+	Enum       []interface{}             `yaml:"enum"`
+	Minimum    *float64                  `yaml:"minimum"`
+	Maximum    *float64                  `yaml:"maximum"`
+	MinLength  *int                      `yaml:"minLength"`
+	MaxLength  *int                      `yaml:"maxLength"`
+	Pattern    string                    `yaml:"pattern"`
+	Nullable   bool                      `yaml:"nullable"`
+	Required   []string                  `yaml:"required"`
+	Properties map[string]*openAPISchema `yaml:"properties"`
+	Items      *openAPISchema            `yaml:"items"`
+}
+
+type openAPIParameter struct {
+	Ref      string         `yaml:"$ref"`
+	Name     string         `yaml:"name"`
+	In       string         `yaml:"in"`
+	Required bool           `yaml:"required"`
+	Schema   *openAPISchema `yaml:"schema"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `yaml:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Ref      string                       `yaml:"$ref"`
+	Required bool                         `yaml:"required"`
+	Content  map[string]*openAPIMediaType `yaml:"content"`
+}
+
+type openAPIOperation struct {
+	Parameters  []*openAPIParameter `yaml:"parameters"`
+	RequestBody *openAPIRequestBody `yaml:"requestBody"`
+}
+
+type openAPIPathItem struct {
+	Parameters []*openAPIParameter `yaml:"parameters"`
+	Get        *openAPIOperation   `yaml:"get"`
+	Put        *openAPIOperation   `yaml:"put"`
+	Post       *openAPIOperation   `yaml:"post"`
+	Delete     *openAPIOperation   `yaml:"delete"`
+	Options    *openAPIOperation   `yaml:"options"`
+	Head       *openAPIOperation   `yaml:"head"`
+	Patch      *openAPIOperation   `yaml:"patch"`
+}
+
+func (p *openAPIPathItem) operation(method string) *openAPIOperation {
+	switch method {
+	case http.MethodGet:
+		return p.Get
+	case http.MethodPut:
+		return p.Put
+	case http.MethodPost:
+		return p.Post
+	case http.MethodDelete:
+		return p.Delete
+	case http.MethodOptions:
+		return p.Options
+	case http.MethodHead:
+		if p.Head == nil {
+			return p.Get
+		}
+		return p.Head
+	case http.MethodPatch:
+		return p.Patch
+	}
+	return nil
+}
+
+type openAPISpec struct {
+	Servers []struct {
+		URL string `yaml:"url"`
+	} `yaml:"servers"`
+	Paths      map[string]*openAPIPathItem `yaml:"paths"`
+	Components struct {
+		Schemas       map[string]*openAPISchema      `yaml:"schemas"`
+		Parameters    map[string]*openAPIParameter   `yaml:"parameters"`
+		RequestBodies map[string]*openAPIRequestBody `yaml:"requestBodies"`
+	} `yaml:"components"`
+}
+
+type openAPIPath struct {
+	template string
+	segments []string
+	item     *openAPIPathItem
+}
+
+// OpenAPIValidator rejects requests that do not match an OpenAPI 3 document.
+type OpenAPIValidator struct {
+	spec     *openAPISpec
+	basePath string
+	paths    []*openAPIPath
+	patterns sync.Map // pattern string -> *regexp.Regexp
+}
+
+// LoadOpenAPIValidator reads an OpenAPI 3 document in YAML or JSON format.
+func LoadOpenAPIValidator(path string) (*OpenAPIValidator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OpenAPI spec: %v", err)
+	}
+
+	spec := &openAPISpec{}
+	if err := yaml.Unmarshal(data, spec); err != nil {
+		return nil, fmt.Errorf("failed to parse OpenAPI spec: %v", err)
+	}
+	if len(spec.Paths) == 0 {
+		return nil, fmt.Errorf("OpenAPI spec defines no paths")
+	}
+
+	v := &OpenAPIValidator{spec: spec}
+	if len(spec.Servers) > 0 {
+		if u, err := url.Parse(spec.Servers[0].URL); err == nil {
+			v.basePath = strings.TrimSuffix(u.Path, "/")
+		}
+	}
+
+	for template, item := range spec.Paths {
+		v.paths = append(v.paths, &openAPIPath{
+			template: template,
+			segments: strings.Split(strings.Trim(template, "/"), "/"),
+			item:     item,
+		})
+	}
+	// Prefer literal segments over templated ones when both match
+	sort.Slice(v.paths, func(i, j int) bool {
+		return strings.Count(v.paths[i].template, "{") < strings.Count(v.paths[j].template, "{")
+	})
+
+	return v, nil
+}
+
+func (v *OpenAPIValidator) matchPath(path string) (*openAPIPath, map[string]string) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, candidate := range v.paths {
+		if len(candidate.segments) != len(segments) {
+			continue
+		}
+		params := make(map[string]string)
+		matched := true
+		for i, segment := range candidate.segments {
+			if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+				params[segment[1:len(segment)-1]] = segments[i]
+				continue
+			}
+			if segment != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return candidate, params
+		}
+	}
+	return nil, nil
+}
+
+func (v *OpenAPIValidator) resolveParameter(p *openAPIParameter) *openAPIParameter {
+	for depth := 0; p != nil && p.Ref != "" && depth < maxSchemaDepth; depth++ {
+		p = v.spec.Components.Parameters[strings.TrimPrefix(p.Ref, "#/components/parameters/")]
+	}
+	return p
+}
+
+func (v *OpenAPIValidator) resolveRequestBody(b *openAPIRequestBody) *openAPIRequestBody {
+	for depth := 0; b != nil && b.Ref != "" && depth < maxSchemaDepth; depth++ {
+		b = v.spec.Components.RequestBodies[strings.TrimPrefix(b.Ref, "#/components/requestBodies/")]
+	}
+	return b
+}
+
+func (v *OpenAPIValidator) resolveSchema(s *openAPISchema) *openAPISchema {
+	for depth := 0; s != nil && s.Ref != "" && depth < maxSchemaDepth; depth++ {
+		s = v.spec.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	return s
+}
+
+// ValidateRequest checks r against the spec and returns human readable
+// problems. The request body is buffered for validation and restored.
+func (v *OpenAPIValidator) ValidateRequest(r *http.Request) []string {
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		raw, err := readLimitedBody(&deadlineReader{r: r.Body, deadline: time.Now().Add(inspectTimeout)})
+		r.Body.Close()
+		if err != nil {
+			return []string{fmt.Sprintf("request body could not be read for validation: %v", err)}
+		}
+		r.Body = io.NopCloser(bytes.NewReader(raw))
+
+		body, err = readPlainBody(bytes.NewReader(raw), strings.ToLower(r.Header.Get("Content-Encoding")))
+		if err != nil {
+			return []string{fmt.Sprintf("request body could not be decoded for validation: %v", err)}
+		}
+	}
+	return v.validate(r, body)
+}
+
+func (v *OpenAPIValidator) validate(r *http.Request, body []byte) []string {
+	path := r.URL.Path
+	if v.basePath != "" {
+		if !strings.HasPrefix(path, v.basePath) {
+			return []string{fmt.Sprintf("path %s is outside the API base path %s", path, v.basePath)}
+		}
+		path = strings.TrimPrefix(path, v.basePath)
+	}
+
+	match, pathParams := v.matchPath(path)
+	if match == nil {
+		return []string{fmt.Sprintf("unknown path %s", path)}
+	}
+	operation := match.item.operation(r.Method)
+	if operation == nil {
+		return []string{fmt.Sprintf("method %s is not allowed on %s", r.Method, match.template)}
+	}
+
+	var problems []string
+
+	// Operation-level parameters override path-level ones with the same name
+	params := make(map[string]*openAPIParameter)
+	for _, p := range append(append([]*openAPIParameter{}, match.item.Parameters...), operation.Parameters...) {
+		if p = v.resolveParameter(p); p != nil {
+			params[p.In+":"+p.Name] = p
+		}
+	}
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	query := r.URL.Query()
+	for _, key := range keys {
+		p := params[key]
+		var values []string
+		switch p.In {
+		case "path":
+			if value, ok := pathParams[p.Name]; ok {
+				values = []string{value}
+			}
+		case "query":
+			values = query[p.Name]
+		case "header":
+			values = r.Header.Values(p.Name)
+		default:
+			continue
+		}
+
+		if len(values) == 0 {
+			if p.Required || p.In == "path" {
+				problems = append(problems, fmt.Sprintf("missing required %s parameter %q", p.In, p.Name))
+			}
+			continue
+		}
+
+		schema := v.resolveSchema(p.Schema)
+		if schema == nil {
+			continue
+		}
+		if schema.Type == "array" {
+			if p.In != "query" && len(values) == 1 {
+				values = strings.Split(values[0], ",")
+			}
+			for _, value := range values {
+				problems = append(problems, v.validateParameterValue(v.resolveSchema(schema.Items), value, p.In+" parameter "+p.Name)...)
+			}
+			continue
+		}
+		problems = append(problems, v.validateParameterValue(schema, values[0], p.In+" parameter "+p.Name)...)
+	}
+
+	problems = append(problems, v.validateBody(r, v.resolveRequestBody(operation.RequestBody), body)...)
+	return problems
+}
+
+func (v *OpenAPIValidator) validateBody(r *http.Request, requestBody *openAPIRequestBody, body []byte) []string {
+	if requestBody == nil {
+		return nil
+	}
+	if len(body) == 0 {
+		if requestBody.Required {
+			return []string{"missing required request body"}
+		}
+		return nil
+	}
+
+	mediaType := mediaTypeOf(r.Header.Get("Content-Type"))
+	var content *openAPIMediaType
+	for pattern, candidate := range requestBody.Content {
+		if mediaTypeMatches(pattern, mediaType) {
+			content = candidate
+			break
+		}
+	}
+	if content == nil && len(requestBody.Content) > 0 {
+		return []string{fmt.Sprintf("content type %q is not accepted", mediaType)}
+	}
+	if content == nil || content.Schema == nil || !isJSONContentType(mediaType) {
+		return nil
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return []string{fmt.Sprintf("request body is not valid JSON: %v", err)}
+	}
+	return v.validateValue(content.Schema, doc, "body", 0)
+}
+
+// validateParameterValue converts a raw parameter string according to the
+// schema type before validating it.
+func (v *OpenAPIValidator) validateParameterValue(schema *openAPISchema, raw, name string) []string {
+	if schema == nil {
+		return nil
+	}
+
+	var value interface{} = raw
+	switch schema.Type {
+	case "integer":
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return []string{fmt.Sprintf("%s must be an integer, got %q", name, raw)}
+		}
+		value = float64(n)
+	case "number":
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return []string{fmt.Sprintf("%s must be a number, got %q", name, raw)}
+		}
+		value = n
+	case "boolean":
+		if raw != "true" && raw != "false" {
+			return []string{fmt.Sprintf("%s must be a boolean, got %q", name, raw)}
+		}
+		value = raw == "true"
+	}
+	return v.validateValue(schema, value, name, 0)
+}
+
+func (v *OpenAPIValidator) validateValue(schema *openAPISchema, value interface{}, name string, depth int) []string {
+	schema = v.resolveSchema(schema)
+	if schema == nil || depth > maxSchemaDepth {
+		return nil
+	}
+	if value == nil {
+		if schema.Nullable || schema.Type == "" {
+			return nil
+		}
+		return []string{fmt.Sprintf("%s must not be null", name)}
+	}
+
+	var problems []string
+	switch schema.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s must be an object", name)}
+		}
+		for _, field := range schema.Required {
+			if _, ok := obj[field]; !ok {
+				problems = append(problems, fmt.Sprintf("%s.%s is required", name, field))
+			}
+		}
+		fields := make([]string, 0, len(schema.Properties))
+		for field := range schema.Properties {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			if fieldValue, ok := obj[field]; ok {
+				problems = append(problems, v.validateValue(schema.Properties[field], fieldValue, name+"."+field, depth+1)...)
+			}
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s must be an array", name)}
+		}
+		for i, item := range items {
+			problems = append(problems, v.validateValue(schema.Items, item, fmt.Sprintf("%s[%d]", name, i), depth+1)...)
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return []string{fmt.Sprintf("%s must be a string", name)}
+		}
+		if schema.MinLength != nil && len(s) < *schema.MinLength {
+			problems = append(problems, fmt.Sprintf("%s must be at least %d characters", name, *schema.MinLength))
+		}
+		if schema.MaxLength != nil && len(s) > *schema.MaxLength {
+			problems = append(problems, fmt.Sprintf("%s must be at most %d characters", name, *schema.MaxLength))
+		}
+		if schema.Pattern != "" {
+			re, ok := v.patterns.Load(schema.Pattern)
+			if !ok {
+				compiled, err := regexp.Compile(schema.Pattern)
+				if err != nil {
+					break
+				}
+				re, _ = v.patterns.LoadOrStore(schema.Pattern, compiled)
+			}
+			if !re.(*regexp.Regexp).MatchString(s) {
+				problems = append(problems, fmt.Sprintf("%s does not match pattern %s", name, schema.Pattern))
+			}
+		}
+	case "integer", "number":
+		n, ok := value.(float64)
+		if !ok || (schema.Type == "integer" && n != float64(int64(n))) {
+			return []string{fmt.Sprintf("%s must be of type %s", name, schema.Type)}
+		}
+		if schema.Minimum != nil && n < *schema.Minimum {
+			problems = append(problems, fmt.Sprintf("%s must be >= %v", name, *schema.Minimum))
+		}
+		if schema.Maximum != nil && n > *schema.Maximum {
+			problems = append(problems, fmt.Sprintf("%s must be <= %v", name, *schema.Maximum))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return []string{fmt.Sprintf("%s must be a boolean", name)}
+		}
+	}
+
+	if len(schema.Enum) > 0 && !enumContains(schema.Enum, value) {
+		problems = append(problems, fmt.Sprintf("%s must be one of %v", name, schema.Enum))
+	}
+	return problems
+}
+
+func enumContains(enum []interface{}, value interface{}) bool {
+	for _, candidate := range enum {
+		if fmt.Sprint(candidate) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Requests on the priority lane, such as the target's health checks, skip the
+// rate and concurrency limits and travel on priority streams, which the
+// offramp serves with workers of their own. Data traffic piling up can then
+// not make a healthy target look down.
+const priorityKey contextKey = "priority"
+
+// priorityListener marks the connections accepted on --priority-listen, all
+// of whose requests take the priority lane.
+type priorityListener struct {
+	net.Listener
+}
+
+type priorityConn struct {
+	net.Conn
+}
+
+func (l priorityListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return priorityConn{conn}, nil
+}
+
+// priorityConnContext marks the requests of connections from a
+// priorityListener, for http.Server.ConnContext.
+func priorityConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if _, ok := conn.(priorityConn); ok {
+		return context.WithValue(ctx, priorityKey, true)
+	}
+	return ctx
+}
+
+// isPriority reports whether r takes the priority lane, because it arrived
+// on the priority listener or its path starts with one of paths.
+func isPriority(r *http.Request, paths []string) bool {
+	if r.Context().Value(priorityKey) != nil {
+		return true
+	}
+	for _, prefix := range paths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
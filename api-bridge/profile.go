@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/spf13/pflag"
+)
+
+// builtinProfiles are the flag defaults of the standard profiles. Settings
+// from the config file and flags on the command line take precedence.
+var builtinProfiles = map[string]map[string]string{
+	"dev": {
+		"listen-host":       "127.0.0.1",
+		"https":             "false",
+		"log-level":         "debug",
+		"log-sample-burst":  "0",
+		"clock-skew-action": "warn",
+	},
+	"staging": {
+		"log-level": "info",
+	},
+	"prod": {
+		"https":             "true",
+		"log-level":         "info",
+		"clock-skew-action": "fail",
+	},
+}
+
+// minProdPSKLength is the shortest PSK the prod profile accepts.
+const minProdPSKLength = 16
+
+// resolveProfile loads the config for a profile. A file may define profiles
+// under "profiles"; a directory holds an optional base.json and one
+// <profile>.json per profile. Profile settings are merged over the base
+// settings, and profile routes and logging replace those of the base.
+func resolveProfile(path, profile string) (*FileConfig, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var base, override *FileConfig
+	if info.IsDir() {
+		base = &FileConfig{}
+		if basePath := configFileIn(path, "base"); basePath != "" {
+			if base, err = readFileConfig(basePath); err != nil {
+				return nil, err
+			}
+		}
+		if profile != "" {
+			if profilePath := configFileIn(path, profile); profilePath != "" {
+				if override, err = readFileConfig(profilePath); err != nil {
+					return nil, err
+				}
+			} else if _, builtin := builtinProfiles[profile]; !builtin {
+				return nil, fmt.Errorf("profile %q not found in %s", profile, path)
+			}
+		}
+	} else {
+		if base, err = readFileConfig(path); err != nil {
+			return nil, err
+		}
+		if profile != "" {
+			override = base.Profiles[profile]
+			if _, builtin := builtinProfiles[profile]; override == nil && !builtin {
+				return nil, fmt.Errorf("profile %q not found in %s", profile, path)
+			}
+		}
+	}
+
+	resolved := &FileConfig{
+		Settings: make(map[string]interface{}),
+		Routes:   base.Routes,
+		Logging:  base.Logging,
+
+		TunnelACLs:      base.TunnelACLs,
+		OfframpPolicy:   base.OfframpPolicy,
+		ClientSchedules: base.ClientSchedules,
+	}
+	for name, value := range base.Settings {
+		resolved.Settings[name] = value
+	}
+	if override != nil {
+		for name, value := range override.Settings {
+			resolved.Settings[name] = value
+		}
+		if len(override.Routes) > 0 {
+			resolved.Routes = override.Routes
+		}
+		if len(override.Logging) > 0 {
+			resolved.Logging = override.Logging
+		}
+		if len(override.TunnelACLs) > 0 {
+			resolved.TunnelACLs = override.TunnelACLs
+		}
+		if len(override.OfframpPolicy) > 0 {
+			resolved.OfframpPolicy = override.OfframpPolicy
+		}
+		if len(override.ClientSchedules) > 0 {
+			resolved.ClientSchedules = override.ClientSchedules
+		}
+	}
+	return resolved, nil
+}
+
+// applySettings sets flags from the built-in profile defaults and the config
+// file settings, skipping flags given on the command line. Settings may use
+// deprecated flag names.
+func applySettings(flags *pflag.FlagSet, profile string, settings map[string]interface{}) error {
+	values := make(map[string]string)
+	for name, value := range builtinProfiles[profile] {
+		values[name] = value
+	}
+	for name, value := range settings {
+		if renamed, ok := flagAliases[name]; ok {
+			name = renamed
+		}
+		switch v := value.(type) {
+		case string:
+			values[name] = v
+		case bool:
+			values[name] = strconv.FormatBool(v)
+		case float64:
+			values[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return fmt.Errorf("setting %s: unsupported value %v", name, value)
+		}
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "config" || name == "profile" {
+			return fmt.Errorf("setting %s cannot be set in the config file", name)
+		}
+		if flags.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %s", name)
+		}
+		if flagChanged(flags, name) {
+			continue
+		}
+		if err := flags.Set(name, values[name]); err != nil {
+			return fmt.Errorf("setting %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// checkProfile enforces the requirements of the prod profile.
+func checkProfile(config *Config) error {
+	if config.Profile != "prod" {
+		return nil
+	}
+	if !config.EnableHTTPS {
+		return fmt.Errorf("--https is required")
+	}
+	if config.PSK != "" && len(config.PSK) < minProdPSKLength {
+		return fmt.Errorf("the PSK must have at least %d characters", minProdPSKLength)
+	}
+	if config.Inspect {
+		return fmt.Errorf("--inspect is not allowed, as it keeps request bodies in memory")
+	}
+	return nil
+}
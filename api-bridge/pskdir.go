@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"apiduct/pkg/auth"
+)
+
+// defaultKeyID names the key given with --psk.
+const defaultKeyID = "default"
+
+// pskKeyring holds the PSKs in --psk-dir, one per file named after its key
+// ID, so offramps can move to a new key one at a time while the old one is
+// still accepted. The directory is read again when its files change.
+type pskKeyring struct {
+	dir       string
+	minLength int // of each key, for the prod profile
+
+	mu     sync.Mutex
+	keys   map[string]string // key by ID
+	loaded map[string]time.Time
+}
+
+// psks is nil without --psk-dir.
+var psks *pskKeyring
+
+// loadPSKDir reads the keys in dir, refusing keys shorter than minLength.
+func loadPSKDir(dir string, minLength int) (*pskKeyring, error) {
+	k := &pskKeyring{dir: dir, minLength: minLength}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// load reads the directory again if a key file was added, changed or
+// removed. Hidden files are skipped, so editors' swap files are not keys.
+func (k *pskKeyring) load() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	entries, err := os.ReadDir(k.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read PSK directory: %v", err)
+	}
+	files := make(map[string]time.Time)
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("failed to read PSK file: %v", err)
+		}
+		files[entry.Name()] = info.ModTime()
+	}
+	if k.keys != nil && sameFiles(files, k.loaded) {
+		return nil
+	}
+
+	keys := make(map[string]string, len(files))
+	for id := range files {
+		data, err := os.ReadFile(filepath.Join(k.dir, id))
+		if err != nil {
+			return fmt.Errorf("failed to read PSK file: %v", err)
+		}
+		key := strings.TrimSpace(string(data))
+		if key == "" {
+			return fmt.Errorf("PSK file %s is empty", id)
+		}
+		if len(key) < k.minLength {
+			return fmt.Errorf("PSK %s must have at least %d characters", id, k.minLength)
+		}
+		if id == defaultKeyID {
+			return fmt.Errorf("key ID %q is reserved for --psk", defaultKeyID)
+		}
+		keys[id] = key
+	}
+	k.keys = keys
+	k.loaded = files
+	log.Printf("[BRIDGE] Loaded %d PSKs from %s: %s", len(keys), k.dir, strings.Join(k.idsLocked(), ", "))
+	return nil
+}
+
+func sameFiles(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, modTime := range a {
+		if loaded, ok := b[name]; !ok || !loaded.Equal(modTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// verify returns the ID of the key the offramp proved it knows, "" if none.
+func (k *pskKeyring) verify(hello *auth.Hello) string {
+	if k == nil {
+		return ""
+	}
+	if err := k.load(); err != nil {
+		log.Printf("[BRIDGE] Failed to reload PSKs, using the loaded ones: %v", err)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for id, key := range k.keys {
+		if hello.Verify(key) {
+			return id
+		}
+	}
+	return ""
+}
+
+// ids returns the key IDs in order.
+func (k *pskKeyring) ids() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.idsLocked()
+}
+
+func (k *pskKeyring) idsLocked() []string {
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket admitting RequestsPerSecond requests on
+// average, with bursts of up to Burst. Limits per client keep a bucket for
+// each client IP address.
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst,omitempty"` // defaults to the rate, at least 1
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+// newRateLimit returns a limit of rate requests per second, or nil for no
+// limit.
+func newRateLimit(rate float64, burst int) *RateLimit {
+	if rate <= 0 {
+		return nil
+	}
+	return &RateLimit{RequestsPerSecond: rate, Burst: burst}
+}
+
+func (l *RateLimit) validate() error {
+	if l == nil {
+		return nil
+	}
+	if l.RequestsPerSecond <= 0 || math.IsInf(l.RequestsPerSecond, 0) || math.IsNaN(l.RequestsPerSecond) {
+		return fmt.Errorf("requests_per_second must be positive")
+	}
+	if l.Burst < 0 {
+		return fmt.Errorf("burst must not be negative")
+	}
+	return nil
+}
+
+func (l *RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.RequestsPerSecond))
+}
+
+// tokenBucket holds the tokens left at the time it was last used.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take spends a token from key's bucket, reporting whether there was one and
+// otherwise how long until there is. A nil limit admits everything.
+func (l *RateLimit) take(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	burst := l.burst()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*tokenBucket)
+	}
+	// A bucket that has filled up again is no different from a new one, so
+	// forget those of clients gone quiet
+	full := time.Duration(burst / l.RequestsPerSecond * float64(time.Second))
+	if now.Sub(l.swept) > full && now.Sub(l.swept) > time.Minute {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > full {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.RequestsPerSecond)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.RequestsPerSecond * float64(time.Second))
+}
+
+// clientIP returns the IP address of the client that sent r.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimited checks a request against the per-client and shared limits of
+// its route and then of the bridge, reporting the first one exceeded ("" if
+// none) and when to retry.
+func rateLimited(r *http.Request, route *Route, global, client *RateLimit) (string, time.Duration) {
+	ip := clientIP(r)
+	if route != nil {
+		if ok, wait := route.ClientRateLimit.take(ip); !ok {
+			return "route_client", wait
+		}
+		if ok, wait := route.RateLimit.take(""); !ok {
+			return "route", wait
+		}
+	}
+	if ok, wait := client.take(ip); !ok {
+		return "client", wait
+	}
+	if ok, wait := global.take(""); !ok {
+		return "global", wait
+	}
+	return "", 0
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ready is closed once all listeners are bound and the bridge can take
+// traffic.
+var (
+	ready     = make(chan struct{})
+	readyOnce sync.Once
+)
+
+// markReady reports the bridge as ready, to the admin interface, systemd
+// (Type=notify units) and the Windows service control manager.
+func markReady() {
+	readyOnce.Do(func() {
+		close(ready)
+		logEvent("ready", nil, "[BRIDGE] Listeners bound, ready for traffic")
+		if err := sdNotify("READY=1"); err != nil {
+			logFields(nil, "[BRIDGE] Failed to notify systemd: %v", err)
+		}
+	})
+}
+
+func isReady() bool {
+	select {
+	case <-ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// sdNotify sends a state change to systemd if NOTIFY_SOCKET is set.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		// Abstract socket namespace
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// handleReady answers readiness probes. A draining bridge is not ready, so
+// load balancers stop sending it traffic.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	draining := maintenance.isDraining()
+	status := map[string]bool{"ready": isReady() && !draining, "draining": draining}
+	if !status["ready"] {
+		writeJSON(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
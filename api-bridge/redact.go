@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Default replacement value for masked fields
+const defaultRedactionMask = "[REDACTED]"
+
+// Redaction strips or masks JSON fields. A plain field name (e.g. "password")
+// matches that key at any depth, while a dotted path (e.g. "user.ssn") only
+// matches that exact location.
+type Redaction struct {
+	Fields []string `json:"fields"`
+	Action string   `json:"action,omitempty"` // "mask" (default) or "remove"
+	Mask   string   `json:"mask,omitempty"`
+}
+
+func (rd *Redaction) validate() error {
+	if rd == nil {
+		return nil
+	}
+	switch rd.Action {
+	case "":
+		rd.Action = "mask"
+	case "mask", "remove":
+	default:
+		return fmt.Errorf("unknown redaction action %q", rd.Action)
+	}
+	if rd.Mask == "" {
+		rd.Mask = defaultRedactionMask
+	}
+	return nil
+}
+
+func (rd *Redaction) apply(body []byte) ([]byte, error) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return body, nil
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("body is not valid JSON: %v", err)
+	}
+
+	for _, field := range rd.Fields {
+		if strings.Contains(field, ".") {
+			if obj, ok := doc.(map[string]interface{}); ok {
+				if _, found := getField(obj, field); found {
+					rd.redactPath(obj, field)
+				}
+			}
+			continue
+		}
+		rd.redactKey(doc, field)
+	}
+
+	return json.Marshal(doc)
+}
+
+func (rd *Redaction) redactPath(obj map[string]interface{}, path string) {
+	if rd.Action == "remove" {
+		deleteField(obj, path)
+		return
+	}
+	setField(obj, path, rd.Mask)
+}
+
+// redactKey walks objects and arrays, redacting every occurrence of key.
+func (rd *Redaction) redactKey(node interface{}, key string) {
+	switch value := node.(type) {
+	case map[string]interface{}:
+		for k, child := range value {
+			if k == key {
+				if rd.Action == "remove" {
+					delete(value, k)
+				} else {
+					value[k] = rd.Mask
+				}
+				continue
+			}
+			rd.redactKey(child, key)
+		}
+	case []interface{}:
+		for _, child := range value {
+			rd.redactKey(child, key)
+		}
+	}
+}
+
+func redactRequest(r *http.Request, rd *Redaction) error {
+	return rewriteRequestBody(r, rd.apply)
+}
+
+func redactResponse(resp *http.Response, rd *Redaction) error {
+	return rewriteResponseBody(resp, rd.apply)
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestRedaction(t *testing.T) {
+	const body = `{"user":{"name":"bob","ssn":"123-45-6789","password":"hunter2"},"items":[{"password":"x"}],"password":"y"}`
+	tests := []struct {
+		name      string
+		redaction Redaction
+		body      string
+		want      string
+	}{
+		{"mask key at any depth", Redaction{Fields: []string{"password"}}, body,
+			`{"items":[{"password":"[REDACTED]"}],"password":"[REDACTED]","user":{"name":"bob","password":"[REDACTED]","ssn":"123-45-6789"}}`},
+		{"remove key at any depth", Redaction{Fields: []string{"password"}, Action: "remove"}, body,
+			`{"items":[{}],"user":{"name":"bob","ssn":"123-45-6789"}}`},
+		{"mask path", Redaction{Fields: []string{"user.ssn"}, Mask: "***"}, body,
+			`{"items":[{"password":"x"}],"password":"y","user":{"name":"bob","password":"hunter2","ssn":"***"}}`},
+		{"remove path", Redaction{Fields: []string{"user.ssn"}, Action: "remove"}, body,
+			`{"items":[{"password":"x"}],"password":"y","user":{"name":"bob","password":"hunter2"}}`},
+		{"missing path", Redaction{Fields: []string{"user.email"}}, `{"user":{"name":"bob"}}`, `{"user":{"name":"bob"}}`},
+		{"top level array", Redaction{Fields: []string{"ssn"}}, `[{"ssn":"1"},{"id":2}]`, `[{"ssn":"[REDACTED]"},{"id":2}]`},
+		{"empty body", Redaction{Fields: []string{"ssn"}}, ` `, ` `},
+	}
+	for _, tt := range tests {
+		if err := tt.redaction.validate(); err != nil {
+			t.Errorf("%s: validate: %v", tt.name, err)
+			continue
+		}
+		got, err := tt.redaction.apply([]byte(tt.body))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRedactionErrors(t *testing.T) {
+	if err := (&Redaction{Fields: []string{"ssn"}, Action: "hash"}).validate(); err == nil {
+		t.Error("validated an unknown action")
+	}
+	rd := &Redaction{Fields: []string{"ssn"}}
+	rd.validate()
+	if _, err := rd.apply([]byte(`{"ssn":`)); err == nil {
+		t.Error("redacted a body that is not JSON")
+	}
+}
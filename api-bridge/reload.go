@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var errNoConfigFile = errors.New("no config file to reload, the bridge was started without --config")
+
+// liveConfig is the part of the configuration that can be reloaded while the
+// bridge runs: the routes, client schedules, tunnel ACLs and offramp policy.
+// Settings only take effect on restart.
+type liveConfig struct {
+	mu              sync.RWMutex
+	routes          []*Route
+	clientSchedules map[string]Schedule
+	tunnelACLs      tunnelACLs
+	offrampPolicy   offrampPolicy
+	loadedAt        time.Time
+}
+
+// live is the configuration requests are served with.
+var live = &liveConfig{}
+
+// set replaces the configuration, returning when it was loaded.
+func (c *liveConfig) set(routes []*Route, clientSchedules map[string]Schedule, acls tunnelACLs, policy offrampPolicy) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.routes = routes
+	c.clientSchedules = clientSchedules
+	c.tunnelACLs = acls
+	c.offrampPolicy = policy
+	c.loadedAt = time.Now()
+	return c.loadedAt
+}
+
+func (c *liveConfig) Routes() []*Route {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.routes
+}
+
+func (c *liveConfig) ClientSchedules() map[string]Schedule {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.clientSchedules
+}
+
+func (c *liveConfig) TunnelACLs() tunnelACLs {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.tunnelACLs
+}
+
+func (c *liveConfig) OfframpPolicy() offrampPolicy {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.offrampPolicy
+}
+
+// ReloadStatus is the result of a reload reported by the admin interface.
+type ReloadStatus struct {
+	Routes   int       `json:"routes"`
+	LoadedAt time.Time `json:"loaded_at"`
+}
+
+// reloadConfig reads the config file again, with the profile and the
+// --offramp-route, --tunnel-acl and --offramp-policy flags the bridge was
+// started with, and serves new requests and tunnels with its routes, client
+// schedules, tunnel ACLs and offramp policy. On error the loaded
+// configuration is kept. Connected tunnels stay, but are only sent the
+// requests the new policy allows them.
+func reloadConfig(config *Config) (ReloadStatus, error) {
+	if config.ConfigFile == "" {
+		return ReloadStatus{}, errNoConfigFile
+	}
+	fileConfig, err := loadFileConfig(config.ConfigFile, config.Profile)
+	if err != nil {
+		return ReloadStatus{}, fmt.Errorf("failed to load config: %v", err)
+	}
+	routes := fileConfig.Routes
+	for _, value := range config.OfframpRoutes {
+		route, err := parseOfframpRoute(value)
+		if err != nil {
+			return ReloadStatus{}, fmt.Errorf("invalid --offramp-route: %v", err)
+		}
+		routes = append(routes, route)
+	}
+	acls, err := buildTunnelACLs(fileConfig.TunnelACLs, config.TunnelACL)
+	if err != nil {
+		return ReloadStatus{}, fmt.Errorf("invalid tunnel ACL: %v", err)
+	}
+	policy, err := buildOfframpPolicy(fileConfig.OfframpPolicy, config.OfframpPolicy, routes)
+	if err != nil {
+		return ReloadStatus{}, fmt.Errorf("invalid offramp policy: %v", err)
+	}
+
+	loadedAt := live.set(routes, fileConfig.ClientSchedules, acls, policy)
+	logEvent("config_reloaded", map[string]string{"routes": fmt.Sprint(len(routes))}, "[BRIDGE] Reloaded %d routes from %s", len(routes), config.ConfigFile)
+	return ReloadStatus{Routes: len(routes), LoadedAt: loadedAt}, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/spf13/cobra"
+
+	"apiduct/pkg/mux"
+	"apiduct/pkg/proxy"
+)
+
+func newReplayCommand() *cobra.Command {
+	var frames bool
+	cmd := &cobra.Command{
+		Use:   "replay FILE",
+		Short: "Replay a tunnel session recorded with --record-dir",
+		Long: "replay feeds the frames of a session recorded with --record-dir, by the bridge\n" +
+			"or an offramp, through the tunnel protocol again and reports each stream's\n" +
+			"request or response and the error the session ended with, if any.\n" +
+			"With --frames it lists the recorded frames instead.",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return fmt.Errorf("failed to open recording: %v", err)
+			}
+			defer f.Close()
+			recording, err := mux.NewRecordingReader(f)
+			if err != nil {
+				return err
+			}
+			if frames {
+				return listFrames(cmd.OutOrStdout(), recording)
+			}
+			return replaySession(cmd.OutOrStdout(), recording)
+		},
+	}
+	cmd.Flags().BoolVar(&frames, "frames", false, "List the recorded frames instead of replaying them")
+	return cmd
+}
+
+// listFrames prints one line per recorded frame, > for the frames the
+// recorded side sent and < for those it received.
+func listFrames(w io.Writer, recording *mux.RecordingReader) error {
+	for {
+		rec, err := recording.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		dir := "<"
+		if rec.Sent {
+			dir = ">"
+		}
+		line := fmt.Sprintf("%10.3fms %s %s %d", float64(rec.At.Microseconds())/1000, dir, rec.Type(), rec.StreamID())
+		if flags := rec.Flags(); flags != "" {
+			line += " " + flags
+		}
+		if rec.Type() == "data" {
+			line += fmt.Sprintf(" %d bytes", len(rec.Payload()))
+		} else {
+			line += fmt.Sprintf(" %d", rec.Length())
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// replaySession replays the recording, reading the request off each stream
+// the peer opened and the response off each stream the recorded side opened.
+func replaySession(w io.Writer, recording *mux.RecordingReader) error {
+	side := "an offramp"
+	if recording.Client {
+		side = "a bridge"
+	}
+	fmt.Fprintf(w, "Replaying %s session\n", side)
+
+	var mu sync.Mutex
+	err := mux.Replay(recording, func(stream *mux.Stream, opened bool) {
+		summary := readStream(stream, opened)
+		mu.Lock()
+		fmt.Fprintf(w, "stream %d: %s\n", stream.ID(), summary)
+		mu.Unlock()
+	})
+	if err != nil {
+		return fmt.Errorf("session failed: %v", err)
+	}
+	fmt.Fprintln(w, "Session ended without errors")
+	return nil
+}
+
+// readStream reads the message on a replayed stream and describes it. The
+// stream is left open, Replay writes and closes it as recorded.
+func readStream(stream *mux.Stream, response bool) string {
+	reader := proxy.NewReader(stream)
+	if response {
+		resp, err := reader.ReadResponse(nil)
+		if err != nil {
+			return fmt.Sprintf("failed to read response: %v", err)
+		}
+		n, err := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return describe(resp.Proto+" "+resp.Status, n, err)
+	}
+	req, err := reader.ReadRequest()
+	if err != nil {
+		return fmt.Sprintf("failed to read request: %v", err)
+	}
+	n, err := io.Copy(io.Discard, req.Body)
+	req.Body.Close()
+	return describe(req.Method+" "+req.URL.RequestURI()+" "+req.Proto, n, err)
+}
+
+func describe(line string, n int64, err error) string {
+	if err != nil {
+		return fmt.Sprintf("%s, body failed after %d bytes: %v", line, n, err)
+	}
+	return fmt.Sprintf("%s, %d body bytes", line, n)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"apiduct/pkg/stats"
+	"apiduct/pkg/tunnel"
+)
+
+var startTime = time.Now()
+
+// parseReportInterval accepts "daily", "weekly" or a Go duration.
+func parseReportInterval(value string) (time.Duration, error) {
+	switch value {
+	case "", "off":
+		return 0, nil
+	case "daily":
+		return 24 * time.Hour, nil
+	case "weekly":
+		return 7 * 24 * time.Hour, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if interval < time.Minute {
+		return 0, fmt.Errorf("report interval must be at least one minute")
+	}
+	return interval, nil
+}
+
+type RouteSummary struct {
+	Route     string  `json:"route"`
+	Requests  int64   `json:"requests"`
+	Errors    int64   `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+}
+
+type UsageReport struct {
+	PeriodStart     time.Time      `json:"period_start"`
+	PeriodEnd       time.Time      `json:"period_end"`
+	Uptime          string         `json:"uptime"`
+	TunnelConnected bool           `json:"tunnel_connected"`
+	Reconnects      int64          `json:"reconnects"`
+	Requests        int64          `json:"requests"`
+	Errors          int64          `json:"errors"`
+	ErrorRate       float64        `json:"error_rate"`
+	TopRoutes       []RouteSummary `json:"top_routes"`
+}
+
+func labelValue(labels []string, key string) string {
+	for i := 0; i+1 < len(labels); i += 2 {
+		if labels[i] == key {
+			return labels[i+1]
+		}
+	}
+	return ""
+}
+
+func errorRate(errors, requests int64) float64 {
+	if requests == 0 {
+		return 0
+	}
+	return float64(errors) / float64(requests)
+}
+
+// Reporter builds usage summaries from counter deltas between reports.
+type Reporter struct {
+	tunnelConn  *tunnel.Pool
+	previous    map[string]int64
+	periodStart time.Time
+}
+
+func NewReporter(tunnelConn *tunnel.Pool) *Reporter {
+	r := &Reporter{tunnelConn: tunnelConn, previous: make(map[string]int64), periodStart: time.Now()}
+	r.snapshot()
+	return r
+}
+
+// snapshot returns counter deltas since the previous call.
+func (r *Reporter) snapshot() map[*stats.Counter]int64 {
+	deltas := make(map[*stats.Counter]int64)
+	for _, c := range metrics.Counters() {
+		key := stats.Key(c.Name, c.Labels)
+		value := c.Value()
+		deltas[c] = value - r.previous[key]
+		r.previous[key] = value
+	}
+	return deltas
+}
+
+func (r *Reporter) Build() *UsageReport {
+	now := time.Now()
+	report := &UsageReport{
+		PeriodStart:     r.periodStart,
+		PeriodEnd:       now,
+		Uptime:          now.Sub(startTime).Round(time.Second).String(),
+		TunnelConnected: r.tunnelConn.IsConnected(),
+	}
+	r.periodStart = now
+
+	routes := make(map[string]*RouteSummary)
+	for c, delta := range r.snapshot() {
+		switch c.Name {
+		case "apiduct_tunnel_connections_total":
+			report.Reconnects += delta
+		case "apiduct_requests_total":
+			name := labelValue(c.Labels, "route")
+			summary, ok := routes[name]
+			if !ok {
+				summary = &RouteSummary{Route: name}
+				routes[name] = summary
+			}
+			summary.Requests += delta
+			report.Requests += delta
+			if labelValue(c.Labels, "code") == "5xx" {
+				summary.Errors += delta
+				report.Errors += delta
+			}
+		}
+	}
+	report.ErrorRate = errorRate(report.Errors, report.Requests)
+
+	for _, summary := range routes {
+		if summary.Requests == 0 {
+			continue
+		}
+		summary.ErrorRate = errorRate(summary.Errors, summary.Requests)
+		report.TopRoutes = append(report.TopRoutes, *summary)
+	}
+	sort.Slice(report.TopRoutes, func(i, j int) bool {
+		return report.TopRoutes[i].Requests > report.TopRoutes[j].Requests
+	})
+	if len(report.TopRoutes) > 5 {
+		report.TopRoutes = report.TopRoutes[:5]
+	}
+	return report
+}
+
+func (report *UsageReport) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "apiduct bridge summary %s - %s\n\n",
+		report.PeriodStart.UTC().Format(time.RFC3339), report.PeriodEnd.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "Uptime:           %s\n", report.Uptime)
+	fmt.Fprintf(&b, "Tunnel connected: %v\n", report.TunnelConnected)
+	fmt.Fprintf(&b, "Reconnects:       %d\n", report.Reconnects)
+	fmt.Fprintf(&b, "Requests:         %d\n", report.Requests)
+	fmt.Fprintf(&b, "Errors (5xx):     %d (%.2f%%)\n", report.Errors, report.ErrorRate*100)
+	if len(report.TopRoutes) > 0 {
+		b.WriteString("\nTop routes:\n")
+		for _, route := range report.TopRoutes {
+			fmt.Fprintf(&b, "  %-24s %8d requests  %.2f%% errors\n", route.Route, route.Requests, route.ErrorRate*100)
+		}
+	}
+	return b.String()
+}
+
+// runReports periodically delivers usage summaries via the notifier.
+func runReports(reporter *Reporter, notifier Notifier, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		report := reporter.Build()
+		subject := fmt.Sprintf("apiduct bridge summary: %d requests, %.2f%% errors", report.Requests, report.ErrorRate*100)
+		if err := notifier.Notify(subject, report.Text(), report); err != nil {
+			log.Printf("[BRIDGE] Failed to deliver summary report: %v", err)
+			continue
+		}
+		log.Printf("[BRIDGE] Delivered summary report")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TimeWindow is a daily period, such as 06:00-20:00 on weekdays. A window
+// ending before it starts runs past midnight into the next day.
+type TimeWindow struct {
+	Days     []string `json:"days,omitempty"` // mon..sun, every day if empty
+	From     string   `json:"from"`           // HH:MM
+	To       string   `json:"to"`             // HH:MM, 24:00 for the end of the day
+	Timezone string   `json:"timezone,omitempty"`
+
+	days     [7]bool
+	from, to time.Duration
+	location *time.Location
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func parseClock(value string) (time.Duration, error) {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(value, "%d:%d", &hours, &minutes); err != nil || len(value) != 5 ||
+		hours < 0 || minutes < 0 || minutes > 59 || hours > 24 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+func (w *TimeWindow) compile() error {
+	var err error
+	if w.from, err = parseClock(w.From); err != nil {
+		return err
+	}
+	if w.to, err = parseClock(w.To); err != nil {
+		return err
+	}
+	if w.from == w.to {
+		return fmt.Errorf("window %s-%s is empty", w.From, w.To)
+	}
+	w.location = time.UTC
+	if w.Timezone != "" {
+		if w.location, err = time.LoadLocation(w.Timezone); err != nil {
+			return fmt.Errorf("unknown timezone %q", w.Timezone)
+		}
+	}
+	if len(w.Days) == 0 {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, day := range w.Days {
+		found := false
+		for i, name := range weekdays {
+			if strings.EqualFold(day, name) {
+				w.days[i] = true
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown day %q (use mon, tue, wed, thu, fri, sat or sun)", day)
+		}
+	}
+	return nil
+}
+
+// contains reports whether t falls within the window.
+func (w *TimeWindow) contains(t time.Time) bool {
+	t = t.In(w.location)
+	since := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.from < w.to {
+		return w.days[t.Weekday()] && since >= w.from && since < w.to
+	}
+	// Overnight windows belong to the day they start on
+	yesterday := (t.Weekday() + 6) % 7
+	return (w.days[t.Weekday()] && since >= w.from) || (w.days[yesterday] && since < w.to)
+}
+
+func (w *TimeWindow) String() string {
+	days := "daily"
+	if len(w.Days) > 0 {
+		days = strings.Join(w.Days, ",")
+	}
+	return fmt.Sprintf("%s %s-%s %s", days, w.From, w.To, w.location)
+}
+
+// Schedule limits access to its time windows. An empty schedule always
+// allows access.
+type Schedule []*TimeWindow
+
+func (s Schedule) compile() error {
+	for _, w := range s {
+		if err := w.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allows reports whether t falls within any of the windows.
+func (s Schedule) allows(t time.Time) bool {
+	if len(s) == 0 {
+		return true
+	}
+	for _, w := range s {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Schedule) String() string {
+	windows := make([]string, len(s))
+	for i, w := range s {
+		windows[i] = w.String()
+	}
+	return strings.Join(windows, "; ")
+}
+
+// compileClientSchedules checks the schedules of client certificates.
+func compileClientSchedules(schedules map[string]Schedule) error {
+	for client, schedule := range schedules {
+		if err := schedule.compile(); err != nil {
+			return fmt.Errorf("client %s: %v", client, err)
+		}
+	}
+	return nil
+}
+
+// outsideSchedule returns the schedule r is outside of and what it applies
+// to, or a nil schedule: the route's, or the one of the client certificate's
+// common name.
+func outsideSchedule(r *http.Request, route *Route, clients map[string]Schedule, now time.Time) (string, Schedule) {
+	if route != nil && !route.Schedule.allows(now) {
+		return "route " + route.Name, route.Schedule
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		client := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if schedule, ok := clients[client]; ok && !schedule.allows(now) {
+			return "client " + client, schedule
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseClock(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"06:30", 6*time.Hour + 30*time.Minute, true},
+		{"00:00", 0, true},
+		{"24:00", 24 * time.Hour, true},
+		{"24:01", 0, false},
+		{"12:60", 0, false},
+		{"6:30", 0, false},
+		{"noon", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseClock(tt.value)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseClock(%q) = %v, %v; want %v, ok %v", tt.value, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestScheduleAllows(t *testing.T) {
+	// 2026-10-12 is a Monday
+	at := func(day int, clock string) time.Time {
+		t, _ := time.Parse("2006-01-02 15:04", "2026-10-"+[]string{"11", "12", "13", "14", "15", "16", "17"}[day]+" "+clock)
+		return t
+	}
+	weekdays := &TimeWindow{Days: []string{"mon", "tue", "wed", "thu", "fri"}, From: "06:00", To: "20:00"}
+	overnight := &TimeWindow{Days: []string{"Fri"}, From: "22:00", To: "02:00"}
+	berlin := &TimeWindow{From: "08:00", To: "09:00", Timezone: "Europe/Berlin"}
+	tests := []struct {
+		name     string
+		schedule Schedule
+		time     time.Time
+		want     bool
+	}{
+		{"no windows", nil, at(0, "03:00"), true},
+		{"weekday inside", Schedule{weekdays}, at(1, "06:00"), true},
+		{"weekday end", Schedule{weekdays}, at(1, "20:00"), false},
+		{"weekday before", Schedule{weekdays}, at(1, "05:59"), false},
+		{"weekend", Schedule{weekdays}, at(6, "12:00"), false},
+		{"overnight start day", Schedule{overnight}, at(5, "23:00"), true},
+		{"overnight next day", Schedule{overnight}, at(6, "01:59"), true},
+		{"overnight next day end", Schedule{overnight}, at(6, "02:00"), false},
+		{"overnight other day", Schedule{overnight}, at(4, "23:00"), false},
+		{"overnight day before", Schedule{overnight}, at(5, "01:00"), false},
+		{"timezone", Schedule{berlin}, at(1, "06:30"), true},
+		{"timezone UTC hours", Schedule{berlin}, at(1, "08:30"), false},
+		{"any window", Schedule{weekdays, overnight}, at(6, "01:00"), true},
+	}
+	for _, tt := range tests {
+		if err := tt.schedule.compile(); err != nil {
+			t.Fatalf("%s: compile: %v", tt.name, err)
+		}
+		if got := tt.schedule.allows(tt.time); got != tt.want {
+			t.Errorf("%s: allows %s = %v, want %v", tt.name, tt.time.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestScheduleCompileErrors(t *testing.T) {
+	for _, window := range []*TimeWindow{
+		{From: "08:00", To: "08:00"},
+		{From: "8", To: "09:00"},
+		{From: "08:00", To: "09:00", Days: []string{"monday"}},
+		{From: "08:00", To: "09:00", Timezone: "Mars/Olympus"},
+	} {
+		if err := window.compile(); err == nil {
+			t.Errorf("compiled %+v", window)
+		}
+	}
+}
+
+func TestOutsideSchedule(t *testing.T) {
+	closed := Schedule{{From: "00:00", To: "00:01"}}
+	if err := closed.compile(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	route := &Route{Name: "api", Schedule: closed}
+	r := httptest.NewRequest("GET", "/", nil)
+	if what, _ := outsideSchedule(r, route, nil, now); what != "route api" {
+		t.Errorf("outside %q, want the route's schedule", what)
+	}
+	if what, schedule := outsideSchedule(r, &Route{Name: "open"}, nil, now); schedule != nil {
+		t.Errorf("outside %q without a schedule", what)
+	}
+
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "night-shift"}}}}}
+	clients := map[string]Schedule{"night-shift": closed}
+	if what, _ := outsideSchedule(r, &Route{Name: "open"}, clients, now); what != "client night-shift" {
+		t.Errorf("outside %q, want the client's schedule", what)
+	}
+}
@@ -0,0 +1,6 @@
+//go:build !windows
+
+package main
+
+// runAsService is a no-op outside Windows.
+func runAsService(config *Config, onStop func()) <-chan struct{} { return nil }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+type windowsService struct {
+	onStop func()
+}
+
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	// Stay pending until the listeners are bound
+	changes <- svc.Status{State: svc.StartPending}
+	readyC := ready
+	for {
+		select {
+		case <-readyC:
+			readyC = nil
+			changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+		case req, ok := <-requests:
+			if !ok {
+				return false, 0
+			}
+			switch req.Cmd {
+			case svc.Interrogate:
+				changes <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				s.onStop()
+				return false, 0
+			}
+		}
+	}
+}
+
+// runAsService reports to the service control manager when started as a
+// Windows service, calling onStop while the service is stopping. The returned
+// channel is closed once the service has stopped, it is nil when not running
+// as a service.
+func runAsService(config *Config, onStop func()) <-chan struct{} {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return nil
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := svc.Run(config.ServiceName, &windowsService{onStop: onStop}); err != nil {
+			log.Printf("[BRIDGE] Failed to run as Windows service: %v", err)
+		}
+	}()
+	return stopped
+}
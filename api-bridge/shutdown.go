@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"apiduct/pkg/tunnel"
+)
+
+// gracefulShutdown stops the bridge: it stops accepting requests and tunnels,
+// gives the requests in flight until the timeout to finish, tells the
+// offramps their tunnels are closing and closes them.
+type gracefulShutdown struct {
+	once sync.Once
+	done chan struct{}
+
+	mu             sync.Mutex
+	server         *http.Server
+	tunnelListener net.Listener
+	tunnels        *tunnel.Pool
+	timeout        time.Duration
+	cleanup        func()
+	stopping       bool
+}
+
+// bridgeShutdown is triggered by SIGINT, SIGTERM or a Windows service stop.
+var bridgeShutdown = &gracefulShutdown{done: make(chan struct{})}
+
+// attach hands the shutdown what it has to stop once the bridge is serving.
+// It returns false if the shutdown already began.
+func (g *gracefulShutdown) attach(server *http.Server, tunnelListener net.Listener, tunnels *tunnel.Pool, timeout time.Duration) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.server, g.tunnelListener, g.tunnels, g.timeout = server, tunnelListener, tunnels, timeout
+	return !g.stopping
+}
+
+// onStop sets what to do after the bridge stopped serving, such as flushing
+// state to disk.
+func (g *gracefulShutdown) onStop(cleanup func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.cleanup = cleanup
+}
+
+// Done is closed once the bridge has shut down.
+func (g *gracefulShutdown) Done() <-chan struct{} {
+	return g.done
+}
+
+// Stop shuts the bridge down. Only the first call does the work, later ones
+// wait for it to finish.
+func (g *gracefulShutdown) Stop(reason string) {
+	g.once.Do(func() {
+		defer close(g.done)
+		g.mu.Lock()
+		g.stopping = true
+		server, tunnelListener, tunnels, timeout, cleanup := g.server, g.tunnelListener, g.tunnels, g.timeout, g.cleanup
+		g.mu.Unlock()
+
+		logEvent("shutdown", nil, "[BRIDGE] Shutting down (%s), %d requests in flight", reason, maintenance.Status().InFlight)
+		if server != nil {
+			// Offramps learn the tunnels are closing, the requests in
+			// flight continue on them
+			for _, t := range tunnels.All() {
+				t.Session.GoAway()
+			}
+			tunnelListener.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("[BRIDGE] Requests still in flight after %s, closing them", timeout)
+				server.Close()
+			}
+			cancel()
+
+			for _, t := range tunnels.All() {
+				tunnels.Drop(t, "bridge shutting down")
+			}
+		}
+		if cleanup != nil {
+			cleanup()
+		}
+		log.Printf("[BRIDGE] Shutdown complete")
+	})
+	<-g.done
+}
+
+// handleSignals shuts the bridge down on SIGINT or SIGTERM. A second signal
+// exits at once.
+func handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	go func() {
+		<-signals
+		log.Printf("[BRIDGE] Second signal received, exiting without draining")
+		os.Exit(1)
+	}()
+	bridgeShutdown.Stop(sig.String())
+}
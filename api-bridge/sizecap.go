@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	errRequestTooLarge  = errors.New("request size limit exceeded")
+	errResponseTooLarge = errors.New("response size limit exceeded")
+)
+
+// requestLimit returns the largest request body accepted on route, 0 for no
+// limit. The route's request_bytes takes precedence over --max-request-body.
+func requestLimit(config *Config, route *Route) int64 {
+	if route != nil && route.RequestBytes.max() > 0 {
+		return route.RequestBytes.Max
+	}
+	return config.MaxRequestBody
+}
+
+// responseLimit returns the largest response body passed on for route, 0 for
+// no limit. The route's response_bytes takes precedence over
+// --max-response-body.
+func responseLimit(config *Config, route *Route) int64 {
+	if route != nil && route.ResponseBytes.max() > 0 {
+		return route.ResponseBytes.Max
+	}
+	return config.MaxResponseBody
+}
+
+// cappedReader fails with err once more than limit bytes have been read from
+// the underlying reader.
+type cappedReader struct {
+	r         io.Reader
+	remaining int64
+	err       error
+}
+
+func newCappedReader(r io.Reader, limit int64, err error) *cappedReader {
+	return &cappedReader{r: r, remaining: limit, err: err}
+}
+
+// exceeded reports whether the limit was crossed, false for a nil reader.
+func (c *cappedReader) exceeded() bool {
+	return c != nil && c.remaining < 0
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if c.remaining < 0 {
+		return 0, c.err
+	}
+	// Read one byte past the limit so an exact-size body is not rejected
+	if int64(len(p)) > c.remaining+1 {
+		p = p[:c.remaining+1]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if c.remaining < 0 {
+		return n + int(c.remaining), c.err
+	}
+	return n, err
+}
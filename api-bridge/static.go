@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// StaticResponse is a fixed response served by the bridge itself, without
+// going through the tunnel.
+type StaticResponse struct {
+	Status      int               `json:"status,omitempty"`       // defaults to 200
+	ContentType string            `json:"content_type,omitempty"` // defaults to text/plain
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        string            `json:"body,omitempty"`
+	BodyFile    string            `json:"body_file,omitempty"` // read once at startup
+
+	body []byte
+}
+
+func (s *StaticResponse) load() error {
+	if s == nil {
+		return nil
+	}
+	if s.Status == 0 {
+		s.Status = http.StatusOK
+	}
+	if s.Status < 100 || s.Status > 999 {
+		return fmt.Errorf("invalid status %d", s.Status)
+	}
+	if s.ContentType == "" {
+		s.ContentType = "text/plain; charset=utf-8"
+	}
+	if s.Body != "" && s.BodyFile != "" {
+		return fmt.Errorf("body and body_file are mutually exclusive")
+	}
+	s.body = []byte(s.Body)
+	if s.BodyFile != "" {
+		data, err := os.ReadFile(s.BodyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read body file: %v", err)
+		}
+		s.body = data
+	}
+	return nil
+}
+
+func (s *StaticResponse) serve(w http.ResponseWriter) {
+	for key, value := range s.Headers {
+		w.Header().Set(key, value)
+	}
+	w.Header().Set("Content-Type", s.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(s.body)))
+	w.WriteHeader(s.Status)
+	w.Write(s.body)
+}
+
+// Redirect sends requests for a route elsewhere, without going through the
+// tunnel. With AppendPath, the part of the path after the route's prefix and
+// the query are appended to To, so /old/a?b=c can go to /new/a?b=c.
+type Redirect struct {
+	To         string `json:"to"`
+	Status     int    `json:"status,omitempty"` // 301, 302, 303, 307 or 308, defaults to 301
+	AppendPath bool   `json:"append_path,omitempty"`
+}
+
+func (d *Redirect) validate() error {
+	if d == nil {
+		return nil
+	}
+	if d.To == "" {
+		return fmt.Errorf("missing redirect target")
+	}
+	if _, err := url.Parse(d.To); err != nil {
+		return fmt.Errorf("invalid redirect target: %v", err)
+	}
+	switch d.Status {
+	case 0:
+		d.Status = http.StatusMovedPermanently
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("invalid redirect status %d", d.Status)
+	}
+	return nil
+}
+
+func (d *Redirect) serve(w http.ResponseWriter, r *http.Request, prefix string) {
+	location := d.To
+	if d.AppendPath {
+		if rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/"); rest != "" {
+			location = strings.TrimSuffix(location, "/") + "/" + rest
+		}
+		if r.URL.RawQuery != "" {
+			location += "?" + r.URL.RawQuery
+		}
+	}
+	http.Redirect(w, r, location, d.Status)
+}
+
+// serveLocal answers the request from the bridge if the route has a static
+// response or a redirect, and reports whether it did.
+func serveLocal(w http.ResponseWriter, r *http.Request, route *Route) bool {
+	switch {
+	case route == nil:
+		return false
+	case route.Static != nil:
+		route.Static.serve(w)
+	case route.Redirect != nil:
+		route.Redirect.serve(w, r, route.PathPrefix)
+	default:
+		return false
+	}
+	metrics.Counter("apiduct_local_responses_total", "route", route.Name).Inc()
+	return true
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSeverity maps entry severities to RFC 5424 severity codes.
+func syslogSeverity(s Severity) int {
+	switch s {
+	case SeverityDebug:
+		return 7
+	case SeverityWarning:
+		return 4
+	case SeverityError:
+		return 3
+	}
+	return 6
+}
+
+// syslogSink sends RFC 5424 messages to a local socket or a remote collector
+// over UDP, TCP or TLS. Stream transports use octet-counting framing.
+type syslogSink struct {
+	network   string
+	addr      string
+	tlsConfig *tls.Config
+	facility  int
+	hostname  string
+	appName   string
+
+	conn    net.Conn
+	entries chan *LogEntry
+	stopped chan struct{}
+}
+
+// newSyslogSink parses addresses such as udp://host:514, tcp://host:601,
+// tls://host:6514 or unix:///dev/log. An empty address uses /dev/log.
+func newSyslogSink(addr, facility, caFile string) (*syslogSink, error) {
+	code, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	if addr == "" {
+		addr = "unix:///dev/log"
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid syslog address: %v", err)
+	}
+
+	s := &syslogSink{
+		facility: code,
+		appName:  filepath.Base(os.Args[0]),
+		entries:  make(chan *LogEntry, 1000),
+		stopped:  make(chan struct{}),
+	}
+	s.hostname, _ = os.Hostname()
+	if s.hostname == "" {
+		s.hostname = "-"
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		s.network, s.addr = u.Scheme, u.Host
+	case "tls":
+		s.network, s.addr = "tcp", u.Host
+		host, _, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid syslog address: %v", err)
+		}
+		s.tlsConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+		if caFile != "" {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read syslog CA file: %v", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", caFile)
+			}
+			s.tlsConfig.RootCAs = pool
+		}
+	case "unix":
+		s.network, s.addr = "unixgram", u.Path
+	default:
+		return nil, fmt.Errorf("unsupported syslog scheme %q (use udp, tcp, tls or unix)", u.Scheme)
+	}
+	if s.addr == "" {
+		return nil, fmt.Errorf("syslog address %q has no host or path", addr)
+	}
+
+	go s.run()
+	return s, nil
+}
+
+func (s *syslogSink) Emit(entry *LogEntry) {
+	select {
+	case s.entries <- entry:
+	default:
+		metrics.Counter("apiduct_log_entries_dropped_total", "sink", "syslog").Inc()
+	}
+}
+
+func (s *syslogSink) format(entry *LogEntry) string {
+	msgID := entry.Component
+	if msgID == "" {
+		msgID = "-"
+	}
+	return fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+		s.facility*8+syslogSeverity(entry.Severity),
+		entry.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname, s.appName, os.Getpid(), msgID, syslogStructuredData(entry.Fields), entry.Message)
+}
+
+// syslogStructuredData renders fields as an RFC 5424 SD-ELEMENT.
+func syslogStructuredData(fields map[string]string) string {
+	if len(fields) == 0 {
+		return "-"
+	}
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+	var b strings.Builder
+	b.WriteString("[apiduct@32473")
+	for _, key := range keys {
+		fmt.Fprintf(&b, ` %s="%s"`, key, escaper.Replace(fields[key]))
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+func (s *syslogSink) connect() error {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	var conn net.Conn
+	var err error
+	if s.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, s.network, s.addr, s.tlsConfig)
+	} else {
+		conn, err = dialer.Dial(s.network, s.addr)
+	}
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+func (s *syslogSink) send(entry *LogEntry) error {
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+
+	msg := s.format(entry)
+	if s.network == "tcp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *syslogSink) run() {
+	defer close(s.stopped)
+
+	var lastErr time.Time
+	for entry := range s.entries {
+		// Retry once on a fresh connection, e.g. after the collector restarted
+		err := s.send(entry)
+		if err != nil {
+			err = s.send(entry)
+		}
+		if err != nil {
+			metrics.Counter("apiduct_log_entries_dropped_total", "sink", "syslog").Inc()
+			if time.Since(lastErr) > time.Minute {
+				sinkError("Failed to send log entry to syslog %s: %v", s.addr, err)
+				lastErr = time.Now()
+			}
+		}
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// Close sends queued entries, giving up after a few seconds.
+func (s *syslogSink) Close() error {
+	close(s.entries)
+	select {
+	case <-s.stopped:
+	case <-time.After(5 * time.Second):
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// What an access policy does with a client whose address it refuses
+const (
+	denyActionReject = "reject" // answer 403 at once
+	denyActionTarpit = "tarpit" // answer 403 after the tarpit delay
+)
+
+// tarpit holds requests from refused clients before answering them, so
+// scraping and probing through the bridge costs the client time and open
+// connections. Only a limited number are held at once; the bridge must not
+// run out of connections itself.
+type tarpit struct {
+	delay time.Duration
+	slots chan struct{}
+}
+
+// tarpits is nil unless --tarpit-delay and --tarpit-max are above 0.
+var tarpits *tarpit
+
+func newTarpit(delay time.Duration, max int) *tarpit {
+	if delay <= 0 || max <= 0 {
+		return nil
+	}
+	return &tarpit{delay: delay, slots: make(chan struct{}, max)}
+}
+
+// hold waits for the delay, or until the client gives up, and then answers
+// 403 and closes the connection. It returns false without answering if the
+// tarpit is full, so the caller rejects r at once instead.
+func (t *tarpit) hold(w http.ResponseWriter, r *http.Request) bool {
+	if t == nil {
+		return false
+	}
+	select {
+	case t.slots <- struct{}{}:
+	default:
+		return false
+	}
+	defer func() { <-t.slots }()
+	metrics.Gauge("apiduct_tarpit_held").Add(1)
+	defer metrics.Gauge("apiduct_tarpit_held").Add(-1)
+
+	timer := time.NewTimer(t.delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+		return true
+	}
+	w.Header().Set("Connection", "close")
+	writeError(w, http.StatusForbidden, errCodeAccessDenied, "Access denied")
+	return true
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// requestTimeout returns how long a request on route waits for its response
+// headers from the tunnel, 0 for no limit. The route's timeout takes
+// precedence over --request-timeout.
+func requestTimeout(config *Config, route *Route) time.Duration {
+	if route != nil && route.timeout > 0 {
+		return route.timeout
+	}
+	return config.RequestTimeout
+}
+
+// parseTimeout parses the route's timeout, if it has one.
+func (r *Route) parseTimeout() error {
+	if r.Timeout == "" {
+		return nil
+	}
+	timeout, err := time.ParseDuration(r.Timeout)
+	if err != nil {
+		return err
+	}
+	if timeout <= 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	r.timeout = timeout
+	return nil
+}
+
+// isTimeout reports whether err comes from a tunnel stream deadline.
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Prefix of the headers describing the client's TLS connection to the bridge
+const forwardedTLSPrefix = "X-Forwarded-Tls-"
+
+// setTLSHeaders describes the TLS connection the request arrived on in
+// X-Forwarded-TLS-* headers, so the target can make policy decisions on it.
+// Headers with that prefix sent by the client are always removed.
+func setTLSHeaders(r *http.Request, forward bool) {
+	for key := range r.Header {
+		if strings.HasPrefix(key, forwardedTLSPrefix) {
+			r.Header.Del(key)
+		}
+	}
+	if !forward || r.TLS == nil {
+		return
+	}
+
+	state := r.TLS
+	r.Header.Set("X-Forwarded-TLS-Version", tls.VersionName(state.Version))
+	r.Header.Set("X-Forwarded-TLS-Cipher", tls.CipherSuiteName(state.CipherSuite))
+	if state.ServerName != "" {
+		r.Header.Set("X-Forwarded-TLS-SNI", state.ServerName)
+	}
+	if state.NegotiatedProtocol != "" {
+		r.Header.Set("X-Forwarded-TLS-ALPN", state.NegotiatedProtocol)
+	}
+	if len(state.VerifiedChains) == 0 {
+		return
+	}
+	cert := state.VerifiedChains[0][0]
+	fingerprint := sha256.Sum256(cert.Raw)
+	r.Header.Set("X-Forwarded-TLS-Client-Subject", cert.Subject.String())
+	r.Header.Set("X-Forwarded-TLS-Client-Issuer", cert.Issuer.String())
+	r.Header.Set("X-Forwarded-TLS-Client-Serial", cert.SerialNumber.Text(16))
+	r.Header.Set("X-Forwarded-TLS-Client-Fingerprint", hex.EncodeToString(fingerprint[:]))
+	r.Header.Set("X-Forwarded-TLS-Client-Not-After", cert.NotAfter.UTC().Format(time.RFC3339))
+	if len(cert.DNSNames) > 0 {
+		r.Header.Set("X-Forwarded-TLS-Client-DNS-Names", strings.Join(cert.DNSNames, ","))
+	}
+	if len(cert.EmailAddresses) > 0 {
+		r.Header.Set("X-Forwarded-TLS-Client-Emails", strings.Join(cert.EmailAddresses, ","))
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// requestIDHeader returns the request ID to the client on every response. A
+// client may also send it to choose the ID.
+const requestIDHeader = "X-Apiduct-Request-Id"
+
+// requestIDFor returns the ID the client supplied in X-Apiduct-Request-Id or
+// X-Request-Id when it is usable, otherwise a new random ID.
+func requestIDFor(header http.Header) string {
+	for _, name := range []string{requestIDHeader, "X-Request-Id"} {
+		if id := header.Get(name); validRequestID(id) {
+			return id
+		}
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
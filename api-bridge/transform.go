@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// Transform describes a declarative rewrite of a JSON body. Field names may
+// use dots to address nested objects (e.g. "user.email"). Steps are applied
+// in the order rename, remove, set, template.
+type Transform struct {
+	Rename   map[string]string      `json:"rename,omitempty"`
+	Remove   []string               `json:"remove,omitempty"`
+	Set      map[string]interface{} `json:"set,omitempty"`
+	Template string                 `json:"template,omitempty"`
+
+	tmpl *template.Template
+}
+
+// transformData is exposed to templates as the dot value.
+type transformData struct {
+	Body   interface{}
+	Method string
+	Path   string
+	Query  map[string][]string
+	Status int
+}
+
+var transformFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+func (t *Transform) compile() error {
+	if t == nil || t.Template == "" {
+		return nil
+	}
+	tmpl, err := template.New("transform").Funcs(transformFuncs).Option("missingkey=zero").Parse(t.Template)
+	if err != nil {
+		return err
+	}
+	t.tmpl = tmpl
+	return nil
+}
+
+func (t *Transform) apply(body []byte, data transformData) ([]byte, error) {
+	var doc interface{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return nil, fmt.Errorf("body is not valid JSON: %v", err)
+		}
+	}
+
+	// Field operations only make sense on objects
+	if obj, ok := doc.(map[string]interface{}); ok {
+		for from, to := range t.Rename {
+			if value, found := getField(obj, from); found {
+				deleteField(obj, from)
+				setField(obj, to, value)
+			}
+		}
+		for _, field := range t.Remove {
+			deleteField(obj, field)
+		}
+		for field, value := range t.Set {
+			setField(obj, field, value)
+		}
+	}
+
+	if t.tmpl != nil {
+		data.Body = doc
+		var buf bytes.Buffer
+		if err := t.tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("template execution failed: %v", err)
+		}
+		return buf.Bytes(), nil
+	}
+
+	return json.Marshal(doc)
+}
+
+func splitField(path string) []string {
+	return strings.Split(path, ".")
+}
+
+func getField(obj map[string]interface{}, path string) (interface{}, bool) {
+	parts := splitField(path)
+	current := obj
+	for i, part := range parts {
+		value, ok := current[part]
+		if !ok {
+			return nil, false
+		}
+		if i == len(parts)-1 {
+			return value, true
+		}
+		if current, ok = value.(map[string]interface{}); !ok {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+func setField(obj map[string]interface{}, path string, value interface{}) {
+	parts := splitField(path)
+	current := obj
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := current[part].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			current[part] = next
+		}
+		current = next
+	}
+	current[parts[len(parts)-1]] = value
+}
+
+func deleteField(obj map[string]interface{}, path string) {
+	parts := splitField(path)
+	current := obj
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := current[part].(map[string]interface{})
+		if !ok {
+			return
+		}
+		current = next
+	}
+	delete(current, parts[len(parts)-1])
+}
+
+func transformRequest(r *http.Request, t *Transform) error {
+	return rewriteRequestBody(r, func(body []byte) ([]byte, error) {
+		return t.apply(body, transformData{Method: r.Method, Path: r.URL.Path, Query: r.URL.Query()})
+	})
+}
+
+func transformResponse(resp *http.Response, r *http.Request, t *Transform) error {
+	return rewriteResponseBody(resp, func(body []byte) ([]byte, error) {
+		return t.apply(body, transformData{Method: r.Method, Path: r.URL.Path, Query: r.URL.Query(), Status: resp.StatusCode})
+	})
+}
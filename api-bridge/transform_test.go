@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTransform(t *testing.T) {
+	tests := []struct {
+		name      string
+		transform Transform
+		body      string
+		want      string
+	}{
+		{"rename", Transform{Rename: map[string]string{"user_name": "user.name"}},
+			`{"user_name":"alice","id":1}`, `{"id":1,"user":{"name":"alice"}}`},
+		{"rename missing field", Transform{Rename: map[string]string{"nickname": "alias"}},
+			`{"id":1}`, `{"id":1}`},
+		{"remove nested", Transform{Remove: []string{"user.password", "user.missing.field"}},
+			`{"user":{"name":"alice","password":"hunter2"}}`, `{"user":{"name":"alice"}}`},
+		{"set", Transform{Set: map[string]interface{}{"meta.source": "apiduct", "id": 2.0}},
+			`{"id":1}`, `{"id":2,"meta":{"source":"apiduct"}}`},
+		{"rename before remove", Transform{Rename: map[string]string{"a": "b"}, Remove: []string{"b"}},
+			`{"a":1}`, `{}`},
+		{"array left alone", Transform{Remove: []string{"id"}},
+			`[{"id":1}]`, `[{"id":1}]`},
+		{"empty body", Transform{}, ``, `null`},
+		{"template", Transform{Template: `{"items":{{json .Body.data}},"path":"{{.Path}}","page":"{{index .Query.page 0}}"}`},
+			`{"data":[1,2]}`, `{"items":[1,2],"path":"/orders","page":"2"}`},
+	}
+	for _, tt := range tests {
+		if err := tt.transform.compile(); err != nil {
+			t.Errorf("%s: compile: %v", tt.name, err)
+			continue
+		}
+		got, err := tt.transform.apply([]byte(tt.body), transformData{Method: "GET", Path: "/orders",
+			Query: map[string][]string{"page": {"2"}}})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTransformErrors(t *testing.T) {
+	if err := (&Transform{Template: "{{.Body"}).compile(); err == nil {
+		t.Error("compiled a malformed template")
+	}
+	if _, err := (&Transform{}).apply([]byte(`{"id":`), transformData{}); err == nil {
+		t.Error("transformed a body that is not JSON")
+	}
+}
+
+func TestTransformRequest(t *testing.T) {
+	gzipped := func(s string) string {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(s))
+		zw.Close()
+		return buf.String()
+	}
+	tests := []struct {
+		name        string
+		contentType string
+		encoding    string
+		body        string
+		want        string
+	}{
+		{"JSON", "application/json", "", `{"a":1}`, `{"b":1}`},
+		{"JSON suffix", "application/vnd.api+json; charset=utf-8", "", `{"a":1}`, `{"b":1}`},
+		{"gzip", "application/json", "gzip", gzipped(`{"a":1}`), gzipped(`{"b":1}`)},
+		{"not JSON", "text/plain", "", `{"a":1}`, `{"a":1}`},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/orders", strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", tt.contentType)
+		r.Header.Set("Content-Encoding", tt.encoding)
+		if err := transformRequest(r, &Transform{Rename: map[string]string{"a": "b"}}); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		body, _ := io.ReadAll(r.Body)
+		got, want := string(body), tt.want
+		if tt.encoding == "gzip" {
+			got, want = gunzip(t, body), gunzip(t, []byte(want))
+		}
+		if got != want {
+			t.Errorf("%s: body %q, want %q", tt.name, got, want)
+		}
+		if tt.contentType != "text/plain" && r.ContentLength != int64(len(body)) {
+			t.Errorf("%s: content length %d, body has %d bytes", tt.name, r.ContentLength, len(body))
+		}
+	}
+}
+
+func gunzip(t *testing.T, data []byte) string {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("body is not gzipped: %v", err)
+	}
+	plain, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("body is not gzipped: %v", err)
+	}
+	return string(plain)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"apiduct/pkg/auth"
+)
+
+// unnamedOfframp stands for the offramps without a name in tunnel ACLs
+const unnamedOfframp = "-"
+
+// aclRule allows forwarding to matching host:port addresses. The host is a
+// name, a wildcard such as *.example.com, an IP address or a CIDR range; the
+// port is a number or * for any port.
+type aclRule struct {
+	host    string
+	network *net.IPNet
+	port    string
+}
+
+func parseACLRule(value string) (aclRule, error) {
+	i := strings.LastIndex(value, ":")
+	if i <= 0 || i == len(value)-1 {
+		return aclRule{}, fmt.Errorf("invalid address %q, expected host:port", value)
+	}
+	rule := aclRule{host: strings.ToLower(strings.Trim(value[:i], "[]")), port: value[i+1:]}
+	if rule.port != "*" {
+		if port, err := strconv.Atoi(rule.port); err != nil || port < 1 || port > 65535 {
+			return aclRule{}, fmt.Errorf("invalid port in %q", value)
+		}
+	}
+	if strings.Contains(rule.host, "/") {
+		_, network, err := net.ParseCIDR(rule.host)
+		if err != nil {
+			return aclRule{}, fmt.Errorf("invalid network in %q: %v", value, err)
+		}
+		rule.network = network
+	}
+	return rule, nil
+}
+
+func (r aclRule) matches(host, port string) bool {
+	if r.port != "*" && r.port != port {
+		return false
+	}
+	if r.network != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && r.network.Contains(ip)
+	}
+	if strings.HasPrefix(r.host, "*.") {
+		return strings.HasSuffix(host, r.host[1:])
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.Equal(net.ParseIP(r.host))
+	}
+	return host == r.host
+}
+
+// tunnelACLs lists, per offramp name, the addresses forward clients may reach
+// through its tunnels. Everything else is denied.
+type tunnelACLs map[string][]aclRule
+
+// allows reports whether a forward to addr may go through the offramp called
+// name, empty for unnamed offramps.
+func (a tunnelACLs) allows(name, addr string) bool {
+	if name == "" {
+		name = unnamedOfframp
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, rule := range a[name] {
+		if rule.matches(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// add parses addresses into rules for the offramp called name.
+func (a tunnelACLs) add(name string, addresses []string) error {
+	if name != unnamedOfframp {
+		if err := auth.ValidateName(name); err != nil {
+			return err
+		}
+	}
+	for _, address := range addresses {
+		rule, err := parseACLRule(strings.TrimSpace(address))
+		if err != nil {
+			return fmt.Errorf("offramp %s: %v", name, err)
+		}
+		a[name] = append(a[name], rule)
+	}
+	return nil
+}
+
+// buildTunnelACLs combines the config file's tunnel_acls with the
+// --tunnel-acl values, given as name=host:port[,host:port...].
+func buildTunnelACLs(fromFile map[string][]string, fromFlags []string) (tunnelACLs, error) {
+	acls := make(tunnelACLs)
+	for name, addresses := range fromFile {
+		if err := acls.add(name, addresses); err != nil {
+			return nil, err
+		}
+	}
+	for _, value := range fromFlags {
+		name, addresses, ok := strings.Cut(value, "=")
+		if !ok || addresses == "" {
+			return nil, fmt.Errorf("invalid tunnel ACL %q, expected name=host:port[,host:port...]", value)
+		}
+		if err := acls.add(name, strings.Split(addresses, ",")); err != nil {
+			return nil, err
+		}
+	}
+	return acls, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"apiduct/pkg/auth"
+	"apiduct/pkg/mux"
+	"apiduct/pkg/tunnel"
+)
+
+// handleTunnelConnection authenticates a connection from an offramp and,
+// for a tunnel, adds it to tunnelConn until it closes. Goodbye and forward
+// connections are handed on.
+func handleTunnelConnection(conn net.Conn, tunnelConn *tunnel.Pool, config *Config, onConnect func()) {
+	defer conn.Close()
+
+	remote := conn.RemoteAddr().String()
+	logTunnel := func(format string, args ...interface{}) {
+		logFields(map[string]string{"tunnel": remote}, format, args...)
+	}
+
+	// Challenge the offramp to prove it knows the PSK
+	start := time.Now()
+	conn.SetDeadline(start.Add(auth.Timeout))
+	hello, err := auth.ReadHello(conn, config.PSK)
+	if err == auth.ErrOldHandshake {
+		mux.ObserveHandshake(start, "rejected")
+		logEvent("auth_failure", map[string]string{"tunnel": remote, "code": errCodeAuthFailed}, "[BRIDGE] Rejecting tunnel connection: %v", err)
+		auth.WriteStatus(conn, auth.StatusBadVersion)
+		return
+	}
+	if err != nil {
+		mux.ObserveHandshake(start, "error")
+		logTunnel("[BRIDGE] Failed to complete handshake: %v", err)
+		return
+	}
+
+	// Offramps enrolling with a bootstrap token get a key of their own
+	if hello.Kind == auth.KindEnroll {
+		enrollOfframp(conn, hello, start)
+		return
+	}
+
+	// Verify the PSK, one from --psk-dir, or the key of an enrolled offramp
+	identity, keyID := "", ""
+	if hello.Valid {
+		keyID = defaultKeyID
+	} else {
+		keyID = psks.verify(hello)
+	}
+	if keyID == "" {
+		identity = enrollments.verify(hello)
+	}
+	if keyID == "" && identity == "" {
+		mux.ObserveHandshake(start, "failed")
+		logEvent("auth_failure", map[string]string{"tunnel": remote, "code": errCodeAuthFailed}, "[BRIDGE] PSK verification failed")
+		auth.WriteStatus(conn, auth.StatusFailed)
+		return
+	}
+
+	// The client ID the offramp presented is its identity, unless it
+	// enrolled under another one. A --psk-dir key filed under an identity
+	// the offramp policy lists only authenticates that identity
+	if msg := checkClientID(hello.ClientID, identity, keyID); msg != "" {
+		mux.ObserveHandshake(start, "failed")
+		logEvent("auth_failure", map[string]string{"tunnel": remote, "code": errCodeAuthFailed}, "[BRIDGE] %s", msg)
+		auth.WriteStatus(conn, auth.StatusFailed)
+		return
+	}
+	if hello.ClientID != "" {
+		identity = hello.ClientID
+	}
+
+	// Named offramps announce their name, offramps keeping standby tunnels
+	// their tunnel group and name
+	kind := hello.Kind
+	name, group := hello.Name, hello.Group
+	if kind == auth.KindNamedTunnel || kind == auth.KindGroupedTunnel {
+		kind = auth.KindTunnel
+	}
+
+	// Check the clock difference, the offramp does the same with our time
+	skew := time.Since(hello.Clock)
+	status := byte(auth.StatusOK)
+	if config.MaxClockSkew > 0 && (skew > config.MaxClockSkew || skew < -config.MaxClockSkew) {
+		metrics.Counter("apiduct_clock_skew_exceeded_total", "action", config.ClockSkewAction).Inc()
+		if config.ClockSkewAction == "fail" {
+			status = auth.StatusClockSkew
+			logEvent("auth_failure", map[string]string{"tunnel": remote},
+				"[BRIDGE] Rejecting tunnel connection: clock skew of %s exceeds %s", skew.Round(time.Millisecond), config.MaxClockSkew)
+		} else {
+			logTunnel("[BRIDGE] Warning: clock skew of %s to the offramp exceeds %s, token expiry and replay windows may break",
+				skew.Round(time.Millisecond), config.MaxClockSkew)
+		}
+	}
+
+	// Refuse new tunnels while draining, but let offramps say goodbye. The
+	// kill switch looks the same to offramps, which keep trying to reconnect
+	if status == auth.StatusOK && kind != auth.KindGoodbye && maintenance.isDraining() {
+		status = auth.StatusDraining
+		logTunnel("[BRIDGE] Refusing tunnel connection, bridge is draining")
+	}
+	if status == auth.StatusOK && kind != auth.KindGoodbye && emergency.isEngaged() {
+		status = auth.StatusDraining
+		logTunnel("[BRIDGE] Refusing tunnel connection, kill switch is engaged")
+	}
+
+	// Only accept offramps that serve a route
+	if status == auth.StatusOK && name != "" && !servesRoute(live.Routes(), name) {
+		status = auth.StatusNoRoute
+		logEvent("auth_failure", map[string]string{"tunnel": remote, "offramp": name},
+			"[BRIDGE] Refusing tunnel connection: no route is served by offramp %q", name)
+	}
+
+	// Only accept offramps whose identity may serve the routes they would be
+	// sent
+	if status == auth.StatusOK && kind == auth.KindTunnel && !live.OfframpPolicy().admits(identity, name, live.Routes()) {
+		status = auth.StatusForbidden
+		metrics.Counter("apiduct_offramp_policy_denied_total").Inc()
+		logEvent("auth_failure", map[string]string{"tunnel": remote, "offramp": name, "identity": identity},
+			"[BRIDGE] Refusing tunnel connection: offramp policy does not let %s serve %s", describeIdentity(identity), describeOfframpName(name))
+	}
+
+	if status != auth.StatusOK {
+		mux.ObserveHandshake(start, "rejected")
+		auth.WriteStatus(conn, status)
+		return
+	}
+
+	// Send authentication success
+	if keyID != "" {
+		metrics.Counter("apiduct_psk_auth_total", "key_id", keyID).Inc()
+		logTunnel("[BRIDGE] PSK verification successful with key %s", keyID)
+	} else {
+		logTunnel("[BRIDGE] Key verification successful for enrolled offramp %s", identity)
+	}
+	if err := auth.WriteStatus(conn, auth.StatusOK); err != nil {
+		mux.ObserveHandshake(start, "error")
+		logTunnel("[BRIDGE] Failed to send authentication success: %v", err)
+		return
+	}
+	mux.ObserveHandshake(start, "ok")
+	conn.SetDeadline(time.Time{})
+
+	// An offramp announcing its shutdown, rather than opening a tunnel
+	if kind == auth.KindGoodbye {
+		handleGoodbye(conn, tunnelConn, logTunnel)
+		return
+	}
+	if kind == auth.KindForward {
+		handleForward(conn, tunnelConn, live.TunnelACLs(), logTunnel)
+		return
+	}
+	if kind != auth.KindTunnel {
+		logTunnel("[BRIDGE] Unknown connection kind %d", kind)
+		return
+	}
+
+	// Add the tunnel to the pool, requests are multiplexed over it from now on
+	sessionConn, stopRecording := mux.RecordSession(conn, config.RecordDir, true, logf)
+	defer stopRecording()
+	session := mux.NewSession(sessionConn, true)
+	if config.TunnelChecksums {
+		if err := session.EnableChecksums(); err != nil {
+			logTunnel("[BRIDGE] Failed to ask for tunnel checksums: %v", err)
+		}
+	}
+	t := tunnelConn.Add(conn, session, name, identity, group)
+	if emergency.isEngaged() {
+		tunnelConn.Drop(t, "kill switch engaged")
+		return
+	}
+
+	fields := map[string]string{"tunnel": remote, "tunnel_id": t.ID}
+	if name != "" {
+		fields["offramp"] = name
+	}
+	if identity != "" {
+		fields["identity"] = identity
+	}
+	if keyID != "" {
+		fields["key_id"] = keyID
+	}
+	metrics.Counter("apiduct_tunnel_connections_total").Inc()
+	if tunnelConn.IsStandby(t) {
+		// Warmed up already through the active tunnel of its group
+		fields["standby"] = "true"
+		logEvent("tunnel_up", fields, "[BRIDGE] Standby tunnel connection established, %d in the pool", tunnelConn.Len())
+	} else {
+		logEvent("tunnel_up", fields, "[BRIDGE] Tunnel connection established, %d in the pool", tunnelConn.Len())
+		// Warm up alongside the heartbeat, which must not wait for it
+		go onConnect()
+	}
+	go mux.Heartbeat(session, config.HeartbeatInterval, config.HeartbeatTimeout, "tunnel_id", t.ID)
+
+	// Wait for the connection to end
+	<-session.CloseChan()
+	if tunnelConn.Remove(t) {
+		logEvent("tunnel_down", map[string]string{"tunnel": remote, "tunnel_id": t.ID}, "[BRIDGE] Tunnel connection lost: %v", session.Err())
+	}
+}
@@ -0,0 +1,5 @@
+package main
+
+// tunnelHeader tells clients which tunnel served a response, for debugging
+// routing. It is only added with --tunnel-header.
+const tunnelHeader = "X-Apiduct-Tunnel"
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// usageCounters are the accounting counters kept across restarts, along with
+// the quota consumption of the current windows.
+var usageCounters = map[string]bool{
+	"apiduct_requests_total":       true,
+	"apiduct_request_bytes_total":  true,
+	"apiduct_response_bytes_total": true,
+}
+
+type usageRecord struct {
+	Name   string   `json:"name"`
+	Labels []string `json:"labels,omitempty"`
+	Value  int64    `json:"value"`
+}
+
+type usageState struct {
+	SavedAt  time.Time              `json:"saved_at"`
+	Counters []usageRecord          `json:"counters"`
+	Quotas   map[string]*quotaUsage `json:"quotas,omitempty"`
+}
+
+// loadUsage restores usage counters from a checkpoint. A missing file is not
+// an error, so the first start begins at zero.
+func loadUsage(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read usage state: %v", err)
+	}
+
+	var state usageState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse usage state: %v", err)
+	}
+	for _, record := range state.Counters {
+		if usageCounters[record.Name] {
+			metrics.Counter(record.Name, record.Labels...).Add(record.Value)
+		}
+	}
+	quotas.restore(state.Quotas)
+	log.Printf("[BRIDGE] Restored %d usage counters saved at %s", len(state.Counters), state.SavedAt.Format(time.RFC3339))
+	return nil
+}
+
+// saveUsage writes the usage counters atomically via a temporary file.
+func saveUsage(path string) error {
+	state := usageState{SavedAt: time.Now().UTC(), Quotas: quotas.snapshot()}
+	for _, c := range metrics.Counters() {
+		if usageCounters[c.Name] {
+			state.Counters = append(state.Counters, usageRecord{Name: c.Name, Labels: c.Labels, Value: c.Value()})
+		}
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".usage-*")
+	if err != nil {
+		return fmt.Errorf("failed to create usage state: %v", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write usage state: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write usage state: %v", err)
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to replace usage state: %v", err)
+	}
+	return nil
+}
+
+func runUsageCheckpoints(path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := saveUsage(path); err != nil {
+			log.Printf("[BRIDGE] Failed to checkpoint usage counters: %v", err)
+		}
+	}
+}
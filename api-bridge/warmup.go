@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// parseWarmupURLs splits a comma separated list of paths or absolute URLs.
+func parseWarmupURLs(list string) ([]string, error) {
+	var urls []string
+	for _, raw := range strings.Split(list, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		if !u.IsAbs() && !strings.HasPrefix(u.Path, "/") {
+			return nil, fmt.Errorf("warm-up URL %q must be absolute or start with /", raw)
+		}
+		urls = append(urls, raw)
+	}
+	return urls, nil
+}
+
+// warmUp fetches the configured URLs through the proxy so recorded responses
+// are primed and the end-to-end path is verified before regular traffic.
+func warmUp(proxy http.Handler, config *Config) {
+	if len(config.WarmupURLs) == 0 {
+		return
+	}
+
+	defaultHost := config.ListenIP
+	if defaultHost == "0.0.0.0" || defaultHost == "" {
+		defaultHost = "localhost"
+	}
+
+	log.Printf("[BRIDGE] Warming up %d URLs through the tunnel", len(config.WarmupURLs))
+	succeeded := 0
+	for _, raw := range config.WarmupURLs {
+		u, _ := url.Parse(raw)
+		host := u.Host
+		if host == "" {
+			host = net.JoinHostPort(defaultHost, strconv.Itoa(config.ListenPort))
+		}
+
+		req, err := http.NewRequestWithContext(context.WithValue(context.Background(), internalKey, true),
+			http.MethodGet, u.RequestURI(), nil)
+		if err != nil {
+			log.Printf("[BRIDGE] Warm-up request for %s could not be created: %v", raw, err)
+			continue
+		}
+		req.RequestURI = u.RequestURI()
+		req.Host = host
+		req.RemoteAddr = "warmup"
+		req.Header.Set("User-Agent", "apiduct-warmup/"+Version)
+
+		resp := newBufferedResponse()
+		proxy.ServeHTTP(resp, req)
+
+		if resp.status >= 200 && resp.status < 400 {
+			succeeded++
+			metrics.Counter("apiduct_warmup_requests_total", "result", "success").Inc()
+			continue
+		}
+		log.Printf("[BRIDGE] Warm-up request for %s failed with status %d", raw, resp.status)
+		metrics.Counter("apiduct_warmup_requests_total", "result", "failure").Inc()
+	}
+
+	if succeeded < len(config.WarmupURLs) {
+		log.Printf("[BRIDGE] Warm-up finished: %d/%d URLs succeeded, end-to-end path may be unhealthy", succeeded, len(config.WarmupURLs))
+		return
+	}
+	log.Printf("[BRIDGE] Warm-up finished: all %d URLs succeeded", succeeded)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+
+	"apiduct/pkg/mux"
+)
+
+// serveUpgraded hands the client connection over to the tunnel stream after
+// the target agreed to switch protocols, and copies in both directions until
+// either side closes. streamReader holds what was read from the stream past
+// the response.
+func serveUpgraded(w http.ResponseWriter, resp *http.Response, stream *mux.Stream, streamReader *bufio.Reader) error {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		stream.Reset()
+		return fmt.Errorf("connection cannot be taken over")
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		stream.Reset()
+		return err
+	}
+	defer client.Close()
+
+	// Pass the target's 101 response on as is
+	fmt.Fprintf(buffered, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(buffered)
+	buffered.WriteString("\r\n")
+	if err := buffered.Flush(); err != nil {
+		stream.Reset()
+		return err
+	}
+
+	metrics.Counter("apiduct_websocket_connections_total").Inc()
+	open := metrics.Gauge("apiduct_websocket_open")
+	open.Add(1)
+	defer open.Add(-1)
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(stream, buffered.Reader)
+		stream.Close()
+		close(done)
+	}()
+	io.Copy(client, streamReader)
+	client.Close()
+	<-done
+	return nil
+}
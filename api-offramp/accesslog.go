@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"apiduct/pkg/accesslog"
+)
+
+// accessLog logs every request with --access-log, nil if disabled.
+var accessLog *accesslog.Logger
+
+// checkAccessLog validates the --access-log-* settings.
+func checkAccessLog(format string, maxSize int, rotate time.Duration, maxBackups int) error {
+	if err := accesslog.CheckFormat(format); err != nil {
+		return err
+	}
+	if maxSize < 0 || rotate < 0 || maxBackups < 0 {
+		return fmt.Errorf("access log rotation settings must not be negative")
+	}
+	return nil
+}
+
+func openAccessLog(config *Config) (*accesslog.Logger, error) {
+	return accesslog.Open(config.AccessLog, config.AccessLogFormat, accesslog.Rotation{
+		MaxSize:    int64(config.AccessLogMaxSize) << 20,
+		Interval:   config.AccessLogRotate,
+		MaxBackups: config.AccessLogMaxBackups,
+	})
+}
+
+// logAccess writes a finished request to the access log. The client is the
+// address the bridge added last to X-Forwarded-For; the offramp does not
+// know the bridge's route, so none is logged.
+func logAccess(req *http.Request, requestID string, status int, bytes int64, duration time.Duration) {
+	if accessLog == nil {
+		return
+	}
+	client := req.Header.Get("X-Forwarded-For")
+	if i := strings.LastIndex(client, ","); i >= 0 {
+		client = client[i+1:]
+	}
+	err := accessLog.Log(accesslog.Entry{
+		Time:      time.Now().Add(-duration),
+		ClientIP:  strings.TrimSpace(client),
+		User:      req.Header.Get("X-Apiduct-Client-Subject"),
+		Method:    req.Method,
+		URI:       req.RequestURI,
+		Proto:     req.Proto,
+		Status:    status,
+		Bytes:     bytes,
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+		Duration:  duration,
+		RequestID: requestID,
+	})
+	if err != nil {
+		log.Printf("[OFFRAMP] Failed to write access log: %v", err)
+	}
+}
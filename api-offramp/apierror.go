@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"apiduct/pkg/mux"
+	"apiduct/pkg/proxy"
+)
+
+// Error codes of responses generated by the offramp
+const (
+	errCodeTargetUnreachable = "TARGET_UNREACHABLE" // the target refused or did not accept the connection
+	errCodeTargetTimeout     = "TARGET_TIMEOUT"     // the target did not answer in time
+	errCodeTargetError       = "TARGET_ERROR"       // the request to the target failed otherwise
+	errCodeForwardDenied     = "FORWARD_DENIED"     // the forward address is not in --forward-allow
+	errCodeEgressDenied      = "EGRESS_DENIED"      // the target is outside --egress-allow
+	errCodeTunnelError       = "TUNNEL_ERROR"       // the request could not be read from the tunnel
+	errCodeHeaderTooLarge    = "HEADER_TOO_LARGE"   // the request header exceeds the tunnel's limits
+)
+
+// unreadableDrainWait bounds how long the rest of a request answered with an
+// error, or that could not be read, is discarded, so the bridge can finish
+// sending it and read the answer.
+const unreadableDrainWait = 10 * time.Second
+
+// targetErrorResponse picks the status and code for a request the target
+// could not answer.
+func targetErrorResponse(err error) (int, string) {
+	var denied *deniedError
+	if errors.As(err, &denied) {
+		return http.StatusBadGateway, errCodeEgressDenied
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout, errCodeTargetTimeout
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return http.StatusBadGateway, errCodeTargetUnreachable
+	}
+	return http.StatusBadGateway, errCodeTargetError
+}
+
+// Messages sent with the target error codes. Details such as the target's
+// address stay in the offramp log.
+var targetErrorMessages = map[string]string{
+	errCodeTargetUnreachable: "Target is unreachable",
+	errCodeTargetTimeout:     "Target did not respond in time",
+	errCodeTargetError:       "Request to the target failed",
+	errCodeEgressDenied:      "Target is outside the offramp's egress allowlist",
+}
+
+// writeTargetError answers a request the target could not answer.
+func writeTargetError(stream *mux.Stream, req *http.Request, status int, code string) {
+	writeError(stream, req, status, code, targetErrorMessages[code])
+}
+
+// writeError answers a request from the tunnel with an apiduct error: the
+// code in the X-Apiduct-Error header and a JSON body such as
+// {"error": "...", "code": "TARGET_TIMEOUT"}. The stream is reset if that
+// fails or the bridge does not finish sending the request in time.
+func writeError(stream *mux.Stream, req *http.Request, status int, code, message string) {
+	// The bridge reads the response once it sent the whole request. A body
+	// the target client closed was already read to its end.
+	stream.SetReadDeadline(time.Now().Add(unreadableDrainWait))
+	if _, err := io.Copy(io.Discard, req.Body); err != nil && !errors.Is(err, http.ErrBodyReadAfterClose) {
+		log.Printf("[OFFRAMP] Failed to read the rest of %s %s before answering it: %v", req.Method, req.RequestURI, err)
+		stream.Reset()
+		return
+	}
+	metrics.Counter("apiduct_errors_total", "code", code).Inc()
+	resp := proxy.ErrorResponse(req, status, code, message)
+	if err := resp.Write(stream); err != nil {
+		log.Printf("[OFFRAMP] Failed to forward response through tunnel: %v", err)
+		stream.Reset()
+		return
+	}
+	stream.Close()
+}
+
+// writeUnreadable answers a stream whose request could not be read, so the
+// bridge does not wait for a response that never comes: 431 for a header
+// over the limits, else 502. The stream is reset if that fails or the bridge
+// does not finish sending in time.
+func writeUnreadable(stream *mux.Stream, reason error) {
+	status, code, message := http.StatusBadGateway, errCodeTunnelError, "Request could not be read from the tunnel"
+	if errors.Is(reason, proxy.ErrHeaderTooLarge) {
+		status, code, message = http.StatusRequestHeaderFieldsTooLarge, errCodeHeaderTooLarge, "Request header too large"
+	}
+	metrics.Counter("apiduct_errors_total", "code", code).Inc()
+	resp := proxy.ErrorResponse(nil, status, code, message)
+	if err := resp.Write(stream); err != nil {
+		stream.Reset()
+		return
+	}
+	stream.SetReadDeadline(time.Now().Add(unreadableDrainWait))
+	if _, err := io.Copy(io.Discard, stream); err != nil {
+		stream.Reset()
+		return
+	}
+	stream.Close()
+}
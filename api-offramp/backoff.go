@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// stableAfter is how long a tunnel must stay up before its reconnects start
+// over at the initial delay, so a bridge that accepts and at once drops
+// tunnels is still backed off from.
+const stableAfter = 30 * time.Second
+
+// errBridgeGoneAway is returned for a tunnel the bridge closed after it
+// announced so with go away, e.g. while restarting, a hint to reconnect at
+// once.
+var errBridgeGoneAway = errors.New("bridge closed the tunnel after go away")
+
+// backoff spaces reconnect attempts: the delay doubles with each failure up
+// to max, and each wait is drawn between half the delay and the full delay
+// so offramps restarting together do not reconnect in lockstep.
+type backoff struct {
+	initial, max time.Duration
+	delay        time.Duration
+}
+
+func newBackoff(initial, max time.Duration) *backoff {
+	return &backoff{initial: initial, max: max}
+}
+
+// next returns how long to wait before the next attempt.
+func (b *backoff) next() time.Duration {
+	if b.delay == 0 {
+		b.delay = b.initial
+	} else if b.delay *= 2; b.delay > b.max {
+		b.delay = b.max
+	}
+	half := b.delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// wait sleeps for the next delay.
+func (b *backoff) wait() {
+	time.Sleep(b.next())
+}
+
+// reset starts over at the initial delay.
+func (b *backoff) reset() {
+	b.delay = 0
+}
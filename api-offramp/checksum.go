@@ -0,0 +1,28 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"apiduct/pkg/mux"
+)
+
+// checksumWait bounds how long a response waits for the end of its request,
+// whose checksum tells whether the request arrived intact.
+const checksumWait = time.Second
+
+// verifyRequest reports whether the request read from stream passed its
+// checksum. Requests still streaming after checksumWait pass unchecked.
+func verifyRequest(stream *mux.Stream, req *http.Request) bool {
+	stream.SetReadDeadline(time.Now().Add(checksumWait))
+	if err := stream.Verify(); err != mux.ErrChecksumMismatch {
+		return true
+	}
+	requestChecksumFailed(req)
+	return false
+}
+
+func requestChecksumFailed(req *http.Request) {
+	log.Printf("[OFFRAMP] Request %s %s failed its tunnel checksum, the target may have received damaged bytes; resetting the stream", req.Method, req.URL.RequestURI())
+}
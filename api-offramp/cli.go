@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"apiduct/pkg/accesslog"
+	"apiduct/pkg/buildinfo"
+	"apiduct/pkg/telemetry"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// flagAliases maps deprecated flag names to their replacements. The old names
+// keep working but print a deprecation notice.
+var flagAliases = map[string]string{
+	"bridge-ip": "bridge-host",
+}
+
+// flagGroup is a titled section of flags in the help output.
+type flagGroup struct {
+	title string
+	flags *pflag.FlagSet
+}
+
+func newFlagGroup(title string) *flagGroup {
+	return &flagGroup{title: title, flags: pflag.NewFlagSet(title, pflag.ContinueOnError)}
+}
+
+func newRootCommand() *cobra.Command {
+	config := &Config{}
+
+	bridge := newFlagGroup("Bridge")
+	bridge.flags.StringVar(&config.BridgeHost, "bridge-host", "", "Host name or IP address of the bridge server")
+	bridge.flags.IntVar(&config.BridgePort, "bridge-port", 8000, "Port of the bridge server")
+	bridge.flags.StringVar(&config.PSK, "psk", "", "Pre-shared key for tunnel authentication")
+	bridge.flags.StringVar(&config.CredentialsFile, "credentials-file", "", "File with the key this offramp enrolled with, used in place of --psk; written on enrollment with --bootstrap-token")
+	bridge.flags.StringVar(&config.BootstrapToken, "bootstrap-token", "", "One-time token to enroll with the bridge if --credentials-file does not exist yet")
+	bridge.flags.StringVar(&config.ClientID, "client-id", "", "Client ID presented to the bridge, whose offramp policy decides which routes it may serve")
+	bridge.flags.StringVar(&config.Name, "name", "", "Name announced to the bridge, which sends this offramp only the requests of routes naming it")
+	bridge.flags.StringVar(&config.SecondaryBridge, "secondary-bridge", "", "Bridge (host:port) to fail over to while the primary bridge is unreachable")
+	bridge.flags.DurationVar(&config.FailbackInterval, "failback-interval", 30*time.Second, "Interval between probes of the primary bridge while connected to the secondary")
+	bridge.flags.IntVar(&config.StandbyTunnels, "standby-tunnels", 0, "Extra tunnel connections kept to the bridge, which promotes one the moment the active tunnel dies; needs a bridge that supports them")
+	bridge.flags.DurationVar(&config.HeartbeatInterval, "heartbeat-interval", 15*time.Second, "Interval between pings on the tunnel, 0 to disable the heartbeat")
+	bridge.flags.DurationVar(&config.HeartbeatTimeout, "heartbeat-timeout", 15*time.Second, "Time to wait for a ping answer before the tunnel is considered dead and reconnected")
+	bridge.flags.StringVar(&config.RecordDir, "record-dir", "", "Record the frames of each tunnel session to a file in this directory for 'api-bridge replay'; credentials are redacted, bodies are not")
+	bridge.flags.BoolVar(&config.TunnelChecksums, "tunnel-checksums", false, "Have the bridge checksum each request it sends, resetting the response to requests that arrive damaged so the bridge does not pass it on")
+	bridge.flags.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "Time to wait on shutdown for the bridge to finish requests in flight, 0 to exit at once")
+	bridge.flags.DurationVar(&config.TunnelMaxAge, "tunnel-max-age", 0, "Replace the tunnel with a new one after this long, draining the old one once the new one is up; 0 to keep it")
+	bridge.flags.Int64Var(&config.TunnelMaxRequests, "tunnel-max-requests", 0, "Replace the tunnel after it carried this many requests, 0 for no limit")
+	bridge.flags.Int64Var(&config.TunnelMaxBytes, "tunnel-max-bytes", 0, "Replace the tunnel after it carried this many bytes, 0 for no limit")
+	bridge.flags.DurationVar(&config.ReconnectInitial, "reconnect-initial", time.Second, "Delay before the first attempt to reconnect to the bridge, doubling with each failure")
+	bridge.flags.DurationVar(&config.ReconnectMax, "reconnect-max", time.Minute, "Longest delay between attempts to reconnect to the bridge")
+	bridge.flags.DurationVar(&config.ReconnectLogInterval, "reconnect-log-interval", time.Minute, "Interval between summaries of repeated connection failures, 0 to log every failure")
+	bridge.flags.DurationVar(&config.MaxClockSkew, "max-clock-skew", 30*time.Second, "Maximum tolerated clock difference to the bridge, 0 to disable the check")
+	bridge.flags.StringVar(&config.ClockSkewAction, "clock-skew-action", "warn", "Action when the clock skew is exceeded: warn or fail")
+
+	target := newFlagGroup("Target")
+	target.flags.StringVar(&config.TargetHost, "target-host", "localhost", "Target host to forward requests to")
+	target.flags.IntVar(&config.TargetPort, "target-port", 8080, "Target port to forward requests to")
+	target.flags.StringVar(&config.TargetScheme, "target-scheme", targetSchemeHTTP, "Scheme of the target: http or https")
+	target.flags.BoolVar(&config.TargetInsecureSkipVerify, "target-insecure-skip-verify", false, "Accept any certificate from an https target (insecure)")
+	target.flags.StringVar(&config.TargetCAFile, "target-ca-file", "", "PEM file with the CA certificates to verify an https target with instead of the system's")
+	target.flags.StringVar(&config.TargetServerName, "target-server-name", "", "Server name (SNI) to send to an https target and verify its certificate for; the target host if empty")
+	target.flags.StringVar(&config.TargetHostHeader, "target-host-header", "", "Host header of the requests to the target; the target host and port if empty")
+	target.flags.StringVar(&config.StripPrefix, "strip-prefix", "", "Path prefix removed from requests before they are sent to the target, e.g. /api")
+	target.flags.StringVar(&config.AddPrefix, "add-prefix", "", "Path prefix put in front of requests before they are sent to the target, after --strip-prefix")
+	target.flags.StringArrayVar(&config.RewritePath, "rewrite-path", nil, "Rewrite of the request path as regexp=replacement, applied after the prefixes (repeatable, in order)")
+	target.flags.StringVar(&config.TargetProtocol, "target-protocol", targetProtocolAuto, "Protocol to the target: auto (HTTP/2 without TLS for gRPC calls, HTTP/1.1 otherwise), http1 or h2c")
+	target.flags.IntVar(&config.MaxConcurrency, "max-concurrency", 4, "Maximum requests sent to the target at once")
+	target.flags.IntVar(&config.QueueDepth, "queue-depth", 16, "Requests queued for a free slot before reading from the tunnel pauses")
+	target.flags.IntVar(&config.PriorityWorkers, "priority-workers", 2, "Requests the bridge marked as priority, e.g. health checks, sent to the target at once on top of --max-concurrency; 0 queues them with the others")
+	target.flags.StringArrayVar(&config.ForwardAllow, "forward-allow", nil, "Address that forward clients may reach through this offramp, in the --egress-allow format (repeatable); none if empty")
+	target.flags.StringArrayVar(&config.EgressAllow, "egress-allow", nil, "Address (host:port, *.domain:port, ip:port or cidr:port, * for any port) the offramp may connect to, for the target and forwards alike (repeatable); any address if empty")
+	target.flags.IntVar(&config.TargetPrewarm, "target-prewarm", 0, "Connections to the target dialled each time the tunnel connects, so the first requests do not wait for a dial; 0 to disable")
+	target.flags.IntVar(&config.TargetRetries, "target-retries", 0, "Times a GET, HEAD or OPTIONS request without a body is sent again when the connection to the target fails, 0 to disable")
+	target.flags.DurationVar(&config.TargetRetryBackoff, "target-retry-backoff", 100*time.Millisecond, "Wait before the first retry of a failed target request, doubling with each retry")
+	target.flags.DurationVar(&config.TargetRetryBackoffMax, "target-retry-backoff-max", time.Second, "Longest wait between retries of a failed target request")
+	target.flags.DurationVar(&config.TargetDownCache, "target-down-cache", 2*time.Second, "Time requests fail fast with 502 after the target was found unreachable, before it is probed again; 0 to disable")
+	target.flags.IntVar(&config.TargetMaxIdleConns, "target-max-idle-conns", 100, "Idle connections to the target kept open for reuse, 0 for no limit")
+	target.flags.IntVar(&config.TargetMaxIdleConnsPerHost, "target-max-idle-conns-per-host", 0, "Idle connections kept open to each target address; --max-concurrency plus --priority-workers if 0")
+	target.flags.IntVar(&config.TargetMaxConnsPerHost, "target-max-conns-per-host", 0, "Connections open to each target address at most, requests beyond it waiting for one to free up; 0 for no limit")
+	target.flags.DurationVar(&config.TargetIdleConnTimeout, "target-idle-conn-timeout", 90*time.Second, "Time an idle connection to the target is kept open for reuse, 0 to keep it until the target closes it")
+
+	dns := newFlagGroup("DNS")
+	dns.flags.StringVar(&config.DNSServer, "dns-server", "", "DNS server (ip[:port]) to resolve the bridge and target with, caching answers for their TTL; system resolver if empty")
+	dns.flags.DurationVar(&config.DNSRefresh, "dns-refresh", 30*time.Second, "Time lookups through the system resolver are reused before resolving again")
+	dns.flags.StringArrayVar(&config.DNSOverrides, "dns-override", nil, "Resolve a host to fixed addresses instead of using DNS, as host=ip[,ip...] (repeatable)")
+
+	metricsGroup := newFlagGroup("Metrics")
+	metricsGroup.flags.IntVar(&config.MetricsPort, "metrics-port", 0, "Port to serve Prometheus metrics on at /metrics, disabled if 0")
+	metricsGroup.flags.StringVar(&config.Telemetry, "telemetry", telemetry.Off, "Send anonymous usage reports (version, features used, error counts by code) to --telemetry-endpoint: on or off")
+	metricsGroup.flags.StringVar(&config.TelemetryEndpoint, "telemetry-endpoint", "", "URL telemetry reports are posted to")
+	metricsGroup.flags.DurationVar(&config.TelemetryInterval, "telemetry-interval", 24*time.Hour, "Interval between telemetry reports, at least 1h")
+	metricsGroup.flags.IntVar(&config.HealthPort, "health-port", 0, "Port to answer liveness and readiness probes on at /healthz and /readyz, disabled if 0")
+	metricsGroup.flags.IntVar(&config.StatusPort, "status-port", 0, "Port to serve a status page on, showing the tunnel, the last handshake, target health and recent errors, disabled if 0")
+	metricsGroup.flags.StringVar(&config.StatusBind, "status-bind", "127.0.0.1", "Address the status page listens on; only local users can see it by default")
+
+	logging := newFlagGroup("Logging")
+	logging.flags.StringVar(&config.LogLevel, "log-level", "info", "Minimum level logged: debug (adds per-request progress and wire traces), info, warning or error")
+	logging.flags.StringVar(&config.LogFormat, "log-format", "text", "Log format: text or json")
+
+	accessLogging := newFlagGroup("Access Log")
+	accessLogging.flags.StringVar(&config.AccessLog, "access-log", "", "File logging every request sent to the target, separate from the operational log, disabled if empty")
+	accessLogging.flags.StringVar(&config.AccessLogFormat, "access-log-format", accesslog.FormatCombined, "Format of access log lines: common, combined or json")
+	accessLogging.flags.IntVar(&config.AccessLogMaxSize, "access-log-max-size", 100, "Megabytes the access log may grow to before it is rotated, 0 for no limit")
+	accessLogging.flags.DurationVar(&config.AccessLogRotate, "access-log-rotate", 24*time.Hour, "Rotate the access log at each multiple of this interval (UTC), 0 to only rotate by size")
+	accessLogging.flags.IntVar(&config.AccessLogMaxBackups, "access-log-max-backups", 7, "Rotated access logs kept, 0 to keep all")
+
+	configuration := newFlagGroup("Configuration")
+	configuration.flags.StringVar(&config.ConfigFile, "config", "", "Path to a JSON, YAML or TOML config file with settings keyed by flag name; flags given on the command line take precedence")
+	configuration.flags.BoolVar(&config.ValidateConfig, "validate-config", false, "Check the config file and flags, then exit without connecting")
+
+	groups := []*flagGroup{bridge, target, dns, metricsGroup, logging, accessLogging, configuration}
+	for _, group := range groups {
+		addDeprecatedAliases(group.flags)
+	}
+
+	runOfframp := func(cmd *cobra.Command, args []string) {
+		if err := applyConfigFile(config, cmd.Flags()); err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		if err := setupLogging(config.LogLevel, config.LogFormat); err != nil {
+			log.Fatalf("Invalid logging configuration: %v", err)
+		}
+		if err := checkConfig(config); err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		if config.ValidateConfig {
+			fmt.Println("Configuration is valid")
+			return
+		}
+		run(config)
+	}
+	root := &cobra.Command{
+		Use:   "api-offramp [flags]",
+		Short: "Connect to an api-bridge and relay its requests to the target API",
+		Long: "api-offramp opens a tunnel to an api-bridge and forwards the requests it\n" +
+			"receives to the target API.\n\n" +
+			"Without a command, api-offramp runs the offramp like the run command.",
+		Args: cobra.NoArgs,
+		Run:  runOfframp,
+	}
+	runCmd := &cobra.Command{
+		Use:   "run [flags]",
+		Short: "Run the offramp",
+		Args:  cobra.NoArgs,
+		Run:   runOfframp,
+	}
+	for _, cmd := range []*cobra.Command{root, runCmd} {
+		for _, group := range groups {
+			cmd.Flags().AddFlagSet(group.flags)
+		}
+		cmd.SetUsageFunc(groupedUsage(groups))
+	}
+	root.RegisterFlagCompletionFunc("clock-skew-action", func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+		return []string{"warn", "fail"}, cobra.ShellCompDirectiveNoFileComp
+	})
+	root.RegisterFlagCompletionFunc("target-scheme", func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+		return []string{targetSchemeHTTP, targetSchemeHTTPS}, cobra.ShellCompDirectiveNoFileComp
+	})
+	root.RegisterFlagCompletionFunc("target-protocol", func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+		return []string{targetProtocolAuto, targetProtocolHTTP1, targetProtocolH2C}, cobra.ShellCompDirectiveNoFileComp
+	})
+	root.RegisterFlagCompletionFunc("log-level", func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+		return []string{"debug", "info", "warning", "error"}, cobra.ShellCompDirectiveNoFileComp
+	})
+	root.RegisterFlagCompletionFunc("log-format", func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+		return []string{"text", "json"}, cobra.ShellCompDirectiveNoFileComp
+	})
+	root.RegisterFlagCompletionFunc("access-log-format", func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+		return []string{accesslog.FormatCommon, accesslog.FormatCombined, accesslog.FormatJSON}, cobra.ShellCompDirectiveNoFileComp
+	})
+
+	forward := &ForwardConfig{}
+	forwardFlags := newFlagGroup("Forward")
+	forwardFlags.flags.StringVar(&forward.Bridge, "bridge", "", "Tunnel address (host:port) of the bridge")
+	forwardFlags.flags.StringVar(&forward.PSK, "psk", "", "Pre-shared key for tunnel authentication")
+	forwardFlags.flags.StringVar(&forward.Listen, "listen", "", "Local address to accept connections on, e.g. :5432")
+	forwardFlags.flags.StringVar(&forward.Remote, "remote", "", "Address (host:port) behind the offramp to relay connections to")
+	forwardFlags.flags.StringVar(&forward.Offramp, "offramp", "", "Name of the offramp to connect through, unnamed offramps if empty")
+	forwardCmd := &cobra.Command{
+		Use:   "forward [flags]",
+		Short: "Relay a local port through the bridge to an address behind an offramp",
+		Long: "forward listens on a local address and relays each connection through the\n" +
+			"bridge and an offramp to a remote address, like ssh -L. The offramp must\n" +
+			"allow the address with --forward-allow.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupLogging(config.LogLevel, config.LogFormat); err != nil {
+				log.Fatalf("Invalid logging configuration: %v", err)
+			}
+			runForward(forward)
+		},
+	}
+	forwardCmd.Flags().AddFlagSet(forwardFlags.flags)
+	forwardCmd.Flags().AddFlagSet(logging.flags)
+	forwardCmd.SetUsageFunc(groupedUsage([]*flagGroup{forwardFlags, logging}))
+
+	root.AddCommand(runCmd, forwardCmd, &cobra.Command{
+		Use:   "version",
+		Short: "Print the version",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Printf("api-offramp %s (built %s)\n", Version, BuildTime)
+			fmt.Printf("features: %s\n", strings.Join(buildinfo.Compiled(features(&Config{})), " "))
+		},
+	})
+	root.SetArgs(normalizeArgs(os.Args[1:], root.Flags(), forwardCmd.Flags()))
+	return root
+}
+
+// addDeprecatedAliases registers the old name of each renamed flag in the set.
+// The alias shares the flag's value and is hidden from the help output.
+func addDeprecatedAliases(flags *pflag.FlagSet) {
+	for old, name := range flagAliases {
+		f := flags.Lookup(name)
+		if f == nil {
+			continue
+		}
+		flags.Var(f.Value, old, f.Usage)
+		flags.Lookup(old).NoOptDefVal = f.NoOptDefVal
+		flags.MarkDeprecated(old, "use --"+name+" instead")
+	}
+}
+
+// normalizeArgs rewrites single-dash long flags such as -psk to --psk, so
+// existing command lines keep working.
+func normalizeArgs(args []string, flagSets ...*pflag.FlagSet) []string {
+	normalized := make([]string, 0, len(args))
+	for i, arg := range args {
+		if arg == "--" {
+			return append(normalized, args[i:]...)
+		}
+		if len(arg) > 2 && arg[0] == '-' && arg[1] != '-' {
+			name := strings.SplitN(arg[1:], "=", 2)[0]
+			if len(name) > 1 && (isFlag(name, flagSets) || flagAliases[name] != "") {
+				arg = "-" + arg
+			}
+		}
+		normalized = append(normalized, arg)
+	}
+	return normalized
+}
+
+func isFlag(name string, flagSets []*pflag.FlagSet) bool {
+	for _, flags := range flagSets {
+		if flags.Lookup(name) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// groupedUsage prints the flags of a command in titled sections.
+func groupedUsage(groups []*flagGroup) func(*cobra.Command) error {
+	return func(cmd *cobra.Command) error {
+		out := cmd.OutOrStderr()
+		fmt.Fprintf(out, "Usage:\n  %s\n", cmd.UseLine())
+		if cmd.HasAvailableSubCommands() {
+			fmt.Fprintf(out, "  %s [command]\n\nCommands:\n", cmd.CommandPath())
+			for _, sub := range cmd.Commands() {
+				if sub.IsAvailableCommand() {
+					fmt.Fprintf(out, "  %-12s %s\n", sub.Name(), sub.Short)
+				}
+			}
+		}
+		for _, group := range groups {
+			fmt.Fprintf(out, "\n%s:\n%s", group.title, group.flags.FlagUsages())
+		}
+		fmt.Fprintf(out, "\n  -h, --help   help for %s\n", cmd.Name())
+		if cmd.HasAvailableSubCommands() {
+			fmt.Fprintf(out, "\nUse \"%s [command] --help\" for more information about a command.\n", cmd.CommandPath())
+		}
+		return nil
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"apiduct/pkg/auth"
+	"apiduct/pkg/buildinfo"
+	"apiduct/pkg/proxy"
+	"apiduct/pkg/telemetry"
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings of the offramp, from flags and the config file.
+type Config struct {
+	BridgeHost string
+	BridgePort int
+	PSK        string
+	Name       string
+	ClientID   string
+	TargetPort int
+	TargetHost string
+
+	TargetProtocol string
+
+	TargetScheme             string
+	TargetInsecureSkipVerify bool
+	TargetCAFile             string
+	TargetServerName         string
+	TargetHostHeader         string
+
+	StripPrefix string
+	AddPrefix   string
+	RewritePath []string
+	Rewrite     *proxy.Rewrite // from the three above, nil if none is set
+
+	MaxClockSkew    time.Duration
+	ClockSkewAction string
+
+	MaxConcurrency  int
+	QueueDepth      int
+	PriorityWorkers int
+
+	SecondaryBridge  string
+	FailbackInterval time.Duration
+
+	StandbyTunnels int
+
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+	TunnelChecksums   bool
+	RecordDir         string
+
+	ShutdownTimeout time.Duration
+
+	ReconnectLogInterval time.Duration
+	ReconnectInitial     time.Duration
+	ReconnectMax         time.Duration
+
+	CredentialsFile string
+	BootstrapToken  string
+
+	TunnelMaxAge      time.Duration
+	TunnelMaxRequests int64
+	TunnelMaxBytes    int64
+
+	MetricsPort int
+	HealthPort  int
+	StatusPort  int
+	StatusBind  string
+
+	Telemetry         string
+	TelemetryEndpoint string
+	TelemetryInterval time.Duration
+
+	DNSServer    string
+	DNSRefresh   time.Duration
+	DNSOverrides []string
+
+	TargetDownCache time.Duration
+
+	TargetRetries         int
+	TargetRetryBackoff    time.Duration
+	TargetRetryBackoffMax time.Duration
+	TargetPrewarm         int
+
+	TargetMaxIdleConns        int
+	TargetMaxIdleConnsPerHost int
+	TargetMaxConnsPerHost     int
+	TargetIdleConnTimeout     time.Duration
+
+	ForwardAllow []string
+	ForwardRules addressRules
+	EgressAllow  []string
+
+	LogLevel  string
+	LogFormat string
+
+	AccessLog           string
+	AccessLogFormat     string
+	AccessLogMaxSize    int // megabytes
+	AccessLogRotate     time.Duration
+	AccessLogMaxBackups int
+
+	ConfigFile     string
+	ValidateConfig bool
+}
+
+// FileConfig is the content of a config file. Settings are keyed by flag
+// name, as in the bridge's config file.
+type FileConfig struct {
+	Settings map[string]interface{} `json:"settings"`
+}
+
+// readFileConfig reads a JSON, YAML or TOML config file, chosen by its
+// extension. YAML and TOML use the same keys as JSON.
+func readFileConfig(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	// Other formats are converted to JSON, so they decode the same way
+	var document interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &document)
+	case ".toml":
+		err = toml.Unmarshal(data, &document)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	if document != nil {
+		if data, err = json.Marshal(document); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+		}
+	}
+
+	fileConfig := &FileConfig{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(fileConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return fileConfig, nil
+}
+
+// applySettings sets the flags named in the config file, unless they were
+// given on the command line. Lists set flags that can be repeated.
+func applySettings(flags *pflag.FlagSet, settings map[string]interface{}) error {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := settings[name]
+		if renamed, ok := flagAliases[name]; ok {
+			name = renamed
+		}
+		if name == "config" || name == "validate-config" {
+			return fmt.Errorf("setting %s cannot be set in the config file", name)
+		}
+		if flags.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %s", name)
+		}
+		if flagChanged(flags, name) {
+			continue
+		}
+		values, isList := value.([]interface{})
+		if !isList {
+			values = []interface{}{value}
+		}
+		for _, v := range values {
+			var s string
+			switch v := v.(type) {
+			case string:
+				s = v
+			case bool:
+				s = strconv.FormatBool(v)
+			case float64:
+				s = strconv.FormatFloat(v, 'f', -1, 64)
+			default:
+				return fmt.Errorf("setting %s: unsupported value %v", name, v)
+			}
+			if err := flags.Set(name, s); err != nil {
+				return fmt.Errorf("setting %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// flagChanged reports whether a flag was given on the command line, under its
+// name or a deprecated alias.
+func flagChanged(flags *pflag.FlagSet, name string) bool {
+	if flags.Changed(name) {
+		return true
+	}
+	for old, renamed := range flagAliases {
+		if renamed == name && flags.Changed(old) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConfig validates the settings once flags and the config file are
+// applied, and sets up the resolver and allowlists they describe. It does not
+// connect anywhere.
+func checkConfig(config *Config) error {
+	if config.BridgeHost == "" {
+		return fmt.Errorf("bridge host is required")
+	}
+	if config.BootstrapToken != "" && config.CredentialsFile == "" {
+		return fmt.Errorf("a bootstrap token needs a credentials file to keep the enrolled key in")
+	}
+	if config.PSK == "" && config.CredentialsFile == "" {
+		return fmt.Errorf("PSK is required")
+	}
+	if config.Name != "" {
+		if err := auth.ValidateName(config.Name); err != nil {
+			return err
+		}
+	}
+	if config.ClientID != "" {
+		if err := auth.ValidateName(config.ClientID); err != nil {
+			return fmt.Errorf("invalid client ID: %v", err)
+		}
+	}
+	if config.ClockSkewAction != "warn" && config.ClockSkewAction != "fail" {
+		return fmt.Errorf("clock skew action must be warn or fail")
+	}
+	if config.HeartbeatInterval < 0 || config.HeartbeatTimeout <= 0 {
+		return fmt.Errorf("heartbeat interval must not be negative and heartbeat timeout must be positive")
+	}
+	if config.SecondaryBridge != "" {
+		if _, _, err := net.SplitHostPort(config.SecondaryBridge); err != nil {
+			return fmt.Errorf("invalid secondary bridge address: %v", err)
+		}
+		if config.FailbackInterval < time.Second {
+			return fmt.Errorf("failback interval must be at least one second")
+		}
+	}
+	if config.ReconnectInitial <= 0 || config.ReconnectMax < config.ReconnectInitial {
+		return fmt.Errorf("reconnect initial delay must be positive and reconnect max must not be below it")
+	}
+	if config.TunnelMaxAge < 0 || config.TunnelMaxRequests < 0 || config.TunnelMaxBytes < 0 {
+		return fmt.Errorf("tunnel max age, requests and bytes must not be negative")
+	}
+	if config.StandbyTunnels < 0 {
+		return fmt.Errorf("standby tunnels must not be negative")
+	}
+	if config.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown timeout must not be negative")
+	}
+	if err := buildinfo.Check(features(config), "offramp"); err != nil {
+		return err
+	}
+	if err := telemetry.Check(config.Telemetry, config.TelemetryEndpoint, config.TelemetryInterval); err != nil {
+		return err
+	}
+	if config.HealthPort != 0 && config.HealthPort == config.MetricsPort {
+		return fmt.Errorf("health port must differ from the metrics port")
+	}
+	if config.StatusPort != 0 && (config.StatusPort == config.MetricsPort || config.StatusPort == config.HealthPort) {
+		return fmt.Errorf("status port must differ from the metrics and health ports")
+	}
+	if config.TargetPrewarm < 0 {
+		return fmt.Errorf("target prewarm must not be negative")
+	}
+	if config.TargetRetries < 0 || config.TargetRetries > 10 {
+		return fmt.Errorf("target retries must be between 0 and 10")
+	}
+	if config.TargetRetries > 0 && config.TargetRetryBackoff <= 0 {
+		return fmt.Errorf("target retry backoff must be positive")
+	}
+	if config.TargetRetries > 0 && config.TargetRetryBackoffMax < config.TargetRetryBackoff {
+		return fmt.Errorf("target retry backoff max must be at least the target retry backoff")
+	}
+	if config.TargetDownCache < 0 {
+		return fmt.Errorf("target down cache must not be negative")
+	}
+	if err := configureTargetTLS(config); err != nil {
+		return err
+	}
+	if err := configureTargetPool(config); err != nil {
+		return err
+	}
+	if err := configureRewrite(config); err != nil {
+		return err
+	}
+	if err := checkAccessLog(config.AccessLogFormat, config.AccessLogMaxSize, config.AccessLogRotate, config.AccessLogMaxBackups); err != nil {
+		return err
+	}
+	switch config.TargetProtocol {
+	case targetProtocolAuto, targetProtocolHTTP1, targetProtocolH2C:
+	default:
+		return fmt.Errorf("target protocol must be auto, http1 or h2c")
+	}
+	if config.MaxConcurrency < 1 || config.QueueDepth < 0 {
+		return fmt.Errorf("max concurrency must be at least 1 and queue depth must not be negative")
+	}
+	if config.PriorityWorkers < 0 {
+		return fmt.Errorf("priority workers must not be negative")
+	}
+
+	// Resolve host names as configured
+	if config.DNSServer != "" {
+		if _, _, err := net.SplitHostPort(config.DNSServer); err != nil {
+			config.DNSServer = net.JoinHostPort(config.DNSServer, "53")
+		}
+		if host, _, _ := net.SplitHostPort(config.DNSServer); net.ParseIP(host) == nil {
+			return fmt.Errorf("DNS server must be an IP address, got %q", config.DNSServer)
+		}
+	}
+	if config.DNSRefresh < 0 {
+		return fmt.Errorf("DNS refresh interval must not be negative")
+	}
+	overrides, err := parseDNSOverrides(config.DNSOverrides)
+	if err != nil {
+		return fmt.Errorf("invalid DNS override: %v", err)
+	}
+	resolver = newHostResolver(config.DNSServer, config.DNSRefresh, overrides)
+
+	// Limit where the offramp connects to inside the protected network
+	if config.ForwardRules, err = parseAddressRules(config.ForwardAllow); err != nil {
+		return fmt.Errorf("invalid forward allowlist: %v", err)
+	}
+	if egress, err = parseAddressRules(config.EgressAllow); err != nil {
+		return fmt.Errorf("invalid egress allowlist: %v", err)
+	}
+	if egress != nil {
+		if err := checkEgress(net.JoinHostPort(config.TargetHost, strconv.Itoa(config.TargetPort))); err != nil {
+			return fmt.Errorf("target is outside the egress allowlist: %v", err)
+		}
+	}
+	return nil
+}
+
+// applyConfigFile sets the flags from the config file, if there is one.
+func applyConfigFile(config *Config, flags *pflag.FlagSet) error {
+	if config.ConfigFile == "" {
+		return nil
+	}
+	fileConfig, err := readFileConfig(config.ConfigFile)
+	if err != nil {
+		return err
+	}
+	if err := applySettings(flags, fileConfig.Settings); err != nil {
+		return fmt.Errorf("failed to apply config settings: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"apiduct/pkg/auth"
+	"apiduct/pkg/mux"
+)
+
+// createTunnelConnection dials a tunnel to the bridge at addr, recording the
+// handshake's outcome for the status page.
+func createTunnelConnection(config *Config, addr string) (net.Conn, error) {
+	conn, err := dialBridge(config, addr, auth.KindTunnel)
+	localStatus.handshakeDone(addr, err)
+	if err != nil || !recycling(config) {
+		return conn, err
+	}
+	return &usageConn{Conn: conn, since: time.Now()}, nil
+}
+
+// dialBridge connects and authenticates to the bridge, announcing the kind of
+// connection.
+func dialBridge(config *Config, addr string, kind byte) (conn net.Conn, err error) {
+	// Connect to bridge
+	log.Printf("[OFFRAMP] Connecting to bridge at %s", addr)
+	conn, err = resolver.Dial("tcp", addr, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to bridge: %v", err)
+	}
+	start := time.Now()
+	defer func() {
+		if err != nil {
+			mux.ObserveHandshake(start, "failed")
+		} else {
+			mux.ObserveHandshake(start, "ok")
+		}
+	}()
+
+	// Set keep-alive
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(30 * time.Second)
+	}
+
+	// Answer the bridge's challenge with proof of the PSK, along with our
+	// clock for skew detection
+	log.Printf("[OFFRAMP] Sending PSK authentication")
+	conn.SetDeadline(time.Now().Add(auth.Timeout))
+	if kind == auth.KindTunnel && config.StandbyTunnels > 0 {
+		kind = auth.KindGroupedTunnel
+	} else if kind == auth.KindTunnel && config.Name != "" {
+		kind = auth.KindNamedTunnel
+	}
+	var announcement []byte
+	if kind == auth.KindNamedTunnel {
+		announcement = auth.AppendName(nil, config.Name)
+	}
+	if kind == auth.KindGroupedTunnel {
+		announcement = auth.AppendGroup(nil, standbyGroup, config.Name)
+	}
+	hello, err := auth.SendHello(conn, config.PSK, kind, config.ClientID, announcement)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sentAt := auth.HelloClock(hello)
+	if _, err := conn.Write(hello); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send PSK: %v", err)
+	}
+
+	// Read authentication response
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read authentication response: %v", err)
+	}
+
+	if response[0] == auth.StatusFailed {
+		conn.Close()
+		return nil, fmt.Errorf("authentication failed")
+	}
+
+	// Compare the bridge clock with the midpoint of the round trip
+	bridgeTime := make([]byte, 8)
+	if _, err := io.ReadFull(conn, bridgeTime); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read bridge time: %v", err)
+	}
+	receivedAt := time.Now()
+	midpoint := sentAt.Add(receivedAt.Sub(sentAt) / 2)
+	skew := time.Unix(0, int64(binary.BigEndian.Uint64(bridgeTime))).Sub(midpoint)
+
+	if response[0] == auth.StatusClockSkew {
+		conn.Close()
+		return nil, fmt.Errorf("bridge rejected connection due to clock skew of %s", skew.Round(time.Millisecond))
+	}
+	if response[0] == auth.StatusDraining {
+		conn.Close()
+		return nil, fmt.Errorf("bridge is draining for maintenance")
+	}
+	if response[0] == auth.StatusBadVersion {
+		conn.Close()
+		return nil, fmt.Errorf("bridge rejected handshake version %d", auth.Version)
+	}
+	if response[0] == auth.StatusNoRoute {
+		conn.Close()
+		return nil, fmt.Errorf("bridge has no route for offramp name %q", config.Name)
+	}
+	if response[0] == auth.StatusForbidden {
+		conn.Close()
+		return nil, fmt.Errorf("bridge's offramp policy does not allow this offramp's identity to serve its routes")
+	}
+	if response[0] != auth.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected authentication response %d", response[0])
+	}
+	if config.MaxClockSkew > 0 && (skew > config.MaxClockSkew || skew < -config.MaxClockSkew) {
+		if config.ClockSkewAction == "fail" {
+			conn.Close()
+			return nil, fmt.Errorf("clock skew of %s to the bridge exceeds %s", skew.Round(time.Millisecond), config.MaxClockSkew)
+		}
+		log.Printf("[OFFRAMP] Warning: clock skew of %s to the bridge exceeds %s, token expiry and replay windows may break",
+			skew.Round(time.Millisecond), config.MaxClockSkew)
+	}
+	log.Printf("[OFFRAMP] PSK authentication successful")
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
@@ -0,0 +1,144 @@
+//go:build !nodnsserver
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const dnsServerCompiled = true
+
+// queryDNS asks server for the A and AAAA records of host. It returns the
+// addresses and the lowest TTL among the answers.
+func queryDNS(ctx context.Context, server, host string) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid host name %q: %v", host, err)
+	}
+	var addrs []net.IP
+	var ttl uint32
+	found := false
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, err := exchangeDNS(ctx, server, dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET})
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, answer := range answers {
+			if !found || answer.Header.TTL < ttl {
+				ttl = answer.Header.TTL
+				found = true
+			}
+			switch body := answer.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, net.IP(body.A[:]))
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, net.IP(body.AAAA[:]))
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, 0, fmt.Errorf("no addresses for %s from %s", host, server)
+	}
+	return addrs, time.Duration(ttl) * time.Second, nil
+}
+
+// exchangeDNS sends one question to server over UDP, or over TCP if the
+// answer was truncated, and returns the answer records.
+func exchangeDNS(ctx context.Context, server string, question dnsmessage.Question) ([]dnsmessage.Resource, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var id [2]byte
+	rand.Read(id[:])
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:]), RecursionDesired: true},
+		Questions: []dnsmessage.Question{question},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build DNS query: %v", err)
+	}
+
+	reply, err := exchangeUDP(ctx, server, packed)
+	if err != nil {
+		return nil, err
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(reply); err != nil {
+		return nil, fmt.Errorf("failed to parse DNS answer: %v", err)
+	}
+	if msg.Truncated {
+		if reply, err = exchangeTCP(ctx, server, packed); err != nil {
+			return nil, err
+		}
+		if err := msg.Unpack(reply); err != nil {
+			return nil, fmt.Errorf("failed to parse DNS answer: %v", err)
+		}
+	}
+	if msg.ID != query.ID {
+		return nil, fmt.Errorf("DNS answer from %s does not match the query", server)
+	}
+	switch msg.RCode {
+	case dnsmessage.RCodeSuccess:
+		return msg.Answers, nil
+	case dnsmessage.RCodeNameError:
+		return nil, fmt.Errorf("no such host %s", strings.TrimSuffix(question.Name.String(), "."))
+	default:
+		return nil, fmt.Errorf("DNS server %s answered %v", server, msg.RCode)
+	}
+}
+
+func exchangeUDP(ctx context.Context, server string, query []byte) ([]byte, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach DNS server: %v", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, fmt.Errorf("failed to send DNS query: %v", err)
+	}
+	reply := make([]byte, 4096)
+	n, err := conn.Read(reply)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DNS answer: %v", err)
+	}
+	return reply[:n], nil
+}
+
+func exchangeTCP(ctx context.Context, server string, query []byte) ([]byte, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach DNS server: %v", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	framed := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	copy(framed[2:], query)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, fmt.Errorf("failed to send DNS query: %v", err)
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, fmt.Errorf("failed to read DNS answer: %v", err)
+	}
+	reply := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, fmt.Errorf("failed to read DNS answer: %v", err)
+	}
+	return reply, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// egress limits every connection the offramp opens inside the protected
+// network, to the target and for forward clients, whatever arrives over the
+// tunnel. Nil allows any address.
+var egress addressRules
+
+// aclRule allows connections to matching host:port addresses. The host is a
+// name, a wildcard such as *.example.com, an IP address or a CIDR range; the
+// port is a number or * for any port. Names match the host as requested,
+// addresses and ranges the address it resolves to.
+type aclRule struct {
+	host    string
+	network *net.IPNet
+	port    string
+}
+
+func parseACLRule(value string) (aclRule, error) {
+	i := strings.LastIndex(value, ":")
+	if i <= 0 || i == len(value)-1 {
+		return aclRule{}, fmt.Errorf("invalid address %q, expected host:port", value)
+	}
+	rule := aclRule{host: strings.ToLower(strings.Trim(value[:i], "[]")), port: value[i+1:]}
+	if rule.port != "*" {
+		if port, err := strconv.Atoi(rule.port); err != nil || port < 1 || port > 65535 {
+			return aclRule{}, fmt.Errorf("invalid port in %q", value)
+		}
+	}
+	if strings.Contains(rule.host, "/") {
+		_, network, err := net.ParseCIDR(rule.host)
+		if err != nil {
+			return aclRule{}, fmt.Errorf("invalid network in %q: %v", value, err)
+		}
+		rule.network = network
+	} else if ip := net.ParseIP(rule.host); ip != nil {
+		rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+	}
+	return rule, nil
+}
+
+func (r aclRule) matches(host string, ip net.IP, port string) bool {
+	if r.port != "*" && r.port != port {
+		return false
+	}
+	if r.network != nil {
+		return r.network.Contains(ip)
+	}
+	if strings.HasPrefix(r.host, "*.") {
+		return strings.HasSuffix(host, r.host[1:])
+	}
+	return host == r.host
+}
+
+// addressRules is an allowlist of addresses, denying everything else.
+type addressRules []aclRule
+
+func parseAddressRules(values []string) (addressRules, error) {
+	var rules addressRules
+	for _, value := range values {
+		rule, err := parseACLRule(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// allows reports whether host, resolved to ip, may be connected to on port.
+func (rules addressRules) allows(host string, ip net.IP, port string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, rule := range rules {
+		if rule.matches(host, ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// deniedError reports a connection refused because the allowlists allow none
+// of the addresses its host resolves to.
+type deniedError struct {
+	addr string
+}
+
+func (e *deniedError) Error() string {
+	return fmt.Sprintf("%s is not an allowed address", e.addr)
+}
+
+// dialAllowed connects to addr, trying only the addresses its host resolves
+// to that every one of the allowlists allows. Nil allowlists allow all.
+func dialAllowed(ctx context.Context, network, addr string, allowlists ...addressRules) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := resolver.Lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	allowed := make([]net.IP, 0, len(addrs))
+	for _, ip := range addrs {
+		ok := true
+		for _, rules := range allowlists {
+			if rules != nil && !rules.allows(host, ip, port) {
+				ok = false
+			}
+		}
+		if ok {
+			allowed = append(allowed, ip)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, &deniedError{addr: addr}
+	}
+	return dialAddresses(ctx, network, host, allowed, port)
+}
+
+// dialEgress connects to addr within the egress allowlist.
+func dialEgress(addr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return dialAllowed(ctx, "tcp", addr, egress)
+}
+
+// checkEgress fails if the egress allowlist rules out every address of the
+// target. Lookup failures are left for the connection attempts to report.
+func checkEgress(target string) error {
+	host, port, _ := net.SplitHostPort(target)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := resolver.Lookup(ctx, host)
+	if err != nil {
+		return nil
+	}
+	for _, ip := range addrs {
+		if egress.allows(host, ip, port) {
+			return nil
+		}
+	}
+	return &deniedError{addr: target}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"apiduct/pkg/auth"
+)
+
+// errEnrollmentRefused is returned when the bridge does not accept the
+// bootstrap token, which retrying does not change.
+var errEnrollmentRefused = errors.New("bridge refused the bootstrap token, it may be used up or expired")
+
+// Credentials are what the offramp got when it enrolled with a bootstrap
+// token, kept in --credentials-file.
+type Credentials struct {
+	Identity   string    `json:"identity"`
+	Key        string    `json:"key"`
+	Bridge     string    `json:"bridge"`
+	EnrolledAt time.Time `json:"enrolled_at"`
+}
+
+// useCredentials has the offramp authenticate with the key in
+// --credentials-file in place of the PSK, enrolling with --bootstrap-token
+// first if the file does not exist yet.
+func useCredentials(config *Config) error {
+	data, err := os.ReadFile(config.CredentialsFile)
+	if err == nil {
+		var credentials Credentials
+		if err := json.Unmarshal(data, &credentials); err != nil {
+			return fmt.Errorf("failed to parse credentials: %v", err)
+		}
+		if credentials.Key == "" {
+			return fmt.Errorf("no key in %s", config.CredentialsFile)
+		}
+		log.Printf("[OFFRAMP] Authenticating as enrolled offramp %s", credentials.Identity)
+		config.PSK = credentials.Key
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read credentials: %v", err)
+	}
+	if config.BootstrapToken == "" {
+		return fmt.Errorf("%s does not exist and there is no bootstrap token to enroll with", config.CredentialsFile)
+	}
+
+	bridge := net.JoinHostPort(config.BridgeHost, strconv.Itoa(config.BridgePort))
+	retry := newBackoff(config.ReconnectInitial, config.ReconnectMax)
+	var credentials *Credentials
+	for {
+		if credentials, err = enroll(config, bridge); err == nil {
+			break
+		}
+		if err == errEnrollmentRefused {
+			return err
+		}
+		log.Printf("[OFFRAMP] Failed to enroll: %v", err)
+		retry.wait()
+	}
+	if data, err = json.MarshalIndent(credentials, "", "  "); err != nil {
+		return err
+	}
+	if err := os.WriteFile(config.CredentialsFile, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to save credentials: %v", err)
+	}
+	log.Printf("[OFFRAMP] Enrolled as %s, credentials saved to %s", credentials.Identity, config.CredentialsFile)
+	config.PSK = credentials.Key
+	return nil
+}
+
+// enroll proves the bootstrap token to the bridge at addr and derives the
+// key the bridge enrolled the offramp with.
+func enroll(config *Config, addr string) (*Credentials, error) {
+	log.Printf("[OFFRAMP] Enrolling with bridge at %s", addr)
+	conn, err := resolver.Dial("tcp", addr, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to bridge: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(auth.Timeout))
+
+	hello, err := auth.SendHello(conn, config.BootstrapToken, auth.KindEnroll, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(hello); err != nil {
+		return nil, fmt.Errorf("failed to send bootstrap token proof: %v", err)
+	}
+	response := make([]byte, 9)
+	if _, err := io.ReadFull(conn, response[:1]); err != nil {
+		return nil, fmt.Errorf("failed to read enrollment response: %v", err)
+	}
+	if response[0] == auth.StatusFailed {
+		return nil, errEnrollmentRefused
+	}
+	if _, err := io.ReadFull(conn, response[1:]); err != nil {
+		return nil, fmt.Errorf("failed to read enrollment response: %v", err)
+	}
+	if response[0] != auth.StatusOK {
+		return nil, fmt.Errorf("bridge answered enrollment with status %d", response[0])
+	}
+	identity, key, err := auth.ReadEnrollment(conn, config.BootstrapToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read enrollment: %v", err)
+	}
+	return &Credentials{Identity: identity, Key: key, Bridge: addr, EnrolledAt: time.Now().UTC().Truncate(time.Second)}, nil
+}
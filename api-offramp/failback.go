@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// connectToBridge connects to the primary bridge, or to the secondary if the
+// primary is unreachable. It reports whether the tunnel is to the primary.
+func connectToBridge(config *Config) (net.Conn, bool, error) {
+	conn, err := createTunnelConnection(config, net.JoinHostPort(config.BridgeHost, strconv.Itoa(config.BridgePort)))
+	if err == nil || config.SecondaryBridge == "" {
+		return conn, true, err
+	}
+	log.Printf("[OFFRAMP] Primary bridge unavailable (%v), failing over to %s", err, config.SecondaryBridge)
+	conn, secondaryErr := createTunnelConnection(config, config.SecondaryBridge)
+	if secondaryErr != nil {
+		return nil, false, fmt.Errorf("primary: %v, secondary: %v", err, secondaryErr)
+	}
+	return conn, false, nil
+}
+
+// serveUntilFailback serves the tunnel to the secondary bridge while probing
+// the primary, and returns the tunnel to the primary once it is up. It
+// returns nil and why the tunnel was lost if the secondary tunnel closes first.
+func serveUntilFailback(conn net.Conn, targetConn *TargetConnection, config *Config) (net.Conn, error) {
+	primary := net.JoinHostPort(config.BridgeHost, strconv.Itoa(config.BridgePort))
+	return serveUntilReplaced(conn, targetConn, config, config.FailbackInterval, func() net.Conn {
+		primaryConn, err := createTunnelConnection(config, primary)
+		if err != nil {
+			log.Printf("[OFFRAMP] Primary bridge still unavailable: %v", err)
+			return nil
+		}
+		log.Printf("[OFFRAMP] Failing back to primary bridge %s", primary)
+		return primaryConn
+	})
+}
+
+// serveUntilReplaced serves conn and calls replace every interval. Once
+// replace returns a new tunnel, the bridge at the other end of conn is asked
+// to drain it in the background and the new tunnel is returned. It returns
+// nil and why conn was lost if conn closes first.
+func serveUntilReplaced(conn net.Conn, targetConn *TargetConnection, config *Config, interval time.Duration, replace func() net.Conn) (net.Conn, error) {
+	drain := make(chan struct{})
+	done := make(chan struct{})
+	var lost error
+	go func() {
+		lost = handleTunnelTraffic(conn, targetConn, config, drain)
+		close(done)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return nil, lost
+		case <-ticker.C:
+			replacement := replace()
+			if replacement == nil {
+				continue
+			}
+			go func() {
+				// Have the old bridge stop routing to us before we stop reading
+				addr := conn.RemoteAddr()
+				if err := sayGoodbye(config, conn); err != nil {
+					log.Printf("[OFFRAMP] Bridge at %s did not drain the tunnel: %v", addr, err)
+				}
+				close(drain)
+				<-done
+				log.Printf("[OFFRAMP] Tunnel to bridge at %s drained and closed", addr)
+			}()
+			return replacement, nil
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// failureLog aggregates repeated connection failures. The first failure and
+// the recovery are logged as they happen, the failures in between only as a
+// periodic summary with the count and the duration of the outage.
+type failureLog struct {
+	what     string
+	interval time.Duration
+
+	count   int
+	since   time.Time
+	logged  time.Time
+	pending int
+}
+
+func newFailureLog(what string, interval time.Duration) *failureLog {
+	return &failureLog{what: what, interval: interval}
+}
+
+// Failure records a failed attempt.
+func (f *failureLog) Failure(err error) {
+	now := time.Now()
+	localStatus.failed(f.what, err)
+	f.count++
+	if f.count == 1 {
+		f.since = now
+		f.logged = now
+		log.Printf("[OFFRAMP] Failed to establish %s: %v", f.what, err)
+		return
+	}
+	f.pending++
+	if f.interval <= 0 || now.Sub(f.logged) >= f.interval {
+		log.Printf("[OFFRAMP] Still unable to establish %s: %d failures in the last %s, %d in total over %s, last error: %v",
+			f.what, f.pending, now.Sub(f.logged).Round(time.Second), f.count, now.Sub(f.since).Round(time.Second), err)
+		f.logged = now
+		f.pending = 0
+	}
+}
+
+// Success records a successful attempt, ending the outage if there was one.
+func (f *failureLog) Success() {
+	if f.count > 0 {
+		log.Printf("[OFFRAMP] Recovered %s after %d failures over %s", f.what, f.count, time.Since(f.since).Round(time.Second))
+	}
+	f.count = 0
+	f.pending = 0
+}
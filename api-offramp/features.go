@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"apiduct/pkg/buildinfo"
+)
+
+// features lists the optional subsystems, and whether config uses them.
+func features(config *Config) []buildinfo.Feature {
+	h2c := config.TargetProtocol == targetProtocolH2C || (config.TargetProtocol == targetProtocolAuto && h2cCompiled)
+	return []buildinfo.Feature{
+		{Name: "h2c", BuildTag: "noh2c", Compiled: h2cCompiled, Enabled: h2c},
+		{Name: "dns_server", BuildTag: "nodnsserver", Compiled: dnsServerCompiled, Enabled: config.DNSServer != ""},
+		{Name: "enrollment", Compiled: true, Enabled: config.CredentialsFile != ""},
+		{Name: "forward", Compiled: true, Enabled: len(config.ForwardAllow) > 0},
+		{Name: "standby_tunnels", Compiled: true, Enabled: config.StandbyTunnels > 0},
+		{Name: "failback", Compiled: true, Enabled: config.SecondaryBridge != ""},
+		{Name: "tunnel_checksums", Compiled: true, Enabled: config.TunnelChecksums},
+	}
+}
+
+// handleFeatures answers GET /features.
+func handleFeatures(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(buildinfo.NewReport(Version, BuildTime, features(config)))
+	}
+}
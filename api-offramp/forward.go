@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"apiduct/pkg/auth"
+	"apiduct/pkg/mux"
+	"apiduct/pkg/proxy"
+)
+
+// forwardOfframpHeader names the offramp a forward client connects through
+const forwardOfframpHeader = "X-Apiduct-Offramp"
+
+// ForwardConfig holds the settings of the forward command.
+type ForwardConfig struct {
+	Bridge  string
+	PSK     string
+	Listen  string
+	Remote  string
+	Offramp string
+}
+
+// handleConnect connects a forward client's CONNECT request to the address it
+// names and copies between the stream and the connection in the background,
+// like an upgraded WebSocket. It returns the status sent to the bridge.
+func handleConnect(stream *mux.Stream, reader *bufio.Reader, req *http.Request, config *Config) int {
+	// Only addresses both --forward-allow and --egress-allow list
+	var remote net.Conn
+	var err error = &deniedError{addr: req.Host}
+	if config.ForwardRules != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		remote, err = dialAllowed(ctx, "tcp", req.Host, config.ForwardRules, egress)
+		cancel()
+	}
+	var denied *deniedError
+	if errors.As(err, &denied) {
+		log.Printf("[OFFRAMP] Refusing to forward to %s, not an allowed address", req.Host)
+		writeError(stream, req, http.StatusForbidden, errCodeForwardDenied, "Forwarding to this address is not allowed")
+		return http.StatusForbidden
+	}
+	if err != nil {
+		log.Printf("[OFFRAMP] Failed to connect to %s for forwarding: %v", req.Host, err)
+		status, code := targetErrorResponse(err)
+		writeTargetError(stream, req, status, code)
+		return status
+	}
+	if _, err := io.WriteString(stream, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		log.Printf("[OFFRAMP] Failed to forward response through tunnel: %v", err)
+		remote.Close()
+		stream.Reset()
+		return http.StatusOK
+	}
+	log.Printf("[OFFRAMP] Forwarding connection to %s", req.Host)
+
+	go func() {
+		io.Copy(remote, reader)
+		remote.Close()
+	}()
+	go func() {
+		io.Copy(stream, remote)
+		stream.Close()
+	}()
+	return http.StatusOK
+}
+
+// runForward listens on the local address and relays each connection through
+// the bridge to the remote address behind an offramp, like ssh -L.
+func runForward(config *ForwardConfig) {
+	if config.Bridge == "" || config.PSK == "" || config.Listen == "" || config.Remote == "" {
+		log.Fatal("--bridge, --psk, --listen and --remote are required")
+	}
+	if _, _, err := net.SplitHostPort(config.Bridge); err != nil {
+		log.Fatalf("Invalid bridge address: %v", err)
+	}
+	if _, _, err := net.SplitHostPort(config.Remote); err != nil {
+		log.Fatalf("Invalid remote address: %v", err)
+	}
+	if config.Offramp != "" {
+		if err := auth.ValidateName(config.Offramp); err != nil {
+			log.Fatalf("Invalid offramp: %v", err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", config.Listen, err)
+	}
+	log.Printf("[FORWARD] Forwarding %s to %s through bridge %s", listener.Addr(), config.Remote, config.Bridge)
+	for {
+		local, err := listener.Accept()
+		if err != nil {
+			log.Printf("[FORWARD] Failed to accept connection: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go forwardConnection(local, config)
+	}
+}
+
+// forwardConnection relays one local connection through the bridge.
+func forwardConnection(local net.Conn, config *ForwardConfig) {
+	defer local.Close()
+
+	conn, err := openForward(config)
+	if err != nil {
+		log.Printf("[FORWARD] Failed to forward connection from %s: %v", local.RemoteAddr(), err)
+		return
+	}
+	defer conn.Close()
+	log.Printf("[FORWARD] Connection from %s forwarded to %s", local.RemoteAddr(), config.Remote)
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(conn, local)
+		conn.Close()
+		close(done)
+	}()
+	io.Copy(local, conn)
+	local.Close()
+	<-done
+}
+
+// forwardConn is a connection to the bridge whose reads go through the
+// reader that parsed the CONNECT response.
+type forwardConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *forwardConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// openForward authenticates to the bridge and asks it for a connection to the
+// remote address.
+func openForward(config *ForwardConfig) (net.Conn, error) {
+	conn, err := dialBridge(&Config{PSK: config.PSK, ClockSkewAction: "warn"}, config.Bridge, auth.KindForward)
+	if err != nil {
+		return nil, err
+	}
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", config.Remote, config.Remote)
+	if config.Offramp != "" {
+		request += forwardOfframpHeader + ": " + config.Offramp + "\r\n"
+	}
+	if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send forward request: %v", err)
+	}
+
+	reader := proxy.NewReader(conn)
+	resp, err := reader.ReadResponse(&http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read forward response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+			Code  string `json:"code"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&apiErr)
+		conn.Close()
+		return nil, fmt.Errorf("forward refused with %s: %s (%s)", resp.Status, apiErr.Error, apiErr.Code)
+	}
+	return &forwardConn{Conn: conn, reader: reader.Reader}, nil
+}
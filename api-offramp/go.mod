@@ -1,3 +1,19 @@
 module offramp
 
 go 1.21.3
+
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/spf13/cobra v1.8.0
+	github.com/spf13/pflag v1.0.5
+	golang.org/x/net v0.19.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	apiduct v0.0.0-00010101000000-000000000000
+	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+)
+
+replace apiduct => ../
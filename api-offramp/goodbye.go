@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"apiduct/pkg/auth"
+)
+
+// sayGoodbye tells the bridge at the other end of the tunnel that the offramp
+// is leaving, naming the tunnel by its local port. The bridge stops routing
+// requests to the tunnel, waits for the ones in flight and closes it;
+// sayGoodbye returns once it has done so, or after the shutdown timeout. The
+// tunnel must keep being served meanwhile.
+func sayGoodbye(config *Config, tunnel net.Conn) error {
+	addr := tunnel.RemoteAddr().String()
+	log.Printf("[OFFRAMP] Announcing disconnect to bridge at %s", addr)
+	conn, err := dialBridge(config, addr, auth.KindGoodbye)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, port, _ := net.SplitHostPort(tunnel.LocalAddr().String())
+	n, _ := strconv.Atoi(port)
+	if err := auth.WriteGoodbye(conn, n); err != nil {
+		return fmt.Errorf("failed to announce disconnect: %v", err)
+	}
+
+	timeout := config.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	result := make([]byte, 1)
+	if _, err := io.ReadFull(conn, result); err != nil {
+		return fmt.Errorf("failed to read drain result: %v", err)
+	}
+	switch result[0] {
+	case auth.GoodbyeDrained:
+		log.Printf("[OFFRAMP] Bridge at %s drained the tunnel", addr)
+		return nil
+	case auth.GoodbyeUnknown:
+		return fmt.Errorf("bridge does not know the tunnel")
+	default:
+		return fmt.Errorf("unexpected drain result %d", result[0])
+	}
+}
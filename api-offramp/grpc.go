@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+
+	"apiduct/pkg/proxy"
+)
+
+// Protocols for requests to the target
+const (
+	targetProtocolAuto  = "auto"  // h2c for gRPC calls, HTTP/1.1 for the rest
+	targetProtocolHTTP1 = "http1" // HTTP/1.1 only
+	targetProtocolH2C   = "h2c"   // HTTP/2 without TLS for every request
+)
+
+// clientFor returns the client to forward req to the target with.
+func clientFor(req *http.Request, config *Config) *http.Client {
+	switch {
+	case proxy.IsWebSocket(req):
+		return upgradeClient
+	case !h2cCompiled:
+		// gRPC calls try HTTP/1.1, which the target may refuse
+	case config.TargetProtocol == targetProtocolH2C,
+		config.TargetProtocol == targetProtocolAuto && proxy.IsGRPC(req):
+		return h2cClient
+	}
+	return targetClient
+}
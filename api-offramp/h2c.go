@@ -0,0 +1,43 @@
+//go:build !noh2c
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const h2cCompiled = true
+
+// h2cClient forwards requests to the target over HTTP/2 without TLS, with
+// prior knowledge, or with TLS if the target is https. It has no response
+// header timeout, as a streaming gRPC
+// call may only answer once the client is done sending; pings detect a dead
+// connection instead.
+var h2cClient = &http.Client{
+	Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			conn, err := dialTarget(ctx, network, addr)
+			if err != nil || targetTLS == nil {
+				return conn, err
+			}
+			tlsConfig := targetTLS.Clone()
+			tlsConfig.NextProtos = []string{"h2"}
+			tlsConn := tls.Client(conn, tlsConfig)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+		DisableCompression: true,
+		ReadIdleTimeout:    30 * time.Second,
+		PingTimeout:        15 * time.Second,
+	},
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Duct health reported on --health-port: whether the active tunnel is
+// connected, and when a request last got a response from the target, in Unix
+// nanoseconds.
+var (
+	tunnelUp    atomic.Bool
+	lastSuccess atomic.Int64
+)
+
+// HealthReport is the body of /healthz and /readyz.
+type HealthReport struct {
+	Status          string     `json:"status"` // ok or unavailable
+	TunnelConnected bool       `json:"tunnel_connected"`
+	TargetReachable bool       `json:"target_reachable"`
+	LastSuccess     *time.Time `json:"last_success,omitempty"`
+	Problems        []string   `json:"problems,omitempty"`
+}
+
+// health reports on the duct. The offramp is live as long as it runs, and
+// ready while its tunnel is connected and the target passes health checks.
+func health(targetConn *TargetConnection, readiness bool) HealthReport {
+	report := HealthReport{Status: "ok", TunnelConnected: tunnelUp.Load()}
+	select {
+	case <-targetHealthy:
+		report.TargetReachable = targetConn.reachable.Err() == nil
+	default:
+	}
+	if nanos := lastSuccess.Load(); nanos != 0 {
+		last := time.Unix(0, nanos).UTC()
+		report.LastSuccess = &last
+	}
+	if readiness {
+		if !report.TunnelConnected {
+			report.Problems = append(report.Problems, "tunnel not connected")
+		}
+		if !report.TargetReachable {
+			report.Problems = append(report.Problems, "target unreachable")
+		}
+	}
+	if len(report.Problems) > 0 {
+		report.Status = "unavailable"
+	}
+	return report
+}
+
+// serveHealth answers liveness probes on /healthz and readiness probes on
+// /readyz on listener, with 503 while the offramp is not healthy, and
+// describes the build on /features.
+func serveHealth(listener net.Listener, targetConn *TargetConnection, config *Config) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/features", handleFeatures(config))
+	for path, readiness := range map[string]bool{"/healthz": false, "/readyz": true} {
+		readiness := readiness
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			report := health(targetConn, readiness)
+			w.Header().Set("Content-Type", "application/json")
+			if report.Status != "ok" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			json.NewEncoder(w).Encode(report)
+		})
+	}
+	log.Printf("[OFFRAMP] Serving health checks on %s/healthz and /readyz", listener.Addr())
+	if err := http.Serve(listener, mux); err != nil {
+		log.Fatalf("Failed to serve health checks: %v", err)
+	}
+}
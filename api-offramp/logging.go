@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logger writes structured entries with their level and fields. Lines from
+// log.Printf are passed to it too, their level guessed from the wording.
+var logger = slog.New(newLogHandler(os.Stderr, slog.LevelInfo, false)).With("component", "OFFRAMP")
+
+// logf logs a line for the library packages, which leave out the prefix.
+func logf(format string, args ...interface{}) {
+	log.Printf("[OFFRAMP] "+format, args...)
+}
+
+// setupLogging sends logs of at least the level to stderr, as text lines in
+// the standard logger format or as JSON objects.
+func setupLogging(level, format string) error {
+	var min slog.Level
+	switch strings.ToLower(level) {
+	case "debug":
+		min = slog.LevelDebug
+	case "", "info":
+		min = slog.LevelInfo
+	case "warn", "warning":
+		min = slog.LevelWarn
+	case "error":
+		min = slog.LevelError
+	default:
+		return fmt.Errorf("unknown log level %q (use debug, info, warning or error)", level)
+	}
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown log format %q (use text or json)", format)
+	}
+
+	handler := newLogHandler(os.Stderr, min, format == "json")
+	logger = slog.New(handler).With("component", "OFFRAMP")
+	log.SetFlags(0)
+	log.SetOutput(&logLineWriter{handler: handler})
+	return nil
+}
+
+// logHandler is an slog.Handler writing entries in the bridge's log format.
+type logHandler struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	min    slog.Level
+	json   bool
+	attrs  []slog.Attr
+	prefix string // of attribute keys, from groups
+}
+
+func newLogHandler(w io.Writer, min slog.Level, json bool) *logHandler {
+	return &logHandler{mu: &sync.Mutex{}, w: w, min: min, json: json}
+}
+
+func (h *logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.min
+}
+
+func (h *logHandler) Handle(_ context.Context, record slog.Record) error {
+	component := ""
+	fields := make(map[string]string)
+	add := func(a slog.Attr) {
+		if a.Key == "component" {
+			component = a.Value.String()
+			return
+		}
+		fields[a.Key] = a.Value.Resolve().String()
+	}
+	for _, a := range h.attrs {
+		add(a)
+	}
+	record.Attrs(func(a slog.Attr) bool {
+		a.Key = h.prefix + a.Key
+		add(a)
+		return true
+	})
+
+	var line []byte
+	if h.json {
+		entry := map[string]string{
+			"time":    record.Time.UTC().Format(time.RFC3339Nano),
+			"level":   strings.ToLower(levelName(record.Level)),
+			"message": record.Message,
+		}
+		if component != "" {
+			entry["component"] = component
+		}
+		for key, value := range fields {
+			if _, exists := entry[key]; !exists {
+				entry[key] = value
+			}
+		}
+		line, _ = json.Marshal(entry)
+		line = append(line, '\n')
+	} else {
+		prefix := ""
+		if component != "" {
+			prefix = "[" + component + "] "
+		}
+		line = []byte(fmt.Sprintf("%s %s%s%s\n", record.Time.Format("2006/01/02 15:04:05"), prefix, record.Message, textFields(fields)))
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(line)
+	return err
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	withAttrs := *h
+	withAttrs.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		a.Key = h.prefix + a.Key
+		withAttrs.attrs = append(withAttrs.attrs, a)
+	}
+	return &withAttrs
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	withGroup := *h
+	withGroup.prefix = h.prefix + name + "."
+	return &withGroup
+}
+
+func levelName(level slog.Level) string {
+	if level >= slog.LevelWarn && level < slog.LevelError {
+		return "WARNING"
+	}
+	return level.String()
+}
+
+// textFields renders fields as " key=value" pairs, so IDs can be grepped in
+// plain text logs.
+func textFields(fields map[string]string) string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		value := fields[key]
+		if strings.ContainsAny(value, "\r\n") {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(" " + key + "=" + value)
+	}
+	return b.String()
+}
+
+// logLineWriter is the output of the standard logger. It splits "[OFFRAMP]
+// Failed to ..." into component and message and guesses the level from the
+// wording, as log.Printf carries none.
+type logLineWriter struct {
+	handler slog.Handler
+}
+
+func (w *logLineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		component, message := "", line
+		if strings.HasPrefix(line, "[") {
+			if end := strings.Index(line, "] "); end > 0 {
+				component, message = line[1:end], line[end+2:]
+			}
+		}
+
+		level := slog.LevelInfo
+		lower := strings.ToLower(message)
+		switch {
+		case strings.Contains(lower, "failed") || strings.Contains(lower, "error") ||
+			strings.Contains(lower, "invalid") || strings.Contains(lower, "authentication failed"):
+			level = slog.LevelError
+		case strings.Contains(lower, "warning") || strings.Contains(lower, "closed") || strings.Contains(lower, "lost") ||
+			strings.Contains(lower, "timeout") || strings.Contains(lower, "unable"):
+			level = slog.LevelWarn
+		}
+		if !w.handler.Enabled(context.Background(), level) {
+			continue
+		}
+		record := slog.NewRecord(time.Now(), level, message, 0)
+		if component != "" {
+			record.AddAttrs(slog.String("component", component))
+		}
+		w.handler.Handle(context.Background(), record)
+	}
+	return len(p), nil
+}
+
+// wireRedacted lists headers whose values are left out of wire traces.
+var wireRedacted = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Api-Key":           true,
+}
+
+// traceWire logs the start line and headers of a request or response at
+// debug level, with credentials redacted.
+func traceWire(l *slog.Logger, message, startLine string, header http.Header) {
+	if !l.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lines := []string{startLine}
+	for _, key := range keys {
+		for _, value := range header[key] {
+			if wireRedacted[key] {
+				value = "[REDACTED]"
+			}
+			lines = append(lines, fmt.Sprintf("%s: %s", key, value))
+		}
+	}
+	l.Debug(message, "wire", strings.Join(lines, "\n"))
+}
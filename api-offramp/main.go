@@ -2,18 +2,21 @@ package main
 
 import (
 	"bufio"
-	"crypto/sha256"
-	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
+
+	"apiduct/pkg/buildinfo"
+	"apiduct/pkg/mux"
+	"apiduct/pkg/stats"
+	"apiduct/pkg/telemetry"
 )
 
 var (
@@ -21,35 +24,14 @@ var (
 	BuildTime = "unknown"
 )
 
-type Config struct {
-	BridgeIP   string
-	BridgePort int
-	PSK        string
-	TargetPort int
-	TargetHost string
-}
-
 type TunnelConnection struct {
 	conn net.Conn
 	mu   sync.Mutex
-}
-
-func (t *TunnelConnection) Write(data []byte) (int, error) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	return t.conn.Write(data)
-}
 
-func (t *TunnelConnection) Read(p []byte) (int, error) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	return t.conn.Read(p)
-}
-
-func (t *TunnelConnection) Close() error {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	return t.conn.Close()
+	// Standby tunnels follow the active tunnel to its bridge
+	moved   chan struct{} // closed when conn connects to another bridge
+	standby map[net.Conn]bool
+	closing bool
 }
 
 func (t *TunnelConnection) IsConnected() bool {
@@ -61,18 +43,9 @@ func (t *TunnelConnection) IsConnected() bool {
 type TargetConnection struct {
 	conn net.Conn
 	mu   sync.Mutex
-}
-
-func (t *TargetConnection) Write(data []byte) (int, error) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	return t.conn.Write(data)
-}
 
-func (t *TargetConnection) Read(p []byte) (int, error) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	return t.conn.Read(p)
+	// reachable is shared by the health checks and the requests
+	reachable *reachability
 }
 
 func (t *TargetConnection) Close() error {
@@ -88,74 +61,191 @@ func (t *TargetConnection) IsConnected() bool {
 }
 
 func main() {
-	config := &Config{}
-
-	// Command line flags
-	flag.StringVar(&config.BridgeIP, "bridge-ip", "", "IP address of the bridge server")
-	flag.IntVar(&config.BridgePort, "bridge-port", 8000, "Port of the bridge server")
-	flag.StringVar(&config.PSK, "psk", "", "Pre-shared key for tunnel authentication")
-	flag.IntVar(&config.TargetPort, "target-port", 8080, "Target port to forward requests to")
-	flag.StringVar(&config.TargetHost, "target-host", "localhost", "Target host to forward requests to")
-	flag.Parse()
-
-	// Validate required parameters
-	if config.BridgeIP == "" {
-		log.Fatal("Bridge IP is required")
+	if err := newRootCommand().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+// run starts the offramp with the parsed command line.
+func run(config *Config) {
+	if config.ConfigFile != "" {
+		log.Printf("[OFFRAMP] Loaded settings from %s", config.ConfigFile)
+	}
+
+	// Serve metrics for Prometheus
+	if config.MetricsPort != 0 {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.MetricsPort))
+		if err != nil {
+			log.Fatalf("Failed to start metrics listener: %v", err)
+		}
+		go func() {
+			if err := stats.Serve(listener, metrics, logf); err != nil {
+				log.Fatalf("Failed to serve metrics: %v", err)
+			}
+		}()
+	}
+
+	if config.Telemetry == telemetry.On {
+		telemetry.NewReporter(config.TelemetryEndpoint, config.TelemetryInterval, "api-offramp", Version, func() []string {
+			return buildinfo.Enabled(features(config))
+		}).Start(logf)
 	}
-	if config.PSK == "" {
-		log.Fatal("PSK is required")
+	if config.AccessLog != "" {
+		var err error
+		if accessLog, err = openAccessLog(config); err != nil {
+			log.Fatalf("Failed to open access log: %v", err)
+		}
+		defer accessLog.Close()
+		log.Printf("[OFFRAMP] Logging requests to %s in %s format", config.AccessLog, config.AccessLogFormat)
+	}
+	if targetTLS != nil && config.TargetInsecureSkipVerify {
+		log.Printf("[OFFRAMP] Not verifying the target's certificate, connections to it can be intercepted")
+	}
+
+	// Authenticate with the key issued at enrollment
+	if config.CredentialsFile != "" {
+		if err := useCredentials(config); err != nil {
+			log.Fatalf("Failed to set up credentials: %v", err)
+		}
 	}
 
 	// Create connection managers
-	tunnelConn := &TunnelConnection{}
-	targetConn := &TargetConnection{}
+	tunnelConn := &TunnelConnection{moved: make(chan struct{}), standby: make(map[net.Conn]bool)}
+	targetConn := &TargetConnection{
+		reachable: newReachability(config.TargetDownCache, func() error { return checkTargetHealth(config) }),
+	}
+
+	// Answer probes on the duct's health
+	if config.HealthPort != 0 {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.HealthPort))
+		if err != nil {
+			log.Fatalf("Failed to start health listener: %v", err)
+		}
+		go serveHealth(listener, targetConn, config)
+	}
+
+	// Show the state of the duct to people on this host
+	if config.StatusPort != 0 {
+		listener, err := net.Listen("tcp", net.JoinHostPort(config.StatusBind, strconv.Itoa(config.StatusPort)))
+		if err != nil {
+			log.Fatalf("Failed to start status listener: %v", err)
+		}
+		go serveStatus(listener, targetConn, config)
+	}
 
 	// Start connection managers
 	go manageTunnelConnection(tunnelConn, targetConn, config)
+	if config.StandbyTunnels > 0 {
+		standbyGroup = newStandbyGroup()
+		for i := 0; i < config.StandbyTunnels; i++ {
+			go maintainStandby(tunnelConn, targetConn, config)
+		}
+	}
 	go manageTargetConnection(targetConn, config)
+	go watchTargetAddress(config)
 
 	// Wait for signals
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
 	log.Println("Shutting down...")
+
+	// Let the bridge finish the requests in flight before we go, taking the
+	// standby tunnels out first so none is promoted
+	conn, standbys := tunnelConn.shutdown()
+	if conn == nil || config.ShutdownTimeout == 0 {
+		return
+	}
+	done := make(chan error, 1)
+	go func() {
+		sayGoodbyeAll(config, standbys)
+		done <- sayGoodbye(config, conn)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Printf("[OFFRAMP] Bridge did not drain the tunnel: %v", err)
+		}
+	case <-sigChan:
+		log.Printf("[OFFRAMP] Second signal received, exiting without draining")
+	}
 }
 
 func manageTunnelConnection(tunnelConn *TunnelConnection, targetConn *TargetConnection, config *Config) {
+	var conn net.Conn
+	onPrimary := true
+	failures := newFailureLog("tunnel connection", config.ReconnectLogInterval)
+	retry := newBackoff(config.ReconnectInitial, config.ReconnectMax)
 	for {
-		// Create tunnel connection
-		conn, err := createTunnelConnection(config)
-		if err != nil {
-			log.Printf("Failed to establish tunnel connection: %v", err)
-			time.Sleep(5 * time.Second) // Wait before retrying
-			continue
+		// Create tunnel connection, unless failback already established one
+		if conn == nil {
+			waitForTarget()
+			var err error
+			conn, onPrimary, err = connectToBridge(config)
+			if err != nil {
+				failures.Failure(err)
+				retry.wait()
+				continue
+			}
 		}
+		connected := time.Now()
 
 		// Store the new connection
-		tunnelConn.mu.Lock()
-		if tunnelConn.conn != nil {
-			tunnelConn.conn.Close()
-		}
-		tunnelConn.conn = conn
-		tunnelConn.mu.Unlock()
+		tunnelConn.set(conn)
+		tunnelUp.Store(true)
+		localStatus.tunnelConnected(conn.RemoteAddr().String())
 
+		failures.Success()
+		metrics.Counter("apiduct_tunnel_connections_total").Inc()
 		log.Printf("Tunnel connection established")
+		if config.TargetPrewarm > 0 {
+			go warmConns.fill(net.JoinHostPort(config.TargetHost, strconv.Itoa(config.TargetPort)), config.TargetPrewarm)
+		}
+
+		// Handle tunnel traffic, watching for the primary while on the
+		// secondary and for address changes while on the primary
+		var lost error
+		if onPrimary {
+			conn, lost = serveUntilMoved(conn, targetConn, config)
+		} else {
+			conn, lost = serveUntilFailback(conn, targetConn, config)
+			onPrimary = true
+		}
+		if conn != nil {
+			continue
+		}
+		tunnelUp.Store(false)
+		localStatus.tunnelLost(lost)
+		if time.Since(connected) >= stableAfter {
+			retry.reset()
+		}
 
-		// Handle tunnel traffic
-		handleTunnelTraffic(tunnelConn.conn, targetConn, config)
+		// The bridge may be fine, only the path to it died
+		if lost == mux.ErrHeartbeatTimeout {
+			log.Printf("[OFFRAMP] Bridge stopped answering pings, reconnecting at once")
+			continue
+		}
+
+		// A bridge restarting says so, its replacement is worth trying at once
+		if lost == errBridgeGoneAway {
+			log.Printf("[OFFRAMP] Bridge closed the tunnel after go away, reconnecting at once")
+			retry.reset()
+			continue
+		}
 
 		// If we get here, the connection was closed
 		log.Printf("Tunnel connection closed, attempting to reconnect...")
-		time.Sleep(5 * time.Second) // Wait before retrying
+		retry.wait()
 	}
 }
 
 func manageTargetConnection(targetConn *TargetConnection, config *Config) {
+	failures := newFailureLog("target connection", config.ReconnectLogInterval)
 	for {
 		// Create target connection
 		conn, err := createTargetConnection(config)
 		if err != nil {
-			log.Printf("[OFFRAMP] Failed to establish target connection: %v", err)
+			failures.Failure(err)
 			time.Sleep(5 * time.Second) // Wait before retrying
 			continue
 		}
@@ -168,178 +258,77 @@ func manageTargetConnection(targetConn *TargetConnection, config *Config) {
 		targetConn.conn = conn
 		targetConn.mu.Unlock()
 
+		failures.Success()
 		log.Printf("[OFFRAMP] Target connection established")
 
 		// Monitor connection health
+		unhealthy := make(chan struct{})
 		go func() {
+			defer close(unhealthy)
 			log.Printf("[OFFRAMP] Starting health check loop")
 			ticker := time.NewTicker(1 * time.Second)
 			defer ticker.Stop()
 
-			for range ticker.C {
-				// Create a new connection for health check
-				healthConn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", config.TargetHost, config.TargetPort))
-				if err != nil {
-					log.Printf("[OFFRAMP] Failed to create health check connection: %v", err)
-					targetConn.Close()
-					return
-				}
-
-				// Create HEAD request
-				//log.Printf("[OFFRAMP] Creating health check request")
-				req, err := http.NewRequest("HEAD", fmt.Sprintf("http://%s:%d/", config.TargetHost, config.TargetPort), nil)
-				if err != nil {
-					log.Printf("[OFFRAMP] Failed to create health check request: %v", err)
-					healthConn.Close()
-					targetConn.Close()
-					return
-				}
-
-				// Send request
-				//log.Printf("[OFFRAMP] Sending health check request")
-				if err := req.Write(healthConn); err != nil {
-					log.Printf("[OFFRAMP] Health check request failed: %v", err)
-					healthConn.Close()
+			for ; ; <-ticker.C {
+				if err := targetConn.reachable.Probe(); err != nil {
+					log.Printf("[OFFRAMP] %v", err)
 					targetConn.Close()
 					return
 				}
-
-				// Read response with timeout
-				//log.Printf("[OFFRAMP] Reading health check response")
-				healthConn.SetReadDeadline(time.Now().Add(5 * time.Second))
-				resp, err := http.ReadResponse(bufio.NewReader(healthConn), req)
-				healthConn.SetReadDeadline(time.Time{}) // Clear deadline
-
-				if err != nil {
-					log.Printf("[OFFRAMP] Health check response failed: %v", err)
-					healthConn.Close()
-					targetConn.Close()
-					return
-				}
-
-				// Check response status
-				if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-					// Connection is healthy
-					//log.Printf("[OFFRAMP] Health check OK with status: %d", resp.StatusCode)
-					resp.Body.Close()
-					healthConn.Close()
-					continue
-				}
-
-				// Unexpected status code
-				//log.Printf("[OFFRAMP] Health check failed with status: %d", resp.StatusCode)
-				resp.Body.Close()
-				healthConn.Close()
-				targetConn.Close()
-				return
+				markTargetHealthy()
 			}
 		}()
 
-		// Wait for connection to close
-		<-make(chan struct{}) // Block until connection is closed
+		// Wait for the health check to fail
+		<-unhealthy
 		log.Printf("[OFFRAMP] Target connection closed, attempting to reconnect...")
 		time.Sleep(5 * time.Second) // Wait before retrying
 	}
 }
 
-func handleTunnelTraffic(conn net.Conn, targetConn *TargetConnection, config *Config) {
-	defer conn.Close()
-
-	// Process requests from the tunnel
-	for {
-		// Read HTTP request from tunnel
-		req, err := http.ReadRequest(bufio.NewReader(conn))
-		if err != nil {
-			if err != io.EOF {
-				log.Printf("[OFFRAMP] Failed to read request from tunnel: %v", err)
-			}
-			return
-		}
-		log.Printf("[OFFRAMP] Received request from tunnel: %s %s", req.Method, req.URL.Path)
-
-		// Create a new request for the target
-		targetURL := fmt.Sprintf("http://%s:%d%s", config.TargetHost, config.TargetPort, req.URL.Path)
-		targetReq, err := http.NewRequest(req.Method, targetURL, req.Body)
-		if err != nil {
-			log.Printf("[OFFRAMP] Failed to create target request: %v", err)
-			continue
-		}
-
-		// Copy headers from original request
-		for key, values := range req.Header {
-			for _, value := range values {
-				targetReq.Header.Add(key, value)
-			}
-		}
-
-		// Create a new HTTP client for this request
-		client := &http.Client{
-			Timeout: 30 * time.Second,
-		}
-
-		// Forward the request to target
-		log.Printf("[OFFRAMP] Forwarding request to target: %s %s", req.Method, req.URL.Path)
-		resp, err := client.Do(targetReq)
-		if err != nil {
-			log.Printf("[OFFRAMP] Failed to forward request to target: %v", err)
-			continue
-		}
-
-		log.Printf("[OFFRAMP] Received response from target: %d %s", resp.StatusCode, resp.Status)
-
-		// Forward response back through tunnel
-		log.Printf("[OFFRAMP] Forwarding response through tunnel: %d %s", resp.StatusCode, resp.Status)
-		if err := resp.Write(conn); err != nil {
-			log.Printf("[OFFRAMP] Failed to forward response through tunnel: %v", err)
-			resp.Body.Close()
-			continue
-		}
-		resp.Body.Close()
+// checkTargetHealth sends a HEAD request to the target and expects a 2xx
+// response.
+func checkTargetHealth(config *Config) error {
+	// Create a new connection for health check
+	healthConn, err := dialTargetTLS(net.JoinHostPort(config.TargetHost, strconv.Itoa(config.TargetPort)), 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to create health check connection: %v", err)
 	}
-}
+	defer healthConn.Close()
 
-func createTunnelConnection(config *Config) (net.Conn, error) {
-	// Connect to bridge
-	log.Printf("[OFFRAMP] Connecting to bridge at %s:%d", config.BridgeIP, config.BridgePort)
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", config.BridgeIP, config.BridgePort))
+	// Create HEAD request
+	req, err := http.NewRequest("HEAD", fmt.Sprintf("%s://%s:%d/", targetScheme(config), config.TargetHost, config.TargetPort), nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to bridge: %v", err)
+		return fmt.Errorf("failed to create health check request: %v", err)
 	}
-
-	// Set keep-alive
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
-		tcpConn.SetKeepAlive(true)
-		tcpConn.SetKeepAlivePeriod(30 * time.Second)
+	if config.TargetHostHeader != "" {
+		req.Host = config.TargetHostHeader
 	}
 
-	// Send PSK for authentication
-	log.Printf("[OFFRAMP] Sending PSK authentication")
-	pskHash := sha256.Sum256([]byte(config.PSK))
-	if _, err := conn.Write(pskHash[:]); err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("failed to send PSK: %v", err)
+	// Send request
+	if err := req.Write(healthConn); err != nil {
+		return fmt.Errorf("health check request failed: %v", err)
 	}
 
-	// Read authentication response
-	response := make([]byte, 1)
-	if _, err := io.ReadFull(conn, response); err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("failed to read authentication response: %v", err)
+	// Read response with timeout
+	healthConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(healthConn), req)
+	if err != nil {
+		return fmt.Errorf("health check response failed: %v", err)
 	}
+	resp.Body.Close()
 
-	if response[0] != 0 {
-		conn.Close()
-		return nil, fmt.Errorf("authentication failed")
+	// Check response status
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("health check failed with status: %d", resp.StatusCode)
 	}
-	log.Printf("[OFFRAMP] PSK authentication successful")
-
-	return conn, nil
+	return nil
 }
 
 func createTargetConnection(config *Config) (net.Conn, error) {
 	// Connect to target
 	log.Printf("[OFFRAMP] Connecting to target at %s:%d", config.TargetHost, config.TargetPort)
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", config.TargetHost, config.TargetPort))
+	conn, err := dialEgress(net.JoinHostPort(config.TargetHost, strconv.Itoa(config.TargetPort)), 30*time.Second)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to target: %v", err)
 	}
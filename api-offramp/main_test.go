@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"apiduct/pkg/mux"
+	"apiduct/pkg/proxy"
+)
+
+// throughTunnel parses a request line the way the bridge does, writes the
+// request as the bridge writes it to a stream and reads it back the way
+// handleStream does.
+func throughTunnel(t *testing.T, uri string) *http.Request {
+	t.Helper()
+	raw := "GET " + uri + " HTTP/1.1\r\nHost: api.example.com\r\n\r\n"
+	received, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatalf("failed to parse %q: %v", uri, err)
+	}
+	var stream bytes.Buffer
+	if err := received.Write(&stream); err != nil {
+		t.Fatalf("failed to write %q: %v", uri, err)
+	}
+	req, err := http.ReadRequest(bufio.NewReader(&stream))
+	if err != nil {
+		t.Fatalf("failed to read %q from the stream: %v", uri, err)
+	}
+	return req
+}
+
+var forwardedURIs = []string{
+	"/",
+	"/users?id=42",
+	"/search?q=a%20b&tag=x&tag=y",
+	"/search?q=caf%C3%A9&empty=&flag",
+	"/items;v=2/details;lang=en?x=1",
+	"/files/a%2Fb%2Fc.txt",
+	"/files/%E2%82%AC%20report.pdf",
+	"/path%3Bnot-a-param/%3Fnot-a-query",
+	"/encoded%41letter",
+	"/trailing/?",
+}
+
+func TestTargetURL(t *testing.T) {
+	config := &Config{TargetHost: "10.0.0.5", TargetPort: 8080}
+	for _, uri := range forwardedURIs {
+		req := throughTunnel(t, uri)
+		want := "http://10.0.0.5:8080" + uri
+		if got := targetURL(config, req); got != want {
+			t.Errorf("targetURL(%q) = %q, want %q", uri, got, want)
+		}
+	}
+}
+
+func TestTargetURLRewrite(t *testing.T) {
+	config := &Config{TargetHost: "10.0.0.5", TargetPort: 8080, StripPrefix: "/api", RewritePath: []string{"^/v1/=/v2/"}}
+	if err := configureRewrite(config); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"/api/v1/users?id=42": "/v2/users?id=42",
+		"/api/files/a%2Fb":    "/files/a%2Fb",
+		"/apiary/v1/x":        "/apiary/v1/x",
+		"/api":                "/",
+		"/api/trailing/?":     "/trailing/?",
+	}
+	for uri, want := range tests {
+		req := throughTunnel(t, uri)
+		if got := targetURL(config, req); got != "http://10.0.0.5:8080"+want {
+			t.Errorf("targetURL(%q) = %q, want path %q", uri, got, want)
+		}
+	}
+}
+
+func TestForwardToTargetPreservesRequestURI(t *testing.T) {
+	seen := make(chan string, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.RequestURI
+	}))
+	defer target.Close()
+
+	host, port, err := net.SplitHostPort(target.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNum, _ := strconv.Atoi(port)
+	config := &Config{TargetHost: host, TargetPort: portNum}
+
+	for _, uri := range forwardedURIs {
+		resp, err := forwardToTarget(throughTunnel(t, uri), config, logger)
+		if err != nil {
+			t.Fatalf("forwarding %q failed: %v", uri, err)
+		}
+		resp.Body.Close()
+		if got := <-seen; got != uri {
+			t.Errorf("target saw %q, want %q", got, uri)
+		}
+	}
+}
+
+func TestForwardToHTTPSTarget(t *testing.T) {
+	seen := make(chan string, 1)
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Host
+	}))
+	defer target.Close()
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: target.Certificate().Raw})
+	if err := os.WriteFile(ca, certificate, 0600); err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(target.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNum, _ := strconv.Atoi(port)
+	config := &Config{
+		TargetHost:       host,
+		TargetPort:       portNum,
+		TargetScheme:     targetSchemeHTTPS,
+		TargetCAFile:     ca,
+		TargetServerName: "example.com",
+		TargetHostHeader: "api.internal",
+	}
+	if err := configureTargetTLS(config); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		targetTLS = nil
+		targetClient.Transport.(*http.Transport).TLSClientConfig = nil
+		upgradeClient.Transport.(*http.Transport).TLSClientConfig = nil
+	}()
+
+	resp, err := forwardToTarget(throughTunnel(t, "/"), config, logger)
+	if err != nil {
+		t.Fatalf("forwarding to the https target failed: %v", err)
+	}
+	resp.Body.Close()
+	if got := <-seen; got != "api.internal" {
+		t.Errorf("target saw Host %q, want api.internal", got)
+	}
+	if err := checkTargetHealth(config); err != nil {
+		t.Errorf("health check of the https target failed: %v", err)
+	}
+	<-seen
+
+	// A server name the certificate is not for is refused
+	config.TargetServerName = "other.example"
+	if err := configureTargetTLS(config); err != nil {
+		t.Fatal(err)
+	}
+	targetClient.CloseIdleConnections()
+	if resp, err := forwardToTarget(throughTunnel(t, "/"), config, logger); err == nil {
+		resp.Body.Close()
+		t.Error("forwarded to a target whose certificate does not match the server name")
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	timedOut := &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	tests := []struct {
+		method   string
+		body     string
+		err      error
+		bodyRead int64
+		want     bool
+	}{
+		{"GET", "", reset, 0, true},
+		{"GET", "", refused, 0, true},
+		{"HEAD", "", reset, 0, true},
+		{"OPTIONS", "", reset, 0, true},
+		{"POST", "", reset, 0, false},
+		{"GET", "x", reset, 0, false},
+		{"GET", "", reset, 3, false},
+		{"GET", "", timedOut, 0, false},
+		{"GET", "", &deniedError{}, 0, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body))
+		if got := retryable(req, tt.bodyRead, tt.err); got != tt.want {
+			t.Errorf("retryable(%s with %q body, %d read, %v) = %v, want %v", tt.method, tt.body, tt.bodyRead, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestUnreadableRequestIsAnswered(t *testing.T) {
+	bridgeConn, offrampConn := net.Pipe()
+	bridge := mux.NewSession(bridgeConn, true)
+	offramp := mux.NewSession(offrampConn, false)
+	defer bridge.Close()
+	defer offramp.Close()
+	go func() {
+		for {
+			stream, err := offramp.Accept()
+			if err != nil {
+				return
+			}
+			go handleStream(stream, nil, &Config{}, 0)
+		}
+	}()
+
+	tests := []struct {
+		request string
+		status  int
+		code    string
+	}{
+		{"NOT HTTP\r\n\r\n", http.StatusBadGateway, errCodeTunnelError},
+		{"GET / HTTP/1.1\r\nHost: x\r\n" + strings.Repeat("X-Many: y\r\n", proxy.MaxHeaders+1) + "\r\n", http.StatusRequestHeaderFieldsTooLarge, errCodeHeaderTooLarge},
+	}
+	for _, tt := range tests {
+		stream, err := bridge.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.Write([]byte(tt.request))
+		stream.Close()
+		resp, err := http.ReadResponse(bufio.NewReader(stream), nil)
+		if err != nil {
+			t.Fatalf("no answer to %.20q: %v", tt.request, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status || resp.Header.Get(proxy.ErrorCodeHeader) != tt.code {
+			t.Errorf("%.20q answered %d %s, want %d %s", tt.request, resp.StatusCode, resp.Header.Get(proxy.ErrorCodeHeader), tt.status, tt.code)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"apiduct/pkg/stats"
+)
+
+// metrics is the registry of the process
+var metrics = stats.Default
+
+// statusClass groups status codes as "2xx", "4xx", etc.
+func statusClass(status int) string {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
@@ -0,0 +1,18 @@
+//go:build nodnsserver
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+const dnsServerCompiled = false
+
+// queryDNS is never called without DNS server support, --dns-server is
+// refused instead.
+func queryDNS(ctx context.Context, server, host string) ([]net.IP, time.Duration, error) {
+	return nil, 0, errors.New("built without DNS server support")
+}
@@ -0,0 +1,11 @@
+//go:build noh2c
+
+package main
+
+import "net/http"
+
+const h2cCompiled = false
+
+// h2cClient is never used without h2c support: gRPC calls go to the target
+// over HTTP/1.1, and --target-protocol h2c is refused.
+var h2cClient *http.Client
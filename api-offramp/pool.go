@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// configureTargetPool checks the --target-*-conns options and sizes the pool
+// of connections to the target that the requests share.
+func configureTargetPool(config *Config) error {
+	if config.TargetMaxIdleConns < 0 || config.TargetMaxIdleConnsPerHost < 0 || config.TargetMaxConnsPerHost < 0 {
+		return fmt.Errorf("target connection limits must not be negative")
+	}
+	if config.TargetIdleConnTimeout < 0 {
+		return fmt.Errorf("target idle connection timeout must not be negative")
+	}
+	perHost := config.TargetMaxIdleConnsPerHost
+	if perHost == 0 {
+		// Every request sent at once can put its connection back
+		perHost = config.MaxConcurrency + config.PriorityWorkers
+	}
+
+	transport := targetClient.Transport.(*http.Transport)
+	transport.MaxIdleConns = config.TargetMaxIdleConns
+	transport.MaxIdleConnsPerHost = perHost
+	transport.MaxConnsPerHost = config.TargetMaxConnsPerHost
+	transport.IdleConnTimeout = config.TargetIdleConnTimeout
+	return nil
+}
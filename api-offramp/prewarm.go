@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// warmConnMaxAge bounds how long a pre-dialled connection waits for a
+// request, as targets close idle connections after a while.
+const warmConnMaxAge = 30 * time.Second
+
+// warmPool holds target connections dialled ahead of the requests that will
+// use them, so the first burst after the tunnel connects does not wait for
+// the dials.
+type warmPool struct {
+	mu    sync.Mutex
+	conns []warmConn
+}
+
+type warmConn struct {
+	net.Conn
+	addr   string
+	dialed time.Time
+}
+
+// warmConns is handed out by dialTarget before it dials.
+var warmConns = &warmPool{}
+
+// fill dials n connections to addr at once, replacing the warm connections
+// left over.
+func (p *warmPool) fill(addr string, n int) {
+	p.flush()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := dialAllowed(ctx, "tcp", addr, egress)
+			if err != nil {
+				log.Printf("[OFFRAMP] Failed to pre-warm target connection: %v", err)
+				return
+			}
+			p.mu.Lock()
+			p.conns = append(p.conns, warmConn{conn, addr, time.Now()})
+			p.mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	log.Printf("[OFFRAMP] Pre-warmed %d connections to the target", p.count())
+	time.AfterFunc(warmConnMaxAge, p.expire)
+}
+
+// take returns a warm connection to addr the target has not closed, or nil
+// if there is none.
+func (p *warmPool) take(addr string) net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.countLocked()
+	for len(p.conns) > 0 {
+		warm := p.conns[len(p.conns)-1]
+		p.conns = p.conns[:len(p.conns)-1]
+		if warm.addr == addr && time.Since(warm.dialed) < warmConnMaxAge && isOpen(warm.Conn) {
+			metrics.Counter("apiduct_target_warm_connections_used_total").Inc()
+			return warm.Conn
+		}
+		warm.Close()
+	}
+	return nil
+}
+
+// expire closes the connections that waited too long.
+func (p *warmPool) expire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fresh := p.conns[:0]
+	for _, warm := range p.conns {
+		if time.Since(warm.dialed) < warmConnMaxAge {
+			fresh = append(fresh, warm)
+		} else {
+			warm.Close()
+		}
+	}
+	p.conns = fresh
+	p.countLocked()
+}
+
+// flush closes all warm connections, e.g. when the target moved.
+func (p *warmPool) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, warm := range p.conns {
+		warm.Close()
+	}
+	p.conns = nil
+	p.countLocked()
+}
+
+func (p *warmPool) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.countLocked()
+}
+
+// countLocked updates the warm connection gauge. The caller must hold p.mu.
+func (p *warmPool) countLocked() int {
+	metrics.Gauge("apiduct_target_warm_connections").Set(int64(len(p.conns)))
+	return len(p.conns)
+}
+
+// isOpen reports whether the peer has not closed conn, which an idle
+// connection shows by a read that does not return at once.
+func isOpen(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	conn.SetReadDeadline(time.Time{})
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
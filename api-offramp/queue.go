@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// requestQueue bounds the tunnel streams handled at once. At most workers
+// requests reach the target concurrently and up to depth more wait for a
+// worker. When the queue is full, no new streams are accepted from the
+// tunnel, which pushes back on the bridge.
+type requestQueue struct {
+	name    string
+	slots   chan struct{} // workers + depth, taken before accepting a stream
+	workers chan struct{} // taken while the target handles a request
+	wg      sync.WaitGroup
+}
+
+func newRequestQueue(name string, workers, depth int) *requestQueue {
+	return &requestQueue{
+		name:    name,
+		slots:   make(chan struct{}, workers+depth),
+		workers: make(chan struct{}, workers),
+	}
+}
+
+// Reserve takes a queue slot for the next stream. It blocks while the queue
+// is full.
+func (q *requestQueue) Reserve() {
+	select {
+	case q.slots <- struct{}{}:
+	default:
+		log.Printf("[OFFRAMP] %s queue full, pausing accepting streams from the tunnel", q.name)
+		q.slots <- struct{}{}
+	}
+}
+
+// Cancel gives back a slot taken by Reserve that was not used.
+func (q *requestQueue) Cancel() {
+	<-q.slots
+}
+
+// Run handles a request in the reserved slot once a worker is free.
+func (q *requestQueue) Run(handle func()) {
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		defer func() { <-q.slots }()
+		q.workers <- struct{}{}
+		defer func() { <-q.workers }()
+		handle()
+	}()
+}
+
+// Wait blocks until every running request is done.
+func (q *requestQueue) Wait() {
+	q.wg.Wait()
+}
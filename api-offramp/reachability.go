@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// reachability remembers whether the target is reachable, so a burst of
+// requests to a target that is down fails fast instead of each request
+// waiting to find out. Probes are single flight: callers arriving while one
+// runs share its result.
+type reachability struct {
+	probe func() error
+	ttl   time.Duration // how long a failure is trusted, 0 disables fast failing
+
+	mu      sync.Mutex
+	err     error // why the target is unreachable, nil if it is reachable
+	checked time.Time
+	probing chan struct{} // closed when the probe in progress finishes
+}
+
+func newReachability(ttl time.Duration, probe func() error) *reachability {
+	return &reachability{probe: probe, ttl: ttl}
+}
+
+// Probe checks the target, or waits for the check in progress, and returns
+// the result.
+func (r *reachability) Probe() error {
+	r.mu.Lock()
+	if wait := r.probing; wait != nil {
+		r.mu.Unlock()
+		<-wait
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.err
+	}
+	done := make(chan struct{})
+	r.probing = done
+	r.mu.Unlock()
+
+	err := r.probe()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+	r.checked = time.Now()
+	r.probing = nil
+	close(done)
+	return err
+}
+
+// Check returns why the target is unreachable, or nil if requests should be
+// sent to it. A failure older than the TTL is confirmed by a new probe.
+func (r *reachability) Check() error {
+	if r.ttl <= 0 {
+		return nil
+	}
+	r.mu.Lock()
+	err, age := r.err, time.Since(r.checked)
+	r.mu.Unlock()
+	if err == nil || age < r.ttl {
+		return err
+	}
+	return r.Probe()
+}
+
+// Err returns why the target was last found unreachable, nil if it was
+// reachable.
+func (r *reachability) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Failed records a request that could not connect to the target, so other
+// requests fail fast until a probe finds the target again. Requests that
+// reached the target and failed for another reason are ignored.
+func (r *reachability) Failed(err error) {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "dial" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.probing == nil {
+		r.err = fmt.Errorf("failed to connect to target: %v", opErr.Err)
+		r.checked = time.Now()
+	}
+}
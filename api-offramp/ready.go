@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// targetHealthy is closed after the first successful target health check.
+// Until then the offramp does not open a tunnel, so the bridge never routes
+// requests to a target that is still starting.
+var (
+	targetHealthy     = make(chan struct{})
+	targetHealthyOnce sync.Once
+)
+
+// markTargetHealthy reports the offramp as ready, also to systemd for
+// Type=notify units.
+func markTargetHealthy() {
+	targetHealthyOnce.Do(func() {
+		close(targetHealthy)
+		log.Printf("[OFFRAMP] Target passed its first health check, ready for traffic")
+		if err := sdNotify("READY=1"); err != nil {
+			log.Printf("[OFFRAMP] Failed to notify systemd: %v", err)
+		}
+	})
+}
+
+// waitForTarget blocks until the target passed a health check.
+func waitForTarget() {
+	select {
+	case <-targetHealthy:
+	default:
+		log.Printf("[OFFRAMP] Waiting for the target to pass a health check before connecting to the bridge")
+		<-targetHealthy
+	}
+}
+
+// sdNotify sends a state change to systemd if NOTIFY_SOCKET is set.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		// Abstract socket namespace
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// usageConn counts what a tunnel carried, so it can be recycled before a
+// middlebox that tracks long-lived flows silently kills it.
+type usageConn struct {
+	net.Conn
+	since    time.Time
+	bytes    atomic.Int64
+	requests atomic.Int64
+}
+
+func (c *usageConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.bytes.Add(int64(n))
+	return n, err
+}
+
+func (c *usageConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.bytes.Add(int64(n))
+	return n, err
+}
+
+// recycling reports whether tunnels are recycled at all.
+func recycling(config *Config) bool {
+	return config.TunnelMaxAge > 0 || config.TunnelMaxRequests > 0 || config.TunnelMaxBytes > 0
+}
+
+// countRequest counts a request accepted on the tunnel conn.
+func countRequest(conn net.Conn) {
+	if c, ok := conn.(*usageConn); ok {
+		c.requests.Add(1)
+	}
+}
+
+// recycleDue returns which limit conn reached, or "" if it may carry on.
+func recycleDue(conn net.Conn, config *Config) (reason, detail string) {
+	c, ok := conn.(*usageConn)
+	switch {
+	case !ok:
+		return "", ""
+	case config.TunnelMaxAge > 0 && time.Since(c.since) >= config.TunnelMaxAge:
+		return "age", fmt.Sprintf("up for %s", time.Since(c.since).Round(time.Second))
+	case config.TunnelMaxRequests > 0 && c.requests.Load() >= config.TunnelMaxRequests:
+		return "requests", fmt.Sprintf("carried %d requests", c.requests.Load())
+	case config.TunnelMaxBytes > 0 && c.bytes.Load() >= config.TunnelMaxBytes:
+		return "bytes", fmt.Sprintf("carried %d bytes", c.bytes.Load())
+	}
+	return "", ""
+}
+
+// recycle returns a new tunnel to the bridge in place of conn once conn
+// reached a limit, or nil. The caller drains conn once it has the new one.
+func recycle(conn net.Conn, config *Config) net.Conn {
+	reason, detail := recycleDue(conn, config)
+	if reason == "" {
+		return nil
+	}
+	log.Printf("[OFFRAMP] Recycling tunnel to %s, %s", conn.RemoteAddr(), detail)
+	replacement, err := createTunnelConnection(config, net.JoinHostPort(config.BridgeHost, strconv.Itoa(config.BridgePort)))
+	if err != nil {
+		log.Printf("[OFFRAMP] Failed to recycle the tunnel, keeping it: %v", err)
+		return nil
+	}
+	metrics.Counter("apiduct_tunnel_recycled_total", "reason", reason).Inc()
+	return replacement
+}
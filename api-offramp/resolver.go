@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shortest time a lookup is reused, so records with a TTL of 0 do not cause a
+// query per connection
+const minDNSTTL = time.Second
+
+// hostResolver resolves the bridge and target host names. Lookups are cached
+// for the TTL of the DNS records when a DNS server is configured, or for a
+// fixed refresh interval with the system resolver, which does not report
+// TTLs. Static overrides take precedence over DNS.
+type hostResolver struct {
+	server    string // DNS server (host:port) queried directly, "" for the system resolver
+	refresh   time.Duration
+	overrides map[string][]net.IP
+
+	mu    sync.Mutex
+	cache map[string]*resolution
+}
+
+type resolution struct {
+	addrs   []net.IP
+	expires time.Time
+}
+
+// resolver is used for every connection the offramp opens
+var resolver = newHostResolver("", 0, nil)
+
+func newHostResolver(server string, refresh time.Duration, overrides map[string][]net.IP) *hostResolver {
+	return &hostResolver{server: server, refresh: refresh, overrides: overrides, cache: make(map[string]*resolution)}
+}
+
+// parseDNSOverrides parses --dns-override values of the form
+// host=ip[,ip...].
+func parseDNSOverrides(values []string) (map[string][]net.IP, error) {
+	overrides := make(map[string][]net.IP)
+	for _, value := range values {
+		host, list, ok := strings.Cut(value, "=")
+		if !ok || host == "" || list == "" {
+			return nil, fmt.Errorf("invalid DNS override %q, expected host=ip[,ip...]", value)
+		}
+		for _, s := range strings.Split(list, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q in DNS override for %s", s, host)
+			}
+			key := strings.ToLower(strings.TrimSuffix(host, "."))
+			overrides[key] = append(overrides[key], ip)
+		}
+	}
+	return overrides, nil
+}
+
+// Lookup returns the addresses of host.
+func (h *hostResolver) Lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	key := strings.ToLower(strings.TrimSuffix(host, "."))
+	if addrs, ok := h.overrides[key]; ok {
+		return addrs, nil
+	}
+
+	h.mu.Lock()
+	cached := h.cache[key]
+	h.mu.Unlock()
+	if cached != nil && time.Now().Before(cached.expires) {
+		return cached.addrs, nil
+	}
+
+	var addrs []net.IP
+	var ttl time.Duration
+	var err error
+	if h.server != "" {
+		addrs, ttl, err = queryDNS(ctx, h.server, key)
+	} else {
+		addrs, err = lookupSystem(ctx, key)
+		ttl = h.refresh
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ttl < minDNSTTL {
+		ttl = minDNSTTL
+	}
+	h.mu.Lock()
+	h.cache[key] = &resolution{addrs: addrs, expires: time.Now().Add(ttl)}
+	h.mu.Unlock()
+	return addrs, nil
+}
+
+func lookupSystem(ctx context.Context, host string) ([]net.IP, error) {
+	ipAddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]net.IP, len(ipAddrs))
+	for i, addr := range ipAddrs {
+		addrs[i] = addr.IP
+	}
+	return addrs, nil
+}
+
+// DialContext connects to addr, trying the addresses of its host in turn.
+func (h *hostResolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := h.Lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return dialAddresses(ctx, network, host, addrs, port)
+}
+
+// dialAddresses connects to the first of the addresses of host that accepts.
+func dialAddresses(ctx context.Context, network, host string, addrs []net.IP, port string) (net.Conn, error) {
+	dialer := &net.Dialer{KeepAlive: 30 * time.Second}
+	var firstErr error
+	for _, ip := range addrs {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = fmt.Errorf("no addresses for %s", host)
+	}
+	return nil, firstErr
+}
+
+// Dial is DialContext with a timeout.
+func (h *hostResolver) Dial(network, addr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return h.DialContext(ctx, network, addr)
+}
+
+// Resolves reports whether host currently resolves to ip. Lookup failures
+// count as a match, so a DNS outage does not move connections.
+func (h *hostResolver) Resolves(host string, ip net.IP) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addrs, err := h.Lookup(ctx, host)
+	if err != nil {
+		return true
+	}
+	for _, addr := range addrs {
+		if addr.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialTarget connects to the target with the configured resolver, within the
+// egress allowlist, or hands out a pre-warmed connection.
+func dialTarget(ctx context.Context, network, addr string) (net.Conn, error) {
+	if conn := warmConns.take(addr); conn != nil {
+		return conn, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	return dialAllowed(ctx, network, addr, egress)
+}
+
+// serveUntilMoved serves the tunnel to the primary bridge until the bridge
+// host name no longer resolves to the address the tunnel is connected to, or
+// the tunnel is due for recycling. It then opens a tunnel to a current
+// address and returns it, while the old one drains. It returns nil and why
+// the tunnel was lost if it closes first.
+func serveUntilMoved(conn net.Conn, targetConn *TargetConnection, config *Config) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	ip := net.ParseIP(host)
+	watchAddress := net.ParseIP(config.BridgeHost) == nil && ip != nil
+	if !watchAddress && !recycling(config) {
+		return nil, handleTunnelTraffic(conn, targetConn, config, nil)
+	}
+	return serveUntilReplaced(conn, targetConn, config, 5*time.Second, func() net.Conn {
+		if !watchAddress || resolver.Resolves(config.BridgeHost, ip) {
+			return recycle(conn, config)
+		}
+		log.Printf("[OFFRAMP] Bridge %s no longer resolves to %s, moving the tunnel", config.BridgeHost, ip)
+		moved, err := createTunnelConnection(config, net.JoinHostPort(config.BridgeHost, strconv.Itoa(config.BridgePort)))
+		if err != nil {
+			log.Printf("[OFFRAMP] Failed to move the tunnel: %v", err)
+			return nil
+		}
+		return moved
+	})
+}
+
+// watchTargetAddress closes idle connections to the target whenever its host
+// name resolves to different addresses, so new requests use the new ones.
+func watchTargetAddress(config *Config) {
+	if net.ParseIP(config.TargetHost) != nil {
+		return
+	}
+	var previous string
+	for ; ; time.Sleep(5 * time.Second) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		addrs, err := resolver.Lookup(ctx, config.TargetHost)
+		cancel()
+		if err != nil {
+			continue
+		}
+		current := addressList(addrs)
+		if previous != "" && current != previous {
+			log.Printf("[OFFRAMP] Target %s now resolves to %s, reconnecting", config.TargetHost, current)
+			targetClient.CloseIdleConnections()
+			h2cClient.CloseIdleConnections()
+			warmConns.flush()
+		}
+		previous = current
+	}
+}
+
+func addressList(addrs []net.IP) string {
+	list := make([]string, len(addrs))
+	for i, addr := range addrs {
+		list[i] = addr.String()
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"apiduct/pkg/mux"
+)
+
+// retryable reports whether a request the target failed may be sent again:
+// a GET, HEAD or OPTIONS without a body, that failed for a reason a second
+// attempt can fix. Timeouts are not retried, the client waited long enough.
+func retryable(req *http.Request, bodyRead int64, err error) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return false
+	}
+	if req.ContentLength != 0 || bodyRead != 0 {
+		return false
+	}
+	var denied *deniedError
+	var netErr net.Error
+	if errors.As(err, &denied) || errors.Is(err, mux.ErrChecksumMismatch) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,24 @@
+package main
+
+import "apiduct/pkg/proxy"
+
+// configureRewrite builds the path rewrite from --strip-prefix, --add-prefix
+// and --rewrite-path, leaving config.Rewrite nil when none is set.
+func configureRewrite(config *Config) error {
+	if config.StripPrefix == "" && config.AddPrefix == "" && len(config.RewritePath) == 0 {
+		return nil
+	}
+	rewrite := &proxy.Rewrite{StripPrefix: config.StripPrefix, AddPrefix: config.AddPrefix}
+	for _, value := range config.RewritePath {
+		rule, err := proxy.ParseRewriteRule(value)
+		if err != nil {
+			return err
+		}
+		rewrite.Replace = append(rewrite.Replace, rule)
+	}
+	if err := rewrite.Compile(); err != nil {
+		return err
+	}
+	config.Rewrite = rewrite
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// standbyGroup identifies this offramp's tunnels to the bridge, which keeps
+// one of them active and the others as standbys. It is chosen at startup, so
+// a restarted offramp does not inherit the tunnels of its predecessor.
+var standbyGroup uint64
+
+func newStandbyGroup() uint64 {
+	b := make([]byte, 8)
+	rand.Read(b)
+	// Zero means no group
+	return binary.BigEndian.Uint64(b) | 1
+}
+
+// set stores the active tunnel, waking the standby tunnels if it connects to
+// a different bridge than before.
+func (t *TunnelConnection) set(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == nil || t.conn.RemoteAddr().String() != conn.RemoteAddr().String() {
+		close(t.moved)
+		t.moved = make(chan struct{})
+	}
+	t.conn = conn
+}
+
+// bridge returns the address of the bridge the active tunnel is connected to,
+// empty if there has been none yet, and a channel closed once that changes.
+func (t *TunnelConnection) bridge() (string, <-chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == nil {
+		return "", t.moved
+	}
+	return t.conn.RemoteAddr().String(), t.moved
+}
+
+// addStandby records a standby tunnel, failing once the offramp shuts down.
+func (t *TunnelConnection) addStandby(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closing {
+		return false
+	}
+	t.standby[conn] = true
+	metrics.Gauge("apiduct_standby_tunnels").Set(int64(len(t.standby)))
+	return true
+}
+
+func (t *TunnelConnection) removeStandby(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.standby, conn)
+	metrics.Gauge("apiduct_standby_tunnels").Set(int64(len(t.standby)))
+}
+
+// shutdown stops new standby tunnels and returns the active tunnel and the
+// standby ones.
+func (t *TunnelConnection) shutdown() (net.Conn, []net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closing = true
+	standbys := make([]net.Conn, 0, len(t.standby))
+	for conn := range t.standby {
+		standbys = append(standbys, conn)
+	}
+	return t.conn, standbys
+}
+
+func (t *TunnelConnection) isClosing() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closing
+}
+
+// maintainStandby keeps a standby tunnel to the bridge of the active tunnel.
+// The bridge sends it no requests until it promotes it in place of the active
+// tunnel, which it does the moment that one dies, with no reconnect to wait
+// for. The standby tunnel is served like the active one meanwhile, and
+// follows it when it moves to another bridge.
+func maintainStandby(tunnelConn *TunnelConnection, targetConn *TargetConnection, config *Config) {
+	failures := newFailureLog("standby tunnel", config.ReconnectLogInterval)
+	retry := newBackoff(config.ReconnectInitial, config.ReconnectMax)
+	for !tunnelConn.isClosing() {
+		addr, moved := tunnelConn.bridge()
+		if addr == "" {
+			<-moved
+			continue
+		}
+		conn, err := createTunnelConnection(config, addr)
+		if err != nil {
+			failures.Failure(err)
+			retry.wait()
+			continue
+		}
+		if !tunnelConn.addStandby(conn) {
+			conn.Close()
+			return
+		}
+		failures.Success()
+		connected := time.Now()
+		log.Printf("[OFFRAMP] Standby tunnel connection established")
+
+		drain := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			handleTunnelTraffic(conn, targetConn, config, drain)
+			close(done)
+		}()
+		select {
+		case <-done:
+			log.Printf("[OFFRAMP] Standby tunnel connection closed, attempting to reconnect...")
+			if time.Since(connected) >= stableAfter {
+				retry.reset()
+			}
+			retry.wait()
+		case <-moved:
+			// The old bridge may have promoted it already
+			if err := sayGoodbye(config, conn); err != nil {
+				log.Printf("[OFFRAMP] Bridge at %s did not drain the standby tunnel: %v", addr, err)
+			}
+			close(drain)
+			<-done
+		}
+		tunnelConn.removeStandby(conn)
+	}
+}
+
+// sayGoodbyeAll says goodbye for the tunnels at once.
+func sayGoodbyeAll(config *Config, tunnels []net.Conn) {
+	var wg sync.WaitGroup
+	for _, conn := range tunnels {
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			if err := sayGoodbye(config, conn); err != nil {
+				log.Printf("[OFFRAMP] Bridge did not drain the standby tunnel: %v", err)
+			}
+		}(conn)
+	}
+	wg.Wait()
+}
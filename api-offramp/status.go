@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// recentErrorsKept is how many errors the status page lists.
+const recentErrorsKept = 20
+
+// StatusReport is what the status page shows, also served as JSON on
+// /api/status.
+type StatusReport struct {
+	Name      string           `json:"name,omitempty"`
+	ClientID  string           `json:"client_id,omitempty"`
+	Version   string           `json:"version"`
+	Started   time.Time        `json:"started"`
+	Bridge    string           `json:"bridge"`
+	Target    string           `json:"target"`
+	Tunnel    TunnelStatus     `json:"tunnel"`
+	Handshake *HandshakeResult `json:"last_handshake,omitempty"`
+	Health    HealthReport     `json:"health"`
+	TargetErr string           `json:"target_error,omitempty"`
+	Errors    []StatusError    `json:"recent_errors"`
+}
+
+// TunnelStatus is the state of the active tunnel.
+type TunnelStatus struct {
+	Connected bool       `json:"connected"`
+	Bridge    string     `json:"bridge,omitempty"` // address connected to
+	Since     *time.Time `json:"since,omitempty"`  // of the connection or the outage
+	LostError string     `json:"lost_error,omitempty"`
+}
+
+// HandshakeResult is the outcome of the last authentication with a bridge.
+type HandshakeResult struct {
+	Time   time.Time `json:"time"`
+	Bridge string    `json:"bridge"`
+	Result string    `json:"result"` // ok or the error
+}
+
+// StatusError is a failure listed on the status page.
+type StatusError struct {
+	Time    time.Time `json:"time"`
+	What    string    `json:"what"`
+	Message string    `json:"message"`
+}
+
+// offrampStatus collects what the status page shows. It records even the
+// failures the log only summarizes.
+type offrampStatus struct {
+	mu        sync.Mutex
+	started   time.Time
+	tunnel    TunnelStatus
+	handshake *HandshakeResult
+	errors    []StatusError // oldest first
+}
+
+var localStatus = &offrampStatus{started: time.Now()}
+
+// handshakeDone records the outcome of authenticating with the bridge at addr.
+func (s *offrampStatus) handshakeDone(addr string, err error) {
+	result := &HandshakeResult{Time: time.Now(), Bridge: addr, Result: "ok"}
+	if err != nil {
+		result.Result = err.Error()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handshake = result
+}
+
+// tunnelConnected records the active tunnel connecting to addr.
+func (s *offrampStatus) tunnelConnected(addr string) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tunnel = TunnelStatus{Connected: true, Bridge: addr, Since: &now}
+}
+
+// tunnelLost records the active tunnel closing, and why if known.
+func (s *offrampStatus) tunnelLost(err error) {
+	now := time.Now()
+	if err != nil {
+		s.failed("tunnel", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tunnel = TunnelStatus{Since: &now}
+	if err != nil {
+		s.tunnel.LostError = err.Error()
+	}
+}
+
+// failed adds an error to the recent ones.
+func (s *offrampStatus) failed(what string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors = append(s.errors, StatusError{Time: time.Now(), What: what, Message: err.Error()})
+	if len(s.errors) > recentErrorsKept {
+		s.errors = s.errors[len(s.errors)-recentErrorsKept:]
+	}
+}
+
+// report describes the offramp now, newest errors first.
+func (s *offrampStatus) report(targetConn *TargetConnection, config *Config) StatusReport {
+	report := StatusReport{
+		Name:     config.Name,
+		ClientID: config.ClientID,
+		Version:  Version,
+		Bridge:   net.JoinHostPort(config.BridgeHost, strconv.Itoa(config.BridgePort)),
+		Target:   fmt.Sprintf("%s://%s", targetScheme(config), net.JoinHostPort(config.TargetHost, strconv.Itoa(config.TargetPort))),
+		Health:   health(targetConn, true),
+	}
+	if err := targetConn.reachable.Err(); err != nil {
+		report.TargetErr = err.Error()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report.Started = s.started
+	report.Tunnel = s.tunnel
+	report.Handshake = s.handshake
+	report.Errors = make([]StatusError, 0, len(s.errors))
+	for i := len(s.errors) - 1; i >= 0; i-- {
+		report.Errors = append(report.Errors, s.errors[i])
+	}
+	return report
+}
+
+var statusPage = template.Must(template.New("status").Funcs(template.FuncMap{
+	"ago": func(t time.Time) string { return time.Since(t).Round(time.Second).String() + " ago" },
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta http-equiv="refresh" content="5">
+<title>apiduct offramp {{.Name}}</title>
+<style>body{font-family:sans-serif;margin:2em}td,th{padding:.2em 1em .2em 0;text-align:left;vertical-align:top}.ok{color:#080}.bad{color:#c00}</style>
+</head><body>
+<h1>apiduct offramp {{.Name}}</h1>
+<p>Version {{.Version}}, running for {{ago .Started}}{{if .ClientID}}, client ID {{.ClientID}}{{end}}</p>
+<table>
+<tr><th>Status</th><td class="{{if eq .Health.Status "ok"}}ok{{else}}bad{{end}}">{{.Health.Status}}{{range .Health.Problems}}: {{.}}{{end}}</td></tr>
+<tr><th>Tunnel</th><td>{{if .Tunnel.Connected}}<span class="ok">connected</span> to {{.Tunnel.Bridge}}{{else}}<span class="bad">not connected</span> (bridge {{.Bridge}}){{end}}{{with .Tunnel.Since}}, since {{ago .}}{{end}}{{with .Tunnel.LostError}}<br>lost: {{.}}{{end}}</td></tr>
+<tr><th>Last handshake</th><td>{{with .Handshake}}<span class="{{if eq .Result "ok"}}ok{{else}}bad{{end}}">{{.Result}}</span> with {{.Bridge}}, {{ago .Time}}{{else}}none yet{{end}}</td></tr>
+<tr><th>Target</th><td>{{.Target}}: {{if .Health.TargetReachable}}<span class="ok">reachable</span>{{else}}<span class="bad">unreachable</span>{{end}}{{with .TargetErr}}<br>{{.}}{{end}}</td></tr>
+<tr><th>Last success</th><td>{{with .Health.LastSuccess}}{{ago .}}{{else}}none yet{{end}}</td></tr>
+</table>
+<h2>Recent errors</h2>
+{{if .Errors}}<table>{{range .Errors}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.What}}</td><td>{{.Message}}</td></tr>{{end}}</table>{{else}}<p>None.</p>{{end}}
+</body></html>
+`))
+
+// serveStatus serves the status page on listener for people on the offramp's
+// host, e.g. field technicians without access to the logs.
+func serveStatus(listener net.Listener, targetConn *TargetConnection, config *Config) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusPage.Execute(w, localStatus.report(targetConn, config)); err != nil {
+			log.Printf("[OFFRAMP] Failed to render status page: %v", err)
+		}
+	})
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(localStatus.report(targetConn, config))
+	})
+	log.Printf("[OFFRAMP] Serving the status page on http://%s/", listener.Addr())
+	if err := http.Serve(listener, mux); err != nil {
+		log.Fatalf("Failed to serve status page: %v", err)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"apiduct/pkg/mux"
+	"apiduct/pkg/proxy"
+)
+
+// handleTunnelTraffic serves requests from the tunnel until it closes. When
+// drain is closed, it stops reading new requests, finishes the queued ones and
+// closes the tunnel. It returns why the tunnel was lost, nil after draining.
+func handleTunnelTraffic(conn net.Conn, targetConn *TargetConnection, config *Config, drain <-chan struct{}) error {
+	sessionConn, stopRecording := mux.RecordSession(conn, config.RecordDir, false, logf)
+	defer stopRecording()
+	session := mux.NewSession(sessionConn, false)
+	defer session.Close()
+	if config.TunnelChecksums {
+		if err := session.EnableChecksums(); err != nil {
+			return fmt.Errorf("failed to ask for tunnel checksums: %v", err)
+		}
+	}
+	go mux.Heartbeat(session, config.HeartbeatInterval, config.HeartbeatTimeout, "bridge", conn.RemoteAddr().String())
+
+	queue := newRequestQueue("Request", config.MaxConcurrency, config.QueueDepth)
+	defer queue.Wait()
+
+	// Priority streams, e.g. health checks, have workers of their own so a
+	// full queue does not hold them up
+	if config.PriorityWorkers > 0 {
+		priority := newRequestQueue("Priority request", config.PriorityWorkers, 0)
+		done := make(chan struct{})
+		defer func() {
+			<-done
+			priority.Wait()
+		}()
+		go func() {
+			defer close(done)
+			for {
+				priority.Reserve()
+				stream, err := session.AcceptPriority()
+				if err != nil {
+					priority.Cancel()
+					return
+				}
+				accepted := time.Now()
+				countRequest(conn)
+				priority.Run(func() { handleStream(stream, targetConn, config, time.Since(accepted)) })
+			}
+		}()
+	}
+
+	// Stop accepting streams when draining starts, the ones in flight finish
+	draining := make(chan struct{})
+	if drain != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-drain:
+				close(draining)
+				session.GoAway()
+			case <-stop:
+			}
+		}()
+	}
+
+	// The bridge sends go away when it shuts down
+	go func() {
+		select {
+		case <-session.GoneAway():
+			log.Printf("[OFFRAMP] Bridge at %s is shutting down, the tunnel closes once its requests finish", conn.RemoteAddr())
+		case <-session.CloseChan():
+		}
+	}()
+
+	// Each request arrives on its own stream
+	for {
+		queue.Reserve()
+		stream, err := session.Accept()
+		if err != nil {
+			queue.Cancel()
+			select {
+			case <-draining:
+				log.Printf("[OFFRAMP] Draining tunnel to %s", conn.RemoteAddr())
+				return nil
+			default:
+			}
+			select {
+			case <-session.GoneAway():
+				return errBridgeGoneAway
+			default:
+			}
+			if err != mux.ErrSessionClosed {
+				log.Printf("[OFFRAMP] Tunnel connection lost: %v", err)
+			}
+			return err
+		}
+		accepted := time.Now()
+		countRequest(conn)
+		queue.Run(func() { handleStream(stream, targetConn, config, time.Since(accepted)) })
+	}
+}
+
+// handleStream reads one request from a tunnel stream and writes back the
+// target's response, or an apiduct error if there is none. The stream is
+// only reset once a response was started, or to abort a damaged request.
+// queued is how long the stream waited for a worker.
+func handleStream(stream *mux.Stream, targetConn *TargetConnection, config *Config, queued time.Duration) {
+	reader := proxy.NewReader(stream)
+	req, err := reader.ReadRequest()
+	if err != nil {
+		log.Printf("[OFFRAMP] Failed to read request from tunnel: %v", err)
+		writeUnreadable(stream, err)
+		return
+	}
+	// Stop working on the request once nobody is left to answer
+	ctx, cancel := streamContext(stream)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	// Count the request, its status class and the bytes in each direction
+	start := time.Now()
+	requestLog := requestLogger(req)
+	requestID := takeTraceID(req)
+	inFlight := metrics.Gauge("apiduct_requests_in_flight")
+	inFlight.Add(1)
+	defer inFlight.Add(-1)
+	requestBody := &proxy.CountingReader{ReadCloser: req.Body}
+	req.Body = requestBody
+	responseBody := &proxy.CountingReader{}
+	status := 0
+	defer func() {
+		requestLog.Info(fmt.Sprintf("Completed %s %s with %d", req.Method, req.URL.Path, status), "status", status, "duration", time.Since(start))
+		if status != 0 && status < http.StatusInternalServerError {
+			lastSuccess.Store(time.Now().UnixNano())
+		}
+		logAccess(req, requestID, status, responseBody.N, time.Since(start))
+		metrics.Counter("apiduct_requests_total", "code", statusClass(status)).Inc()
+		metrics.Counter("apiduct_request_bytes_total").Add(requestBody.N)
+		metrics.Counter("apiduct_response_bytes_total").Add(responseBody.N)
+	}()
+
+	// Every request read from the tunnel is answered, so the bridge never
+	// waits for a response that is not coming: with the target's response,
+	// with an apiduct error while no response was started, or by resetting
+	// the stream if one was started or must not be sent
+	aborted := false
+	defer func() {
+		p := recover()
+		if p != nil {
+			log.Printf("[OFFRAMP] Panic while serving %s %s: %v\n%s", req.Method, req.RequestURI, p, debug.Stack())
+			if status != 0 || req.Method == http.MethodConnect {
+				stream.Reset()
+				return
+			}
+		}
+		if status != 0 || aborted {
+			return
+		}
+		status = http.StatusBadGateway
+		writeTargetError(stream, req, status, errCodeTargetError)
+	}()
+
+	// Forward clients reach other addresses, not the target
+	if req.Method == http.MethodConnect {
+		status = handleConnect(stream, reader.Reader, req, config)
+		return
+	}
+
+	if reason := targetConn.reachable.Check(); reason != nil {
+		log.Printf("[OFFRAMP] Failing %s %s fast, %v", req.Method, req.URL.RequestURI(), reason)
+		status = http.StatusBadGateway
+		writeTargetError(stream, req, status, errCodeTargetUnreachable)
+		return
+	}
+	wantTiming := req.Header.Get(proxy.TimingHeader) != ""
+	req.Header.Del(proxy.TimingHeader)
+	sent := time.Now()
+	resp, err := forwardToTarget(req, config, requestLog)
+	if err != nil && config.TargetRetries > 0 {
+		retry := newBackoff(config.TargetRetryBackoff, config.TargetRetryBackoffMax)
+		for attempt := 1; err != nil && attempt <= config.TargetRetries && retryable(req, requestBody.N, err); attempt++ {
+			wait := retry.next()
+			requestLog.Warn(fmt.Sprintf("Request %s %s to target failed, retrying in %s (%d of %d): %v", req.Method, req.RequestURI, wait.Round(time.Millisecond), attempt, config.TargetRetries, err))
+			metrics.Counter("apiduct_target_retries_total").Inc()
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			resp, err = forwardToTarget(req, config, requestLog)
+		}
+	}
+	targetTime := time.Since(sent)
+	if err != nil && ctx.Err() != nil {
+		requestLog.Info(fmt.Sprintf("Stream of %s %s ended, giving up on the target: %v", req.Method, req.RequestURI, err))
+		aborted = true
+		return
+	}
+	if errors.Is(err, mux.ErrChecksumMismatch) {
+		requestChecksumFailed(req)
+		stream.Reset()
+		aborted = true
+		return
+	}
+	if err != nil {
+		targetConn.reachable.Failed(err)
+		localStatus.failed(fmt.Sprintf("request %s %s", req.Method, req.RequestURI), err)
+		var code string
+		status, code = targetErrorResponse(err)
+		writeTargetError(stream, req, status, code)
+		return
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		status = relayUpgraded(stream, reader.Reader, req, resp)
+		return
+	}
+	status = resp.StatusCode
+	defer resp.Body.Close()
+	responseBody.ReadCloser = resp.Body
+	resp.Body = responseBody
+	// The header is reserved for errors apiduct generates itself
+	resp.Header.Del(proxy.ErrorCodeHeader)
+	// Report where the time went when the bridge asked for it
+	resp.Header.Del(proxy.TimingHeader)
+	if wantTiming {
+		resp.Header.Set(proxy.TimingHeader, proxy.FormatTiming(queued, targetTime))
+	}
+	if err := proxy.WriteResponse(stream, resp); err != nil {
+		log.Printf("[OFFRAMP] Failed to forward response through tunnel: %v", err)
+		stream.Reset()
+		return
+	}
+	if config.TunnelChecksums && !verifyRequest(stream, req) {
+		stream.Reset()
+		return
+	}
+	stream.Close()
+}
+
+// requestLogger returns a logger adding the request ID the bridge assigned to
+// req, if any.
+func requestLogger(req *http.Request) *slog.Logger {
+	if id := req.Header.Get(proxy.TraceHeader); id != "" {
+		return logger.With("request_id", id)
+	}
+	return logger
+}
+
+// takeTraceID removes the request ID the bridge assigned to req and returns
+// it, passing it on to the target as X-Request-Id unless the client sent one.
+func takeTraceID(req *http.Request) string {
+	id := req.Header.Get(proxy.TraceHeader)
+	req.Header.Del(proxy.TraceHeader)
+	if id != "" && req.Header.Get("X-Request-Id") == "" {
+		req.Header.Set("X-Request-Id", id)
+	}
+	return id
+}
+
+// streamContext returns a context that is cancelled once stream is reset or
+// its tunnel is lost.
+func streamContext(stream *mux.Stream) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-stream.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// forwardToTarget sends a request from the tunnel to the target, logging to
+// requestLog. It may be called again for a retry, and gives up once the
+// request's context is cancelled.
+func forwardToTarget(req *http.Request, config *Config, requestLog *slog.Logger) (*http.Response, error) {
+	requestLog.Debug(fmt.Sprintf("Received request from tunnel: %s %s", req.Method, req.URL.RequestURI()))
+
+	// Create a new request for the target
+	targetReq, err := http.NewRequestWithContext(req.Context(), req.Method, targetURL(config, req), req.Body)
+	if err != nil {
+		requestLog.Error(fmt.Sprintf("Failed to create target request: %v", err))
+		return nil, err
+	}
+
+	// Copy headers from original request
+	for key, values := range req.Header {
+		for _, value := range values {
+			targetReq.Header.Add(key, value)
+		}
+	}
+	if !proxy.IsWebSocket(req) {
+		proxy.RemoveHopHeaders(targetReq.Header)
+	}
+	// Stream the body as it arrives, keeping its framing
+	targetReq.ContentLength = req.ContentLength
+	if config.TargetHostHeader != "" {
+		targetReq.Host = config.TargetHostHeader
+	}
+
+	client := clientFor(req, config)
+
+	// Forward the request to target
+	requestLog.Debug(fmt.Sprintf("Forwarding request to target: %s %s", req.Method, targetReq.URL.RequestURI()))
+	traceWire(requestLog, "Request to target", fmt.Sprintf("%s %s %s", targetReq.Method, targetReq.URL.RequestURI(), targetReq.Proto), targetReq.Header)
+	resp, err := client.Do(targetReq)
+	if err != nil {
+		requestLog.Error(fmt.Sprintf("Failed to forward request to target: %v", err))
+		return nil, err
+	}
+
+	requestLog.Debug(fmt.Sprintf("Received response from target: %s", resp.Status))
+	traceWire(requestLog, "Response from target", resp.Proto+" "+resp.Status, resp.Header)
+
+	// Forward response back through tunnel
+	requestLog.Debug(fmt.Sprintf("Forwarding response through tunnel: %s", resp.Status))
+	return resp, nil
+}
+
+// targetClient forwards plain requests. Its timeout only covers waiting for
+// the response headers, so long transfers and event streams are not cut off.
+// Bodies pass through as the target encoded them.
+var targetClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                  http.ProxyFromEnvironment,
+		DialContext:            dialTarget,
+		ResponseHeaderTimeout:  30 * time.Second,
+		MaxResponseHeaderBytes: proxy.MaxHeaderBytes,
+		IdleConnTimeout:        90 * time.Second,
+		DisableCompression:     true,
+	},
+}
+
+// targetURL returns the URL of req on the target. The request URI is kept as
+// the client sent it, with its query and percent-encoding intact, unless
+// --strip-prefix, --add-prefix or --rewrite-path change its path.
+func targetURL(config *Config, req *http.Request) string {
+	uri := req.URL.RequestURI()
+	if config.Rewrite != nil {
+		uri = config.Rewrite.Path(req.URL.EscapedPath())
+		if req.URL.ForceQuery || req.URL.RawQuery != "" {
+			uri += "?" + req.URL.RawQuery
+		}
+	}
+	return fmt.Sprintf("%s://%s:%d%s", targetScheme(config), config.TargetHost, config.TargetPort, uri)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Schemes of the target
+const (
+	targetSchemeHTTP  = "http"
+	targetSchemeHTTPS = "https"
+)
+
+// targetTLS is the TLS configuration for an https target, nil for http.
+var targetTLS *tls.Config
+
+// configureTargetTLS checks the --target-scheme options and has the clients
+// for the target use TLS if it is https.
+func configureTargetTLS(config *Config) error {
+	switch config.TargetScheme {
+	case targetSchemeHTTP:
+		if config.TargetInsecureSkipVerify || config.TargetCAFile != "" || config.TargetServerName != "" {
+			return fmt.Errorf("target TLS options need --target-scheme https")
+		}
+		targetTLS = nil
+		return nil
+	case targetSchemeHTTPS:
+	default:
+		return fmt.Errorf("target scheme must be http or https")
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         config.TargetServerName,
+		InsecureSkipVerify: config.TargetInsecureSkipVerify,
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = config.TargetHost
+	}
+	if config.TargetCAFile != "" {
+		pem, err := os.ReadFile(config.TargetCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read target CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", config.TargetCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	targetTLS = tlsConfig
+	for _, client := range []*http.Client{targetClient, upgradeClient} {
+		client.Transport.(*http.Transport).TLSClientConfig = tlsConfig
+	}
+	return nil
+}
+
+// dialTargetTLS connects to the target at addr for a health check, with TLS
+// if it is https.
+func dialTargetTLS(addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := dialEgress(addr, timeout)
+	if err != nil || targetTLS == nil {
+		return conn, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	tlsConn := tls.Client(conn, targetTLS)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with target failed: %v", err)
+	}
+	return tlsConn, nil
+}
+
+// targetScheme returns the scheme of the target's URLs.
+func targetScheme(config *Config) string {
+	if config.TargetScheme == "" {
+		return targetSchemeHTTP
+	}
+	return config.TargetScheme
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"apiduct/pkg/mux"
+)
+
+// upgradeClient forwards WebSocket handshakes. Unlike the client for plain
+// requests, its timeout only covers the handshake, not the connection that
+// follows.
+var upgradeClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialTarget,
+		ResponseHeaderTimeout: 30 * time.Second,
+		DisableKeepAlives:     true,
+	},
+}
+
+// relayUpgraded passes the target's 101 response to the bridge and copies
+// between the stream and the target's connection in the background, so the
+// WebSocket does not hold a worker while it is open. reader holds what was
+// read from the stream past the request. It returns the status sent: 101, or
+// 502 if the target's connection cannot be used.
+func relayUpgraded(stream *mux.Stream, reader *bufio.Reader, req *http.Request, resp *http.Response) int {
+	target, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		log.Printf("[OFFRAMP] Target switched protocols without a usable connection")
+		resp.Body.Close()
+		writeTargetError(stream, req, http.StatusBadGateway, errCodeTargetError)
+		return http.StatusBadGateway
+	}
+
+	header := &strings.Builder{}
+	fmt.Fprintf(header, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(header)
+	header.WriteString("\r\n")
+	if _, err := io.WriteString(stream, header.String()); err != nil {
+		log.Printf("[OFFRAMP] Failed to forward response through tunnel: %v", err)
+		target.Close()
+		stream.Reset()
+		return resp.StatusCode
+	}
+
+	go func() {
+		io.Copy(target, reader)
+		target.Close()
+	}()
+	go func() {
+		io.Copy(stream, target)
+		stream.Close()
+	}()
+	return resp.StatusCode
+}
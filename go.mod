@@ -1,5 +1,3 @@
 module apiduct
 
 go 1.21
-
-require golang.org/x/sys v0.33.0
@@ -0,0 +1,281 @@
+// Package accesslog writes one line per HTTP request to a file, in the
+// Common or Combined Log Format or as JSON, rotating the file by size and
+// time. It is kept apart from the operational log so it can be fed to the
+// usual log analysers.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of the lines.
+const (
+	FormatCommon   = "common"
+	FormatCombined = "combined"
+	FormatJSON     = "json"
+)
+
+// clfTime is the timestamp layout of the Common Log Format.
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// backupTime names rotated files, e.g. access.log.20261016-120000.
+const backupTime = "20060102-150405"
+
+// Entry is one request.
+type Entry struct {
+	Time      time.Time
+	ClientIP  string
+	User      string // client certificate subject or other authenticated user
+	Method    string
+	URI       string
+	Proto     string
+	Status    int
+	Bytes     int64 // of the response body
+	Referer   string
+	UserAgent string
+	Route     string
+	Duration  time.Duration
+	RequestID string
+}
+
+// Format returns e as a line in format, without the newline. The CLF
+// formats end with the route and the latency in milliseconds, which
+// analysers that only know CLF ignore.
+func (e Entry) Format(format string) string {
+	if format == FormatJSON {
+		data, _ := json.Marshal(struct {
+			Time       time.Time `json:"time"`
+			ClientIP   string    `json:"client_ip"`
+			User       string    `json:"user,omitempty"`
+			Method     string    `json:"method"`
+			URI        string    `json:"uri"`
+			Proto      string    `json:"proto"`
+			Status     int       `json:"status"`
+			Bytes      int64     `json:"bytes"`
+			Referer    string    `json:"referer,omitempty"`
+			UserAgent  string    `json:"user_agent,omitempty"`
+			Route      string    `json:"route,omitempty"`
+			DurationMs int64     `json:"duration_ms"`
+			RequestID  string    `json:"request_id,omitempty"`
+		}{e.Time, e.ClientIP, e.User, e.Method, e.URI, e.Proto, e.Status, e.Bytes,
+			e.Referer, e.UserAgent, e.Route, e.Duration.Milliseconds(), e.RequestID})
+		return string(data)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s - %s [%s] %s %d %s",
+		dash(e.ClientIP), dash(strings.ReplaceAll(e.User, " ", "_")), e.Time.Format(clfTime),
+		strconv.Quote(e.Method+" "+e.URI+" "+e.Proto), e.Status, bytesField(e.Bytes))
+	if format == FormatCombined {
+		fmt.Fprintf(&b, " %s %s", strconv.Quote(dash(e.Referer)), strconv.Quote(dash(e.UserAgent)))
+	}
+	fmt.Fprintf(&b, " %s %d", strconv.Quote(dash(e.Route)), e.Duration.Milliseconds())
+	return b.String()
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func bytesField(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// CheckFormat returns an error unless format is one of the formats.
+func CheckFormat(format string) error {
+	switch format {
+	case FormatCommon, FormatCombined, FormatJSON:
+		return nil
+	}
+	return fmt.Errorf("invalid access log format %q, expected common, combined or json", format)
+}
+
+// Rotation says when a log file is rotated and how many rotated files are
+// kept. Zero values disable each.
+type Rotation struct {
+	MaxSize    int64         // bytes a file may grow to
+	Interval   time.Duration // rotate at each multiple of it, e.g. daily
+	MaxBackups int           // rotated files kept, the oldest removed first
+}
+
+// Logger appends entries to a file. A nil Logger logs nothing.
+type Logger struct {
+	path     string
+	format   string
+	rotation Rotation
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	period time.Time // Interval the file's lines belong to
+}
+
+// Open opens the access log at path for appending, creating it if needed.
+func Open(path, format string, rotation Rotation) (*Logger, error) {
+	if err := CheckFormat(format); err != nil {
+		return nil, err
+	}
+	l := &Logger{path: path, format: format, rotation: rotation}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Logger) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open access log: %v", err)
+	}
+	l.file = file
+	l.size = info.Size()
+	// A file written to in an earlier period is rotated on the next line,
+	// also across restarts
+	l.period = l.periodOf(info.ModTime())
+	return nil
+}
+
+func (l *Logger) periodOf(t time.Time) time.Time {
+	if l.rotation.Interval <= 0 {
+		return time.Time{}
+	}
+	return t.Truncate(l.rotation.Interval)
+}
+
+// Log appends e, rotating the file first if it is due.
+func (l *Logger) Log(e Entry) error {
+	if l == nil {
+		return nil
+	}
+	line := e.Format(l.format) + "\n"
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return fmt.Errorf("access log is closed")
+	}
+	now := time.Now()
+	full := l.rotation.MaxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.rotation.MaxSize
+	if full || !l.periodOf(now).Equal(l.period) {
+		if err := l.rotate(now); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.WriteString(line)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write access log: %v", err)
+	}
+	return nil
+}
+
+// rotate renames the file after the time it was rotated, opens a new one
+// and removes the backups over MaxBackups.
+func (l *Logger) rotate(now time.Time) error {
+	if l.size == 0 {
+		l.period = l.periodOf(now)
+		return nil
+	}
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("failed to close access log: %v", err)
+	}
+	l.file = nil
+	backup := l.path + "." + now.Format(backupTime)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(backup); os.IsNotExist(err) {
+			break
+		}
+		backup = fmt.Sprintf("%s.%s.%d", l.path, now.Format(backupTime), i)
+	}
+	if err := os.Rename(l.path, backup); err != nil {
+		// Keep appending to the file rather than lose the lines
+		if openErr := l.open(); openErr != nil {
+			return openErr
+		}
+		return fmt.Errorf("failed to rotate access log: %v", err)
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	l.period = l.periodOf(now)
+	return l.prune()
+}
+
+// prune removes the oldest backups over MaxBackups.
+func (l *Logger) prune() error {
+	if l.rotation.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := Backups(l.path)
+	if err != nil {
+		return err
+	}
+	for len(backups) > l.rotation.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return fmt.Errorf("failed to remove rotated access log: %v", err)
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Backups returns the rotated files of the access log at path, oldest first.
+// Other files next to it, even with the same prefix, are left out.
+func Backups(path string) ([]string, error) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rotated access logs: %v", err)
+	}
+	var backups []string
+	for _, entry := range entries {
+		stamp, ok := strings.CutPrefix(entry.Name(), base+".")
+		if entry.IsDir() || !ok || len(stamp) < len(backupTime) {
+			continue
+		}
+		if _, err := time.Parse(backupTime, stamp[:len(backupTime)]); err != nil {
+			continue
+		}
+		backups = append(backups, filepath.Join(dir, entry.Name()))
+	}
+	// The names sort by the time they were rotated
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// Close closes the file.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
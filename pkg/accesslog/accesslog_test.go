@@ -0,0 +1,102 @@
+package accesslog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var entry = Entry{
+	Time:      time.Date(2026, 10, 16, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+	ClientIP:  "203.0.113.7",
+	Method:    "GET",
+	URI:       "/api/users?id=1",
+	Proto:     "HTTP/1.1",
+	Status:    200,
+	Bytes:     2326,
+	UserAgent: `curl/8.0 "quoted"`,
+	Route:     "users",
+	Duration:  42 * time.Millisecond,
+	RequestID: "abc",
+}
+
+func TestFormat(t *testing.T) {
+	tests := map[string]string{
+		FormatCommon:   `203.0.113.7 - - [16/Oct/2026:13:55:36 -0700] "GET /api/users?id=1 HTTP/1.1" 200 2326 "users" 42`,
+		FormatCombined: `203.0.113.7 - - [16/Oct/2026:13:55:36 -0700] "GET /api/users?id=1 HTTP/1.1" 200 2326 "-" "curl/8.0 \"quoted\"" "users" 42`,
+		FormatJSON:     `{"time":"2026-10-16T13:55:36-07:00","client_ip":"203.0.113.7","method":"GET","uri":"/api/users?id=1","proto":"HTTP/1.1","status":200,"bytes":2326,"user_agent":"curl/8.0 \"quoted\"","route":"users","duration_ms":42,"request_id":"abc"}`,
+	}
+	for format, want := range tests {
+		if got := entry.Format(format); got != want {
+			t.Errorf("Format(%s) =\n%s\nwant\n%s", format, got, want)
+		}
+	}
+	if err := CheckFormat("apache"); err == nil {
+		t.Error("CheckFormat accepted an unknown format")
+	}
+}
+
+func TestRotateBySize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	os.WriteFile(filepath.Join(dir, "access.log.keep"), []byte("not a backup"), 0600)
+	line := int64(len(entry.Format(FormatCommon)) + 1)
+	l, err := Open(path, FormatCommon, Rotation{MaxSize: 2 * line, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 0; i < 10; i++ {
+		if err := l.Log(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups, err := Backups(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("kept %d backups, want 2: %v", len(backups), backups)
+	}
+	for _, name := range append(backups, path) {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Count(string(data), "\n"); lines != 2 {
+			t.Errorf("%s has %d lines, want 2", name, lines)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "access.log.keep")); err != nil {
+		t.Errorf("unrelated file was removed: %v", err)
+	}
+}
+
+func TestRotateByInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	os.WriteFile(path, []byte("yesterday\n"), 0600)
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(path, old, old)
+
+	l, err := Open(path, FormatJSON, Rotation{Interval: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Log(entry)
+	l.Log(entry)
+
+	backups, _ := Backups(path)
+	if len(backups) != 1 {
+		t.Fatalf("got %d backups, want the earlier day's file", len(backups))
+	}
+	if data, _ := os.ReadFile(backups[0]); string(data) != "yesterday\n" {
+		t.Errorf("backup holds %q", data)
+	}
+	if data, _ := os.ReadFile(path); strings.Count(string(data), "\n") != 2 {
+		t.Errorf("current file holds %q", data)
+	}
+}
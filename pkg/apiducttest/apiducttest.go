@@ -0,0 +1,361 @@
+// Package apiducttest runs a bridge and an offramp in process, joined by a
+// real tunnel whose network faults a test controls: latency, partitions,
+// dropped requests and resets. Programs embedding the apiduct packages use it
+// to test how they cope with a duct that misbehaves, much as
+// net/http/httptest serves a handler:
+//
+//	duct := apiducttest.NewDuct(handler, nil)
+//	defer duct.Close()
+//	duct.Faults.SetResetRate(0.5)
+//	resp, err := duct.Client().Get(duct.URL + "/orders")
+//
+// The bridge sends requests through a tunnel.Pool and answers like
+// api-bridge does when the tunnel fails, with the apiduct error codes
+// TUNNEL_DOWN, TUNNEL_ERROR and TUNNEL_TIMEOUT. The offramp buffers the
+// target's responses, so the duct suits request and response tests rather
+// than streaming.
+package apiducttest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"time"
+
+	"apiduct/pkg/auth"
+	"apiduct/pkg/mux"
+	"apiduct/pkg/proxy"
+	"apiduct/pkg/tunnel"
+)
+
+// Config tunes a Duct. The zero value is usable.
+type Config struct {
+	PSK               string        // "apiducttest" if empty
+	RequestTimeout    time.Duration // the bridge's wait for a response, 5s if 0
+	HeartbeatInterval time.Duration // the offramp's heartbeat, none if 0
+	HeartbeatTimeout  time.Duration // 1s if 0
+	ReconnectDelay    time.Duration // 20ms if 0
+	Seed              int64         // seeds the choice of requests to drop and reset
+}
+
+// Duct is a bridge forwarding the requests to URL through a tunnel to an
+// offramp, which serves them with the target handler.
+type Duct struct {
+	URL    string // base URL of the bridge, e.g. http://127.0.0.1:54321
+	Faults *Faults
+
+	config  Config
+	target  http.Handler
+	server  *httptest.Server
+	tunnels net.Listener
+	pool    *tunnel.Pool // bridge side of the tunnels
+	closed  chan struct{}
+	wg      sync.WaitGroup
+
+	mu          sync.Mutex
+	offramp     *mux.Session  // offramp side of the tunnel, nil while it is down
+	connected   chan struct{} // closed while both sides of a tunnel are up
+	connections int
+}
+
+// NewDuct starts a bridge and an offramp serving target, with config or the
+// defaults if it is nil. It panics if it cannot listen on the loopback
+// interface, as httptest.NewServer does.
+func NewDuct(target http.Handler, config *Config) *Duct {
+	d := &Duct{target: target, pool: tunnel.NewPool(tunnel.Options{}), closed: make(chan struct{}), connected: make(chan struct{})}
+	if config != nil {
+		d.config = *config
+	}
+	if d.config.PSK == "" {
+		d.config.PSK = "apiducttest"
+	}
+	if d.config.RequestTimeout == 0 {
+		d.config.RequestTimeout = 5 * time.Second
+	}
+	if d.config.HeartbeatTimeout == 0 {
+		d.config.HeartbeatTimeout = time.Second
+	}
+	if d.config.ReconnectDelay == 0 {
+		d.config.ReconnectDelay = 20 * time.Millisecond
+	}
+	d.Faults = newFaults(d.config.Seed)
+
+	var err error
+	if d.tunnels, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		panic(fmt.Sprintf("apiducttest: failed to listen for tunnels: %v", err))
+	}
+	d.server = httptest.NewServer(http.HandlerFunc(d.serveBridge))
+	d.URL = d.server.URL
+
+	d.wg.Add(2)
+	go d.acceptTunnels()
+	go d.runOfframp()
+	return d
+}
+
+// Client returns an HTTP client for the bridge.
+func (d *Duct) Client() *http.Client {
+	return d.server.Client()
+}
+
+// WaitConnected waits up to timeout for a tunnel to be up at both ends.
+func (d *Duct) WaitConnected(timeout time.Duration) error {
+	d.mu.Lock()
+	connected := d.connected
+	d.mu.Unlock()
+	select {
+	case <-connected:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("apiducttest: no tunnel connected")
+	}
+}
+
+// Connections returns the number of tunnels established so far, counting
+// every reconnect.
+func (d *Duct) Connections() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.connections
+}
+
+// Close stops the bridge and the offramp.
+func (d *Duct) Close() {
+	close(d.closed)
+	d.Faults.Heal()
+	d.tunnels.Close()
+	d.Faults.ResetTunnel()
+	for _, t := range d.pool.All() {
+		t.Session.Close()
+	}
+	d.server.Close()
+	d.wg.Wait()
+}
+
+// serveBridge forwards a request through the tunnel, as api-bridge does.
+func (d *Duct) serveBridge(w http.ResponseWriter, r *http.Request) {
+	tun, err := d.pool.Pick("", nil, false)
+	if err != nil {
+		writeError(w, r, http.StatusBadGateway, "TUNNEL_DOWN", "No tunnel connection available")
+		return
+	}
+	defer tun.Release(false)
+	sent, err := tun.Send(r, false, false, false, d.config.RequestTimeout)
+	if err != nil {
+		var sendErr *tunnel.SendError
+		errors.As(err, &sendErr)
+		if sendErr.Op != "open" && errors.Is(err, os.ErrDeadlineExceeded) {
+			writeError(w, r, http.StatusGatewayTimeout, "TUNNEL_TIMEOUT", "No response from the tunnel in time")
+			return
+		}
+		d.pool.Failed(tun)
+		switch sendErr.Op {
+		case "open":
+			writeError(w, r, http.StatusBadGateway, "TUNNEL_ERROR", "Failed to open a tunnel stream")
+		case "write":
+			writeError(w, r, http.StatusBadGateway, "TUNNEL_ERROR", "Failed to forward request")
+		default:
+			writeError(w, r, http.StatusBadGateway, "TUNNEL_ERROR", "Failed to read response")
+		}
+		return
+	}
+	tun.Succeeded()
+	resp := sent.Response
+	defer resp.Body.Close()
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		// The client sees a truncated body, as it would from api-bridge
+		sent.Stream.Reset()
+		return
+	}
+	proxy.CopyTrailers(w, resp)
+}
+
+// writeError answers with an apiduct error response.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	resp := proxy.ErrorResponse(r, status, code, message)
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// acceptTunnels authenticates the offramp's tunnels and keeps the latest.
+func (d *Duct) acceptTunnels() {
+	defer d.wg.Done()
+	for {
+		conn, err := d.tunnels.Accept()
+		if err != nil {
+			return
+		}
+		d.wg.Add(1)
+		go d.serveTunnel(conn)
+	}
+}
+
+func (d *Duct) serveTunnel(conn net.Conn) {
+	defer d.wg.Done()
+	conn.SetDeadline(time.Now().Add(auth.Timeout))
+	hello, err := auth.ReadHello(conn, d.config.PSK)
+	if err != nil || !hello.Valid {
+		if hello != nil {
+			auth.WriteStatus(conn, auth.StatusFailed)
+		}
+		conn.Close()
+		return
+	}
+	if err := auth.WriteStatus(conn, auth.StatusOK); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	session := mux.NewSession(conn, true)
+	d.mu.Lock()
+	for _, old := range d.pool.All() {
+		d.pool.Drop(old, "replaced")
+	}
+	t := d.pool.Add(conn, session, "", "", 0)
+	d.connections++
+	d.updateConnected()
+	d.mu.Unlock()
+
+	select {
+	case <-session.CloseChan():
+	case <-d.closed:
+		session.Close()
+	}
+
+	d.mu.Lock()
+	if d.pool.Remove(t) {
+		d.updateConnected()
+	}
+	d.mu.Unlock()
+}
+
+// updateConnected opens or closes d.connected after either side of the
+// tunnel came up or went down. d.mu must be held.
+func (d *Duct) updateConnected() {
+	up := d.pool.IsConnected() && d.offramp != nil
+	select {
+	case <-d.connected:
+		if !up {
+			d.connected = make(chan struct{})
+		}
+	default:
+		if up {
+			close(d.connected)
+		}
+	}
+}
+
+// runOfframp keeps a tunnel to the bridge and serves the requests on it,
+// reconnecting whenever it is lost.
+func (d *Duct) runOfframp() {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.closed:
+			return
+		default:
+		}
+		if session := d.connectOfframp(); session != nil {
+			d.mu.Lock()
+			d.offramp = session
+			d.updateConnected()
+			d.mu.Unlock()
+			if d.config.HeartbeatInterval > 0 {
+				go mux.Heartbeat(session, d.config.HeartbeatInterval, d.config.HeartbeatTimeout, "duct", d.URL)
+			}
+			for {
+				stream, err := session.Accept()
+				if err != nil {
+					break
+				}
+				d.wg.Add(1)
+				go d.serveOfframp(stream)
+			}
+			session.Close()
+			d.mu.Lock()
+			d.offramp = nil
+			d.updateConnected()
+			d.mu.Unlock()
+		}
+		select {
+		case <-d.closed:
+			return
+		case <-time.After(d.config.ReconnectDelay):
+		}
+	}
+}
+
+// connectOfframp dials and authenticates a tunnel through the faults,
+// returning nil if that fails.
+func (d *Duct) connectOfframp() *mux.Session {
+	raw, err := net.Dial("tcp", d.tunnels.Addr().String())
+	if err != nil {
+		return nil
+	}
+	conn := &faultConn{Conn: raw, faults: d.Faults, done: make(chan struct{})}
+	d.Faults.mu.Lock()
+	d.Faults.conn = conn
+	d.Faults.mu.Unlock()
+
+	hello, err := auth.SendHello(conn, d.config.PSK, auth.KindTunnel, "", nil)
+	if err == nil {
+		_, err = conn.Write(hello)
+	}
+	status := make([]byte, 9)
+	if err == nil {
+		_, err = io.ReadFull(conn, status)
+	}
+	if err != nil || status[0] != auth.StatusOK {
+		conn.Close()
+		return nil
+	}
+	return mux.NewSession(conn, false)
+}
+
+// serveOfframp answers a request from the tunnel with the target handler,
+// unless the faults drop or reset it.
+func (d *Duct) serveOfframp(stream *mux.Stream) {
+	defer d.wg.Done()
+	req, err := proxy.NewReader(stream).ReadRequest()
+	if err != nil {
+		stream.Reset()
+		return
+	}
+	switch d.Faults.requestFault() {
+	case faultDrop:
+		// Never answered, the bridge gives up and resets the stream
+		io.Copy(io.Discard, req.Body)
+		return
+	case faultReset:
+		stream.Reset()
+		return
+	}
+
+	recorder := httptest.NewRecorder()
+	d.target.ServeHTTP(recorder, req)
+	resp := recorder.Result()
+	resp.ContentLength = int64(recorder.Body.Len())
+	if len(resp.Trailer) > 0 {
+		// Chunked, so the trailers can follow the body
+		resp.ContentLength = -1
+		resp.TransferEncoding = []string{"chunked"}
+	}
+	if err := resp.Write(stream); err != nil {
+		stream.Reset()
+		return
+	}
+	stream.Close()
+}
@@ -0,0 +1,126 @@
+package apiducttest
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"apiduct/pkg/proxy"
+)
+
+var hello = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "hello "+r.URL.Path)
+})
+
+// get requests path from the duct and returns the status, the apiduct error
+// code and the body.
+func get(t *testing.T, duct *Duct, path string) (int, string, string) {
+	t.Helper()
+	resp, err := duct.Client().Get(duct.URL + path)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, resp.Header.Get(proxy.ErrorCodeHeader), string(body)
+}
+
+func connect(t *testing.T, duct *Duct) {
+	t.Helper()
+	if err := duct.WaitConnected(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDuct(t *testing.T) {
+	duct := NewDuct(hello, nil)
+	defer duct.Close()
+	connect(t, duct)
+
+	if status, _, body := get(t, duct, "/orders"); status != http.StatusOK || body != "hello /orders" {
+		t.Errorf("got %d %q, want 200 \"hello /orders\"", status, body)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	duct := NewDuct(hello, nil)
+	defer duct.Close()
+	connect(t, duct)
+
+	duct.Faults.SetLatency(50 * time.Millisecond)
+	start := time.Now()
+	if status, _, _ := get(t, duct, "/"); status != http.StatusOK {
+		t.Errorf("status = %d, want 200", status)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("request took %v, want at least twice the latency", elapsed)
+	}
+}
+
+func TestRequestFaults(t *testing.T) {
+	duct := NewDuct(hello, &Config{RequestTimeout: 100 * time.Millisecond})
+	defer duct.Close()
+	connect(t, duct)
+
+	duct.Faults.SetResetRate(1)
+	if status, code, _ := get(t, duct, "/"); status != http.StatusBadGateway || code != "TUNNEL_ERROR" {
+		t.Errorf("reset request: got %d %s, want 502 TUNNEL_ERROR", status, code)
+	}
+	duct.Faults.Clear()
+	duct.Faults.SetDropRate(1)
+	if status, code, _ := get(t, duct, "/"); status != http.StatusGatewayTimeout || code != "TUNNEL_TIMEOUT" {
+		t.Errorf("dropped request: got %d %s, want 504 TUNNEL_TIMEOUT", status, code)
+	}
+	duct.Faults.Clear()
+	if status, _, _ := get(t, duct, "/"); status != http.StatusOK {
+		t.Errorf("after clearing the faults: status = %d, want 200", status)
+	}
+}
+
+func TestResetTunnel(t *testing.T) {
+	duct := NewDuct(hello, nil)
+	defer duct.Close()
+	connect(t, duct)
+
+	duct.Faults.ResetTunnel()
+	deadline := time.Now().Add(5 * time.Second)
+	for duct.Connections() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("offramp did not reconnect after the tunnel was reset")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	connect(t, duct)
+	if status, _, _ := get(t, duct, "/"); status != http.StatusOK {
+		t.Errorf("after reconnecting: status = %d, want 200", status)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	duct := NewDuct(hello, &Config{
+		RequestTimeout:    5 * time.Second,
+		HeartbeatInterval: 20 * time.Millisecond,
+		HeartbeatTimeout:  100 * time.Millisecond,
+	})
+	defer duct.Close()
+	connect(t, duct)
+
+	duct.Faults.Partition()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, code, _ := get(t, duct, "/")
+		if status == http.StatusBadGateway && code == "TUNNEL_DOWN" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d %s during the partition, want 502 TUNNEL_DOWN once the heartbeat gave up", status, code)
+		}
+	}
+
+	duct.Faults.Heal()
+	connect(t, duct)
+	if status, _, _ := get(t, duct, "/"); status != http.StatusOK {
+		t.Errorf("after healing: status = %d, want 200", status)
+	}
+}
@@ -0,0 +1,164 @@
+package apiducttest
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Faults are the network faults of a Duct's tunnel, which a test changes at
+// any time. They start out cleared, with the tunnel working as it should.
+type Faults struct {
+	mu          sync.Mutex
+	rand        *rand.Rand
+	latency     time.Duration
+	dropRate    float64
+	resetRate   float64
+	partitioned chan struct{} // closed when the partition heals, nil without one
+	conn        net.Conn      // the offramp's end of the current tunnel
+}
+
+func newFaults(seed int64) *Faults {
+	return &Faults{rand: rand.New(rand.NewSource(seed))}
+}
+
+// SetLatency delays every read from and write to the offramp's end of the
+// tunnel by d, so a request and its response each take at least d longer.
+func (f *Faults) SetLatency(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latency = d
+}
+
+// SetDropRate has the offramp swallow the fraction p of the requests: it reads
+// them and never answers, so the bridge runs into its request timeout.
+func (f *Faults) SetDropRate(p float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dropRate = p
+}
+
+// SetResetRate has the offramp reset the stream of the fraction p of the
+// requests instead of forwarding them, as when the target connection fails.
+func (f *Faults) SetResetRate(p float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.resetRate = p
+}
+
+// Partition stops the tunnel from carrying bytes in either direction until
+// Heal, like a network path that died without closing the connection. Bytes
+// sent meanwhile are held back, not lost. With a heartbeat configured, the
+// offramp gives up on the tunnel and tries to reconnect, which only succeeds
+// once the partition heals.
+func (f *Faults) Partition() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.partitioned == nil {
+		f.partitioned = make(chan struct{})
+	}
+}
+
+// Heal ends a partition.
+func (f *Faults) Heal() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.partitioned != nil {
+		close(f.partitioned)
+		f.partitioned = nil
+	}
+}
+
+// ResetTunnel closes the tunnel connection at once, cutting off the requests
+// on it. The offramp reconnects.
+func (f *Faults) ResetTunnel() {
+	f.mu.Lock()
+	conn := f.conn
+	f.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Clear removes every fault.
+func (f *Faults) Clear() {
+	f.Heal()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latency, f.dropRate, f.resetRate = 0, 0, 0
+}
+
+// Request faults the offramp applies
+const (
+	faultNone = iota
+	faultDrop
+	faultReset
+)
+
+// requestFault picks the fault of the next request.
+func (f *Faults) requestFault() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch n := f.rand.Float64(); {
+	case n < f.dropRate:
+		return faultDrop
+	case n < f.dropRate+f.resetRate:
+		return faultReset
+	}
+	return faultNone
+}
+
+// delay waits out the latency and any partition, returning false if done
+// closes first.
+func (f *Faults) delay(done <-chan struct{}) bool {
+	f.mu.Lock()
+	latency, partitioned := f.latency, f.partitioned
+	f.mu.Unlock()
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-done:
+			return false
+		}
+	}
+	if partitioned != nil {
+		select {
+		case <-partitioned:
+		case <-done:
+			return false
+		}
+	}
+	return true
+}
+
+// faultConn is the offramp's end of the tunnel, passing the bytes through
+// the faults.
+type faultConn struct {
+	net.Conn
+	faults *Faults
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (c *faultConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && !c.faults.delay(c.done) {
+		return 0, net.ErrClosed
+	}
+	return n, err
+}
+
+func (c *faultConn) Write(p []byte) (int, error) {
+	if !c.faults.delay(c.done) {
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *faultConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
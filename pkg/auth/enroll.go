@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// SaltSize is the length of the salt an enrollment key is derived with.
+const SaltSize = 32
+
+// An offramp enrolls by sending a KindEnroll hello proven with a one-time
+// bootstrap token. Once the bridge ended the handshake with StatusOK, it
+// sends the identity it enrolled the offramp under (1 length byte and the
+// name) and a random salt. Both sides then derive the offramp's long-term key
+// from the token and the salt, so the key never crosses the wire and an
+// eavesdropper without the token cannot learn it.
+
+// NewSalt returns a random salt for an enrolling offramp's key.
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to create salt: %v", err)
+	}
+	return salt, nil
+}
+
+// WriteEnrollment sends the identity and salt to an enrolling offramp.
+func WriteEnrollment(w io.Writer, identity string, salt []byte) error {
+	_, err := w.Write(append(AppendName(nil, identity), salt...))
+	return err
+}
+
+// ReadEnrollment reads the identity and salt the bridge sends an enrolling
+// offramp and returns the identity and the key derived from token.
+func ReadEnrollment(r io.Reader, token string) (string, string, error) {
+	identity, err := ReadName(r)
+	if err != nil {
+		return "", "", err
+	}
+	salt := make([]byte, SaltSize)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return "", "", err
+	}
+	return identity, DeriveKey(token, salt), nil
+}
+
+// DeriveKey derives an enrolled offramp's key from its bootstrap token and
+// the salt the bridge chose, as hex.
+func DeriveKey(token string, salt []byte) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte("apiduct enrollment"))
+	mac.Write(salt)
+	return hex.EncodeToString(mac.Sum(nil))
+}
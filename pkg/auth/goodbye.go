@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// An offramp leaving announces it on a connection of KindGoodbye, naming its
+// tunnel by the tunnel's local port (2 bytes). The bridge answers with one of
+// the goodbye results once the tunnel is drained.
+const (
+	GoodbyeDrained = 0
+	GoodbyeUnknown = 1 // no tunnel from the offramp's host matches the port
+)
+
+// WriteGoodbye announces the disconnect of the tunnel with the local port.
+func WriteGoodbye(w io.Writer, port int) error {
+	announcement := make([]byte, 2)
+	binary.BigEndian.PutUint16(announcement, uint16(port))
+	_, err := w.Write(announcement)
+	return err
+}
+
+// ReadGoodbye reads the port of the tunnel an offramp announces the
+// disconnect of.
+func ReadGoodbye(r io.Reader) (int, error) {
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(port)), nil
+}
@@ -0,0 +1,235 @@
+// Package auth implements the handshake that opens every connection to the
+// bridge's tunnel port: the offramp proves it knows the pre-shared key without
+// sending it, and both sides exchange their clocks.
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// The offramp opens the handshake with Magic and the highest version it
+// speaks. The bridge answers with the version to use, 0 if it supports none,
+// and a random nonce. The offramp then proves it knows the PSK with
+// HMAC-SHA256(PSK, offered version | version | nonce | clock | kind |
+// client ID | announcement), followed by its clock (8 bytes), the connection
+// kind (1 byte), its client ID (1 length byte and the ID, empty if it has
+// none) and the announcement its kind carries, if any. Version 3 leaves both
+// versions out of the proof and has no announcement, so named and grouped
+// tunnels need version 4, and version 2 also has no client ID. Offramps
+// before version 2 sent a static sha256(PSK) instead and are rejected. The
+// bridge ends the handshake with a status (1 byte) and its own clock (8
+// bytes).
+const (
+	Magic      = "APDT"
+	Version    = 4
+	MinVersion = 2
+	Timeout    = 15 * time.Second
+	NonceSize  = 32
+)
+
+// clientIDVersion is the first handshake version carrying a client ID,
+// announceVersion the first carrying an announcement, whose proof covers it
+// and both versions.
+const (
+	clientIDVersion = 3
+	announceVersion = 4
+)
+
+// Connection kinds announced in the last byte of the hello. A named tunnel
+// announces the offramp's name, see AppendName; a forward client follows the
+// handshake with a CONNECT request. A grouped tunnel is one of several from
+// an offramp keeping standby tunnels, see AppendGroup. An enrolling offramp
+// proves a bootstrap token instead of the PSK, see ReadEnrollment.
+const (
+	KindTunnel        = 0
+	KindGoodbye       = 1
+	KindNamedTunnel   = 2
+	KindForward       = 3
+	KindGroupedTunnel = 4
+	KindEnroll        = 5
+)
+
+// Statuses the bridge ends the handshake with
+const (
+	StatusOK         = 0
+	StatusFailed     = 1
+	StatusClockSkew  = 2
+	StatusDraining   = 3
+	StatusNoRoute    = 4
+	StatusBadVersion = 5
+	StatusForbidden  = 6 // the offramp's identity may not serve its routes
+)
+
+// ErrOldHandshake rejects offramps that still send the version 1 hello.
+var ErrOldHandshake = errors.New("offramp uses handshake version 1, upgrade it")
+
+// Hello is what the offramp sent in the handshake.
+type Hello struct {
+	Clock    time.Time
+	Kind     byte
+	ClientID string // as the offramp presented it, covered by its proof
+	Name     string // announced by a named or grouped tunnel
+	Group    uint64 // announced by a grouped tunnel
+	Valid    bool   // the offramp proved it knows the PSK
+
+	challenge, proof, signed []byte
+}
+
+// Verify reports whether the offramp proved it knows key, for offramps that
+// authenticate with a key other than the PSK.
+func (h *Hello) Verify(key string) bool {
+	return key != "" && hmac.Equal(h.proof, helloMAC(key, h.challenge, h.signed))
+}
+
+// ReadHello runs the bridge side of the handshake up to the offramp's proof
+// and the announcement of its kind.
+func ReadHello(conn io.ReadWriter, psk string) (*Hello, error) {
+	opening := make([]byte, len(Magic)+1)
+	if _, err := io.ReadFull(conn, opening); err != nil {
+		return nil, err
+	}
+	if string(opening[:len(Magic)]) != Magic {
+		return nil, ErrOldHandshake
+	}
+	offered := opening[len(Magic)]
+	version := min(offered, Version)
+	if version < MinVersion {
+		conn.Write([]byte{0})
+		return nil, fmt.Errorf("offramp speaks handshake version %d, %d is required", version, MinVersion)
+	}
+
+	challenge := make([]byte, 1+NonceSize)
+	challenge[0] = version
+	if _, err := rand.Read(challenge[1:]); err != nil {
+		return nil, fmt.Errorf("failed to create nonce: %v", err)
+	}
+	if _, err := conn.Write(challenge); err != nil {
+		return nil, err
+	}
+
+	proof := make([]byte, sha256.Size+9)
+	if _, err := io.ReadFull(conn, proof); err != nil {
+		return nil, err
+	}
+	signed := proof[sha256.Size:]
+	hello := &Hello{
+		Clock:     time.Unix(0, int64(binary.BigEndian.Uint64(signed[:8]))),
+		Kind:      signed[8],
+		challenge: provenChallenge(offered, challenge),
+		proof:     proof[:sha256.Size],
+	}
+	if version >= clientIDVersion {
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		id := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, id); err != nil {
+			return nil, err
+		}
+		if len(id) > 0 {
+			if err := ValidateName(string(id)); err != nil {
+				return nil, fmt.Errorf("invalid client ID: %v", err)
+			}
+		}
+		hello.ClientID = string(id)
+		signed = append(append(signed, length...), id...)
+	}
+	// An announcement the proof does not cover could be changed on the way
+	if (hello.Kind == KindNamedTunnel || hello.Kind == KindGroupedTunnel) && version < announceVersion {
+		return nil, fmt.Errorf("offramp speaks handshake version %d, announcing a name requires %d", version, announceVersion)
+	}
+	var announcement bytes.Buffer
+	announced := io.TeeReader(conn, &announcement)
+	var err error
+	switch hello.Kind {
+	case KindNamedTunnel:
+		hello.Name, err = ReadName(announced)
+	case KindGroupedTunnel:
+		hello.Group, hello.Name, err = ReadGroup(announced)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid announcement: %v", err)
+	}
+	hello.signed = append(signed, announcement.Bytes()...)
+	hello.Valid = hello.Verify(psk)
+	return hello, nil
+}
+
+// SendHello runs the offramp side of the handshake up to its proof,
+// returning the proof with the clock, kind, client ID and announcement it
+// carries, for the caller to send. announcement is what kind carries, from
+// AppendName or AppendGroup, and nil for the other kinds. Older bridges are
+// answered with a proof of their version, unless there is a client ID or an
+// announcement their version cannot carry.
+func SendHello(conn io.ReadWriter, psk string, kind byte, clientID string, announcement []byte) ([]byte, error) {
+	if _, err := io.WriteString(conn, Magic+string(rune(Version))); err != nil {
+		return nil, fmt.Errorf("failed to start handshake: %v", err)
+	}
+	challenge := make([]byte, 1+NonceSize)
+	if _, err := io.ReadFull(conn, challenge); err != nil {
+		return nil, fmt.Errorf("bridge did not answer the handshake, it may be older than handshake version %d: %v", Version, err)
+	}
+	version := challenge[0]
+	if version < MinVersion || version > Version {
+		return nil, fmt.Errorf("bridge does not support handshake version %d", Version)
+	}
+	if version < clientIDVersion && clientID != "" {
+		return nil, fmt.Errorf("bridge speaks handshake version %d, which has no client ID, upgrade it", version)
+	}
+	if version < announceVersion && len(announcement) > 0 {
+		return nil, fmt.Errorf("bridge speaks handshake version %d, which does not sign the offramp's name, upgrade it", version)
+	}
+
+	signed := make([]byte, 9)
+	binary.BigEndian.PutUint64(signed, uint64(time.Now().UnixNano()))
+	signed[8] = kind
+	if version >= clientIDVersion {
+		signed = append(append(signed, byte(len(clientID))), clientID...)
+	}
+	signed = append(signed, announcement...)
+	return append(helloMAC(psk, provenChallenge(Version, challenge), signed), signed...), nil
+}
+
+// provenChallenge returns what the offramp's proof covers of the handshake
+// before its hello: the nonce, preceded by the version the offramp offered
+// and the version the bridge chose from version 4, so a peer in between
+// cannot lower them unnoticed.
+func provenChallenge(offered byte, challenge []byte) []byte {
+	if challenge[0] < announceVersion {
+		return challenge[1:]
+	}
+	return append([]byte{offered}, challenge...)
+}
+
+// WriteStatus ends the bridge side of the handshake with status, followed
+// by the bridge's clock for the offramp to check its own against.
+func WriteStatus(w io.Writer, status byte) error {
+	reply := make([]byte, 9)
+	reply[0] = status
+	binary.BigEndian.PutUint64(reply[1:], uint64(time.Now().UnixNano()))
+	_, err := w.Write(reply)
+	return err
+}
+
+// HelloClock returns the clock carried by a hello from SendHello.
+func HelloClock(hello []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(hello[sha256.Size:])))
+}
+
+// helloMAC computes the offramp's proof for the challenge, from
+// provenChallenge, and the clock, kind, client ID and announcement it signs.
+func helloMAC(psk string, challenge, signed []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(psk))
+	mac.Write(challenge)
+	mac.Write(signed)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,419 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// handshake runs both sides of the handshake over an in-memory connection
+// and returns what the bridge read.
+func handshake(t *testing.T, bridgePSK, offrampPSK string, kind byte, name string) *Hello {
+	t.Helper()
+	bridge, offramp := net.Pipe()
+	defer bridge.Close()
+	defer offramp.Close()
+
+	sent := make(chan error, 1)
+	go func() {
+		var announcement []byte
+		if kind == KindNamedTunnel {
+			announcement = AppendName(nil, name)
+		}
+		hello, err := SendHello(offramp, offrampPSK, kind, "", announcement)
+		if err == nil {
+			_, err = offramp.Write(hello)
+		}
+		sent <- err
+	}()
+
+	hello, err := ReadHello(bridge, bridgePSK)
+	if err != nil {
+		t.Fatalf("ReadHello: %v", err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("SendHello: %v", err)
+	}
+	return hello
+}
+
+func TestHandshake(t *testing.T) {
+	before := time.Now()
+	hello := handshake(t, "secret", "secret", KindTunnel, "")
+	if !hello.Valid {
+		t.Error("hello with the right PSK is not valid")
+	}
+	if hello.Kind != KindTunnel {
+		t.Errorf("Kind = %d, want %d", hello.Kind, KindTunnel)
+	}
+	if hello.Clock.Before(before) || hello.Clock.After(time.Now()) {
+		t.Errorf("Clock = %s, want the time of the handshake", hello.Clock)
+	}
+}
+
+func TestHandshakeWrongPSK(t *testing.T) {
+	hello := handshake(t, "secret", "guess", KindTunnel, "")
+	if hello.Valid {
+		t.Error("hello with the wrong PSK is valid")
+	}
+}
+
+func TestHandshakeNamedTunnel(t *testing.T) {
+	hello := handshake(t, "secret", "secret", KindNamedTunnel, "eu-west.1")
+	if !hello.Valid || hello.Kind != KindNamedTunnel {
+		t.Fatalf("hello = %+v, want a valid named tunnel", hello)
+	}
+	if hello.Name != "eu-west.1" {
+		t.Errorf("Name = %q, want %q", hello.Name, "eu-west.1")
+	}
+}
+
+// TestHandshakeAnnouncementSigned checks a grouped tunnel's group and name
+// are covered by the proof, so they cannot be changed on the way.
+func TestHandshakeAnnouncementSigned(t *testing.T) {
+	bridge, offramp := net.Pipe()
+	defer bridge.Close()
+	defer offramp.Close()
+	go func() {
+		hello, err := SendHello(offramp, "secret", KindGroupedTunnel, "", AppendGroup(nil, 7, "edge-1"))
+		if err != nil {
+			return
+		}
+		hello[len(hello)-1] = '2'
+		offramp.Write(hello)
+	}()
+	hello, err := ReadHello(bridge, "secret")
+	if err != nil {
+		t.Fatalf("ReadHello: %v", err)
+	}
+	if hello.Group != 7 || hello.Name != "edge-2" {
+		t.Errorf("announced group %d and name %q, want 7 and edge-2", hello.Group, hello.Name)
+	}
+	if hello.Valid {
+		t.Error("hello with a changed name is valid")
+	}
+}
+
+func TestHandshakeClientID(t *testing.T) {
+	bridge, offramp := net.Pipe()
+	defer bridge.Close()
+	defer offramp.Close()
+	go func() {
+		hello, err := SendHello(offramp, "secret", KindTunnel, "billing-1", nil)
+		if err == nil {
+			offramp.Write(hello)
+		}
+	}()
+
+	hello, err := ReadHello(bridge, "secret")
+	if err != nil {
+		t.Fatalf("ReadHello: %v", err)
+	}
+	if !hello.Valid || hello.ClientID != "billing-1" {
+		t.Errorf("hello = %+v, want a valid hello from billing-1", hello)
+	}
+}
+
+// TestHandshakeVersion2 checks both sides still speak version 2 with a peer
+// that has not been upgraded.
+func TestHandshakeVersion2(t *testing.T) {
+	t.Run("bridge", func(t *testing.T) {
+		bridge, offramp := net.Pipe()
+		defer bridge.Close()
+		defer offramp.Close()
+		go func() {
+			io.ReadFull(bridge, make([]byte, len(Magic)+1))
+			bridge.Write(append([]byte{2}, make([]byte, NonceSize)...))
+		}()
+		hello, err := SendHello(offramp, "secret", KindTunnel, "", nil)
+		if err != nil {
+			t.Fatalf("SendHello: %v", err)
+		}
+		if len(hello) != 32+9 {
+			t.Errorf("sent %d bytes to a version 2 bridge, want %d", len(hello), 32+9)
+		}
+	})
+	t.Run("bridge with client ID", func(t *testing.T) {
+		bridge, offramp := net.Pipe()
+		defer bridge.Close()
+		defer offramp.Close()
+		go func() {
+			io.ReadFull(bridge, make([]byte, len(Magic)+1))
+			bridge.Write(append([]byte{2}, make([]byte, NonceSize)...))
+		}()
+		if _, err := SendHello(offramp, "secret", KindTunnel, "billing-1", nil); err == nil {
+			t.Error("SendHello presented a client ID to a version 2 bridge")
+		}
+	})
+	t.Run("offramp", func(t *testing.T) {
+		bridge, offramp := net.Pipe()
+		defer bridge.Close()
+		defer offramp.Close()
+		go func() {
+			offramp.Write([]byte(Magic + "\x02"))
+			challenge := make([]byte, 1+NonceSize)
+			io.ReadFull(offramp, challenge)
+			signed := make([]byte, 9)
+			offramp.Write(append(helloMAC("secret", challenge[1:], signed), signed...))
+		}()
+		hello, err := ReadHello(bridge, "secret")
+		if err != nil {
+			t.Fatalf("ReadHello: %v", err)
+		}
+		if !hello.Valid || hello.ClientID != "" {
+			t.Errorf("hello = %+v, want a valid hello without client ID", hello)
+		}
+	})
+}
+
+// TestHandshakeVersion3 checks both sides still speak version 3 with a peer
+// that has not been upgraded, but refuse to announce a name it leaves out of
+// the proof.
+func TestHandshakeVersion3(t *testing.T) {
+	t.Run("bridge", func(t *testing.T) {
+		bridge, offramp := net.Pipe()
+		defer bridge.Close()
+		defer offramp.Close()
+		nonce := make([]byte, NonceSize)
+		go func() {
+			io.ReadFull(bridge, make([]byte, len(Magic)+1))
+			bridge.Write(append([]byte{3}, nonce...))
+		}()
+		hello, err := SendHello(offramp, "secret", KindTunnel, "billing-1", nil)
+		if err != nil {
+			t.Fatalf("SendHello: %v", err)
+		}
+		if signed := hello[32:]; !bytes.Equal(hello[:32], helloMAC("secret", nonce, signed)) {
+			t.Errorf("sent %q to a version 3 bridge, want a proof of the nonce alone", hello)
+		}
+	})
+	t.Run("bridge with name", func(t *testing.T) {
+		bridge, offramp := net.Pipe()
+		defer bridge.Close()
+		defer offramp.Close()
+		go func() {
+			io.ReadFull(bridge, make([]byte, len(Magic)+1))
+			bridge.Write(append([]byte{3}, make([]byte, NonceSize)...))
+		}()
+		if _, err := SendHello(offramp, "secret", KindNamedTunnel, "", AppendName(nil, "edge-1")); err == nil {
+			t.Error("SendHello announced a name to a version 3 bridge")
+		}
+	})
+	t.Run("offramp with name", func(t *testing.T) {
+		bridge, offramp := net.Pipe()
+		defer bridge.Close()
+		defer offramp.Close()
+		go func() {
+			offramp.Write([]byte(Magic + "\x03"))
+			challenge := make([]byte, 1+NonceSize)
+			io.ReadFull(offramp, challenge)
+			signed := []byte{0, 0, 0, 0, 0, 0, 0, 0, KindNamedTunnel, 0}
+			hello := append(helloMAC("secret", challenge[1:], signed), signed...)
+			offramp.Write(append(hello, AppendName(nil, "edge-1")...))
+		}()
+		if _, err := ReadHello(bridge, "secret"); err == nil {
+			t.Error("ReadHello accepted a name a version 3 proof leaves out")
+		}
+	})
+}
+
+// TestHandshakeVersionsSigned checks a version 4 proof covers the offered
+// and chosen versions, so they cannot be lowered on the way.
+func TestHandshakeVersionsSigned(t *testing.T) {
+	for _, offered := range []byte{Version, Version + 1} {
+		bridge, offramp := net.Pipe()
+		go func() {
+			offramp.Write([]byte{'A', 'P', 'D', 'T', offered})
+			challenge := make([]byte, 1+NonceSize)
+			io.ReadFull(offramp, challenge)
+			signed := append([]byte{0, 0, 0, 0, 0, 0, 0, 0, KindNamedTunnel, 0}, AppendName(nil, "edge-1")...)
+			// A proof made after the offered version was lowered to 4
+			offramp.Write(append(helloMAC("secret", provenChallenge(Version, challenge), signed), signed...))
+		}()
+		hello, err := ReadHello(bridge, "secret")
+		if err != nil {
+			t.Fatalf("ReadHello: %v", err)
+		}
+		if want := offered == Version; hello.Valid != want {
+			t.Errorf("offered version %d: Valid = %v, want %v", offered, hello.Valid, want)
+		}
+		bridge.Close()
+		offramp.Close()
+	}
+}
+
+func TestReadHelloOldHandshake(t *testing.T) {
+	// Version 1 offramps open with sha256(PSK)
+	conn := &fakeConn{Reader: bytes.NewReader(bytes.Repeat([]byte{0xab}, 32))}
+	if _, err := ReadHello(conn, "secret"); !errors.Is(err, ErrOldHandshake) {
+		t.Errorf("ReadHello = %v, want %v", err, ErrOldHandshake)
+	}
+}
+
+func TestReadHelloOldVersion(t *testing.T) {
+	conn := &fakeConn{Reader: strings.NewReader(Magic + "\x01")}
+	if _, err := ReadHello(conn, "secret"); err == nil {
+		t.Fatal("ReadHello accepted version 1")
+	}
+	if got := conn.written.Bytes(); !bytes.Equal(got, []byte{0}) {
+		t.Errorf("bridge answered %v, want version 0", got)
+	}
+}
+
+func TestHelloClock(t *testing.T) {
+	bridge, offramp := net.Pipe()
+	defer bridge.Close()
+	defer offramp.Close()
+	go func() {
+		io.ReadFull(bridge, make([]byte, len(Magic)+1))
+		bridge.Write(append([]byte{Version}, make([]byte, NonceSize)...))
+	}()
+
+	before := time.Now()
+	hello, err := SendHello(offramp, "secret", KindGoodbye, "", nil)
+	if err != nil {
+		t.Fatalf("SendHello: %v", err)
+	}
+	if clock := HelloClock(hello); clock.Before(before) || clock.After(time.Now()) {
+		t.Errorf("HelloClock = %s, want the time of SendHello", clock)
+	}
+}
+
+func TestWriteStatus(t *testing.T) {
+	var buf bytes.Buffer
+	before := time.Now()
+	if err := WriteStatus(&buf, StatusDraining); err != nil {
+		t.Fatal(err)
+	}
+	reply := buf.Bytes()
+	if len(reply) != 9 || reply[0] != StatusDraining {
+		t.Fatalf("reply %v, want the status and 8 bytes of clock", reply)
+	}
+	clock := time.Unix(0, int64(binary.BigEndian.Uint64(reply[1:])))
+	if clock.Before(before) || clock.After(time.Now()) {
+		t.Errorf("clock %s, want the time of WriteStatus", clock)
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"offramp", true},
+		{"eu-west_2.prod", true},
+		{"0", true},
+		{strings.Repeat("a", 64), true},
+		{strings.Repeat("a", 65), false},
+		{"", false},
+		{"-leading", false},
+		{".hidden", false},
+		{"with space", false},
+		{"a/b", false},
+	}
+	for _, tt := range tests {
+		if err := ValidateName(tt.name); (err == nil) != tt.valid {
+			t.Errorf("ValidateName(%q) = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestReadNameInvalid(t *testing.T) {
+	if _, err := ReadName(bytes.NewReader(AppendName(nil, "not valid"))); err == nil {
+		t.Error("ReadName accepted an invalid name")
+	}
+	if _, err := ReadName(bytes.NewReader([]byte{10, 'a'})); err == nil {
+		t.Error("ReadName accepted a truncated name")
+	}
+}
+
+func TestReadGroup(t *testing.T) {
+	tests := []struct {
+		group uint64
+		name  string
+	}{
+		{0x0123456789abcdef, "eu-west"},
+		{42, ""},
+	}
+	for _, tt := range tests {
+		group, name, err := ReadGroup(bytes.NewReader(AppendGroup(nil, tt.group, tt.name)))
+		if err != nil {
+			t.Fatalf("ReadGroup(%x, %q): %v", tt.group, tt.name, err)
+		}
+		if group != tt.group || name != tt.name {
+			t.Errorf("ReadGroup = %x, %q, want %x, %q", group, name, tt.group, tt.name)
+		}
+	}
+	if _, _, err := ReadGroup(bytes.NewReader(AppendGroup(nil, 1, "not valid"))); err == nil {
+		t.Error("ReadGroup accepted an invalid name")
+	}
+}
+
+func TestEnrollment(t *testing.T) {
+	hello := handshake(t, "secret", "bootstrap-token", KindEnroll, "")
+	if hello.Valid {
+		t.Error("hello proven with a bootstrap token is valid for the PSK")
+	}
+	if !hello.Verify("bootstrap-token") || hello.Verify("other-token") {
+		t.Error("Verify does not tell the bootstrap token from others")
+	}
+
+	salt, err := NewSalt()
+	if err != nil {
+		t.Fatalf("NewSalt: %v", err)
+	}
+	bridgeKey := DeriveKey("bootstrap-token", salt)
+	var message bytes.Buffer
+	if err := WriteEnrollment(&message, "edge-1", salt); err != nil {
+		t.Fatalf("WriteEnrollment: %v", err)
+	}
+	identity, offrampKey, err := ReadEnrollment(&message, "bootstrap-token")
+	if err != nil {
+		t.Fatalf("ReadEnrollment: %v", err)
+	}
+	if identity != "edge-1" || offrampKey != bridgeKey {
+		t.Errorf("ReadEnrollment = %q, %q, want %q and the bridge's key %q", identity, offrampKey, "edge-1", bridgeKey)
+	}
+}
+
+// fakeConn reads from Reader and records what is written to it.
+type fakeConn struct {
+	io.Reader
+	written bytes.Buffer
+}
+
+func (c *fakeConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+// fuzzConn reads the fuzzer's input and discards what is written to it.
+type fuzzConn struct {
+	io.Reader
+}
+
+func (fuzzConn) Write(p []byte) (int, error) { return len(p), nil }
+
+// FuzzReadHello feeds arbitrary bytes to the bridge side of the handshake,
+// as a client on the tunnel port could.
+func FuzzReadHello(f *testing.F) {
+	f.Add([]byte(Magic + "\x02" + strings.Repeat("p", 32) + "\x00\x00\x00\x00\x00\x00\x00\x00\x00"))
+	f.Add([]byte(Magic + "\x03" + strings.Repeat("p", 32) + "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x03id1"))
+	f.Add([]byte(Magic + "\x04" + strings.Repeat("p", 32) + "\x00\x00\x00\x00\x00\x00\x00\x00\x04\x00\x00\x00\x00\x00\x00\x00\x00\x07\x05edge1"))
+	f.Add([]byte(Magic + "\x01"))
+	f.Add([]byte("GET / HTTP/1.1\r\n\r\n"))
+	f.Fuzz(func(t *testing.T, input []byte) {
+		conn := fuzzConn{bytes.NewReader(input)}
+		hello, err := ReadHello(conn, "secret")
+		if err != nil {
+			return
+		}
+		if hello.Valid {
+			t.Fatal("a hello not made with the PSK was accepted")
+		}
+	})
+}
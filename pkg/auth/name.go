@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// Offramp names are announced in the handshake and used in routes
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// ValidateName checks an offramp name: up to 64 letters, digits, '.', '_'
+// or '-', starting with a letter or digit.
+func ValidateName(name string) error {
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("invalid offramp name %q, use up to 64 letters, digits, '.', '_' or '-'", name)
+	}
+	return nil
+}
+
+// AppendName appends the name of a named offramp to its announcement: one
+// length byte followed by the name.
+func AppendName(hello []byte, name string) []byte {
+	hello = append(hello, byte(len(name)))
+	return append(hello, name...)
+}
+
+// ReadName reads the name a named offramp announces.
+func ReadName(r io.Reader) (string, error) {
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return "", err
+	}
+	name := make([]byte, length[0])
+	if _, err := io.ReadFull(r, name); err != nil {
+		return "", err
+	}
+	if err := ValidateName(string(name)); err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
+
+// AppendGroup appends the standby group of a grouped tunnel to its
+// announcement: the group ID (8 bytes), the length of the offramp's name (1
+// byte, 0 if it has none) and the name. The bridge serves requests on one
+// tunnel of a group and holds the others in reserve.
+func AppendGroup(hello []byte, group uint64, name string) []byte {
+	hello = binary.BigEndian.AppendUint64(hello, group)
+	return AppendName(hello, name)
+}
+
+// ReadGroup reads the group ID and offramp name a grouped tunnel announces.
+func ReadGroup(r io.Reader) (uint64, string, error) {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, "", err
+	}
+	group := binary.BigEndian.Uint64(header)
+	name := make([]byte, header[8])
+	if _, err := io.ReadFull(r, name); err != nil {
+		return 0, "", err
+	}
+	if len(name) > 0 {
+		if err := ValidateName(string(name)); err != nil {
+			return 0, "", err
+		}
+	}
+	return group, string(name), nil
+}
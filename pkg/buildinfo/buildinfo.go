@@ -0,0 +1,96 @@
+// Package buildinfo describes an apiduct binary: the optional features
+// compiled into it and enabled, and the modules it was built from.
+package buildinfo
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+)
+
+// Feature is a subsystem of a binary. Those with a build tag can be left out
+// of the binary by building with it, for a smaller binary.
+type Feature struct {
+	Name     string `json:"name"`
+	BuildTag string `json:"build_tag,omitempty"`
+	Compiled bool   `json:"compiled"`
+	Enabled  bool   `json:"enabled"`
+}
+
+// Check refuses features that are enabled but were left out of the build.
+// binary names the binary in the error, e.g. "bridge".
+func Check(features []Feature, binary string) error {
+	for _, feature := range features {
+		if feature.Enabled && !feature.Compiled {
+			return fmt.Errorf("%s is not available, the %s was built with the %s tag", feature.Name, binary, feature.BuildTag)
+		}
+	}
+	return nil
+}
+
+// Enabled names the enabled features.
+func Enabled(features []Feature) []string {
+	var names []string
+	for _, feature := range features {
+		if feature.Enabled {
+			names = append(names, feature.Name)
+		}
+	}
+	return names
+}
+
+// Compiled names the features with a build tag that are in the binary.
+func Compiled(features []Feature) []string {
+	var names []string
+	for _, feature := range features {
+		if feature.BuildTag != "" && feature.Compiled {
+			names = append(names, feature.Name)
+		}
+	}
+	return names
+}
+
+// Module is a dependency compiled into the binary.
+type Module struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	Sum     string `json:"sum,omitempty"`
+}
+
+// Report describes the binary: its version, the features compiled in and
+// enabled, and the modules it was built from.
+type Report struct {
+	Version   string    `json:"version"`
+	BuildTime string    `json:"build_time"`
+	GoVersion string    `json:"go_version"`
+	BuildTags []string  `json:"build_tags,omitempty"`
+	Features  []Feature `json:"features"`
+	Modules   []Module  `json:"modules"`
+}
+
+// NewReport returns the report of the running binary.
+func NewReport(version, buildTime string, features []Feature) Report {
+	report := Report{
+		Version:   version,
+		BuildTime: buildTime,
+		Features:  features,
+		Modules:   []Module{},
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return report
+	}
+	report.GoVersion = info.GoVersion
+	for _, setting := range info.Settings {
+		if setting.Key == "-tags" && setting.Value != "" {
+			report.BuildTags = strings.Split(setting.Value, ",")
+		}
+	}
+	for _, dep := range info.Deps {
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		report.Modules = append(report.Modules, Module{Path: dep.Path, Version: dep.Version, Sum: dep.Sum})
+	}
+	return report
+}
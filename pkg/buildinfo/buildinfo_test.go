@@ -0,0 +1,43 @@
+package buildinfo
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testFeatures = []Feature{
+	{Name: "acme", BuildTag: "noacme", Compiled: true, Enabled: true},
+	{Name: "h2c", BuildTag: "noh2c", Compiled: false},
+	{Name: "access_log", Compiled: true},
+}
+
+func TestFeatures(t *testing.T) {
+	if got := Enabled(testFeatures); !reflect.DeepEqual(got, []string{"acme"}) {
+		t.Errorf("Enabled = %v, want [acme]", got)
+	}
+	if got := Compiled(testFeatures); !reflect.DeepEqual(got, []string{"acme"}) {
+		t.Errorf("Compiled = %v, want [acme]", got)
+	}
+	if err := Check(testFeatures, "bridge"); err != nil {
+		t.Errorf("Check = %v, want nil", err)
+	}
+
+	missing := append([]Feature{{Name: "h2c", BuildTag: "noh2c", Enabled: true}}, testFeatures...)
+	want := "h2c is not available, the bridge was built with the noh2c tag"
+	if err := Check(missing, "bridge"); err == nil || err.Error() != want {
+		t.Errorf("Check = %v, want %q", err, want)
+	}
+}
+
+func TestNewReport(t *testing.T) {
+	report := NewReport("v1.2.3", "2026-10-16T12:00:00Z", testFeatures)
+	if report.Version != "v1.2.3" || report.BuildTime != "2026-10-16T12:00:00Z" {
+		t.Errorf("report version %q built %q", report.Version, report.BuildTime)
+	}
+	if !reflect.DeepEqual(report.Features, testFeatures) {
+		t.Errorf("report features %v, want %v", report.Features, testFeatures)
+	}
+	if report.Modules == nil {
+		t.Error("report modules are nil, want an empty list for JSON")
+	}
+}
@@ -0,0 +1,44 @@
+package mux
+
+import (
+	"errors"
+	"time"
+
+	"apiduct/pkg/stats"
+)
+
+// ErrHeartbeatTimeout closes a tunnel whose other end stopped answering pings.
+var ErrHeartbeatTimeout = errors.New("tunnel heartbeat timed out")
+
+// Heartbeat pings the other end of the tunnel every interval until the session
+// closes, keeping the round trip time in the apiduct_tunnel_rtt_microseconds
+// gauge, labelled by labels. A ping left unanswered for timeout means the
+// connection is dead, e.g. a NAT mapping expired long before TCP keep-alive
+// would notice, and the session is closed with ErrHeartbeatTimeout.
+func Heartbeat(session *Session, interval, timeout time.Duration, labels ...string) {
+	if interval <= 0 {
+		return
+	}
+	gauge := stats.Default.Gauge("apiduct_tunnel_rtt_microseconds", labels...)
+	defer stats.Default.DeleteGauge("apiduct_tunnel_rtt_microseconds", labels...)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		rtt, err := session.Ping(timeout)
+		if err != nil {
+			select {
+			case <-session.CloseChan():
+			default:
+				stats.Default.Counter("apiduct_tunnel_heartbeat_timeouts_total").Inc()
+				session.closeWithError(ErrHeartbeatTimeout)
+			}
+			return
+		}
+		gauge.Set(rtt.Microseconds())
+		select {
+		case <-ticker.C:
+		case <-session.CloseChan():
+			return
+		}
+	}
+}
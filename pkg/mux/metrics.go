@@ -0,0 +1,94 @@
+package mux
+
+import (
+	"time"
+
+	"apiduct/pkg/stats"
+)
+
+// frameTypeNames label the frame types in the protocol metrics.
+var frameTypeNames = [...]string{
+	frameData:         "data",
+	frameWindowUpdate: "window_update",
+	framePing:         "ping",
+	frameGoAway:       "go_away",
+}
+
+// protocolMetrics are the tunnel protocol internals, kept across all sessions.
+// The counters are looked up once, as they change with every frame.
+type protocolMetrics struct {
+	framesSent, framesReceived [len(frameTypeNames)]*stats.Counter
+	wireSent, wireReceived     *stats.Counter // frame headers and payloads
+	dataSent, dataReceived     *stats.Counter // stream bytes in data frames
+
+	streamsOpen               *stats.Gauge
+	openedLocal, openedRemote *stats.Counter
+	resetLocal, resetRemote   *stats.Counter
+	refused                   *stats.Counter
+	stalls                    *stats.Counter
+	stallTime                 *stats.Counter
+	handshakeTime             *stats.Counter
+	checksumOK                *stats.Counter
+	checksumMismatch          *stats.Counter
+}
+
+var protocolStats = newProtocolMetrics()
+
+func newProtocolMetrics() *protocolMetrics {
+	m := &protocolMetrics{
+		wireSent:         stats.Default.Counter("apiduct_tunnel_wire_bytes_total", "direction", "sent"),
+		wireReceived:     stats.Default.Counter("apiduct_tunnel_wire_bytes_total", "direction", "received"),
+		dataSent:         stats.Default.Counter("apiduct_tunnel_stream_bytes_total", "direction", "sent"),
+		dataReceived:     stats.Default.Counter("apiduct_tunnel_stream_bytes_total", "direction", "received"),
+		streamsOpen:      stats.Default.Gauge("apiduct_tunnel_streams_open"),
+		openedLocal:      stats.Default.Counter("apiduct_tunnel_streams_opened_total", "initiator", "local"),
+		openedRemote:     stats.Default.Counter("apiduct_tunnel_streams_opened_total", "initiator", "remote"),
+		resetLocal:       stats.Default.Counter("apiduct_tunnel_streams_reset_total", "by", "local"),
+		resetRemote:      stats.Default.Counter("apiduct_tunnel_streams_reset_total", "by", "remote"),
+		refused:          stats.Default.Counter("apiduct_tunnel_streams_refused_total"),
+		stalls:           stats.Default.Counter("apiduct_tunnel_flow_control_stalls_total"),
+		stallTime:        stats.Default.Counter("apiduct_tunnel_flow_control_stall_microseconds_total"),
+		handshakeTime:    stats.Default.Counter("apiduct_tunnel_handshake_microseconds_total"),
+		checksumOK:       stats.Default.Counter("apiduct_tunnel_checksums_total", "result", "ok"),
+		checksumMismatch: stats.Default.Counter("apiduct_tunnel_checksums_total", "result", "mismatch"),
+	}
+	for typ, name := range frameTypeNames {
+		m.framesSent[typ] = stats.Default.Counter("apiduct_tunnel_frames_sent_total", "type", name)
+		m.framesReceived[typ] = stats.Default.Counter("apiduct_tunnel_frames_received_total", "type", name)
+	}
+	return m
+}
+
+func (m *protocolMetrics) frameSent(typ byte, payload int) {
+	m.framesSent[typ].Inc()
+	m.wireSent.Add(int64(headerSize + payload))
+	if typ == frameData {
+		m.dataSent.Add(int64(payload))
+	}
+}
+
+func (m *protocolMetrics) frameReceived(typ byte, length uint32) {
+	if int(typ) >= len(m.framesReceived) {
+		return
+	}
+	m.framesReceived[typ].Inc()
+	if typ == frameData {
+		m.wireReceived.Add(int64(headerSize) + int64(length))
+		m.dataReceived.Add(int64(length))
+	} else {
+		m.wireReceived.Add(headerSize)
+	}
+}
+
+// stalled records a write that waited d for the peer to grant window.
+func (m *protocolMetrics) stalled(d time.Duration) {
+	m.stalls.Inc()
+	m.stallTime.Add(d.Microseconds())
+}
+
+// ObserveHandshake records a tunnel handshake that started at start, by its
+// result.
+func ObserveHandshake(start time.Time, result string) {
+	stats.Default.Counter("apiduct_tunnel_handshakes_total", "result", result).Inc()
+	protocolStats.handshakeTime.Add(time.Since(start).Microseconds())
+}
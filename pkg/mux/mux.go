@@ -0,0 +1,906 @@
+// Package mux multiplexes the requests between the bridge and the offramp over
+// one tunnel connection, after the handshake of package auth.
+package mux
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// After the handshake the tunnel carries frames, so many requests can be in
+// flight at once, each on its own stream:
+//
+//	type (1 byte) | flags (1) | stream ID (4) | length (4) | payload
+//
+// Data frames carry stream bytes. A window update grants the peer length more
+// bytes of receive window on the stream; every stream starts with
+// initialWindow, so a slow reader only stalls its own stream. A ping
+// carries its ID in the stream ID field and is answered with the ACK flag. Go
+// away tells the peer that no new streams will be accepted.
+//
+// The bridge opens streams with odd IDs, the offramp with even IDs. A stream
+// is opened by a frame with the SYN flag, half-closed with FIN and aborted
+// with RST. A SYN with the PRI flag opens a priority stream, which the peer
+// queues apart from the others, so health checks are neither refused nor kept
+// waiting behind a backlog of data streams. Peers that do not know the flag
+// treat it as a regular stream.
+//
+// A session that wants the streams it receives checksummed says so with a
+// ping with the SUM flag and ID 0, which older peers merely answer. The peer
+// then ends each stream it sends with a data frame carrying FIN and SUM, whose
+// 4-byte payload is the CRC-32C of the stream bytes, instead of an empty FIN.
+const (
+	frameData         = 0
+	frameWindowUpdate = 1
+	framePing         = 2
+	frameGoAway       = 3
+)
+
+const (
+	flagSYN = 1 << 0
+	flagACK = 1 << 1
+	flagFIN = 1 << 2
+	flagRST = 1 << 3
+	flagPRI = 1 << 4
+	flagSUM = 1 << 5
+)
+
+const (
+	headerSize      = 10
+	maxFrameSize    = 64 * 1024
+	initialWindow   = 256 * 1024
+	acceptBacklog   = 256
+	priorityBacklog = 32
+	checksumSize    = 4
+	maxPendingPongs = 64  // ping answers waiting to be written
+	maxRefused      = 256 // resets of refused streams waiting to be written
+)
+
+var (
+	ErrSessionClosed = errors.New("tunnel session closed")
+	ErrPeerClosed    = errors.New("tunnel closed by the peer")
+	ErrGoAway        = errors.New("tunnel session does not accept new streams")
+	ErrStreamReset   = errors.New("tunnel stream reset")
+	ErrStreamClosed  = errors.New("tunnel stream closed for writing")
+
+	// ErrChecksumMismatch is returned in place of io.EOF by streams whose
+	// bytes do not match the checksum the peer sent
+	ErrChecksumMismatch = errors.New("tunnel stream failed its checksum")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Session multiplexes streams over one tunnel connection.
+type Session struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+
+	mu           sync.Mutex
+	streams      map[uint32]*Stream
+	nextID       uint32
+	localGoAway  bool
+	remoteGoAway bool
+	goneAway     chan struct{} // closed when the peer sends go away
+	pings        map[uint32]chan struct{}
+	nextPing     uint32
+	sendSums     bool // the peer asked for checksums
+	pendingPongs int
+	refused      []uint32 // streams whose reset is waiting to be written
+
+	accept    chan *Stream
+	priority  chan *Stream
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewSession starts a session on conn. The bridge is the client side.
+func NewSession(conn net.Conn, client bool) *Session {
+	s := &Session{
+		conn:     conn,
+		reader:   bufio.NewReaderSize(conn, headerSize+maxFrameSize),
+		streams:  make(map[uint32]*Stream),
+		pings:    make(map[uint32]chan struct{}),
+		accept:   make(chan *Stream, acceptBacklog),
+		priority: make(chan *Stream, priorityBacklog),
+		closed:   make(chan struct{}),
+		goneAway: make(chan struct{}),
+	}
+	if client {
+		s.nextID = 1
+	} else {
+		s.nextID = 2
+	}
+	go s.recvLoop()
+	return s
+}
+
+// EnableChecksums asks the peer to end every stream it sends with a checksum,
+// which Read and Verify then check. Peers that do not support checksums
+// ignore the request.
+func (s *Session) EnableChecksums() error {
+	return s.writeFrame(framePing, flagSUM, 0, 0, nil)
+}
+
+// Open starts a new stream.
+func (s *Session) Open() (*Stream, error) {
+	return s.open(flagSYN)
+}
+
+// OpenPriority starts a new priority stream, which the peer accepts ahead of
+// the streams opened with Open.
+func (s *Session) OpenPriority() (*Stream, error) {
+	return s.open(flagSYN | flagPRI)
+}
+
+func (s *Session) open(flags byte) (*Stream, error) {
+	s.mu.Lock()
+	if s.isClosed() {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	if s.remoteGoAway {
+		s.mu.Unlock()
+		return nil, ErrGoAway
+	}
+	stream := newStream(s, s.nextID)
+	s.nextID += 2
+	s.streams[stream.id] = stream
+	s.mu.Unlock()
+	protocolStats.streamsOpen.Add(1)
+	protocolStats.openedLocal.Inc()
+
+	if err := s.writeFrame(frameWindowUpdate, flags, stream.id, 0, nil); err != nil {
+		s.removeStream(stream.id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for a stream opened by the peer, priority streams included.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case stream, ok := <-s.priority:
+		if ok {
+			return stream, nil
+		}
+	default:
+	}
+	select {
+	case stream, ok := <-s.accept:
+		if !ok {
+			return s.acceptFrom(s.priority)
+		}
+		return stream, nil
+	case stream, ok := <-s.priority:
+		if !ok {
+			return s.acceptFrom(s.accept)
+		}
+		return stream, nil
+	case <-s.closed:
+		return nil, s.Err()
+	}
+}
+
+// AcceptPriority waits for a priority stream opened by the peer. Serving
+// them from their own goroutine keeps them from waiting for the callers of
+// Accept.
+func (s *Session) AcceptPriority() (*Stream, error) {
+	return s.acceptFrom(s.priority)
+}
+
+func (s *Session) acceptFrom(backlog chan *Stream) (*Stream, error) {
+	select {
+	case stream, ok := <-backlog:
+		if !ok {
+			return nil, ErrGoAway
+		}
+		return stream, nil
+	case <-s.closed:
+		return nil, s.Err()
+	}
+}
+
+// GoAway stops accepting streams. Streams opened by the peer from now on are
+// reset, and Accept returns ErrGoAway once the backlog is empty.
+func (s *Session) GoAway() error {
+	s.mu.Lock()
+	if s.localGoAway {
+		s.mu.Unlock()
+		return nil
+	}
+	s.localGoAway = true
+	close(s.accept)
+	close(s.priority)
+	s.mu.Unlock()
+	return s.writeFrame(frameGoAway, 0, 0, 0, nil)
+}
+
+// Ping sends a ping and waits for the answer, returning the round trip time.
+func (s *Session) Ping(timeout time.Duration) (time.Duration, error) {
+	s.mu.Lock()
+	s.nextPing++
+	id := s.nextPing
+	pong := make(chan struct{})
+	s.pings[id] = pong
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pings, id)
+		s.mu.Unlock()
+	}()
+
+	start := time.Now()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	// Writing blocks while the connection is stuck, which counts toward
+	// the timeout as well. Closing the session ends the write.
+	written := make(chan error, 1)
+	go func() { written <- s.writeFrame(framePing, 0, id, 0, nil) }()
+	for {
+		select {
+		case err := <-written:
+			if err != nil {
+				return 0, err
+			}
+			written = nil
+		case <-pong:
+			return time.Since(start), nil
+		case <-timer.C:
+			return 0, fmt.Errorf("no ping answer within %s", timeout)
+		case <-s.closed:
+			return 0, s.Err()
+		}
+	}
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// GoneAway is closed when the peer announces it accepts no new streams.
+func (s *Session) GoneAway() <-chan struct{} {
+	return s.goneAway
+}
+
+// CloseChan is closed when the session ends.
+func (s *Session) CloseChan() <-chan struct{} {
+	return s.closed
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Close ends the session and all its streams.
+func (s *Session) Close() error {
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.closeErr = err
+		close(s.closed)
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.mu.Unlock()
+		protocolStats.streamsOpen.Add(-int64(len(streams)))
+		s.conn.Close()
+		for _, stream := range streams {
+			stream.notify()
+			stream.end()
+		}
+	})
+}
+
+func (s *Session) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeErr
+}
+
+// writeFrame sends one frame. For window updates, length is the increment
+// and payload is nil.
+func (s *Session) writeFrame(typ, flags byte, id, length uint32, payload []byte) error {
+	if payload != nil {
+		length = uint32(len(payload))
+	}
+	frame := make([]byte, headerSize+len(payload))
+	frame[0] = typ
+	frame[1] = flags
+	binary.BigEndian.PutUint32(frame[2:6], id)
+	binary.BigEndian.PutUint32(frame[6:10], length)
+	copy(frame[headerSize:], payload)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.isClosed() {
+		return s.Err()
+	}
+	if _, err := s.conn.Write(frame); err != nil {
+		s.closeWithError(fmt.Errorf("failed to write to tunnel: %v", err))
+		return err
+	}
+	protocolStats.frameSent(typ, len(payload))
+	return nil
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	_, open := s.streams[id]
+	delete(s.streams, id)
+	s.mu.Unlock()
+	if open {
+		protocolStats.streamsOpen.Add(-1)
+	}
+}
+
+func (s *Session) recvLoop() {
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(s.reader, header); err != nil {
+			if err == io.EOF {
+				err = ErrPeerClosed
+			}
+			s.closeWithError(err)
+			return
+		}
+		typ, flags := header[0], header[1]
+		id := binary.BigEndian.Uint32(header[2:6])
+		length := binary.BigEndian.Uint32(header[6:10])
+		protocolStats.frameReceived(typ, length)
+
+		var err error
+		switch typ {
+		case frameData:
+			err = s.handleData(flags, id, length)
+		case frameWindowUpdate:
+			err = s.handleWindowUpdate(flags, id, length)
+		case framePing:
+			if err = checkEmpty(typ, length); err == nil {
+				err = s.handlePing(flags, id)
+			}
+		case frameGoAway:
+			if err = checkEmpty(typ, length); err != nil {
+				break
+			}
+			s.mu.Lock()
+			if !s.remoteGoAway {
+				s.remoteGoAway = true
+				close(s.goneAway)
+			}
+			s.mu.Unlock()
+		default:
+			err = fmt.Errorf("unknown frame type %d", typ)
+		}
+		if err != nil {
+			s.closeWithError(fmt.Errorf("tunnel protocol error: %v", err))
+			return
+		}
+	}
+}
+
+// streamFor returns the stream a frame belongs to, creating it for SYN. It
+// returns nil for frames of streams that were already closed or reset.
+func (s *Session) streamFor(flags byte, id uint32) (*Stream, error) {
+	s.mu.Lock()
+	stream := s.streams[id]
+	if flags&flagSYN == 0 || stream != nil {
+		s.mu.Unlock()
+		return stream, nil
+	}
+
+	// A new stream opened by the peer
+	if id == 0 || id%2 == s.nextID%2 {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("invalid stream ID %d", id)
+	}
+	backlog := s.accept
+	if flags&flagPRI != 0 {
+		backlog = s.priority
+	}
+	if s.localGoAway || len(backlog) == cap(backlog) {
+		err := s.refuse(id)
+		s.mu.Unlock()
+		protocolStats.refused.Inc()
+		return nil, err
+	}
+	stream = newStream(s, id)
+	s.streams[id] = stream
+	backlog <- stream
+	s.mu.Unlock()
+	protocolStats.streamsOpen.Add(1)
+	protocolStats.openedRemote.Inc()
+	return stream, nil
+}
+
+// refuse queues the reset of a stream opened by the peer that is not
+// accepted. The receive loop must not wait for the connection to take it,
+// so the resets are written by a goroutine of their own. The caller must
+// hold s.mu.
+func (s *Session) refuse(id uint32) error {
+	// A peer opening streams faster than their resets can be written is
+	// flooding
+	if len(s.refused) >= maxRefused {
+		return fmt.Errorf("more than %d refused streams waiting for their reset", maxRefused)
+	}
+	s.refused = append(s.refused, id)
+	if len(s.refused) == 1 {
+		go s.writeResets()
+	}
+	return nil
+}
+
+// writeResets writes the queued resets of refused streams until none are
+// left.
+func (s *Session) writeResets() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.refused) > 0 {
+		id := s.refused[0]
+		s.mu.Unlock()
+		s.writeFrame(frameWindowUpdate, flagRST, id, 0, nil)
+		s.mu.Lock()
+		s.refused = s.refused[1:]
+	}
+}
+
+func (s *Session) handleData(flags byte, id, length uint32) error {
+	if length > maxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds the maximum of %d", length, maxFrameSize)
+	}
+	stream, err := s.streamFor(flags, id)
+	if err != nil {
+		return err
+	}
+	if stream == nil {
+		// Data for a stream we no longer know
+		_, err := s.reader.Discard(int(length))
+		return err
+	}
+	if flags&flagSUM != 0 {
+		if length != checksumSize {
+			return fmt.Errorf("checksum of %d bytes on stream %d", length, id)
+		}
+		sum := make([]byte, checksumSize)
+		if _, err := io.ReadFull(s.reader, sum); err != nil {
+			return err
+		}
+		stream.verify(binary.BigEndian.Uint32(sum))
+	} else if length > 0 {
+		if err := stream.receive(s.reader, length); err != nil {
+			return err
+		}
+	}
+	stream.handleFlags(flags)
+	return nil
+}
+
+func (s *Session) handleWindowUpdate(flags byte, id, length uint32) error {
+	stream, err := s.streamFor(flags, id)
+	if err != nil || stream == nil {
+		return err
+	}
+	if length > 0 {
+		if err := stream.grant(length); err != nil {
+			return err
+		}
+	}
+	stream.handleFlags(flags)
+	return nil
+}
+
+// checkEmpty refuses a ping or go away frame announcing a payload, which
+// the protocol has none of.
+func checkEmpty(typ byte, length uint32) error {
+	if length != 0 {
+		return fmt.Errorf("frame of type %d with a %d byte payload", typ, length)
+	}
+	return nil
+}
+
+func (s *Session) handlePing(flags byte, id uint32) error {
+	if flags&flagSUM != 0 && flags&flagACK == 0 {
+		s.mu.Lock()
+		s.sendSums = true
+		s.mu.Unlock()
+	}
+	if flags&flagACK == 0 {
+		// A peer pinging faster than its answers can be written is flooding
+		s.mu.Lock()
+		if s.pendingPongs >= maxPendingPongs {
+			s.mu.Unlock()
+			return fmt.Errorf("more than %d pings unanswered", maxPendingPongs)
+		}
+		s.pendingPongs++
+		s.mu.Unlock()
+		go func() {
+			s.writeFrame(framePing, flagACK, id, 0, nil)
+			s.mu.Lock()
+			s.pendingPongs--
+			s.mu.Unlock()
+		}()
+		return nil
+	}
+	s.mu.Lock()
+	pong := s.pings[id]
+	delete(s.pings, id)
+	s.mu.Unlock()
+	if pong != nil {
+		close(pong)
+	}
+	return nil
+}
+
+// Stream is one request's bidirectional byte stream inside the tunnel. It
+// implements net.Conn.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	mu            sync.Mutex
+	buf           bytes.Buffer
+	recvWindow    uint32 // bytes the peer may still send
+	unacked       uint32 // bytes read but not yet granted back to the peer
+	sendWindow    uint32 // bytes we may still send
+	remoteClosed  bool
+	localClosed   bool
+	reset         bool
+	sendSum       uint32 // CRC-32C of the bytes written
+	recvSum       uint32 // CRC-32C of the bytes received
+	corrupt       bool   // received bytes failed the peer's checksum
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// notifications for blocked readers and writers
+	readable chan struct{}
+	writable chan struct{}
+
+	gone     chan struct{} // closed once the stream is reset or its session ends
+	goneOnce sync.Once
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		session:    s,
+		recvWindow: initialWindow,
+		sendWindow: initialWindow,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+		gone:       make(chan struct{}),
+	}
+}
+
+// end closes the stream's Done channel.
+func (st *Stream) end() {
+	st.goneOnce.Do(func() { close(st.gone) })
+}
+
+// Done returns a channel that is closed once the stream is reset, by either
+// end, or its session ends, after which nothing written to it arrives. It
+// stays open after both ends closed the stream normally.
+func (st *Stream) Done() <-chan struct{} {
+	return st.gone
+}
+
+func (st *Stream) notify() {
+	select {
+	case st.readable <- struct{}{}:
+	default:
+	}
+	select {
+	case st.writable <- struct{}{}:
+	default:
+	}
+}
+
+// receive reads length bytes of a data frame into the stream's buffer.
+func (st *Stream) receive(r io.Reader, length uint32) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if length > st.recvWindow {
+		return fmt.Errorf("stream %d exceeded its receive window", st.id)
+	}
+	st.recvWindow -= length
+	start := st.buf.Len()
+	if _, err := io.CopyN(&st.buf, r, int64(length)); err != nil {
+		return err
+	}
+	st.recvSum = crc32.Update(st.recvSum, castagnoli, st.buf.Bytes()[start:])
+	st.notifyLocked()
+	return nil
+}
+
+func (st *Stream) notifyLocked() {
+	select {
+	case st.readable <- struct{}{}:
+	default:
+	}
+}
+
+// verify checks the received bytes against the peer's checksum.
+func (st *Stream) verify(sum uint32) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if sum != st.recvSum {
+		st.corrupt = true
+		protocolStats.checksumMismatch.Inc()
+	} else {
+		protocolStats.checksumOK.Inc()
+	}
+}
+
+// grant adds n bytes to the send window. The peer only grants back what it
+// read, so a window growing past initialWindow is a protocol error.
+func (st *Stream) grant(n uint32) error {
+	st.mu.Lock()
+	if n > initialWindow-st.sendWindow {
+		st.mu.Unlock()
+		return fmt.Errorf("window update of %d bytes overflows the window of stream %d", n, st.id)
+	}
+	st.sendWindow += n
+	st.mu.Unlock()
+	select {
+	case st.writable <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (st *Stream) handleFlags(flags byte) {
+	st.mu.Lock()
+	if flags&flagRST != 0 && !st.reset {
+		st.reset = true
+		protocolStats.resetRemote.Inc()
+	}
+	if flags&flagFIN != 0 {
+		st.remoteClosed = true
+	}
+	done := st.reset || (st.remoteClosed && st.localClosed)
+	st.mu.Unlock()
+	if flags&(flagRST|flagFIN) != 0 {
+		st.notify()
+	}
+	if flags&flagRST != 0 {
+		st.end()
+	}
+	if done {
+		st.session.removeStream(st.id)
+	}
+}
+
+// Read reads stream data, returning io.EOF once the peer closed the stream,
+// or ErrChecksumMismatch if what it sent failed its checksum.
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(p)
+			st.unacked += uint32(n)
+			var grant uint32
+			if st.unacked >= initialWindow/2 {
+				grant = st.unacked
+				st.recvWindow += grant
+				st.unacked = 0
+			}
+			st.mu.Unlock()
+			if grant > 0 {
+				st.session.writeFrame(frameWindowUpdate, 0, st.id, grant, nil)
+			}
+			return n, nil
+		}
+		switch {
+		case st.reset:
+			st.mu.Unlock()
+			return 0, ErrStreamReset
+		case st.remoteClosed && st.corrupt:
+			st.mu.Unlock()
+			return 0, ErrChecksumMismatch
+		case st.remoteClosed:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.session.isClosed():
+			st.mu.Unlock()
+			return 0, st.session.Err()
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := waitFor(st.readable, st.session.closed, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Verify waits until the peer closed the stream, up to the read deadline,
+// without reading what is left. It returns ErrChecksumMismatch if the bytes
+// the peer sent failed their checksum, and nil if they passed or came
+// without one. Readers that stop at a length they know, rather than at
+// io.EOF, call it to learn whether the bytes they read arrived intact.
+func (st *Stream) Verify() error {
+	for {
+		st.mu.Lock()
+		switch {
+		case st.remoteClosed && st.corrupt:
+			st.mu.Unlock()
+			return ErrChecksumMismatch
+		case st.remoteClosed:
+			st.mu.Unlock()
+			return nil
+		case st.reset:
+			st.mu.Unlock()
+			return ErrStreamReset
+		case st.session.isClosed():
+			st.mu.Unlock()
+			return st.session.Err()
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := waitFor(st.readable, st.session.closed, deadline); err != nil {
+			return err
+		}
+	}
+}
+
+// Write sends p, blocking while the peer's receive window is exhausted.
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		st.mu.Lock()
+		switch {
+		case st.reset:
+			st.mu.Unlock()
+			return written, ErrStreamReset
+		case st.localClosed:
+			st.mu.Unlock()
+			return written, ErrStreamClosed
+		case st.session.isClosed():
+			st.mu.Unlock()
+			return written, st.session.Err()
+		}
+		if st.sendWindow == 0 {
+			// The peer has not read what we sent yet
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			stalled := time.Now()
+			err := waitFor(st.writable, st.session.closed, deadline)
+			protocolStats.stalled(time.Since(stalled))
+			if err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := len(p) - written
+		if n > maxFrameSize {
+			n = maxFrameSize
+		}
+		if uint32(n) > st.sendWindow {
+			n = int(st.sendWindow)
+		}
+		st.sendWindow -= uint32(n)
+		st.sendSum = crc32.Update(st.sendSum, castagnoli, p[written:written+n])
+		st.mu.Unlock()
+
+		if err := st.session.writeFrame(frameData, 0, st.id, 0, p[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close half-closes the stream: the peer reads io.EOF once it has read
+// everything sent so far. Reading is still possible until the peer closes
+// its side.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.localClosed || st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	done := st.remoteClosed
+	sum := st.sendSum
+	st.mu.Unlock()
+	st.notify()
+	if done {
+		st.session.removeStream(st.id)
+	}
+	st.session.mu.Lock()
+	sendSums := st.session.sendSums
+	st.session.mu.Unlock()
+	if sendSums {
+		return st.session.writeFrame(frameData, flagFIN|flagSUM, st.id, 0, binary.BigEndian.AppendUint32(nil, sum))
+	}
+	return st.session.writeFrame(frameData, flagFIN, st.id, 0, nil)
+}
+
+// Reset aborts the stream in both directions.
+func (st *Stream) Reset() {
+	st.mu.Lock()
+	if st.reset {
+		st.mu.Unlock()
+		return
+	}
+	st.reset = true
+	st.mu.Unlock()
+	protocolStats.resetLocal.Inc()
+	st.notify()
+	st.end()
+	st.session.removeStream(st.id)
+	st.session.writeFrame(frameWindowUpdate, flagRST, st.id, 0, nil)
+}
+
+// ID returns the stream ID, odd for streams the client opened.
+func (st *Stream) ID() uint32 { return st.id }
+
+func (st *Stream) LocalAddr() net.Addr  { return st.session.conn.LocalAddr() }
+func (st *Stream) RemoteAddr() net.Addr { return st.session.conn.RemoteAddr() }
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
+
+// waitFor blocks until ready or closed fire, or the deadline passes.
+func waitFor(ready <-chan struct{}, closed <-chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ready:
+	case <-closed:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
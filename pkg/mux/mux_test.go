@@ -0,0 +1,656 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipe returns the bridge and offramp ends of a tunnel over an in-memory
+// connection.
+func pipe(t *testing.T) (*Session, *Session) {
+	t.Helper()
+	bridgeConn, offrampConn := net.Pipe()
+	bridge := NewSession(bridgeConn, true)
+	offramp := NewSession(offrampConn, false)
+	t.Cleanup(func() {
+		bridge.Close()
+		offramp.Close()
+	})
+	return bridge, offramp
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	bridge, offramp := pipe(t)
+
+	// Larger than the initial window, so the window updates are exercised
+	request := bytes.Repeat([]byte("apiduct "), initialWindow/4)
+	go func() {
+		stream, err := offramp.Accept()
+		if err != nil {
+			return
+		}
+		body, _ := io.ReadAll(stream)
+		stream.Write(bytes.ToUpper(body))
+		stream.Close()
+	}()
+
+	stream, err := bridge.Open()
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	go func() {
+		stream.Write(request)
+		stream.Close()
+	}()
+	response, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	if !bytes.Equal(response, bytes.ToUpper(request)) {
+		t.Errorf("got %d bytes back, want the %d request bytes in upper case", len(response), len(request))
+	}
+}
+
+func TestStreamsAreIndependent(t *testing.T) {
+	bridge, offramp := pipe(t)
+
+	first, err := bridge.Open()
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	second, err := bridge.Open()
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	// Streams are announced by their first frame
+	first.Write([]byte("first"))
+	second.Write([]byte("second"))
+
+	for _, want := range []string{"first", "second"} {
+		stream, err := offramp.Accept()
+		if err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+		buf := make([]byte, len(want))
+		if _, err := io.ReadFull(stream, buf); err != nil {
+			t.Fatalf("failed to read %q: %v", want, err)
+		}
+		if string(buf) != want {
+			t.Errorf("stream carried %q, want %q", buf, want)
+		}
+	}
+	if got := bridge.NumStreams(); got != 2 {
+		t.Errorf("NumStreams() = %d, want 2", got)
+	}
+}
+
+func TestSlowReaderStallsOnlyItsStream(t *testing.T) {
+	bridge, offramp := pipe(t)
+
+	// Nothing reads the slow stream: its writer stalls once the window is
+	// exhausted, and no more than the window is held for it
+	slow, err := bridge.Open()
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	stalled := make(chan int)
+	go func() {
+		n, _ := slow.Write(bytes.Repeat([]byte("s"), 4*initialWindow))
+		stalled <- n
+	}()
+	slowAccepted, err := offramp.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+
+	// Meanwhile a stream beside it carries several windows' worth both ways
+	fast, err := bridge.Open()
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	request := bytes.Repeat([]byte("f"), 4*initialWindow)
+	go func() {
+		fast.Write(request)
+		fast.Close()
+	}()
+	fastAccepted, err := offramp.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	go func() {
+		io.Copy(fastAccepted, fastAccepted)
+		fastAccepted.Close()
+	}()
+	fast.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response, err := io.ReadAll(fast)
+	if err != nil {
+		t.Fatalf("fast stream stalled behind the slow one: %v", err)
+	}
+	if !bytes.Equal(response, request) {
+		t.Errorf("fast stream echoed %d bytes, want %d", len(response), len(request))
+	}
+
+	select {
+	case n := <-stalled:
+		t.Fatalf("slow stream wrote all %d bytes without being read", n)
+	default:
+	}
+	var held int
+	for deadline := time.Now().Add(time.Second); held < initialWindow && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		slowAccepted.mu.Lock()
+		held = slowAccepted.buf.Len()
+		slowAccepted.mu.Unlock()
+	}
+	if held != initialWindow {
+		t.Errorf("%d bytes held for the slow stream, want its window of %d", held, initialWindow)
+	}
+
+	// Once read, the slow stream finishes too
+	slow.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	go io.Copy(io.Discard, slowAccepted)
+	if n := <-stalled; n != 4*initialWindow {
+		t.Errorf("slow stream wrote %d bytes, want %d", n, 4*initialWindow)
+	}
+}
+
+func TestPriorityStreams(t *testing.T) {
+	bridge, offramp := pipe(t)
+
+	// Fill the backlog of regular streams nobody accepts
+	for i := 0; i < acceptBacklog+1; i++ {
+		if _, err := bridge.Open(); err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+	}
+	stream, err := bridge.OpenPriority()
+	if err != nil {
+		t.Fatalf("OpenPriority: %v", err)
+	}
+	stream.Write([]byte("health"))
+
+	accepted := make(chan *Stream, 1)
+	go func() {
+		stream, err := offramp.AcceptPriority()
+		if err == nil {
+			accepted <- stream
+		}
+	}()
+	select {
+	case stream := <-accepted:
+		buf := make([]byte, len("health"))
+		if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "health" {
+			t.Errorf("priority stream carried %q, %v", buf, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("priority stream was not accepted behind a full backlog")
+	}
+
+	// Accept takes priority streams first
+	last, err := bridge.OpenPriority()
+	if err != nil {
+		t.Fatalf("OpenPriority: %v", err)
+	}
+	last.Write([]byte("health"))
+	time.Sleep(10 * time.Millisecond)
+	first, err := offramp.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	if first.id != last.id {
+		t.Errorf("Accept returned stream %d, want priority stream %d", first.id, last.id)
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	bridge, offramp := pipe(t)
+
+	stream, err := bridge.Open()
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	stream.Write([]byte("hello"))
+	accepted, err := offramp.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	accepted.Reset()
+
+	stream.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := stream.Read(make([]byte, 1)); !errors.Is(err, ErrStreamReset) {
+		t.Errorf("Read after reset = %v, want %v", err, ErrStreamReset)
+	}
+	for name, st := range map[string]*Stream{"resetting": accepted, "reset": stream} {
+		select {
+		case <-st.Done():
+		case <-time.After(time.Second):
+			t.Errorf("Done of the %s stream stayed open", name)
+		}
+	}
+}
+
+func TestWindowExhaustion(t *testing.T) {
+	bridge, offramp := pipe(t)
+
+	stream, err := bridge.Open()
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	body := bytes.Repeat([]byte("x"), initialWindow+maxFrameSize)
+
+	// Nothing reads the stream yet, so the writer stops once the window is
+	// exhausted
+	stream.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := stream.Write(body)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("Write past the window = %v, want a timeout", err)
+	}
+	if n != initialWindow {
+		t.Fatalf("wrote %d bytes before stalling, want the window of %d", n, initialWindow)
+	}
+
+	// Reading half the window grants it back and the writer resumes
+	accepted, err := offramp.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	if _, err := io.ReadFull(accepted, make([]byte, initialWindow/2)); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	stream.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := stream.Write(body[n:]); err != nil {
+		t.Fatalf("Write after the window update: %v", err)
+	}
+	stream.Close()
+	accepted.SetReadDeadline(time.Now().Add(time.Second))
+	rest, err := io.ReadAll(accepted)
+	if err != nil {
+		t.Fatalf("failed to read the rest: %v", err)
+	}
+	if got := initialWindow/2 + len(rest); got != len(body) {
+		t.Errorf("read %d bytes, want %d", got, len(body))
+	}
+}
+
+// corruptingConn flips a byte of the data written through it, as a faulty
+// middlebox would.
+type corruptingConn struct {
+	net.Conn
+	from, to []byte
+}
+
+func (c *corruptingConn) Write(p []byte) (int, error) {
+	return c.Conn.Write(bytes.ReplaceAll(p, c.from, c.to))
+}
+
+func TestChecksums(t *testing.T) {
+	for _, tc := range []struct {
+		body    string
+		wantErr error
+	}{
+		{"intact", nil},
+		{"corrupt", ErrChecksumMismatch},
+	} {
+		t.Run(tc.body, func(t *testing.T) {
+			bridgeConn, offrampConn := net.Pipe()
+			bridge := NewSession(&corruptingConn{bridgeConn, []byte("corrupt"), []byte("c0rrupt")}, true)
+			offramp := NewSession(offrampConn, false)
+			defer bridge.Close()
+			defer offramp.Close()
+
+			if err := offramp.EnableChecksums(); err != nil {
+				t.Fatalf("EnableChecksums: %v", err)
+			}
+			// The bridge handles the request before it answers the ping
+			if _, err := offramp.Ping(time.Second); err != nil {
+				t.Fatalf("Ping: %v", err)
+			}
+			stream, err := bridge.Open()
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			stream.Write([]byte(tc.body))
+			stream.Close()
+
+			accepted, err := offramp.Accept()
+			if err != nil {
+				t.Fatalf("Accept: %v", err)
+			}
+			accepted.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := io.ReadFull(accepted, make([]byte, len(tc.body))); err != nil {
+				t.Fatalf("failed to read the body: %v", err)
+			}
+			if err := accepted.Verify(); err != tc.wantErr {
+				t.Errorf("Verify = %v, want %v", err, tc.wantErr)
+			}
+			wantEnd := tc.wantErr
+			if wantEnd == nil {
+				wantEnd = io.EOF
+			}
+			if _, err := accepted.Read(make([]byte, 1)); err != wantEnd {
+				t.Errorf("Read at the end = %v, want %v", err, wantEnd)
+			}
+		})
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	bridge, _ := pipe(t)
+
+	stream, err := bridge.Open()
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	stream.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = stream.Read(make([]byte, 1))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Read past the deadline = %v, want a timeout", err)
+	}
+}
+
+func TestGoAway(t *testing.T) {
+	bridge, offramp := pipe(t)
+
+	if err := offramp.GoAway(); err != nil {
+		t.Fatalf("GoAway: %v", err)
+	}
+	select {
+	case <-bridge.GoneAway():
+	case <-time.After(time.Second):
+		t.Fatal("bridge did not see the go away")
+	}
+	if _, err := bridge.Open(); !errors.Is(err, ErrGoAway) {
+		t.Errorf("Open after go away = %v, want %v", err, ErrGoAway)
+	}
+}
+
+func TestPeerClose(t *testing.T) {
+	bridge, offramp := pipe(t)
+
+	stream, err := bridge.Open()
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	offramp.Close()
+	select {
+	case <-bridge.CloseChan():
+	case <-time.After(time.Second):
+		t.Fatal("bridge session stayed open")
+	}
+	select {
+	case <-stream.Done():
+	default:
+		t.Error("Done of a stream stayed open after its session closed")
+	}
+	if _, err := bridge.Open(); err == nil {
+		t.Error("Open on a closed session succeeded")
+	}
+}
+
+func TestPing(t *testing.T) {
+	bridge, _ := pipe(t)
+
+	rtt, err := bridge.Ping(time.Second)
+	if err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if rtt <= 0 {
+		t.Errorf("Ping round trip = %s, want more than zero", rtt)
+	}
+}
+
+func TestHeartbeatTimeout(t *testing.T) {
+	bridgeConn, offrampConn := net.Pipe()
+	defer offrampConn.Close()
+	bridge := NewSession(bridgeConn, true)
+	defer bridge.Close()
+
+	// Nothing reads the other end, as with a connection whose NAT mapping
+	// expired
+	done := make(chan struct{})
+	go func() {
+		Heartbeat(bridge, time.Hour, 20*time.Millisecond, "tunnel_id", "test")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("heartbeat did not give up on the silent peer")
+	}
+	if err := bridge.Err(); !errors.Is(err, ErrHeartbeatTimeout) {
+		t.Errorf("session closed with %v, want %v", err, ErrHeartbeatTimeout)
+	}
+}
+
+// frame encodes a frame as the peer would send it.
+func frame(typ, flags byte, id, length uint32, payload []byte) []byte {
+	b := []byte{typ, flags}
+	b = binary.BigEndian.AppendUint32(b, id)
+	b = binary.BigEndian.AppendUint32(b, length)
+	return append(b, payload...)
+}
+
+func TestProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"unknown frame type", frame(9, 0, 0, 0, nil)},
+		{"oversized data frame", frame(frameData, flagSYN, 2, maxFrameSize+1, nil)},
+		{"ping with payload", frame(framePing, 0, 1, 4, []byte("ping"))},
+		{"window overflow", append(frame(frameData, flagSYN, 2, 0, nil), frame(frameWindowUpdate, 0, 2, 1, nil)...)},
+		{"checksum of the wrong size", frame(frameData, flagSYN|flagFIN|flagSUM, 2, 2, []byte("ok"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, peer := net.Pipe()
+			defer peer.Close()
+			session := NewSession(conn, true)
+			go io.Copy(io.Discard, peer)
+			peer.Write(tt.input)
+			select {
+			case <-session.CloseChan():
+			case <-time.After(time.Second):
+				t.Fatal("session survived a protocol error")
+			}
+		})
+	}
+}
+
+func TestPingFlood(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	session := NewSession(conn, true)
+	// The answers are never read, so they pile up
+	for i := uint32(1); i <= maxPendingPongs+1; i++ {
+		if _, err := peer.Write(frame(framePing, 0, i, 0, nil)); err != nil {
+			break
+		}
+	}
+	select {
+	case <-session.CloseChan():
+	case <-time.After(time.Second):
+		t.Fatal("session kept answering a ping flood")
+	}
+}
+
+func TestRefusedStreams(t *testing.T) {
+	tests := []struct {
+		name    string
+		refuse  func(session *Session, peer net.Conn)
+		refused uint32
+	}{
+		{"go away", func(session *Session, peer net.Conn) {
+			go session.GoAway()
+			io.ReadFull(peer, make([]byte, headerSize))
+		}, 2},
+		{"backlog full", func(session *Session, peer net.Conn) {
+			for id := uint32(2); id <= 2*priorityBacklog; id += 2 {
+				peer.Write(frame(frameWindowUpdate, flagSYN|flagPRI, id, 0, nil))
+			}
+		}, 2*priorityBacklog + 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, peer := net.Pipe()
+			defer peer.Close()
+			session := NewSession(conn, true)
+			defer session.Close()
+			tt.refuse(session, peer)
+
+			// The reset is not read yet, which must not keep the session
+			// from handling the frames that follow
+			go func() {
+				peer.Write(frame(frameWindowUpdate, flagSYN|flagPRI, tt.refused, 0, nil))
+				peer.Write(frame(frameGoAway, 0, 0, 0, nil))
+			}()
+			select {
+			case <-session.GoneAway():
+			case <-time.After(time.Second):
+				t.Fatal("session stopped reading while the reset was pending")
+			}
+
+			got := make([]byte, headerSize)
+			peer.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := io.ReadFull(peer, got); err != nil {
+				t.Fatalf("no reset: %v", err)
+			}
+			if want := frame(frameWindowUpdate, flagRST, tt.refused, 0, nil); !bytes.Equal(got, want) {
+				t.Errorf("got frame %x, want the reset %x", got, want)
+			}
+		})
+	}
+}
+
+func TestRefusedStreamFlood(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	session := NewSession(conn, true)
+	go session.GoAway()
+	io.ReadFull(peer, make([]byte, headerSize))
+	// The resets are never read, so they pile up
+	for id := uint32(2); id <= 2*(maxRefused+2); id += 2 {
+		if _, err := peer.Write(frame(frameWindowUpdate, flagSYN, id, 0, nil)); err != nil {
+			break
+		}
+	}
+	select {
+	case <-session.CloseChan():
+	case <-time.After(time.Second):
+		t.Fatal("session kept refusing a flood of streams")
+	}
+}
+
+// FuzzSession feeds arbitrary bytes to a session as its peer's frames. The
+// session must neither panic nor hang: once the peer closes, it closes too.
+func FuzzSession(f *testing.F) {
+	f.Add(frame(framePing, 0, 1, 0, nil))
+	f.Add(append(frame(frameData, flagSYN, 2, 5, []byte("hello")), frame(frameData, flagFIN, 2, 0, nil)...))
+	f.Add(append(frame(frameData, flagSYN|flagPRI, 2, 0, nil), frame(frameWindowUpdate, flagRST, 2, 0, nil)...))
+	f.Add(frame(frameData, flagFIN|flagSUM, 2, checksumSize, []byte{0, 0, 0, 0}))
+	f.Add(frame(frameGoAway, 0, 0, 0, nil))
+	f.Add(frame(frameData, flagSYN, 3, 0, nil))
+	f.Fuzz(func(t *testing.T, input []byte) {
+		conn, peer := net.Pipe()
+		session := NewSession(conn, true)
+		go func() {
+			for {
+				stream, err := session.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					io.Copy(io.Discard, stream)
+					stream.Close()
+				}()
+			}
+		}()
+		go io.Copy(io.Discard, peer)
+		peer.Write(input)
+		peer.Close()
+		select {
+		case <-session.CloseChan():
+		case <-time.After(5 * time.Second):
+			t.Fatal("session did not close after its peer did")
+		}
+	})
+}
+
+func TestRecordReplay(t *testing.T) {
+	var recording bytes.Buffer
+	recorder, err := NewRecorder(&recording, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bridgeConn, offrampConn := net.Pipe()
+	bridge := NewSession(recorder.Conn(bridgeConn), true)
+	offramp := NewSession(offrampConn, false)
+	go func() {
+		stream, err := offramp.Accept()
+		if err != nil {
+			return
+		}
+		io.ReadAll(stream)
+		io.WriteString(stream, "HTTP/1.1 200 OK\r\nSet-Cookie: session=hunter2\r\nContent-Length: 2\r\n\r\nok")
+		stream.Close()
+	}()
+
+	stream, err := bridge.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(stream, "GET /orders?api_key=hunter2 HTTP/1.1\r\nHost: api\r\nAuthorization: Bearer hunter2\r\n\r\n")
+	stream.Close()
+	response, _ := io.ReadAll(stream)
+	bridge.Close()
+	offramp.Close()
+	if err := recorder.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(recording.Bytes(), []byte("hunter2")) {
+		t.Errorf("recording contains a secret: %q", recording.Bytes())
+	}
+
+	reader, err := NewRecordingReader(bytes.NewReader(recording.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := make(chan []byte, 1)
+	err = Replay(reader, func(stream *Stream, opened bool) {
+		if !opened {
+			t.Error("replay accepted a stream the bridge opened")
+		}
+		body, _ := io.ReadAll(stream)
+		replayed <- body
+	})
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	got := <-replayed
+	want := bytes.Replace(response, []byte(" session=hunter2"), []byte("****************"), 1)
+	if !bytes.Equal(got, want) {
+		t.Errorf("replayed response %q, want %q", got, want)
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	message := "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\nX-Auth-Token: abc\r\nContent-Type: text/plain\r\n\r\nToken: body"
+	want := "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\nX-Auth-Token:****\r\nContent-Type: text/plain\r\n\r\nToken: body"
+	// Split across frames anywhere, the outcome is the same
+	for split := 0; split <= len(message); split++ {
+		p := []byte(message)
+		red := &redactor{}
+		red.redact(p[:split])
+		red.redact(p[split:])
+		if string(p) != want {
+			t.Fatalf("split at %d: got %q, want %q", split, p, want)
+		}
+	}
+}
@@ -0,0 +1,576 @@
+package mux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A recording holds the frames of one session, both directions in the order
+// they crossed the connection, for reproducing a protocol problem with
+// Replay. It starts with recordingMagic, a version byte and a byte telling
+// whether the recorded side is the client. Each record follows as
+//
+//	direction (1 byte, 1 if sent) | time since the start (8, ns) | length (4) | frame
+//
+// The handshake is not part of it, so neither is the PSK proof.
+const (
+	recordingMagic   = "APDTREC"
+	recordingVersion = 1
+)
+
+// ErrNotRecording is returned for files that are not session recordings.
+var ErrNotRecording = errors.New("not a tunnel session recording")
+
+// Recorder writes a session's frames to a recording. The request and
+// response headers carrying credentials, such as Authorization, Cookie and
+// Set-Cookie, and the query string of the request line are overwritten with
+// asterisks of the same length, so the frames still parse. Bodies are
+// recorded as they are.
+type Recorder struct {
+	mu      sync.Mutex
+	w       *bufio.Writer
+	start   time.Time
+	dirs    [2]recordDirection
+	err     error
+	discard bool
+}
+
+// recordDirection splits one direction's bytes into frames.
+type recordDirection struct {
+	pending   []byte
+	redactors map[uint32]*redactor
+}
+
+// NewRecorder starts a recording of the client or server side of a session
+// on w.
+func NewRecorder(w io.Writer, client bool) (*Recorder, error) {
+	header := append([]byte(recordingMagic), recordingVersion, 0)
+	if client {
+		header[len(header)-1] = 1
+	}
+	r := &Recorder{w: bufio.NewWriter(w), start: time.Now()}
+	if _, err := r.w.Write(header); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// RecordSession starts recording the client or server side of the session on
+// conn to a new file in dir, for replay. It returns the connection to run the
+// session on and a function that finishes the recording, logging with logf.
+// If dir is empty or the file cannot be created, the session runs unrecorded.
+func RecordSession(conn net.Conn, dir string, client bool, logf func(string, ...interface{})) (net.Conn, func()) {
+	if dir == "" {
+		return conn, func() {}
+	}
+	name := fmt.Sprintf("tunnel-%s-%s.rec", time.Now().UTC().Format("20060102T150405.000"),
+		strings.NewReplacer(":", "_", "[", "", "]", "").Replace(conn.RemoteAddr().String()))
+	path := filepath.Join(dir, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		logf("Failed to create session recording: %v", err)
+		return conn, func() {}
+	}
+	recorder, err := NewRecorder(f, client)
+	if err != nil {
+		f.Close()
+		logf("Failed to start session recording: %v", err)
+		return conn, func() {}
+	}
+	logf("Recording tunnel session to %s, request and response bodies are not redacted", path)
+	return recorder.Conn(conn), func() {
+		if err := recorder.Flush(); err != nil {
+			logf("Failed to write session recording %s: %v", path, err)
+		}
+		f.Close()
+	}
+}
+
+// Conn returns conn with the frames read from and written to it recorded.
+// Pass it to NewSession in place of conn.
+func (r *Recorder) Conn(conn net.Conn) net.Conn {
+	return &recordedConn{Conn: conn, recorder: r}
+}
+
+// Flush writes the buffered records.
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	return r.w.Flush()
+}
+
+// Err returns the error that stopped the recording, if any.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+type recordedConn struct {
+	net.Conn
+	recorder *Recorder
+}
+
+func (c *recordedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.recorder.add(false, p[:n])
+	}
+	return n, err
+}
+
+func (c *recordedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.recorder.add(true, p[:n])
+	}
+	return n, err
+}
+
+// add records the complete frames among the bytes sent or received so far.
+// They are written out at once, so the recording of a process that crashes
+// holds everything up to the crash.
+func (r *Recorder) add(sent bool, p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil || r.discard {
+		return
+	}
+	defer func() {
+		if r.err == nil {
+			r.err = r.w.Flush()
+		}
+	}()
+	dir := &r.dirs[0]
+	if sent {
+		dir = &r.dirs[1]
+	}
+	dir.pending = append(dir.pending, p...)
+	at := time.Since(r.start)
+	for len(dir.pending) >= headerSize {
+		frame := dir.pending
+		typ := frame[0]
+		length := binary.BigEndian.Uint32(frame[6:10])
+		size := headerSize
+		if typ == frameData && length <= maxFrameSize {
+			size += int(length)
+		}
+		if len(frame) < size {
+			break
+		}
+		frame = append([]byte(nil), frame[:size]...)
+		dir.redact(frame)
+		if r.err = r.write(sent, at, frame); r.err != nil {
+			return
+		}
+		dir.pending = dir.pending[size:]
+		if typ == frameData && length > maxFrameSize {
+			// The session closes on it, nothing after it can be told
+			// apart into frames
+			r.discard = true
+			return
+		}
+	}
+}
+
+func (r *Recorder) write(sent bool, at time.Duration, frame []byte) error {
+	record := make([]byte, 13, 13+len(frame))
+	if sent {
+		record[0] = 1
+	}
+	binary.BigEndian.PutUint64(record[1:9], uint64(at))
+	binary.BigEndian.PutUint32(record[9:13], uint32(len(frame)))
+	_, err := r.w.Write(append(record, frame...))
+	return err
+}
+
+// redact overwrites the secrets in a data frame's payload, keeping track of
+// where each stream is in its HTTP header.
+func (d *recordDirection) redact(frame []byte) {
+	typ, flags := frame[0], frame[1]
+	id := binary.BigEndian.Uint32(frame[2:6])
+	if typ != frameData && typ != frameWindowUpdate {
+		return
+	}
+	if d.redactors == nil {
+		d.redactors = make(map[uint32]*redactor)
+	}
+	if typ == frameData && flags&flagSUM == 0 {
+		red := d.redactors[id]
+		if red == nil {
+			red = &redactor{}
+			d.redactors[id] = red
+		}
+		red.redact(frame[headerSize:])
+	}
+	if flags&(flagFIN|flagRST) != 0 {
+		delete(d.redactors, id)
+	}
+}
+
+// redactor overwrites secrets in the HTTP header at the start of a stream as
+// its bytes pass, one frame at a time.
+type redactor struct {
+	body    bool   // past the header
+	line    int    // of the current header block
+	lineLen int    // bytes on the current line, without CR
+	first   []byte // start of the block's first line
+	name    []byte // header name on the current line
+	value   bool   // past the colon
+	secret  bool   // the value is overwritten
+	query   bool   // in the query of the request line
+}
+
+// maxRedactedName bounds the header names kept; longer ones are not secret.
+const maxRedactedName = 64
+
+func (red *redactor) redact(p []byte) {
+	for i, b := range p {
+		if red.body {
+			return
+		}
+		switch b {
+		case '\n':
+			if red.lineLen == 0 && red.line > 0 {
+				red.endBlock()
+				continue
+			}
+			red.line++
+			red.lineLen, red.name, red.value, red.secret, red.query = 0, red.name[:0], false, false, false
+			continue
+		case '\r':
+			continue
+		}
+		red.lineLen++
+		if red.line == 0 {
+			if len(red.first) < 16 {
+				red.first = append(red.first, b)
+			}
+			switch {
+			case b == '?':
+				red.query = true
+			case b == ' ' && red.query:
+				red.query = false
+			case red.query:
+				p[i] = '*'
+			}
+			continue
+		}
+		switch {
+		case red.secret:
+			p[i] = '*'
+		case red.value:
+		case b == ':':
+			red.value = true
+			red.secret = secretHeader(string(red.name))
+		case len(red.name) < maxRedactedName:
+			red.name = append(red.name, b)
+		}
+	}
+}
+
+// endBlock ends a header block. An interim 1xx response other than 101 is
+// followed by another header block, anything else by the body.
+func (red *redactor) endBlock() {
+	status := strings.Fields(string(red.first))
+	if len(status) > 1 && strings.HasPrefix(status[0], "HTTP/") && len(status[1]) == 3 && status[1][0] == '1' && status[1] != "101" {
+		*red = redactor{}
+		return
+	}
+	red.body = true
+}
+
+// secretHeader reports whether a header's value is a credential.
+func secretHeader(name string) bool {
+	name = strings.ToLower(strings.TrimSpace(name))
+	switch name {
+	case "authorization", "proxy-authorization", "cookie", "set-cookie":
+		return true
+	}
+	for _, word := range []string{"token", "secret", "password", "api-key", "apikey"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// Record is one frame of a recording.
+type Record struct {
+	Sent  bool          // by the recorded side, else received from its peer
+	At    time.Duration // since the recording started
+	Frame []byte        // header and payload
+}
+
+// Type returns the frame type, such as "data" or "window update".
+func (rec Record) Type() string {
+	switch rec.Frame[0] {
+	case frameData:
+		return "data"
+	case frameWindowUpdate:
+		return "window update"
+	case framePing:
+		return "ping"
+	case frameGoAway:
+		return "go away"
+	}
+	return fmt.Sprintf("type %d", rec.Frame[0])
+}
+
+// StreamID returns the stream ID, or the ping ID of a ping.
+func (rec Record) StreamID() uint32 {
+	return binary.BigEndian.Uint32(rec.Frame[2:6])
+}
+
+// Length returns the length field: the payload length of a data frame, the
+// increment of a window update.
+func (rec Record) Length() uint32 {
+	return binary.BigEndian.Uint32(rec.Frame[6:10])
+}
+
+// Payload returns the bytes following the header.
+func (rec Record) Payload() []byte {
+	return rec.Frame[headerSize:]
+}
+
+// Flags returns the frame's flags by name, joined with |.
+func (rec Record) Flags() string {
+	var names []string
+	for _, flag := range []struct {
+		bit  byte
+		name string
+	}{{flagSYN, "SYN"}, {flagACK, "ACK"}, {flagFIN, "FIN"}, {flagRST, "RST"}, {flagPRI, "PRI"}, {flagSUM, "SUM"}} {
+		if rec.Frame[1]&flag.bit != 0 {
+			names = append(names, flag.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// RecordingReader reads the records of a recording in order.
+type RecordingReader struct {
+	r      *bufio.Reader
+	Client bool // the recorded side is the client
+}
+
+// NewRecordingReader reads the start of a recording.
+func NewRecordingReader(r io.Reader) (*RecordingReader, error) {
+	reader := &RecordingReader{r: bufio.NewReader(r)}
+	header := make([]byte, len(recordingMagic)+2)
+	if _, err := io.ReadFull(reader.r, header); err != nil || string(header[:len(recordingMagic)]) != recordingMagic {
+		return nil, ErrNotRecording
+	}
+	if version := header[len(recordingMagic)]; version != recordingVersion {
+		return nil, fmt.Errorf("recording version %d is not supported", version)
+	}
+	reader.Client = header[len(recordingMagic)+1] == 1
+	return reader, nil
+}
+
+// Next returns the next record, io.EOF after the last.
+func (r *RecordingReader) Next() (Record, error) {
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("recording ends within a record")
+		}
+		return Record{}, err
+	}
+	length := binary.BigEndian.Uint32(header[9:13])
+	if length < headerSize || length > headerSize+maxFrameSize {
+		return Record{}, fmt.Errorf("record of %d bytes is not a frame", length)
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(r.r, frame); err != nil {
+		return Record{}, fmt.Errorf("recording ends within a record")
+	}
+	return Record{
+		Sent:  header[0] == 1,
+		At:    time.Duration(binary.BigEndian.Uint64(header[1:9])),
+		Frame: frame,
+	}, nil
+}
+
+// replayWait bounds how long Replay waits on the session for one record,
+// e.g. for window to send a recorded data frame.
+const replayWait = 5 * time.Second
+
+// Replay plays a recording back through a new session in place of the side
+// it recorded. The frames its peer sent are written to the session, which
+// parses them as it did then; the streams the recorded side opened are
+// opened again, and the data it sent, closed or reset is sent, closed and
+// reset again, in the recorded order. Each stream is passed to handle,
+// which reads it, with opened telling whether the recorded side opened it.
+// Replay returns the error the session failed with, nil if the recording
+// ran out with the session intact, once every call to handle has returned.
+func Replay(recording *RecordingReader, handle func(stream *Stream, opened bool)) error {
+	var handlers sync.WaitGroup
+	defer handlers.Wait()
+	local, peer := net.Pipe()
+	session := NewSession(local, recording.Client)
+	defer session.Close()
+	go io.Copy(io.Discard, peer)
+
+	var mu sync.Mutex
+	streams := make(map[uint32]*Stream)
+	added := make(chan struct{}, 1)
+	register := func(stream *Stream, opened bool) {
+		mu.Lock()
+		streams[stream.id] = stream
+		mu.Unlock()
+		select {
+		case added <- struct{}{}:
+		default:
+		}
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			handle(stream, opened)
+		}()
+	}
+	go func() {
+		for {
+			stream, err := session.Accept()
+			if err != nil {
+				return
+			}
+			register(stream, false)
+		}
+	}()
+	// streamFor waits for the stream the peer opened to be accepted
+	streamFor := func(id uint32) *Stream {
+		deadline := time.After(replayWait)
+		for {
+			mu.Lock()
+			stream := streams[id]
+			mu.Unlock()
+			if stream != nil {
+				return stream
+			}
+			select {
+			case <-added:
+			case <-deadline:
+				return nil
+			case <-session.CloseChan():
+				return nil
+			}
+		}
+	}
+
+	for {
+		rec, err := recording.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !rec.Sent {
+			if rec.Frame[0] == frameData {
+				mu.Lock()
+				stream := streams[rec.StreamID()]
+				mu.Unlock()
+				stream.waitWindow(rec.Length())
+			}
+			peer.SetWriteDeadline(time.Now().Add(replayWait))
+			if _, err := peer.Write(rec.Frame); err != nil {
+				break
+			}
+			continue
+		}
+		if err := replaySent(session, recording.Client, rec, streamFor, register); err != nil {
+			return err
+		}
+	}
+	peer.Close()
+	<-session.CloseChan()
+	if err := session.Err(); err != ErrPeerClosed && err != ErrSessionClosed {
+		return err
+	}
+	return nil
+}
+
+// replaySent has the session do what the recorded side did when it sent the
+// frame. Frames the session sends of its own accord, such as window updates
+// and ping answers, need nothing.
+func replaySent(session *Session, client bool, rec Record, streamFor func(uint32) *Stream, register func(*Stream, bool)) error {
+	flags := rec.Frame[1]
+	id := rec.StreamID()
+	switch rec.Frame[0] {
+	case frameGoAway:
+		session.GoAway()
+		return nil
+	case frameData, frameWindowUpdate:
+	default:
+		return nil
+	}
+
+	local := id%2 == 1 == client
+	if flags&flagSYN != 0 && local {
+		open := session.Open
+		if flags&flagPRI != 0 {
+			open = session.OpenPriority
+		}
+		stream, err := open()
+		if err != nil {
+			return nil
+		}
+		if stream.id != id {
+			return fmt.Errorf("replay opened stream %d where the recording has %d", stream.id, id)
+		}
+		register(stream, true)
+	}
+	stream := streamFor(id)
+	if stream == nil {
+		return nil
+	}
+	switch {
+	case flags&flagRST != 0:
+		stream.Reset()
+	case rec.Frame[0] != frameData:
+	case flags&flagSUM != 0:
+		stream.Close()
+	default:
+		if payload := rec.Payload(); len(payload) > 0 {
+			stream.SetWriteDeadline(time.Now().Add(replayWait))
+			if _, err := stream.Write(payload); err != nil && !errors.Is(err, ErrStreamReset) {
+				return fmt.Errorf("failed to replay %d bytes on stream %d: %v", len(payload), id, err)
+			}
+		}
+		if flags&flagFIN != 0 {
+			stream.Close()
+		}
+	}
+	return nil
+}
+
+// waitWindow waits for handle to read enough of the stream for n more bytes
+// to fit its receive window, as they did when the frame was recorded. A peer
+// that overran the window then overruns it again once the wait is over.
+func (st *Stream) waitWindow(n uint32) {
+	if st == nil {
+		return
+	}
+	deadline := time.Now().Add(replayWait)
+	for time.Now().Before(deadline) {
+		st.mu.Lock()
+		fits := st.recvWindow >= n || st.reset
+		st.mu.Unlock()
+		if fits {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
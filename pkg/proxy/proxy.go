@@ -0,0 +1,72 @@
+// Package proxy holds what the bridge and the offramp agree on when they pass
+// HTTP requests through the tunnel: the headers they exchange, how requests
+// are classified and how responses are written onto a tunnel stream.
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ErrorCodeHeader names the cause of a response that apiduct generated itself
+// rather than passing on from the target. The offramp removes it from target
+// responses.
+const ErrorCodeHeader = "X-Apiduct-Error"
+
+// TraceHeader carries the bridge-assigned request ID through the tunnel. The
+// offramp logs it and forwards it to the target as X-Request-Id.
+const TraceHeader = "X-Apiduct-Trace-Id"
+
+// IsWebSocket reports whether r asks to upgrade the connection to WebSocket.
+func IsWebSocket(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RemoveHopHeaders removes the headers that only concern one connection:
+// Connection, the headers it names, Keep-Alive and Proxy-Connection. The
+// bridge keeps or closes its client connections, and the offramp its target
+// connections, on their own, so a client or target that closes after every
+// message must not make the other end do the same. WebSocket upgrades keep
+// theirs, the stream is taken over as the connection.
+func RemoveHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				h.Del(token)
+			}
+		}
+	}
+	h.Del("Connection")
+	h.Del("Keep-Alive")
+	h.Del("Proxy-Connection")
+}
+
+// IsGRPC reports whether r is a gRPC call. Its request and response bodies
+// are streams of messages in both directions at once, and its status arrives
+// in the response trailers.
+func IsGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// CountingReader counts the bytes read from a body.
+type CountingReader struct {
+	io.ReadCloser
+	N int64
+}
+
+func (c *CountingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.N += int64(n)
+	return n, err
+}
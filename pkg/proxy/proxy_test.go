@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsWebSocket(t *testing.T) {
+	tests := []struct {
+		upgrade    string
+		connection []string
+		want       bool
+	}{
+		{"websocket", []string{"Upgrade"}, true},
+		{"WebSocket", []string{"keep-alive, upgrade"}, true},
+		{"websocket", []string{"keep-alive", "Upgrade"}, true},
+		{"websocket", []string{"keep-alive"}, false},
+		{"h2c", []string{"Upgrade"}, false},
+		{"", nil, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		if tt.upgrade != "" {
+			r.Header.Set("Upgrade", tt.upgrade)
+		}
+		r.Header["Connection"] = tt.connection
+		if got := IsWebSocket(r); got != tt.want {
+			t.Errorf("IsWebSocket(Upgrade: %q, Connection: %q) = %v, want %v", tt.upgrade, tt.connection, got, tt.want)
+		}
+	}
+}
+
+func TestIsGRPC(t *testing.T) {
+	tests := map[string]bool{
+		"application/grpc":       true,
+		"application/grpc+proto": true,
+		"application/json":       false,
+		"":                       false,
+	}
+	for contentType, want := range tests {
+		r := httptest.NewRequest("POST", "/pkg.Service/Method", nil)
+		r.Header.Set("Content-Type", contentType)
+		if got := IsGRPC(r); got != want {
+			t.Errorf("IsGRPC(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	tests := []struct {
+		roundTrip time.Duration
+		reported  string
+		want      string
+	}{
+		{
+			50 * time.Millisecond,
+			FormatTiming(5*time.Millisecond, 30*time.Millisecond),
+			`queue;dur=5.000;desc="Offramp queue", tunnel;dur=15.000;desc="Tunnel transfer", target;dur=30.000;desc="Target"`,
+		},
+		{
+			// Clocks of different processes: the tunnel never goes negative
+			10 * time.Millisecond,
+			"queue;dur=4, target;dur=8.5",
+			`queue;dur=4.000;desc="Offramp queue", tunnel;dur=0.000;desc="Tunnel transfer", target;dur=8.500;desc="Target"`,
+		},
+		{
+			12 * time.Millisecond,
+			"",
+			`tunnel;dur=12.000;desc="Tunnel and target"`,
+		},
+		{
+			12 * time.Millisecond,
+			"queue;dur=-1, target;dur=3",
+			`tunnel;dur=12.000;desc="Tunnel and target"`,
+		},
+	}
+	for _, tt := range tests {
+		if got := ServerTiming(tt.roundTrip, tt.reported); got != tt.want {
+			t.Errorf("ServerTiming(%s, %q) = %q, want %q", tt.roundTrip, tt.reported, got, tt.want)
+		}
+	}
+}
+
+// http2Body ends with the trailers of resp, as HTTP/2 response bodies do.
+type http2Body struct {
+	io.Reader
+	resp *http.Response
+}
+
+func (b *http2Body) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		b.resp.Trailer = http.Header{"Grpc-Status": {"0"}}
+	}
+	return n, err
+}
+
+func (b *http2Body) Close() error { return nil }
+
+func TestWriteResponseHTTP2Trailers(t *testing.T) {
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    2,
+		Header:        http.Header{"Content-Type": {"application/grpc"}},
+		ContentLength: -1,
+	}
+	resp.Body = &http2Body{Reader: strings.NewReader("message"), resp: resp}
+
+	var stream bytes.Buffer
+	if err := WriteResponse(&stream, resp); err != nil {
+		t.Fatalf("WriteResponse: %v", err)
+	}
+	got, err := http.ReadResponse(bufio.NewReader(&stream), nil)
+	if err != nil {
+		t.Fatalf("failed to read the response back: %v", err)
+	}
+	body, _ := io.ReadAll(got.Body)
+	if got.ProtoMajor != 1 || string(body) != "message" {
+		t.Errorf("read HTTP/%d.%d with body %q, want HTTP/1.1 with %q", got.ProtoMajor, got.ProtoMinor, body, "message")
+	}
+	if status := got.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("Grpc-Status trailer = %q, want %q", status, "0")
+	}
+}
+
+func TestWriteResponseCloseDelimited(t *testing.T) {
+	target := "HTTP/1.0 200 OK\r\nConnection: close\r\n\r\nread to the end"
+	resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(target)), nil)
+	if err != nil {
+		t.Fatalf("failed to read the target response: %v", err)
+	}
+
+	var stream bytes.Buffer
+	if err := WriteResponse(&stream, resp); err != nil {
+		t.Fatalf("WriteResponse: %v", err)
+	}
+	// Cut off the last chunk, as a stream reset mid-body would
+	truncated := strings.TrimSuffix(stream.String(), "0\r\n\r\n")
+	if truncated == stream.String() {
+		t.Fatalf("body was not chunked:\n%s", stream.String())
+	}
+	got, err := http.ReadResponse(bufio.NewReader(&stream), nil)
+	if err != nil {
+		t.Fatalf("failed to read the response back: %v", err)
+	}
+	body, _ := io.ReadAll(got.Body)
+	if got.Close || string(body) != "read to the end" {
+		t.Errorf("read close %v with body %q, want keep-alive with %q", got.Close, body, "read to the end")
+	}
+
+	got, err = http.ReadResponse(bufio.NewReader(strings.NewReader(truncated)), nil)
+	if err != nil {
+		t.Fatalf("failed to read the truncated response: %v", err)
+	}
+	if _, err := io.ReadAll(got.Body); err == nil {
+		t.Error("truncated body read without an error")
+	}
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{
+		"Connection":   {"close, X-Hop"},
+		"Keep-Alive":   {"timeout=5"},
+		"X-Hop":        {"1"},
+		"Content-Type": {"text/plain"},
+	}
+	RemoveHopHeaders(h)
+	if len(h) != 1 || h.Get("Content-Type") != "text/plain" {
+		t.Errorf("headers left: %v, want only Content-Type", h)
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	var stream bytes.Buffer
+	if err := ErrorResponse(req, http.StatusGatewayTimeout, "TARGET_TIMEOUT", "Target did not respond in time").Write(&stream); err != nil {
+		t.Fatalf("failed to write error response: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(&stream), req)
+	if err != nil {
+		t.Fatalf("failed to read error response: %v", err)
+	}
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusGatewayTimeout)
+	}
+	if code := resp.Header.Get(ErrorCodeHeader); code != "TARGET_TIMEOUT" {
+		t.Errorf("%s = %q, want %q", ErrorCodeHeader, code, "TARGET_TIMEOUT")
+	}
+	var body map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if body["code"] != "TARGET_TIMEOUT" || body["error"] != "Target did not respond in time" {
+		t.Errorf("body = %v", body)
+	}
+}
+
+func TestCountingReader(t *testing.T) {
+	body := &CountingReader{ReadCloser: io.NopCloser(strings.NewReader("twelve bytes"))}
+	io.Copy(io.Discard, body)
+	if body.N != 12 {
+		t.Errorf("N = %d, want 12", body.N)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	tests := []struct {
+		rewrite Rewrite
+		path    string
+		want    string
+	}{
+		{Rewrite{StripPrefix: "/api"}, "/api/v1/users", "/v1/users"},
+		{Rewrite{StripPrefix: "/api/"}, "/api", "/"},
+		{Rewrite{StripPrefix: "/api"}, "/apiary", "/apiary"},
+		{Rewrite{AddPrefix: "/internal/"}, "/v1/users", "/internal/v1/users"},
+		{Rewrite{StripPrefix: "/api", AddPrefix: "/svc"}, "/api/a%2Fb", "/svc/a%2Fb"},
+		{Rewrite{Replace: []RewriteRule{{Pattern: `^/users/(\d+)$`, Replacement: "/v2/accounts/$1"}}}, "/users/42", "/v2/accounts/42"},
+		{Rewrite{Replace: []RewriteRule{{Pattern: `^/old`, Replacement: ""}}}, "/old", "/"},
+	}
+	for _, tt := range tests {
+		if err := tt.rewrite.Compile(); err != nil {
+			t.Fatalf("Compile(%+v): %v", tt.rewrite, err)
+		}
+		u, _ := url.Parse("http://example.com" + tt.path + "?q=1")
+		if err := tt.rewrite.Apply(u); err != nil {
+			t.Fatalf("Apply(%s): %v", tt.path, err)
+		}
+		if got := u.RequestURI(); got != tt.want+"?q=1" {
+			t.Errorf("%+v rewrote %s to %s, want %s?q=1", tt.rewrite, tt.path, got, tt.want)
+		}
+	}
+
+	if err := (&Rewrite{StripPrefix: "api"}).Compile(); err == nil {
+		t.Error("Compile accepted a prefix without a leading slash")
+	}
+	if _, err := ParseRewriteRule("no-separator"); err == nil {
+		t.Error("ParseRewriteRule accepted a rule without replacement")
+	}
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Limits on the header of a request or response read from the tunnel, so a
+// peer cannot make the other side buffer headers without end.
+const (
+	MaxHeaderBytes = 1 << 20 // request or status line and header fields
+	MaxHeaders     = 1000    // header fields, counting repeated ones
+)
+
+// ErrHeaderTooLarge is returned for a message header over MaxHeaderBytes or
+// MaxHeaders.
+var ErrHeaderTooLarge = errors.New("message header too large")
+
+// Reader reads HTTP messages whose header is held to MaxHeaderBytes and
+// MaxHeaders. The body that follows is not limited.
+type Reader struct {
+	*bufio.Reader
+	limit headerLimit
+}
+
+// NewReader returns a Reader reading from r.
+func NewReader(r io.Reader) *Reader {
+	reader := &Reader{limit: headerLimit{r: r, n: -1}}
+	reader.Reader = bufio.NewReader(&reader.limit)
+	return reader
+}
+
+// ReadRequest reads a request, as http.ReadRequest.
+func (r *Reader) ReadRequest() (*http.Request, error) {
+	r.limit.n = MaxHeaderBytes
+	req, err := http.ReadRequest(r.Reader)
+	if err = r.headerRead(err); err != nil {
+		return nil, err
+	}
+	if err := checkFields(req.Header); err != nil {
+		req.Body.Close()
+		return nil, err
+	}
+	return req, nil
+}
+
+// ReadResponse reads the response to req, as http.ReadResponse.
+func (r *Reader) ReadResponse(req *http.Request) (*http.Response, error) {
+	r.limit.n = MaxHeaderBytes
+	resp, err := http.ReadResponse(r.Reader, req)
+	if err = r.headerRead(err); err != nil {
+		return nil, err
+	}
+	if err := checkFields(resp.Header); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// headerRead lifts the limit for the body and turns a read that ran into it
+// into ErrHeaderTooLarge.
+func (r *Reader) headerRead(err error) error {
+	exhausted := r.limit.n == 0
+	r.limit.n = -1
+	if err != nil && exhausted {
+		return ErrHeaderTooLarge
+	}
+	return err
+}
+
+func checkFields(header http.Header) error {
+	fields := 0
+	for _, values := range header {
+		fields += len(values)
+	}
+	if fields > MaxHeaders {
+		return fmt.Errorf("%w: %d fields", ErrHeaderTooLarge, fields)
+	}
+	return nil
+}
+
+// headerLimit reads at most n bytes from r, any number if n is negative.
+type headerLimit struct {
+	r io.Reader
+	n int64
+}
+
+func (l *headerLimit) Read(p []byte) (int, error) {
+	if l.n == 0 {
+		return 0, io.EOF
+	}
+	if l.n > 0 && int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	if l.n > 0 {
+		l.n -= int64(n)
+	}
+	return n, err
+}
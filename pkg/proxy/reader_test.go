@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReaderLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		err     error
+	}{
+		{"small", "GET /orders HTTP/1.1\r\nHost: api\r\nContent-Length: 4\r\n\r\nbody", nil},
+		{"long header", "GET / HTTP/1.1\r\nHost: api\r\nX-Big: " + strings.Repeat("a", MaxHeaderBytes) + "\r\n\r\n", ErrHeaderTooLarge},
+		{"many fields", "GET / HTTP/1.1\r\nHost: api\r\n" + strings.Repeat("X-A: b\r\n", MaxHeaders+1) + "\r\n", ErrHeaderTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := NewReader(strings.NewReader(tt.message)).ReadRequest()
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			body, _ := io.ReadAll(req.Body)
+			if string(body) != "body" {
+				t.Errorf("body = %q", body)
+			}
+		})
+	}
+}
+
+func TestReaderBodyUnlimited(t *testing.T) {
+	body := strings.Repeat("x", 2*MaxHeaderBytes)
+	reader := NewReader(strings.NewReader("HTTP/1.1 200 OK\r\n\r\n" + body))
+	resp, err := reader.ReadResponse(&http.Request{Method: http.MethodGet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(resp.Body)
+	if err != nil || len(got) != len(body) {
+		t.Errorf("read %d bytes of the body, err %v; want %d", len(got), err, len(body))
+	}
+}
+
+// FuzzReadRequest feeds arbitrary bytes to the reader of requests arriving
+// through the tunnel, reading their bodies to the end.
+func FuzzReadRequest(f *testing.F) {
+	f.Add("GET /orders?id=1 HTTP/1.1\r\nHost: api\r\n\r\n")
+	f.Add("POST / HTTP/1.1\r\nHost: api\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nbody\r\n0\r\nGrpc-Status: 0\r\n\r\n")
+	f.Add("CONNECT db:5432 HTTP/1.1\r\nHost: db:5432\r\n\r\n")
+	f.Fuzz(func(t *testing.T, message string) {
+		req, err := NewReader(strings.NewReader(message)).ReadRequest()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	})
+}
+
+// FuzzReadResponse feeds arbitrary bytes to the reader of responses arriving
+// through the tunnel, reading their bodies to the end.
+func FuzzReadResponse(f *testing.F) {
+	f.Add("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	f.Add("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	f.Add("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: Grpc-Status\r\n\r\n0\r\nGrpc-Status: 0\r\n\r\n")
+	f.Fuzz(func(t *testing.T, message string) {
+		resp, err := NewReader(strings.NewReader(message)).ReadResponse(&http.Request{Method: http.MethodGet})
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	})
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// WriteResponse sends a response through the tunnel as HTTP/1.1. Bodies of
+// unknown length are chunked so that the trailers can follow them, which
+// HTTP/2 responses deliver only once the body is read, and so that a body
+// the target ended by closing its connection, as HTTP/1.0 servers do, ends
+// with a last chunk: the bridge can tell it from one cut short. Whether the
+// target closed its connection is not passed on.
+func WriteResponse(w io.Writer, resp *http.Response) error {
+	resp.Close = false
+	RemoveHopHeaders(resp.Header)
+	closeDelimited := resp.ProtoMajor == 1 && resp.ContentLength < 0 && len(resp.TransferEncoding) == 0
+	if resp.ProtoMajor != 2 && !closeDelimited {
+		return resp.Write(w)
+	}
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	if resp.ContentLength < 0 {
+		resp.TransferEncoding = []string{"chunked"}
+	}
+	// Response.Write sends the trailers it was given at the start, so hand
+	// it a map to fill in once the target's trailers arrived
+	trailer := http.Header{}
+	resp.Body = &trailerReader{ReadCloser: resp.Body, resp: resp, trailer: trailer}
+	resp.Trailer = trailer
+	return resp.Write(w)
+}
+
+// trailerReader copies the trailers of resp into trailer at the end of the
+// body.
+type trailerReader struct {
+	io.ReadCloser
+	resp    *http.Response
+	trailer http.Header
+}
+
+func (t *trailerReader) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if err == io.EOF {
+		for key, values := range t.resp.Trailer {
+			t.trailer[key] = values
+		}
+	}
+	return n, err
+}
+
+// CopyTrailers passes the trailers that followed the response body on to the
+// client, e.g. the grpc-status of a gRPC call.
+func CopyTrailers(w http.ResponseWriter, resp *http.Response) {
+	for key, values := range resp.Trailer {
+		for _, value := range values {
+			w.Header().Add(http.TrailerPrefix+key, value)
+		}
+	}
+}
+
+// ErrorResponse returns an apiduct error answering req: the code in the
+// X-Apiduct-Error header and a JSON body such as
+// {"error": "Target did not respond in time", "code": "TARGET_TIMEOUT"}.
+func ErrorResponse(req *http.Request, status int, code, message string) *http.Response {
+	body, _ := json.Marshal(map[string]string{"error": message, "code": code})
+	body = append(body, '\n')
+	return &http.Response{
+		Status:     strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode: status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":  {"application/json"},
+			ErrorCodeHeader: {code},
+		},
+		Body:          io.NopCloser(strings.NewReader(string(body))),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Rewrite changes the path of a request on its way to the target, e.g. to
+// serve /api/v1/* publicly from a service that serves /v1/*. StripPrefix is
+// removed first, then AddPrefix is put in front and the Replace rules are
+// applied in order. Rules work on the escaped path, so encoded characters
+// such as %2F are kept as sent. The query is left alone.
+type Rewrite struct {
+	StripPrefix string        `json:"strip_prefix,omitempty"`
+	AddPrefix   string        `json:"add_prefix,omitempty"`
+	Replace     []RewriteRule `json:"replace,omitempty"`
+}
+
+// RewriteRule replaces the matches of the regular expression Pattern with
+// Replacement, in which $1 or ${name} stand for submatches.
+type RewriteRule struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+
+	re *regexp.Regexp
+}
+
+// ParseRewriteRule parses a rule given as pattern=replacement.
+func ParseRewriteRule(value string) (RewriteRule, error) {
+	pattern, replacement, ok := strings.Cut(value, "=")
+	if !ok || pattern == "" {
+		return RewriteRule{}, fmt.Errorf("invalid rewrite rule %q, expected pattern=replacement", value)
+	}
+	return RewriteRule{Pattern: pattern, Replacement: replacement}, nil
+}
+
+// Compile checks the prefixes and compiles the rules. A nil Rewrite is
+// valid and changes nothing.
+func (rw *Rewrite) Compile() error {
+	if rw == nil {
+		return nil
+	}
+	for _, prefix := range []string{rw.StripPrefix, rw.AddPrefix} {
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("path prefix %q must start with /", prefix)
+		}
+	}
+	for i := range rw.Replace {
+		re, err := regexp.Compile(rw.Replace[i].Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid rewrite pattern %q: %v", rw.Replace[i].Pattern, err)
+		}
+		rw.Replace[i].re = re
+	}
+	return nil
+}
+
+// Path returns the escaped path rewritten. StripPrefix only matches whole
+// segments: /api strips /api and /api/users, not /apiary.
+func (rw *Rewrite) Path(path string) string {
+	if rw == nil {
+		return path
+	}
+	if prefix := strings.TrimSuffix(rw.StripPrefix, "/"); prefix != "" {
+		if rest, ok := strings.CutPrefix(path, prefix); ok && (rest == "" || rest[0] == '/') {
+			path = rest
+		}
+	}
+	if rw.AddPrefix != "" {
+		path = strings.TrimSuffix(rw.AddPrefix, "/") + path
+	}
+	for _, rule := range rw.Replace {
+		path = rule.re.ReplaceAllString(path, rule.Replacement)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// Apply rewrites the path of u.
+func (rw *Rewrite) Apply(u *url.URL) error {
+	if rw == nil {
+		return nil
+	}
+	path := rw.Path(u.EscapedPath())
+	unescaped, err := url.PathUnescape(path)
+	if err != nil {
+		return fmt.Errorf("rewritten path %q is not valid: %v", path, err)
+	}
+	u.Path, u.RawPath = unescaped, path
+	return nil
+}
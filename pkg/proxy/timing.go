@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimingHeader asks the offramp to report how long a request waited in its
+// queue and how long the target took, and carries the answer back in
+// Server-Timing syntax. It never reaches the target or the client.
+const TimingHeader = "X-Apiduct-Timing"
+
+// FormatTiming returns the TimingHeader value for a request that waited
+// queued for a worker and target for the target's response headers.
+func FormatTiming(queued, target time.Duration) string {
+	return fmt.Sprintf("queue;dur=%s, target;dur=%s", milliseconds(queued), milliseconds(target))
+}
+
+// ServerTiming returns the Server-Timing header for a response that took
+// roundTrip from opening the tunnel stream to its response headers, given
+// what the offramp reported. The tunnel transfer is what is left of the round
+// trip after the offramp's queue and the target. Offramps that report nothing
+// only get the round trip attributed to the tunnel.
+func ServerTiming(roundTrip time.Duration, reported string) string {
+	queue, hasQueue := timingDuration(reported, "queue")
+	target, hasTarget := timingDuration(reported, "target")
+	if !hasQueue || !hasTarget {
+		return fmt.Sprintf(`tunnel;dur=%s;desc="Tunnel and target"`, milliseconds(roundTrip))
+	}
+	tunnel := roundTrip - queue - target
+	if tunnel < 0 {
+		tunnel = 0
+	}
+	return fmt.Sprintf(`queue;dur=%s;desc="Offramp queue", tunnel;dur=%s;desc="Tunnel transfer", target;dur=%s;desc="Target"`,
+		milliseconds(queue), milliseconds(tunnel), milliseconds(target))
+}
+
+// timingDuration returns the duration of the named metric in a Server-Timing
+// value.
+func timingDuration(value, name string) (time.Duration, bool) {
+	for _, metric := range strings.Split(value, ",") {
+		params := strings.Split(strings.TrimSpace(metric), ";")
+		if params[0] != name {
+			continue
+		}
+		for _, param := range params[1:] {
+			dur, ok := strings.CutPrefix(strings.TrimSpace(param), "dur=")
+			if !ok {
+				continue
+			}
+			ms, err := strconv.ParseFloat(dur, 64)
+			if err != nil || ms < 0 {
+				return 0, false
+			}
+			return time.Duration(ms * float64(time.Millisecond)), true
+		}
+	}
+	return 0, false
+}
+
+// milliseconds formats d in milliseconds, as Server-Timing durations are.
+func milliseconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", float64(d.Microseconds())/1000)
+}
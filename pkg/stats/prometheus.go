@@ -0,0 +1,75 @@
+package stats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// WritePrometheus writes all counters and gauges of registry in the
+// Prometheus text exposition format.
+func WritePrometheus(w io.Writer, registry *Registry) error {
+	type sample struct {
+		name   string
+		labels []string
+		value  int64
+	}
+	kinds := make(map[string]string)
+	var samples []sample
+	for _, c := range registry.Counters() {
+		kinds[c.Name] = "counter"
+		samples = append(samples, sample{c.Name, c.Labels, c.Value()})
+	}
+	for _, g := range registry.Gauges() {
+		kinds[g.Name] = "gauge"
+		samples = append(samples, sample{g.Name, g.Labels, g.Value()})
+	}
+	// Samples of a metric must be grouped under its TYPE line
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].name < samples[j].name })
+
+	buf := bufio.NewWriter(w)
+	previous := ""
+	for _, s := range samples {
+		if s.name != previous {
+			fmt.Fprintf(buf, "# TYPE %s %s\n", s.name, kinds[s.name])
+			previous = s.name
+		}
+		buf.WriteString(s.name)
+		if len(s.labels) > 0 {
+			buf.WriteByte('{')
+			for i := 0; i+1 < len(s.labels); i += 2 {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				fmt.Fprintf(buf, "%s=\"%s\"", s.labels[i], escapeLabelValue(s.labels[i+1]))
+			}
+			buf.WriteByte('}')
+		}
+		fmt.Fprintf(buf, " %d\n", s.value)
+	}
+	return buf.Flush()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+// Serve serves registry for Prometheus at /metrics on listener until it
+// fails, logging with logf where it serves and the writes that failed.
+func Serve(listener net.Listener, registry *Registry, logf func(string, ...interface{})) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := WritePrometheus(w, registry); err != nil {
+			logf("Failed to write metrics: %v", err)
+		}
+	})
+	logf("Serving Prometheus metrics on %s/metrics", listener.Addr())
+	return http.Serve(listener, mux)
+}
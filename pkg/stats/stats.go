@@ -0,0 +1,138 @@
+// Package stats keeps the counters and gauges of apiduct and writes them in
+// the Prometheus text exposition format.
+package stats
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing metric identified by a name and an
+// ordered list of label key/value pairs.
+type Counter struct {
+	Name   string
+	Labels []string // alternating key, value
+	value  int64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.value, n)
+}
+
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+// Gauge is a metric whose value is set rather than accumulated.
+type Gauge struct {
+	Name   string
+	Labels []string // alternating key, value
+	value  int64
+}
+
+func (g *Gauge) Set(n int64) {
+	atomic.StoreInt64(&g.value, n)
+}
+
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.value, n)
+}
+
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+// Registry holds counters and gauges.
+type Registry struct {
+	mu       sync.Mutex
+	counters map[string]*Counter
+	gauges   map[string]*Gauge
+}
+
+// Default is the registry of the process, which the tunnel protocol reports
+// to and the Prometheus endpoints expose.
+var Default = NewRegistry()
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{counters: make(map[string]*Counter), gauges: make(map[string]*Gauge)}
+}
+
+// Key identifies a metric by name and label values.
+func Key(name string, labels []string) string {
+	return name + "{" + strings.Join(labels, ",") + "}"
+}
+
+// Counter returns the counter for name and labels, creating it on first use.
+func (m *Registry) Counter(name string, labels ...string) *Counter {
+	key := Key(name, labels)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.counters[key]
+	if !ok {
+		c = &Counter{Name: name, Labels: labels}
+		m.counters[key] = c
+	}
+	return c
+}
+
+// Counters returns all counters sorted by name and labels.
+func (m *Registry) Counters() []*Counter {
+	m.mu.Lock()
+	keys := make([]string, 0, len(m.counters))
+	for key := range m.counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	counters := make([]*Counter, 0, len(keys))
+	for _, key := range keys {
+		counters = append(counters, m.counters[key])
+	}
+	m.mu.Unlock()
+	return counters
+}
+
+// Gauge returns the gauge for name and labels, creating it on first use.
+func (m *Registry) Gauge(name string, labels ...string) *Gauge {
+	key := Key(name, labels)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, ok := m.gauges[key]
+	if !ok {
+		g = &Gauge{Name: name, Labels: labels}
+		m.gauges[key] = g
+	}
+	return g
+}
+
+// DeleteGauge removes the gauge for name and labels, for example once the
+// tunnel it describes is gone.
+func (m *Registry) DeleteGauge(name string, labels ...string) {
+	m.mu.Lock()
+	delete(m.gauges, Key(name, labels))
+	m.mu.Unlock()
+}
+
+// Gauges returns all gauges sorted by name and labels.
+func (m *Registry) Gauges() []*Gauge {
+	m.mu.Lock()
+	keys := make([]string, 0, len(m.gauges))
+	for key := range m.gauges {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	gauges := make([]*Gauge, 0, len(keys))
+	for _, key := range keys {
+		gauges = append(gauges, m.gauges[key])
+	}
+	m.mu.Unlock()
+	return gauges
+}
@@ -0,0 +1,49 @@
+package stats
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+	registry.Counter("requests_total", "route", "api").Inc()
+	registry.Counter("requests_total", "route", "api").Add(2)
+	registry.Counter("requests_total", "route", "web").Inc()
+	registry.Gauge("in_flight").Set(3)
+
+	if got := registry.Counter("requests_total", "route", "api").Value(); got != 3 {
+		t.Errorf("requests_total{route=api} = %d, want 3", got)
+	}
+	if got := len(registry.Counters()); got != 2 {
+		t.Errorf("registry has %d counters, want 2", got)
+	}
+	registry.DeleteGauge("in_flight")
+	if got := len(registry.Gauges()); got != 0 {
+		t.Errorf("registry has %d gauges after delete, want 0", got)
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	registry := NewRegistry()
+	registry.Counter("requests_total", "route", "web").Add(2)
+	registry.Counter("requests_total", "route", "api").Add(5)
+	registry.Gauge("tunnels").Set(1)
+	registry.Gauge("offramp_info", "name", "a \"quoted\"\\name\n").Set(1)
+
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf, registry); err != nil {
+		t.Fatalf("WritePrometheus: %v", err)
+	}
+	want := `# TYPE offramp_info gauge
+offramp_info{name="a \"quoted\"\\name\n"} 1
+# TYPE requests_total counter
+requests_total{route="api"} 5
+requests_total{route="web"} 2
+# TYPE tunnels gauge
+tunnels 1
+`
+	if got := buf.String(); got != want {
+		t.Errorf("WritePrometheus wrote\n%s\nwant\n%s", got, want)
+	}
+}
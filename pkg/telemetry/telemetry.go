@@ -0,0 +1,182 @@
+// Package telemetry sends the anonymous usage reports of apiduct binaries
+// whose operators opted in. A report says which version runs where and which
+// features it uses, and counts its error responses by code. It carries no
+// addresses, host names, routes, keys or request data.
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime"
+	"time"
+
+	"apiduct/pkg/stats"
+)
+
+// Values of the --telemetry flag. Telemetry is off unless the operator turns
+// it on.
+const (
+	Off = "off"
+	On  = "on"
+)
+
+// MinInterval is the shortest time allowed between two reports.
+const MinInterval = time.Hour
+
+// ErrorsMetric counts the error responses by their code label, which
+// reports include.
+const ErrorsMetric = "apiduct_errors_total"
+
+// Check validates the telemetry flags: mode, and when it is On the endpoint
+// and the interval.
+func Check(mode, endpoint string, interval time.Duration) error {
+	switch mode {
+	case Off:
+		return nil
+	case On:
+	default:
+		return fmt.Errorf("telemetry must be on or off")
+	}
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("telemetry endpoint must be an absolute http or https URL")
+	}
+	if interval < MinInterval {
+		return fmt.Errorf("telemetry interval must be at least %s", MinInterval)
+	}
+	return nil
+}
+
+// Report is the body of a telemetry report, sent as JSON.
+type Report struct {
+	Binary    string           `json:"binary"` // api-bridge or api-offramp
+	Version   string           `json:"version"`
+	GoVersion string           `json:"go_version"`
+	OS        string           `json:"os"`
+	Arch      string           `json:"arch"`
+	Instance  string           `json:"instance"` // random, new each time the process starts
+	Uptime    int64            `json:"uptime_seconds"`
+	Features  []string         `json:"features"`         // enabled
+	Errors    map[string]int64 `json:"errors,omitempty"` // error responses by code since startup
+}
+
+// Reporter sends a report every Interval, the first one an Interval after
+// it starts, so a binary that is restarted over and over reports nothing.
+type Reporter struct {
+	Endpoint string
+	Interval time.Duration
+	Binary   string
+	Version  string
+	Features func() []string // enabled features, asked anew for each report
+	Stats    *stats.Registry // holding the error counters reported
+
+	instance string
+	started  time.Time
+	client   *http.Client
+}
+
+// NewReporter returns a reporter sending to endpoint every interval, which
+// is raised to MinInterval if shorter, and the errors counted in
+// stats.Default.
+func NewReporter(endpoint string, interval time.Duration, binary, version string, features func() []string) *Reporter {
+	if interval < MinInterval {
+		interval = MinInterval
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &Reporter{
+		Endpoint: endpoint,
+		Interval: interval,
+		Binary:   binary,
+		Version:  version,
+		Features: features,
+		Stats:    stats.Default,
+		instance: hex.EncodeToString(id),
+		started:  time.Now(),
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Report returns the report that would be sent now.
+func (r *Reporter) Report() Report {
+	report := Report{
+		Binary:    r.Binary,
+		Version:   r.Version,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Instance:  r.instance,
+		Uptime:    int64(time.Since(r.started).Seconds()),
+		Features:  r.Features(),
+		Errors:    make(map[string]int64),
+	}
+	if report.Features == nil {
+		report.Features = []string{}
+	}
+	for _, counter := range r.Stats.Counters() {
+		if counter.Name != ErrorsMetric {
+			continue
+		}
+		for i := 0; i+1 < len(counter.Labels); i += 2 {
+			if counter.Labels[i] == "code" && counter.Value() > 0 {
+				report.Errors[counter.Labels[i+1]] += counter.Value()
+			}
+		}
+	}
+	return report
+}
+
+// Send posts the current report to the endpoint.
+func (r *Reporter) Send(ctx context.Context) error {
+	body, err := json.Marshal(r.Report())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("telemetry endpoint answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Run sends a report every interval until ctx is done, passing failures to
+// failed. A failed report is not retried before the next interval.
+func (r *Reporter) Run(ctx context.Context, failed func(error)) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := r.Send(ctx); err != nil && failed != nil {
+			failed(err)
+		}
+	}
+}
+
+// Start runs the reporter in the background for the life of the process,
+// logging with logf where it sends to and the reports that failed.
+func (r *Reporter) Start(logf func(string, ...interface{})) {
+	logf("Sending anonymous usage telemetry to %s every %s", r.Endpoint, r.Interval)
+	go r.Run(context.Background(), func(err error) {
+		logf("Failed to send telemetry: %v", err)
+	})
+}
@@ -0,0 +1,81 @@
+package telemetry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"apiduct/pkg/stats"
+)
+
+func TestSend(t *testing.T) {
+	reports := make(chan Report, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report Report
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			t.Errorf("decode report: %v", err)
+		}
+		reports <- report
+	}))
+	defer server.Close()
+
+	reporter := NewReporter(server.URL, time.Minute, "api-bridge", "v1.2.3", func() []string { return []string{"acme"} })
+	reporter.Stats = stats.NewRegistry()
+	reporter.Stats.Counter(ErrorsMetric, "code", "TUNNEL_UNAVAILABLE").Add(3)
+	reporter.Stats.Counter(ErrorsMetric, "code", "RATE_LIMITED").Inc()
+	if reporter.Interval != MinInterval {
+		t.Errorf("interval = %v, want it raised to %v", reporter.Interval, MinInterval)
+	}
+	if err := reporter.Send(context.Background()); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	report := <-reports
+	if report.Binary != "api-bridge" || report.Version != "v1.2.3" || report.Instance == "" {
+		t.Errorf("report = %+v", report)
+	}
+	if !reflect.DeepEqual(report.Features, []string{"acme"}) {
+		t.Errorf("features = %v", report.Features)
+	}
+	want := map[string]int64{"TUNNEL_UNAVAILABLE": 3, "RATE_LIMITED": 1}
+	if !reflect.DeepEqual(report.Errors, want) {
+		t.Errorf("errors = %v, want %v", report.Errors, want)
+	}
+}
+
+func TestSendFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	reporter := NewReporter(server.URL, time.Hour, "api-offramp", "dev", func() []string { return nil })
+	if err := reporter.Send(context.Background()); err == nil {
+		t.Error("Send succeeded against an endpoint answering 503")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		mode, endpoint string
+		interval       time.Duration
+		ok             bool
+	}{
+		{Off, "", 0, true},
+		{On, "https://telemetry.example.com/v1", MinInterval, true},
+		{"yes", "https://telemetry.example.com/v1", MinInterval, false},
+		{On, "telemetry.example.com/v1", MinInterval, false},
+		{On, "ftp://telemetry.example.com/v1", MinInterval, false},
+		{On, "https://telemetry.example.com/v1", time.Minute, false},
+	}
+	for _, test := range tests {
+		err := Check(test.mode, test.endpoint, test.interval)
+		if (err == nil) != test.ok {
+			t.Errorf("Check(%q, %q, %v) = %v, want ok %v", test.mode, test.endpoint, test.interval, err, test.ok)
+		}
+	}
+}
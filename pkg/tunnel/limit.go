@@ -0,0 +1,155 @@
+package tunnel
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"apiduct/pkg/stats"
+)
+
+// Limiter bounds the number of requests in flight. A nil Limiter admits
+// everything.
+type Limiter struct {
+	slots chan struct{}
+}
+
+// NewLimiter returns a limiter for max requests, or nil for no limit.
+func NewLimiter(max int) *Limiter {
+	if max <= 0 {
+		return nil
+	}
+	return &Limiter{slots: make(chan struct{}, max)}
+}
+
+// TryAcquire takes a slot without waiting, reporting whether one was free.
+func (l *Limiter) TryAcquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release frees a slot taken with TryAcquire.
+func (l *Limiter) Release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// Tuning of the adaptive concurrency limit
+const (
+	adaptiveInitialLimit = 20
+	adaptiveMaxLimit     = 1000 // without a maximum of its own
+	adaptiveWindow       = 100  // samples after which the lowest latency is renewed
+	adaptiveTolerance    = 2    // latency rise accepted before the limit shrinks
+	adaptiveSmoothing    = 0.2  // weight of each sample in the limit
+	adaptiveBackoff      = 0.9  // factor applied to the limit on failures
+)
+
+// adaptiveLimiter bounds the requests in flight on a tunnel by a limit that
+// follows the latency they see, using the gradient method: while responses
+// arrive within twice the lowest recent latency, the limit grows by about its
+// square root per sample, and as requests queue up in front of the target and
+// the latency rises further, it shrinks in proportion. Failed requests cut it
+// by a tenth. A nil limiter admits everything.
+type adaptiveLimiter struct {
+	mu       sync.Mutex
+	limit    float64
+	max      float64
+	inflight int
+	gauge    *stats.Gauge
+
+	// The lowest latency, in seconds, stands for an unloaded target. It is
+	// taken over from the window of samples before, so it follows changes.
+	minRTT, windowMin float64
+	samples           int
+}
+
+// newAdaptiveLimiter returns a limiter that never admits more than max
+// requests, or adaptiveMaxLimit if max is 0. The limit is kept in the
+// apiduct_tunnel_concurrency_limit gauge, labelled by labels.
+func newAdaptiveLimiter(max int, labels ...string) *adaptiveLimiter {
+	if max <= 0 {
+		max = adaptiveMaxLimit
+	}
+	l := &adaptiveLimiter{
+		max:   float64(max),
+		gauge: stats.Default.Gauge("apiduct_tunnel_concurrency_limit", labels...),
+	}
+	l.set(adaptiveInitialLimit)
+	return l
+}
+
+// tryAcquire takes a slot without waiting, reporting whether one was free.
+func (l *adaptiveLimiter) tryAcquire() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if float64(l.inflight) >= math.Floor(l.limit) {
+		return false
+	}
+	l.inflight++
+	return true
+}
+
+func (l *adaptiveLimiter) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.inflight--
+	l.mu.Unlock()
+}
+
+// observe adjusts the limit to the time a request took to get its response
+// headers.
+func (l *adaptiveLimiter) observe(rtt time.Duration) {
+	if l == nil || rtt <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sample := rtt.Seconds()
+	if l.minRTT == 0 || sample < l.minRTT {
+		l.minRTT = sample
+	}
+	if l.windowMin == 0 || sample < l.windowMin {
+		l.windowMin = sample
+	}
+	if l.samples++; l.samples == adaptiveWindow {
+		l.minRTT, l.windowMin, l.samples = l.windowMin, 0, 0
+	}
+
+	// A limit that is not used says nothing about what the target can take
+	if float64(l.inflight) < l.limit/2 {
+		return
+	}
+	gradient := math.Max(0.5, math.Min(1, adaptiveTolerance*l.minRTT/sample))
+	next := l.limit*gradient + math.Sqrt(l.limit)
+	l.set(l.limit*(1-adaptiveSmoothing) + next*adaptiveSmoothing)
+}
+
+// decrease cuts the limit after a request failed on the tunnel.
+func (l *adaptiveLimiter) decrease() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.set(l.limit * adaptiveBackoff)
+}
+
+// set changes the limit, keeping it between 1 and the maximum. l.mu must be
+// held.
+func (l *adaptiveLimiter) set(limit float64) {
+	l.limit = math.Max(1, math.Min(l.max, limit))
+	l.gauge.Set(int64(l.limit))
+}
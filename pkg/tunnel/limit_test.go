@@ -0,0 +1,78 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	var unlimited *Limiter
+	if NewLimiter(0) != nil {
+		t.Error("NewLimiter(0) is not nil")
+	}
+	if !unlimited.TryAcquire() {
+		t.Error("nil limiter refused a request")
+	}
+	unlimited.Release()
+
+	l := NewLimiter(2)
+	if !l.TryAcquire() || !l.TryAcquire() {
+		t.Fatal("limiter of 2 refused the first 2 requests")
+	}
+	if l.TryAcquire() {
+		t.Error("limiter of 2 admitted a third request")
+	}
+	l.Release()
+	if !l.TryAcquire() {
+		t.Error("limiter refused a request after a release")
+	}
+}
+
+// load fills l up to its limit and feeds it a sample of rtt per request.
+func load(l *adaptiveLimiter, samples int, rtt time.Duration) {
+	for i := 0; i < samples; i++ {
+		n := 0
+		for l.tryAcquire() {
+			n++
+		}
+		l.observe(rtt)
+		for ; n > 0; n-- {
+			l.release()
+		}
+	}
+}
+
+func TestAdaptiveLimiter(t *testing.T) {
+	l := newAdaptiveLimiter(100, "tunnel_id", "test")
+	if l.limit != adaptiveInitialLimit {
+		t.Fatalf("initial limit %v, want %v", l.limit, adaptiveInitialLimit)
+	}
+
+	load(l, 50, 10*time.Millisecond)
+	if l.limit <= adaptiveInitialLimit {
+		t.Errorf("limit %v did not grow at a steady latency", l.limit)
+	}
+	if l.limit > 100 {
+		t.Errorf("limit %v exceeds the maximum of 100", l.limit)
+	}
+
+	grown := l.limit
+	load(l, 20, 100*time.Millisecond)
+	if l.limit >= grown {
+		t.Errorf("limit %v did not shrink from %v when the latency rose tenfold", l.limit, grown)
+	}
+
+	shrunk := l.limit
+	l.decrease()
+	if l.limit >= shrunk {
+		t.Errorf("limit %v not cut from %v after a failure", l.limit, shrunk)
+	}
+
+	var unlimited *adaptiveLimiter
+	if !unlimited.tryAcquire() {
+		t.Error("nil adaptive limiter refused a request")
+	}
+	unlimited.observe(time.Second)
+	unlimited.decrease()
+	unlimited.release()
+}
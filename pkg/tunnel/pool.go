@@ -0,0 +1,565 @@
+// Package tunnel keeps the pool of tunnels a bridge spreads requests across:
+// it picks a tunnel for each request, bounds the requests in flight on each,
+// keeps standby tunnels in reserve for their group, drains tunnels whose
+// offramp is leaving and takes out those that keep failing. Send carries a
+// request over the tunnel picked.
+package tunnel
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"apiduct/pkg/mux"
+	"apiduct/pkg/stats"
+)
+
+// Load balancing strategies across the tunnels in the pool
+const (
+	BalanceLeastLoaded = "least-loaded"
+	BalanceRoundRobin  = "round-robin"
+)
+
+var (
+	ErrNoTunnel = errors.New("no tunnel connected")
+	ErrDrained  = errors.New("all tunnels are draining")
+	ErrBusy     = errors.New("all tunnels are busy")
+)
+
+// Tunnel is one authenticated offramp connection in the pool.
+type Tunnel struct {
+	Session  *mux.Session
+	Addr     string // offramp address as seen by the bridge
+	Name     string // offramp name announced in the handshake, empty if unnamed
+	Identity string // enrolled identity or client ID, empty if it has neither
+	ID       string // random, unlike Addr it reveals nothing about the network
+	Since    time.Time
+
+	peer string // offramp host
+
+	// Tunnels of an offramp with standby tunnels share a group, in which one
+	// tunnel is active and the others are kept warm, promoted when it goes.
+	// Guarded by the pool's mu.
+	group   uint64
+	standby bool
+
+	// limiter bounds the requests pushed down this tunnel at once, to a
+	// fixed number or, with adaptive, to what its latency allows
+	limiter  *Limiter
+	adaptive *adaptiveLimiter
+
+	mu        sync.Mutex
+	inflight  int
+	goingAway bool
+	idle      chan struct{}
+	failures  int // consecutive failed requests
+}
+
+// Options tune a Pool. The zero value balances by load without limits.
+type Options struct {
+	Balance        string // BalanceLeastLoaded if empty
+	MaxConcurrency int    // requests in flight per tunnel, 0 for no limit
+	Adaptive       bool   // limit by latency, to at most MaxConcurrency
+	MaxFailures    int    // failed requests in a row that close a tunnel, 0 for no limit
+
+	// Event, if not nil, logs the tunnels the pool promotes and closes
+	Event func(event string, fields map[string]string, format string, args ...interface{})
+}
+
+// Pool is the pool of tunnels requests are spread across.
+type Pool struct {
+	options Options
+
+	mu      sync.Mutex
+	tunnels []*Tunnel
+	next    int           // round robin position
+	joined  chan struct{} // closed when a tunnel joins the pool
+}
+
+// NewPool returns an empty pool.
+func NewPool(options Options) *Pool {
+	if options.Balance == "" {
+		options.Balance = BalanceLeastLoaded
+	}
+	if options.Event == nil {
+		options.Event = func(string, map[string]string, string, ...interface{}) {}
+	}
+	return &Pool{options: options, joined: make(chan struct{})}
+}
+
+// Add puts a newly authenticated tunnel from the offramp called name, with
+// the given identity, into the pool. A tunnel joining a nonzero group that
+// already has an active tunnel becomes a standby.
+func (p *Pool) Add(conn net.Conn, session *mux.Session, name, identity string, group uint64) *Tunnel {
+	t := &Tunnel{
+		Session:  session,
+		Addr:     conn.RemoteAddr().String(),
+		Name:     name,
+		Identity: identity,
+		ID:       newID(),
+		Since:    time.Now(),
+		peer:     hostOf(conn.RemoteAddr()),
+		group:    group,
+	}
+	if p.options.Adaptive {
+		t.adaptive = newAdaptiveLimiter(p.options.MaxConcurrency, "tunnel_id", t.ID)
+	} else {
+		t.limiter = NewLimiter(p.options.MaxConcurrency)
+	}
+	p.mu.Lock()
+	t.standby = group != 0 && p.active(group) != nil
+	p.tunnels = append(p.tunnels, t)
+	n := len(p.tunnels)
+	close(p.joined)
+	p.joined = make(chan struct{})
+	p.countStandby()
+	p.mu.Unlock()
+	stats.Default.Gauge("apiduct_tunnels").Set(int64(n))
+	return t
+}
+
+// newID returns a random ID for a tunnel.
+func newID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// active returns the tunnel serving requests for group, or nil if there is
+// none. The caller must hold p.mu.
+func (p *Pool) active(group uint64) *Tunnel {
+	for _, t := range p.tunnels {
+		if t.group == group && !t.standby && !t.isGoingAway() {
+			return t
+		}
+	}
+	return nil
+}
+
+// Promote makes a standby of t's group active once t has gone away or been
+// removed, unless the group already has an active tunnel again.
+func (p *Pool) Promote(t *Tunnel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.promoteLocked(t)
+}
+
+func (p *Pool) promoteLocked(t *Tunnel) {
+	if t.group == 0 || t.standby || p.active(t.group) != nil {
+		return
+	}
+	for _, other := range p.tunnels {
+		if other.group == t.group && other.standby && !other.isGoingAway() {
+			other.standby = false
+			p.countStandby()
+			stats.Default.Counter("apiduct_tunnel_promotions_total").Inc()
+			p.options.Event("tunnel_promoted", map[string]string{"tunnel": other.Addr, "tunnel_id": other.ID, "replaced": t.ID},
+				"Promoted standby tunnel to replace %s", t.ID)
+			return
+		}
+	}
+}
+
+// IsStandby reports whether t is kept warm for its group rather than
+// serving requests.
+func (p *Pool) IsStandby(t *Tunnel) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return t.standby
+}
+
+// countStandby updates the standby tunnel gauge. The caller must hold p.mu.
+func (p *Pool) countStandby() {
+	n := 0
+	for _, t := range p.tunnels {
+		if t.standby {
+			n++
+		}
+	}
+	stats.Default.Gauge("apiduct_standby_tunnels").Set(int64(n))
+}
+
+// Remove takes t out of the pool, reporting whether it was still in it.
+func (p *Pool) Remove(t *Tunnel) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, other := range p.tunnels {
+		if other == t {
+			p.tunnels = append(p.tunnels[:i:i], p.tunnels[i+1:]...)
+			stats.Default.Gauge("apiduct_tunnels").Set(int64(len(p.tunnels)))
+			if t.adaptive != nil {
+				stats.Default.DeleteGauge("apiduct_tunnel_concurrency_limit", "tunnel_id", t.ID)
+			}
+			p.countStandby()
+			p.promoteLocked(t)
+			return true
+		}
+	}
+	return false
+}
+
+// Drop removes t from the pool and closes it, so the offramp reconnects.
+func (p *Pool) Drop(t *Tunnel, reason string) {
+	if p.Remove(t) {
+		p.options.Event("tunnel_down", map[string]string{"tunnel": t.Addr, "tunnel_id": t.ID}, "Tunnel connection closed: %s", reason)
+	}
+	t.Session.Close()
+}
+
+// Drain stops routing requests to t, as if its offramp said goodbye, and
+// drops it for reason once the requests in flight are done. The offramp then
+// reconnects.
+func (p *Pool) Drain(t *Tunnel, reason string) {
+	idle := t.GoAway()
+	p.Promote(t)
+	go func() {
+		select {
+		case <-idle:
+			p.Drop(t, reason)
+		case <-t.Session.CloseChan():
+		}
+	}()
+}
+
+// IsConnected reports whether the pool has a tunnel.
+func (p *Pool) IsConnected() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.tunnels) > 0
+}
+
+// Len returns the number of tunnels in the pool.
+func (p *Pool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.tunnels)
+}
+
+// Pick chooses a tunnel from the offramp called name for a request, or an
+// unnamed tunnel if name is empty, and counts the request on it. Standby
+// tunnels are passed over, as are those allowed rejects if it is not nil.
+// Requests on the priority lane are not bound by the tunnel's concurrency
+// limit. The caller must call Release on the tunnel when the request is done.
+func (p *Pool) Pick(name string, allowed func(*Tunnel) bool, priority bool) (*Tunnel, error) {
+	p.mu.Lock()
+	candidates := make([]*Tunnel, 0, len(p.tunnels))
+	for i := range p.tunnels {
+		t := p.tunnels[(p.next+i)%len(p.tunnels)]
+		if t.Name == name && !t.standby && (allowed == nil || allowed(t)) {
+			candidates = append(candidates, t)
+		}
+	}
+	if len(p.tunnels) > 0 {
+		p.next = (p.next + 1) % len(p.tunnels)
+	}
+	p.mu.Unlock()
+	if len(candidates) == 0 {
+		return nil, ErrNoTunnel
+	}
+
+	if p.options.Balance == BalanceLeastLoaded {
+		// Stable, so ties keep the round robin order
+		loads := make(map[*Tunnel]int, len(candidates))
+		for _, t := range candidates {
+			t.mu.Lock()
+			loads[t] = t.inflight
+			t.mu.Unlock()
+		}
+		for i := 1; i < len(candidates); i++ {
+			for j := i; j > 0 && loads[candidates[j]] < loads[candidates[j-1]]; j-- {
+				candidates[j], candidates[j-1] = candidates[j-1], candidates[j]
+			}
+		}
+	}
+
+	err := ErrDrained
+	for _, t := range candidates {
+		if priority {
+			if t.beginRequest() {
+				return t, nil
+			}
+			continue
+		}
+		if !t.limiter.TryAcquire() || !t.adaptive.tryAcquire() {
+			err = ErrBusy
+			continue
+		}
+		if !t.beginRequest() {
+			t.limiter.Release()
+			t.adaptive.release()
+			continue
+		}
+		return t, nil
+	}
+	return nil, err
+}
+
+// PickReplacement picks a tunnel to send a request lost on the tunnel lost
+// again, waiting up to wait for one to join the pool while the offramp
+// reconnects. Closed tunnels and those gone away are passed over.
+func (p *Pool) PickReplacement(ctx context.Context, lost *Tunnel, name string, allowed func(*Tunnel) bool, priority bool, wait time.Duration) (*Tunnel, error) {
+	usable := func(t *Tunnel) bool {
+		if t == lost || (allowed != nil && !allowed(t)) {
+			return false
+		}
+		select {
+		case <-t.Session.CloseChan():
+			return false
+		case <-t.Session.GoneAway():
+			return false
+		default:
+			return true
+		}
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		p.mu.Lock()
+		joined := p.joined
+		p.mu.Unlock()
+		t, err := p.Pick(name, usable, priority)
+		if err != ErrNoTunnel && err != ErrDrained {
+			return t, err
+		}
+		select {
+		case <-joined:
+		case <-timer.C:
+			return nil, err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Failed records a request that t could not carry. After too many in a row
+// the tunnel is taken out of the pool and closed.
+func (p *Pool) Failed(t *Tunnel) {
+	t.mu.Lock()
+	t.failures++
+	failures := t.failures
+	t.mu.Unlock()
+	stats.Default.Counter("apiduct_tunnel_failures_total").Inc()
+	t.adaptive.decrease()
+	if p.options.MaxFailures > 0 && failures >= p.options.MaxFailures {
+		p.Drop(t, strconv.Itoa(failures)+" requests failed in a row")
+	}
+}
+
+// Find returns the tunnel an offramp at remote is announcing the shutdown
+// of. The offramp names the local port of its tunnel; behind NAT the port
+// differs, so a single tunnel from the host is taken as the one meant.
+func (p *Pool) Find(remote net.Addr, port int) *Tunnel {
+	host := hostOf(remote)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var fromHost []*Tunnel
+	for _, t := range p.tunnels {
+		if t.peer != host {
+			continue
+		}
+		if t.Addr == net.JoinHostPort(host, strconv.Itoa(port)) {
+			return t
+		}
+		fromHost = append(fromHost, t)
+	}
+	if len(fromHost) == 1 {
+		return fromHost[0]
+	}
+	return nil
+}
+
+// ByID returns the tunnel with the given id, or nil if it is not in the pool.
+func (p *Pool) ByID(id string) *Tunnel {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, t := range p.tunnels {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// All returns the tunnels in the pool.
+func (p *Pool) All() []*Tunnel {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*Tunnel(nil), p.tunnels...)
+}
+
+// Status describes a tunnel in the pool.
+type Status struct {
+	ID             string    `json:"id"`
+	Addr           string    `json:"addr"`
+	Offramp        string    `json:"offramp,omitempty"`
+	Identity       string    `json:"identity,omitempty"`
+	ConnectedSince time.Time `json:"connected_since"`
+	InFlight       int       `json:"in_flight"`
+	Standby        bool      `json:"standby,omitempty"`
+	Draining       bool      `json:"draining,omitempty"`
+}
+
+// Status describes the tunnels in the pool.
+func (p *Pool) Status() []Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tunnels := make([]Status, 0, len(p.tunnels))
+	for _, t := range p.tunnels {
+		tunnels = append(tunnels, t.statusLocked())
+	}
+	return tunnels
+}
+
+// StatusOf describes t.
+func (p *Pool) StatusOf(t *Tunnel) Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return t.statusLocked()
+}
+
+// statusLocked describes t. The caller must hold the pool's mu.
+func (t *Tunnel) statusLocked() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return Status{
+		ID:             t.ID,
+		Addr:           t.Addr,
+		Offramp:        t.Name,
+		Identity:       t.Identity,
+		ConnectedSince: t.Since,
+		InFlight:       t.inflight,
+		Standby:        t.standby,
+		Draining:       t.goingAway,
+	}
+}
+
+// Release marks a request started by Pick as finished.
+func (t *Tunnel) Release(priority bool) {
+	t.endRequest()
+	if !priority {
+		t.limiter.Release()
+		t.adaptive.release()
+	}
+}
+
+// beginRequest counts a request that is about to use the tunnel. It fails
+// when the offramp announced its shutdown.
+func (t *Tunnel) beginRequest() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.goingAway {
+		return false
+	}
+	t.inflight++
+	return true
+}
+
+// isGoingAway reports whether the offramp announced the tunnel's shutdown.
+func (t *Tunnel) isGoingAway() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.goingAway
+}
+
+// endRequest marks a request started with beginRequest as finished.
+func (t *Tunnel) endRequest() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inflight--
+	if t.goingAway && t.inflight == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// GoAway stops new requests from using the tunnel. The returned channel is
+// closed once no request is in flight.
+func (t *Tunnel) GoAway() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.goingAway = true
+	idle := make(chan struct{})
+	if t.inflight == 0 {
+		close(idle)
+	} else {
+		t.idle = idle
+	}
+	return idle
+}
+
+// Succeeded resets the tunnel's failure count after a request made it
+// through.
+func (t *Tunnel) Succeeded() {
+	t.mu.Lock()
+	t.failures = 0
+	t.mu.Unlock()
+}
+
+// Observe adjusts the tunnel's adaptive concurrency limit to the time a
+// request took to get its response headers.
+func (t *Tunnel) Observe(rtt time.Duration) {
+	t.adaptive.observe(rtt)
+}
+
+// TimedOut cuts the tunnel's adaptive concurrency limit after a request got
+// no response in time.
+func (t *Tunnel) TimedOut() {
+	t.adaptive.decrease()
+}
+
+// Describe returns the X-Apiduct-Tunnel value for the tunnel, e.g.
+// "id=1f2e3d4c; age=3600s", with "; offramp=<name>" for named offramps.
+func (t *Tunnel) Describe() string {
+	s := fmt.Sprintf("id=%s; age=%ds", t.ID, int(time.Since(t.Since).Seconds()))
+	if t.Name != "" {
+		s += "; offramp=" + t.Name
+	}
+	return s
+}
+
+// Lost reports whether a request failed with err because t closed or went
+// away, as when the offramp replaces it, rather than because the offramp or
+// the target failed the request. A stream reset after the offramp announced
+// it accepts no new streams is one it refused.
+func Lost(t *Tunnel, err error) bool {
+	if errors.Is(err, mux.ErrGoAway) || errors.Is(err, mux.ErrSessionClosed) {
+		return true
+	}
+	select {
+	case <-t.Session.CloseChan():
+		return true
+	case <-t.Session.GoneAway():
+		return errors.Is(err, mux.ErrStreamReset)
+	default:
+		return false
+	}
+}
+
+// Replayable reports whether r may be sent through a tunnel again after it
+// was lost: its method is idempotent, or it carries an idempotency key, and
+// it has no body, which was already read.
+func Replayable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		if r.Header.Get("Idempotency-Key") == "" && r.Header.Get("X-Idempotency-Key") == "" {
+			return false
+		}
+	}
+	return r.ContentLength == 0 && len(r.TransferEncoding) == 0
+}
@@ -0,0 +1,289 @@
+package tunnel
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"apiduct/pkg/mux"
+)
+
+// addrConn is a pipe end that claims to come from addr.
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.addr }
+
+// add puts a tunnel from addr into p, returning it and the offramp's side of
+// its session.
+func add(t *testing.T, p *Pool, addr, name string, group uint64) (*Tunnel, *mux.Session) {
+	bridgeConn, offrampConn := net.Pipe()
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bridge := mux.NewSession(bridgeConn, true)
+	offramp := mux.NewSession(offrampConn, false)
+	t.Cleanup(func() {
+		bridge.Close()
+		offramp.Close()
+	})
+	return p.Add(addrConn{bridgeConn, tcpAddr}, bridge, name, "", group), offramp
+}
+
+func TestPickBalances(t *testing.T) {
+	p := NewPool(Options{})
+	a, _ := add(t, p, "10.0.0.1:4000", "", 0)
+	b, _ := add(t, p, "10.0.0.2:4000", "", 0)
+
+	first, err := p.Pick("", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := p.Pick("", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Errorf("least loaded picked %s twice while %s was idle", first.Addr, other(first, a, b).Addr)
+	}
+	first.Release(false)
+	second.Release(false)
+
+	p = NewPool(Options{Balance: BalanceRoundRobin})
+	a, _ = add(t, p, "10.0.0.1:4000", "", 0)
+	b, _ = add(t, p, "10.0.0.2:4000", "", 0)
+	var picked []string
+	for i := 0; i < 4; i++ {
+		tun, err := p.Pick("", nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked = append(picked, tun.Addr)
+	}
+	want := []string{a.Addr, b.Addr, a.Addr, b.Addr}
+	if strings.Join(picked, " ") != strings.Join(want, " ") {
+		t.Errorf("round robin picked %v, want %v", picked, want)
+	}
+}
+
+func other(t, a, b *Tunnel) *Tunnel {
+	if t == a {
+		return b
+	}
+	return a
+}
+
+func TestPickFilters(t *testing.T) {
+	p := NewPool(Options{})
+	if _, err := p.Pick("", nil, false); err != ErrNoTunnel {
+		t.Errorf("empty pool: %v, want %v", err, ErrNoTunnel)
+	}
+	unnamed, _ := add(t, p, "10.0.0.1:4000", "", 0)
+	named, _ := add(t, p, "10.0.0.2:4000", "plant-7", 0)
+
+	tun, err := p.Pick("plant-7", nil, false)
+	if err != nil || tun != named {
+		t.Errorf("picking plant-7: %v, %v", tun, err)
+	}
+	tun, err = p.Pick("", nil, false)
+	if err != nil || tun != unnamed {
+		t.Errorf("picking an unnamed tunnel: %v, %v", tun, err)
+	}
+	if _, err := p.Pick("", func(t *Tunnel) bool { return t != unnamed }, false); err != ErrNoTunnel {
+		t.Errorf("picking a disallowed tunnel: %v, want %v", err, ErrNoTunnel)
+	}
+}
+
+func TestPickLimits(t *testing.T) {
+	p := NewPool(Options{MaxConcurrency: 1})
+	tun, _ := add(t, p, "10.0.0.1:4000", "", 0)
+
+	if _, err := p.Pick("", nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Pick("", nil, false); err != ErrBusy {
+		t.Errorf("picking a full tunnel: %v, want %v", err, ErrBusy)
+	}
+	if _, err := p.Pick("", nil, true); err != nil {
+		t.Errorf("priority request on a full tunnel: %v", err)
+	}
+	tun.Release(true)
+	tun.Release(false)
+	if _, err := p.Pick("", nil, false); err != nil {
+		t.Errorf("picking a released tunnel: %v", err)
+	}
+}
+
+func TestGoAway(t *testing.T) {
+	p := NewPool(Options{})
+	tun, _ := add(t, p, "10.0.0.1:4000", "", 0)
+	if _, err := p.Pick("", nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	idle := tun.GoAway()
+	if _, err := p.Pick("", nil, false); err != ErrDrained {
+		t.Errorf("picking a tunnel going away: %v, want %v", err, ErrDrained)
+	}
+	select {
+	case <-idle:
+		t.Fatal("idle with a request in flight")
+	default:
+	}
+	tun.Release(false)
+	select {
+	case <-idle:
+	case <-time.After(time.Second):
+		t.Fatal("not idle after the last request finished")
+	}
+}
+
+func TestStandby(t *testing.T) {
+	var events []string
+	p := NewPool(Options{Event: func(event string, fields map[string]string, format string, args ...interface{}) {
+		events = append(events, event)
+	}})
+	active, _ := add(t, p, "10.0.0.1:4000", "", 7)
+	standby, _ := add(t, p, "10.0.0.1:4001", "", 7)
+	if p.IsStandby(active) || !p.IsStandby(standby) {
+		t.Fatalf("standby: first %v, second %v", p.IsStandby(active), p.IsStandby(standby))
+	}
+	for i := 0; i < 3; i++ {
+		tun, err := p.Pick("", nil, false)
+		if err != nil || tun != active {
+			t.Fatalf("picked %v, %v, want the active tunnel", tun, err)
+		}
+		tun.Release(false)
+	}
+
+	p.Drop(active, "test")
+	if p.IsStandby(standby) {
+		t.Error("standby not promoted when the active tunnel went")
+	}
+	if tun, err := p.Pick("", nil, false); err != nil || tun != standby {
+		t.Errorf("picked %v, %v, want the promoted tunnel", tun, err)
+	}
+	if strings.Join(events, " ") != "tunnel_promoted tunnel_down" {
+		t.Errorf("events %v, want tunnel_promoted and tunnel_down", events)
+	}
+}
+
+func TestFailedDrops(t *testing.T) {
+	p := NewPool(Options{MaxFailures: 2})
+	tun, _ := add(t, p, "10.0.0.1:4000", "", 0)
+
+	p.Failed(tun)
+	tun.Succeeded()
+	p.Failed(tun)
+	if p.Len() != 1 {
+		t.Fatal("tunnel dropped although a success came between its failures")
+	}
+	p.Failed(tun)
+	if p.Len() != 0 {
+		t.Error("tunnel kept after 2 failures in a row")
+	}
+	select {
+	case <-tun.Session.CloseChan():
+	case <-time.After(time.Second):
+		t.Error("dropped tunnel not closed")
+	}
+}
+
+func TestFind(t *testing.T) {
+	p := NewPool(Options{})
+	a, _ := add(t, p, "10.0.0.1:4000", "", 0)
+	b, _ := add(t, p, "10.0.0.1:4001", "", 0)
+	c, _ := add(t, p, "10.0.0.2:4000", "", 0)
+
+	tests := []struct {
+		host string
+		port int
+		want *Tunnel
+	}{
+		{"10.0.0.1", 4001, b},
+		{"10.0.0.1", 4000, a},
+		{"10.0.0.1", 5000, nil}, // ambiguous behind NAT
+		{"10.0.0.2", 5000, c},   // the only tunnel from the host
+		{"10.0.0.3", 4000, nil},
+	}
+	for _, test := range tests {
+		remote := &net.TCPAddr{IP: net.ParseIP(test.host), Port: 9999}
+		if got := p.Find(remote, test.port); got != test.want {
+			t.Errorf("Find(%s, %d) = %v, want %v", test.host, test.port, got, test.want)
+		}
+	}
+	if got := p.ByID(c.ID); got != c {
+		t.Errorf("ByID(%s) = %v, want %v", c.ID, got, c)
+	}
+}
+
+func TestSend(t *testing.T) {
+	p := NewPool(Options{})
+	tun, offramp := add(t, p, "10.0.0.1:4000", "", 0)
+	go func() {
+		stream, err := offramp.Accept()
+		if err != nil {
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(stream))
+		if err != nil {
+			stream.Reset()
+			return
+		}
+		stream.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nX-Path: " + req.URL.Path + "\r\n\r\nok"))
+		stream.Close()
+	}()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://api.example.com/orders", nil)
+	sent, err := tun.Send(req, false, false, false, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sent.Response.Body.Close()
+	if sent.Response.StatusCode != http.StatusOK || sent.Response.Header.Get("X-Path") != "/orders" {
+		t.Errorf("response %s with X-Path %q", sent.Response.Status, sent.Response.Header.Get("X-Path"))
+	}
+
+	offramp.Close()
+	<-tun.Session.CloseChan()
+	_, err = tun.Send(req, false, false, false, 0)
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || sendErr.Op != "open" {
+		t.Errorf("sending on a closed tunnel: %v, want an open error", err)
+	}
+	if !Lost(tun, err) {
+		t.Errorf("request failing with %v on a closed tunnel not lost", err)
+	}
+}
+
+func TestReplayable(t *testing.T) {
+	tests := []struct {
+		method string
+		header string
+		body   string
+		want   bool
+	}{
+		{http.MethodGet, "", "", true},
+		{http.MethodDelete, "", "", true},
+		{http.MethodPost, "", "", false},
+		{http.MethodPost, "Idempotency-Key", "", true},
+		{http.MethodPost, "X-Idempotency-Key", "", true},
+		{http.MethodPut, "", `{"id":1}`, false},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, "http://api.example.com/orders", strings.NewReader(test.body))
+		if test.header != "" {
+			req.Header.Set(test.header, "key-1")
+		}
+		if got := Replayable(req); got != test.want {
+			t.Errorf("%s with %q and body %q: replayable %v, want %v", test.method, test.header, test.body, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package tunnel
+
+import (
+	"net/http"
+	"time"
+
+	"apiduct/pkg/mux"
+	"apiduct/pkg/proxy"
+)
+
+// SendError is a failure to send a request on a tunnel, in one of the steps
+// of Send: "open" the stream, "write" the request or "read" the response.
+type SendError struct {
+	Op  string
+	Err error
+}
+
+func (e *SendError) Error() string {
+	return "tunnel " + e.Op + ": " + e.Err.Error()
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// Sent is a request sent on a tunnel stream, with its response.
+type Sent struct {
+	Stream   *mux.Stream
+	Reader   *proxy.Reader // of the stream, holding bytes read past the response headers
+	Response *http.Response
+}
+
+// Send opens a stream on t, on the priority lane if priority is set, writes
+// r to it and reads the response headers, within timeout if it is not 0;
+// the stream keeps the deadline. Unless upgrade or duplex is set, the
+// stream is closed for writing once r is written. duplex is as for
+// WriteRequest. A stream that fails after it was opened is reset and still
+// returned.
+func (t *Tunnel) Send(r *http.Request, priority, duplex, upgrade bool, timeout time.Duration) (*Sent, error) {
+	open := t.Session.Open
+	if priority {
+		open = t.Session.OpenPriority
+	}
+	stream, err := open()
+	if err != nil {
+		return nil, &SendError{"open", err}
+	}
+	sent := &Sent{Stream: stream}
+	if timeout > 0 {
+		stream.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := WriteRequest(r, stream, duplex); err != nil {
+		stream.Reset()
+		return sent, &SendError{"write", err}
+	}
+	if !upgrade && !duplex {
+		stream.Close()
+	}
+	sent.Reader = proxy.NewReader(stream)
+	if sent.Response, err = sent.Reader.ReadResponse(r); err != nil {
+		stream.Reset()
+		return sent, &SendError{"read", err}
+	}
+	return sent, nil
+}
+
+// WriteRequest sends r through the tunnel stream. gRPC calls and other
+// duplex requests are written in the background, so the response can
+// stream back while the client is still sending; a failure then resets the
+// stream and surfaces as a failed read. Whether the client keeps its
+// connection open, as HTTP/1.0 clients do not, stays between it and the
+// bridge.
+func WriteRequest(r *http.Request, stream *mux.Stream, duplex bool) error {
+	if !proxy.IsWebSocket(r) {
+		r.Close = false
+		proxy.RemoveHopHeaders(r.Header)
+	}
+	if !duplex {
+		return r.Write(stream)
+	}
+	go func() {
+		if err := r.Write(stream); err != nil {
+			stream.Reset()
+			return
+		}
+		stream.Close()
+	}()
+	return nil
+}